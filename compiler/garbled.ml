@@ -49,7 +49,7 @@ let bpr_go_instr b is_gen declared_vars (nopt,i) =
    *)
   let unused =
     (match i with
-    | Call(_,_,_,_,Var(Name(true, ("printf" | "puts" | "putchar"))),_,_,_) -> true
+    | Call(_,_,_,_,Var(Name(true, ("printf" | "puts" | "putchar" | "output"))),_,_,_) -> true
     | Store _ -> true
     | _ -> false) in
   (* Go does not permit re-declaration: in var := expr, var must be a new variable.
@@ -92,8 +92,20 @@ let bpr_go_instr b is_gen declared_vars (nopt,i) =
         failwith "Error: argument of puts must be a string constant")
   | Call(_,_,_,_,Var(Name(true, "putchar")),[typ,_,value],_,_) ->
                bprintf b "%sPrintf(vm, mask, \"%%c\", %a)\n" pkg bpr_go_value (typ, value)
-  | Call(_,_,_,_,Var(Name(true, "input")),[typ,_,value],_,_) ->
-      bprintf b "%sInput32(vm, mask, %a, next_arg)\n" pkg bpr_go_value (typ, value)
+  | Call(_,_,_,_,Var(Name(true, ("input" | "input8" | "input16" | "input64" as f))),[typ,_,value],_,_) ->
+      let bits = match f with "input8" -> 8 | "input16" -> 16 | "input64" -> 64 | _ -> 32 in
+      bprintf b "%sInput%d(vm, mask, %a, runtime.Inputs)\n" pkg bits bpr_go_value (typ, value)
+  | Call(_,_,_,ty,Var(Name(true, "input_bytes")),[(pty,_,party);(_,_,Int n)],_,_) ->
+      let n = Big_int.int_of_big_int n in
+      let bits = State.bitwidth ty in
+      if 8*n > bits then
+        failwith "Error: input_bytes reads more bytes than its result holds";
+      if 8*n = bits then
+        bprintf b "%sInputBytes(vm, mask, %a, %d, runtime.Inputs)\n" pkg bpr_go_value (pty, party) n
+      else
+        bprintf b "%sZext(vm, %sInputBytes(vm, mask, %a, %d, runtime.Inputs), %d)\n" pkg pkg bpr_go_value (pty, party) n bits
+  | Call(_,_,_,_,Var(Name(true, "output")),[(pty,_,party);(ty,_,value)],_,_) ->
+      bprintf b "%sOutput(vm, mask, %a, %a, runtime.Results)\n" pkg bpr_go_value (pty, party) bpr_go_value (ty, value)
   | Call(_,_,_,_,Var(Name(true, "unary")),[(ty,_,op);(_,_,Int l)],_,_) ->
       bprintf b "%sUnary(vm, %a, %d)\n" pkg bpr_go_value (ty, op) (Big_int.int_of_big_int l)
   | Call(_,_,_,_,Var(Name(true, "selectbit")),[(ty,_,Var v);(_,_,Int l)],_,_) ->
@@ -429,7 +441,9 @@ let print_function_circuit m f =
   bprintf b "import \"%sgc/eval\"\n" package_prefix;
   bprintf b "import \"%sgc\"\n" package_prefix;
   bprintf b "import \"%sgc/runtime\"\n" package_prefix;
+  bprintf b "import \"context\"\n";
   bprintf b "import \"fmt\"\n";
+  bprintf b "import \"os\"\n";
   bprintf b "\n";
   (* gen side *)
   bpr_globals b m true;
@@ -444,6 +458,9 @@ let print_function_circuit m f =
   bprintf b "\n";
   (* main function *)
   bprintf b "func main() {\n";
-  bprintf b "\truntime.Run(%d, gen_main, eval_main)\n" (List.length f.fblocks);
+  bprintf b "\tif err := runtime.Run(context.Background(), %d, gen_main, eval_main); err != nil {\n" (List.length f.fblocks);
+  bprintf b "\t\tfmt.Println(\"Error: \", err)\n";
+  bprintf b "\t\tos.Exit(1)\n";
+  bprintf b "\t}\n";
   bprintf b "}\n";
   pr_output_file ".go" (Buffer.contents b)
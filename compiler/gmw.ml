@@ -1,5 +1,12 @@
 (* GMW back end *)
 
+(* With -circuitlib spdz the same code is generated for the spdz VM
+   (runtime/spdz/vm.go), where every value is a Share.  The blocks run in
+   turn on the one Io of the party, rather than in goroutines on an Io
+   each; the outputs of the blocks, which are masked by the block masks,
+   are combined by Sum rather than TreeXor; and there are no 64-bit
+   values. *)
+
 open Llabs
 open Printf
 open Options
@@ -8,12 +15,20 @@ let package_prefix = "github.com/tjim/smpcc/runtime/"
 
 let string_constants = Hashtbl.create 10
 
+let spdz () = options.circuitlib = Some "spdz"
+
+let unsupported_spdz what =
+  failwith (sprintf "Error: the spdz back end does not support %s" what)
+
 let roundup_bitwidth typ =
   let w = State.bitwidth typ in
-  if w = 1 || w mod 8 = 0 then w else begin
-    let w' = w + (8 - w mod 8) in
-    w'
-  end
+  let w =
+    if w = 1 || w mod 8 = 0 then w else begin
+      let w' = w + (8 - w mod 8) in
+      w'
+    end in
+  if spdz() && w <> 1 && w <> 8 && w <> 32 then unsupported_spdz (sprintf "%d-bit values" w);
+  w
 
 let rec bpr_gmw_value b (typ, value) =
   match value with
@@ -22,6 +37,7 @@ let rec bpr_gmw_value b (typ, value) =
       if is_a_global then
         (try
           let loc = Hashtbl.find State.global_locations v in
+          if spdz() then unsupported_spdz "64-bit values";
           bprintf b "Uint64(io, %d)" loc
         with Not_found ->
           eprintf "global not there %s\n" (Garbled.govar v);
@@ -88,7 +104,9 @@ let bpr_gmw_instr b declared_vars (nopt,i) =
         else
           bprintf b "Printf(io, mask, \"%s\", %a)\n"
             s
-            (between ", " (fun b -> bprintf b "uint64(%a)" bpr_gmw_value))
+            (between ", " (fun b ->
+              if spdz() then bprintf b "%a" bpr_gmw_value
+              else bprintf b "uint64(%a)" bpr_gmw_value))
             (List.map (fun (a,b,c) -> (a,c)) ops)
       with _ ->
         failwith "Error: first argument of printf must be a string constant")
@@ -100,22 +118,34 @@ let bpr_gmw_instr b declared_vars (nopt,i) =
         failwith "Error: argument of puts must be a string constant")
   | Call(_,_,_,_,Var(Name(true, "putchar")),[typ,_,Int x],_,_) ->
       bprintf b "Printf(io, mask, \"\\x%02x\")\n" (Big_int.int_of_big_int x)
-  | Call(_,_,_,_,Var(Name(true, "input")),[typ,_,value],_,_) ->
-      bprintf b "Input32(io, mask, %a)\n" bpr_gmw_value (typ, value)
+  | Call(_,_,_,_,Var(Name(true, ("input" | "input8" | "input16" | "input64" as f))),[typ,_,value],_,_) ->
+      let bits = match f with "input8" -> 8 | "input16" -> 16 | "input64" -> 64 | _ -> 32 in
+      bprintf b "Input%d(io, mask, %a)\n" bits bpr_gmw_value (typ, value)
+  | Call(_,_,_,ty,Var(Name(true, "input_bytes")),[(pty,_,party);(_,_,Int n)],_,_) ->
+      let n = Big_int.int_of_big_int n in
+      if spdz() then unsupported_spdz "input_bytes";
+      if 8*n > State.bitwidth ty then
+        failwith "Error: input_bytes reads more bytes than its result holds";
+      bprintf b "uint%d(InputPacked(io, mask, %a, %d))\n" (roundup_bitwidth ty) bpr_gmw_value (pty, party) n
   | Call(_,_,_,_,Var(Name(true, "num_peers")),_,_,_) ->
       bprintf b "NumPeers32(io)\n"
   | Call(_,_,_,_,Var(Name(true, "unary")),[(ty,_,op);(_,_,Int l)],_,_) ->
       bprintf b "Unary(io, %a, %d)\n" bpr_gmw_value (ty, op) (Big_int.int_of_big_int l)
   | Call(_,_,_,_,Var(Name(true, "selectbit")),[(ty,_,Var v);(_,_,Int l)],_,_) ->
       let bitnum = Big_int.int_of_big_int l in
-      bprintf b "((%s >> %d) & 1) > 0\n" (Garbled.govar v) bitnum
+      if spdz() then
+        bprintf b "Bit%d(io, %s, %d)\n" (roundup_bitwidth ty) (Garbled.govar v) bitnum
+      else
+        bprintf b "((%s >> %d) & 1) > 0\n" (Garbled.govar v) bitnum
   | Call(_,_,_,_,Var(Name(true, "llvm.lifetime.start")),_,_,_) ->
       ()
   | Call(_,_,_,_,Var(Name(true, "llvm.lifetime.end")),_,_,_) ->
       ()
   | Load(_,_,(Pointer(ety,_),_ as x),_,_,_) -> (* in case we are debugging loads *)
+      if spdz() then unsupported_spdz "-debug-load-store";
       bprintf b "LoadDebug(io, mask, %a, Uint32(io, %d))\n" bpr_gmw_value x (State.bytewidth ety)
   | Store(_,_,x,addr,_,_,_) -> (* in case we are debugging stores*)
+      if spdz() then unsupported_spdz "-debug-load-store";
       bprintf b "StoreDebug(io, mask, %a, Uint32(io, %d), %a)\n" bpr_gmw_value addr (State.bytewidth (fst x)) bpr_gmw_value x
   | Bitcast(x,_,_) ->
       bprintf b "%a\n" bpr_gmw_value x
@@ -171,6 +201,8 @@ let bpr_gmw_instr b declared_vars (nopt,i) =
       else if bits_result > bits_op then
         (* NB our oTypes do not have signed/unsigned versions so we zextend for now *)
         bprintf b "Zext%d_%d(io, %a)\n" bits_op bits_result bpr_gmw_value (ty,op)
+      else if spdz() then (* bits_result < bits_op *)
+        bprintf b "Trunc%d_%d(io, %a)\n" bits_op bits_result bpr_gmw_value (ty,op)
       else (* bits_result < bits_op *)
         bprintf b "uint%d(%a)\n" bits_result bpr_gmw_value (ty,op);
   | Select([x;(typ,y);z],_) -> (* TODO: maybe enforce 3 args in datatype? *)
@@ -190,6 +222,9 @@ let bpr_gmw_instr b declared_vars (nopt,i) =
   | Trunc(x, ty,_) ->
       let bits_result = roundup_bitwidth ty in
       (match bits_result with
+      | 1
+      | 8 when spdz() ->
+          bprintf b "Trunc%d_%d(io, %a)\n" (roundup_bitwidth (fst x)) bits_result bpr_gmw_value x
       | 1 ->
           bprintf b "(%a > 0)\n" bpr_gmw_value x
       | 8
@@ -205,7 +240,9 @@ let bpr_gmw_instr b declared_vars (nopt,i) =
 
 let bpr_sharetyp b typ =
   let w = roundup_bitwidth typ in
-  if w = 1 then
+  if spdz() then
+    bprintf b "Share"
+  else if w = 1 then
     bprintf b "bool"
   else
     bprintf b "uint%d" w
@@ -237,8 +274,10 @@ let bpr_gmw_block b blocks_fv bl =
     | Id(_,n) -> string_of_int n
     | Name(_,n) -> n in
   bprintf b "// <label>:%s\n" name;
-  bprintf b "func block%d(io Io, ch chan uint64, mask bool%a) {\n"
+  bprintf b "func block%d(io Io, ch chan %s, mask %s%a) {\n"
     (State.bl_num bl.bname)
+    (if spdz() then "Share" else "uint64")
+    (if spdz() then "Share" else "bool")
     (bpr_gmw_block_args true) bl;
   let outputs = outputs_of_block blocks_fv bl in
   if options.debug_blocks then
@@ -250,7 +289,9 @@ let bpr_gmw_block b blocks_fv bl =
         let value = Var var in
         let typ = State.typ_of_var var in
         let width = roundup_bitwidth (State.typ_of_var var) in
-        if width = 1 then begin
+        if spdz() then
+          bprintf b "\tch <- Mask%d(io, mask, %a)\n" width bpr_gmw_value (typ, value)
+        else if width = 1 then begin
           bprintf b "\tif Mask%d(io, mask, %a) {\n" width bpr_gmw_value (typ, value);
           bprintf b "\t\tch <- 1\n";
           bprintf b "\t} else {\n";
@@ -266,14 +307,17 @@ let bpr_main b f =
   let blocks = f.fblocks in
   let blocks_fv = List.fold_left VSet.union VSet.empty
       (List.map free_of_block blocks) in
-  bprintf b "func blocks_main(io Io, ios []Io) {\n";
+  if spdz() then
+    bprintf b "func blocks_main(io Io) {\n"
+  else
+    bprintf b "func blocks_main(io Io, ios []Io) {\n";
   bprintf b "\n";
   bprintf b "\tinitialize_ram(io)\n\n";
   bprintf b "\t/* create output channels */\n";
   List.iter
     (fun bl ->
       let capacity = VSet.cardinal(outputs_of_block blocks_fv bl) in
-      bprintf b "\tch%d := make(chan uint64, %d)\n" (State.bl_num bl.bname) capacity
+      bprintf b "\tch%d := make(chan %s, %d)\n" (State.bl_num bl.bname) (if spdz() then "Share" else "uint64") capacity
       )
     blocks;
   bprintf b "\n";
@@ -300,16 +344,28 @@ let bpr_main b f =
   bprintf b "\tdone := false\n";
   bprintf b "\tfor !done {\n";
   bprintf b "\n";
-  bprintf b "\t\t/* one goroutine invocation per block */\n";
-  List.iter
-    (fun bl ->
-      bprintf b "\t\tgo block%d(ios[%d], ch%d, %s%a)\n"
-        (State.bl_num bl.bname)
-        (State.bl_num bl.bname)
-        (State.bl_num bl.bname)
-        (Garbled.govar (State.bl_mask (State.bl_num bl.bname)))
-        (bpr_gmw_block_args false) bl)
-    blocks;
+  if spdz() then begin
+    bprintf b "\t\t/* one invocation per block, in turn */\n";
+    List.iter
+      (fun bl ->
+        bprintf b "\t\tblock%d(io, ch%d, %s%a)\n"
+          (State.bl_num bl.bname)
+          (State.bl_num bl.bname)
+          (Garbled.govar (State.bl_mask (State.bl_num bl.bname)))
+          (bpr_gmw_block_args false) bl)
+      blocks
+  end else begin
+    bprintf b "\t\t/* one goroutine invocation per block */\n";
+    List.iter
+      (fun bl ->
+        bprintf b "\t\tgo block%d(ios[%d], ch%d, %s%a)\n"
+          (State.bl_num bl.bname)
+          (State.bl_num bl.bname)
+          (State.bl_num bl.bname)
+          (Garbled.govar (State.bl_mask (State.bl_num bl.bname)))
+          (bpr_gmw_block_args false) bl)
+      blocks
+  end;
   bprintf b "\n";
   bprintf b "\t\t/* mux the outputs*/\n";
   List.iter
@@ -320,7 +376,12 @@ let bpr_main b f =
       VSet.iter
         (fun var ->
           let w = (roundup_bitwidth (State.typ_of_var var)) in
-          if w = 1 then
+          if spdz() then
+          bprintf b "\t\t%s_%d := <-ch%d\n"
+              (Garbled.govar var)
+              (State.bl_num bl.bname)
+              (State.bl_num bl.bname)
+          else if w = 1 then
           bprintf b "\t\t%s_%d := (<-ch%d) > 0\n"
               (Garbled.govar var)
               (State.bl_num bl.bname)
@@ -333,22 +394,28 @@ let bpr_main b f =
               (State.bl_num bl.bname))
         outputs)
     blocks;
+  (* At most one block is active, and the outputs of the others are 0, so
+     the spdz VM adds the outputs, which is free, rather than XOR them. *)
+  let combine = if spdz() then "Sum" else "TreeXor" in
   VSet.iter
     (fun var ->
       let sources = List.filter (fun bl -> VSet.mem var (outputs_of_block blocks_fv bl)) blocks in
       if VSet.mem var State.V.special then
         (* specials are assigned 0 unless the active block assigned them *)
-        bprintf b "\t\t%s = TreeXor%d(io, %s)\n"
+        bprintf b "\t\t%s = %s%d(io, %s)\n"
           (Garbled.govar var)
+          combine
           (roundup_bitwidth (State.typ_of_var var))
           (String.concat ", " (List.map (fun bl -> sprintf "%s_%d" (Garbled.govar var) (State.bl_num bl.bname)) sources))
       else
         (* non-specials keep their value from before the blocks unless the active block assigned them *)
-        bprintf b "\t\t%s = TreeXor%d(io, %s, Mask%d(io, Not1(io, TreeXor1(io, %s)), %s))\n"
+        bprintf b "\t\t%s = %s%d(io, %s, Mask%d(io, Not1(io, %s1(io, %s)), %s))\n"
           (Garbled.govar var)
+          combine
           (roundup_bitwidth (State.typ_of_var var))
           (String.concat ", " (List.map (fun bl -> sprintf "%s_%d" (Garbled.govar var) (State.bl_num bl.bname)) sources))
           (roundup_bitwidth (State.typ_of_var var))
+          combine
           (String.concat ", " (List.map (fun bl -> sprintf "mask_%d" (State.bl_num bl.bname)) sources))
           (Garbled.govar var))
     (outputs_of_blocks blocks);
@@ -372,7 +439,7 @@ let bpr_main b f =
   bprintf b "\t\t/* are we done? */\n";
   bprintf b "\t\tdone = Reveal1(io, _vIsDone)\n";
   bprintf b "\t}\n";
-  bprintf b "\tanswer := Reveal32(io, _vAnswer)\n";
+  bprintf b "\tanswer := Output32(io, _vAnswer)\n";
   bprintf b "\tfmt.Printf(\"%%d: %%v\\n\", io.Id(), answer)\n";
   bprintf b "}\n";
   bprintf b "\n"
@@ -438,7 +505,7 @@ let bpr_globals b m =
   List.iter pr_global m.cglobals;
   bprintf b "func initialize_ram(io Io) {\n";
   if !State.loc <> 0 then begin
-    bprintf b "\tram := make([]byte, 0x%x)\n" !State.loc;
+    bprintf b "\tram := make([]%s, 0x%x)\n" (if spdz() then "Share" else "byte") !State.loc;
     Buffer.add_buffer b b1;
     bprintf b "\tio.InitRam(ram)\n";
   end;
@@ -450,8 +517,10 @@ let print_function_circuit m f =
   (* blocks *)
   bprintf b "package main\n";
   bprintf b "\n";
-  bprintf b "import . \"%sgmw\"\n" package_prefix;
+  bprintf b "import . \"%s%s\"\n" package_prefix (if spdz() then "spdz" else "gmw");
+  bprintf b "import \"context\"\n";
   bprintf b "import \"fmt\"\n";
+  bprintf b "import \"os\"\n";
   bprintf b "\n";
   bpr_globals b m;
   bpr_main b f;
@@ -459,6 +528,12 @@ let print_function_circuit m f =
       (List.map free_of_block f.fblocks) in
   List.iter (bpr_gmw_block b blocks_fv) f.fblocks;
   bprintf b "func main() {\n";
-  bprintf b "\tRun(%d, blocks_main)\n" (List.length f.fblocks);
+  if spdz() then
+    bprintf b "\tif err := Run(context.Background(), blocks_main); err != nil {\n"
+  else
+    bprintf b "\tif _, err := Run(context.Background(), %d, blocks_main); err != nil {\n" (List.length f.fblocks);
+  bprintf b "\t\tfmt.Println(\"Error: \", err)\n";
+  bprintf b "\t\tos.Exit(1)\n";
+  bprintf b "\t}\n";
   bprintf b "}\n";
   pr_output_file ".go" (Buffer.contents b)
@@ -679,7 +679,7 @@ let graph f =
               | Call(_,_,_,_,Var(Name(true, "reveal")),_,_,_) ->
                   (* If an instruction is "reveal" then operands don't matter *)
                   ()
-              | Call(_,_,_,_,Var(Name(true, "input")),_,_,_) ->
+              | Call(_,_,_,_,Var(Name(true, ("input" | "input8" | "input16" | "input64" | "input_bytes"))),_,_,_) ->
                   (* The result of "input" is always high *)
                   input_vars := VSet.add v !input_vars
               | _ ->
@@ -967,7 +967,7 @@ begin
      printf "         -debug-load-store           Execute loads and stores inside blocks (without splitting)\n";
      printf "         -no-cil                     Do not run cil transformation (flattening)\n";
      printf "         -delta                      Delta printing\n";
-     printf "         -circuitlib <lib>           Specify the circuit library (default is yao)\n";
+     printf "         -circuitlib <lib>           Specify the circuit library: yao (the default), gmw or spdz\n";
      printf "         -fname <function name>      Specify the function to compile (default is first function)\n";
      printf "         -o <file name>              Specify the output file (default is standard out)\n";
      printf "         -run                        Compile and run the program immediately\n";
@@ -1030,12 +1030,14 @@ begin
                     (fun (f:finfo) -> (string_of_var f.fname) = fname)
                     m.cfuns)) in
     if not options.delta then begin
+      if options.run && options.circuitlib = Some "spdz" then
+        failwith "Error: -run does not support spdz, whose parties need preprocessed material";
       run_phases m.ctyps f;
       if options.run then
         options.output <- Some(Filename.temp_file "smpcc" ".c")
       else if options.output = None then
         options.output <- Some(Filename.basename (Filename.chop_suffix file ".c"));
-      if options.circuitlib = Some "gmw" then
+      if options.circuitlib = Some "gmw" || options.circuitlib = Some "spdz" then
         Gmw.print_function_circuit m f
       else
         Garbled.print_function_circuit m f;
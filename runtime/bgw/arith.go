@@ -0,0 +1,106 @@
+package bgw
+
+// The arithmetic layer: Shares of elements of spdz.Mersenne61, which add
+// and scale locally, and multiply with one round of resharing.
+
+import (
+	"errors"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/spdz"
+)
+
+/* A share of degree T() of an element of spdz.Mersenne61 */
+type Share uint64
+
+var field spdz.Mersenne61
+
+// Input returns a Share of the next input of party, of bits < 61 bits,
+// which party deals to the others.
+func Input(io Io, party, bits int) Share {
+	if party == io.Id() {
+		shares := share[uint64](field, field.FromUint64(io.GetInput(bits)), io.T(), io.N())
+		for j, s := range shares {
+			if j != party {
+				io.Send64(j, s)
+			}
+		}
+		return Share(shares[party])
+	}
+	s, err := field.FromWords([]uint64{io.Receive64(party)})
+	if err != nil {
+		io.Abort(err)
+	}
+	return Share(s)
+}
+
+// Constant returns a Share of v: the polynomial of degree 0.
+func Constant(io Io, v uint64) Share {
+	return Share(field.FromUint64(v))
+}
+
+func Add(io Io, a, b Share) Share {
+	return Share(field.Add(uint64(a), uint64(b)))
+}
+
+func Sub(io Io, a, b Share) Share {
+	return Share(field.Sub(uint64(a), uint64(b)))
+}
+
+// Scale returns c*a, for a public c.
+func Scale(io Io, c uint64, a Share) Share {
+	return Share(field.Mul(field.FromUint64(c), uint64(a)))
+}
+
+// Mul returns a*b.  The products of the shares have degree 2T() < N(),
+// and the parties reduce them to degree T() by resharing.
+func Mul(io Io, a, b Share) Share {
+	return MulM(io, []Share{a}, []Share{b})[0]
+}
+
+// MulM returns the products of as and bs, in one round.
+func MulM(io Io, as, bs []Share) []Share {
+	xs, ys := make([]uint64, len(as)), make([]uint64, len(bs))
+	for i := range as {
+		xs[i], ys[i] = uint64(as[i]), uint64(bs[i])
+	}
+	result := make([]Share, len(as))
+	for i, v := range multiply[uint64](io, field, xs, ys) {
+		result[i] = Share(v)
+	}
+	return result
+}
+
+// Open returns the value of a, from the shares of every party, with
+// robust reconstruction: it corrects up to e wrong shares, where e is
+// the largest number with T()+2e < N() and T()+e < N()-T(), which is
+// T() when N() > 3T().  It aborts, rather than return a wrong value, when
+// up to T() shares are wrong and it cannot correct them, as for any
+// wrong share when N() = 2T()+1.
+func Open(io Io, a Share) uint64 {
+	out := make([][]uint64, io.N())
+	for j := range out {
+		out[j] = []uint64{uint64(a)}
+	}
+	in := exchange[uint64](io, field, out)
+	ys := make([]uint64, io.N())
+	for j := range in {
+		ys[j] = in[j][0]
+	}
+	n, t := io.N(), io.T()
+	e := (n - t - 1) / 2
+	if n-2*t-1 < e {
+		e = n - 2*t - 1
+	}
+	result, ok := decode[uint64](field, ys, t, e)
+	if !ok {
+		io.Abort(errors.New("bgw: too many wrong shares to open"))
+	}
+	return result
+}
+
+// Output opens a, and delivers it as an output of bits bits.
+func Output(io Io, a Share, bits int) uint64 {
+	result := Open(io, a)
+	io.Results().Add(gmw.Output{Party: io.Id(), Bits: bits, Value: result})
+	return result
+}
@@ -0,0 +1,80 @@
+package bgw
+
+import (
+	"context"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/input"
+	"github.com/tjim/smpcc/runtime/spdz"
+	"testing"
+)
+
+// TestSimulation runs gmw functions on the triples of bgw, and the
+// arithmetic layer, for 3 and 4 parties.
+func TestSimulation(t *testing.T) {
+	simulate(t, 3)
+	simulate(t, 4)
+}
+
+func simulate(t *testing.T, n int) {
+	inputs := []*input.Source{
+		input.NewSource([]input.Value{{X: 5}, {X: 20}}),
+		input.NewSource([]input.Value{{X: 9}, {X: 21}}),
+		input.NewSource([]input.Value{{X: 7}, {X: 22}}),
+	}
+	for len(inputs) < n {
+		inputs = append(inputs, input.NewSource(nil))
+	}
+	results, err := Simulation(context.Background(), inputs, 0, func(io gmw.Io, ios []gmw.Io) {
+		xs := make([]uint32, 3)
+		for p := range xs {
+			xs[p] = gmw.Input32(io, io.Id() == 0, gmw.Uint32(io, uint32(p)))
+		}
+		m := gmw.Select32(io, gmw.Icmp_ugt32(io, xs[0], xs[1]), xs[0], xs[1])
+		gmw.Output32(io, gmw.Mul32(io, m, xs[2]))
+		gmw.Output32(io, gmw.Mask32(io, gmw.Icmp_ult32(io, xs[2], xs[0]), xs[1]))
+
+		x := io.(Io)
+		as := make([]Share, 3)
+		for p := range as {
+			as[p] = Input(x, p, 32)
+		}
+		s := Mul(x, Add(x, as[0], as[1]), Sub(x, as[2], Constant(x, 2)))
+		Output(x, Scale(x, 3, s), 32)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{63, 0, 3 * 41 * 20}
+	for p := 0; p < n; p++ {
+		outputs := results.Party(p)
+		if len(outputs) != len(want) {
+			t.Fatalf("%d parties: party %d: %d outputs, want %d", n, p, len(outputs), len(want))
+		}
+		for i, o := range outputs {
+			if o.Value != want[i] {
+				t.Errorf("%d parties: party %d: output %d is %d, want %d", n, p, i, o.Value, want[i])
+			}
+		}
+	}
+}
+
+// TestDecode corrects wrong shares, and detects those it cannot correct.
+func TestDecode(t *testing.T) {
+	f := spdz.Mersenne61{}
+	ys := share[uint64](f, 12345, 2, 7)
+	ys[1], ys[4] = f.Add(ys[1], 1), 99
+	if s, ok := decode[uint64](f, ys, 2, 2); !ok || s != 12345 {
+		t.Errorf("decode with 2 wrong shares of 7: %d, %v", s, ok)
+	}
+	ys = share[uint64](f, 12345, 1, 3)
+	ys[2] = f.Add(ys[2], 1)
+	if s, ok := decode[uint64](f, ys, 1, 0); ok {
+		t.Errorf("decode with 1 wrong share of 3: %d, want failure", s)
+	}
+	g := GF256{}
+	for a := 1; a < 256; a++ {
+		if g.Mul(byte(a), g.Inv(byte(a))) != 1 {
+			t.Fatalf("GF256: %d times its inverse is not 1", a)
+		}
+	}
+}
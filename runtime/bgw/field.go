@@ -0,0 +1,67 @@
+package bgw
+
+import (
+	"fmt"
+	"io"
+)
+
+// GF256 is the field of 2^8 elements modulo x^8+x^4+x^3+x+1, as in AES.
+// Its elements are bytes, and addition is XOR, so the low bit of a
+// share of a bit, times its Lagrange coefficient, is a XOR share of the
+// bit (see X).
+type GF256 struct{}
+
+func (GF256) Zero() byte                 { return 0 }
+func (GF256) One() byte                  { return 1 }
+func (GF256) FromUint64(v uint64) byte   { return byte(v) }
+func (GF256) Add(a, b byte) byte         { return a ^ b }
+func (GF256) Sub(a, b byte) byte         { return a ^ b }
+func (GF256) Equal(a, b byte) bool       { return a == b }
+func (GF256) Words() int                 { return 1 }
+func (GF256) ToWords(a byte, w []uint64) { w[0] = uint64(a) }
+
+func (GF256) Mul(a, b byte) byte {
+	var result byte
+	for b != 0 {
+		if b&1 == 1 {
+			result ^= a
+		}
+		b >>= 1
+		if a&0x80 != 0 {
+			a = a<<1 ^ 0x1b
+		} else {
+			a <<= 1
+		}
+	}
+	return result
+}
+
+// Inv returns a^254, as a^255 = 1
+func (f GF256) Inv(a byte) byte {
+	if a == 0 {
+		panic("Inv: zero")
+	}
+	result := byte(1)
+	for e := 254; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			result = f.Mul(result, a)
+		}
+		a = f.Mul(a, a)
+	}
+	return result
+}
+
+func (GF256) Random(r io.Reader) byte {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		panic("Error: random number generation")
+	}
+	return b[0]
+}
+
+func (GF256) FromWords(w []uint64) (byte, error) {
+	if w[0] > 0xff {
+		return 0, fmt.Errorf("0x%x is not an element of GF(2^8)", w[0])
+	}
+	return byte(w[0]), nil
+}
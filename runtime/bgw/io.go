@@ -0,0 +1,298 @@
+// Package bgw is a backend of Shamir secret sharing for n >= 3 parties,
+// of whom fewer than half are corrupt, after Ben-Or, Goldwasser, and
+// Wigderson, "Completeness Theorems for Non-Cryptographic Fault-Tolerant
+// Distributed Computation", STOC 1988, with the degree reduction of
+// Gennaro, Rabin, and Rabin, "Simplified VSS and Fast-Track Multiparty
+// Computations", PODC 1998: to multiply, each party reshares the product
+// of its shares, which have degree 2t, and the parties recombine the
+// reshares with the Lagrange coefficients of the product.
+//
+// The boolean layer runs the programs of gmw: an X is a gmw.Io whose
+// triples come from BGW over GF256 instead of OT, so an AND costs no
+// public-key or OT work, and one round of resharing makes a batch of
+// triples.  The arithmetic layer (see Share) computes over the prime
+// field spdz.Mersenne61, and opens with robust reconstruction.
+//
+// The parties run over the connections of gmw, so SetupPeer, Simulation,
+// and Run take the configs and flags of gmw.  Like gmw, the protocol is
+// secure against semi-honest parties; a party that sends wrong shares to
+// Open is caught or corrected, see Open.
+package bgw
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/input"
+	"github.com/tjim/smpcc/runtime/spdz"
+)
+
+// Io is the gmw.Io of a party of bgw, with the threshold of the sharing.
+type Io interface {
+	gmw.Io
+	T() int // the degree of the sharing, the most corrupt parties, t < n/2
+}
+
+type triple struct {
+	a, b, c uint32
+}
+
+type maskTriple struct {
+	a    byte
+	B, C uint32
+}
+
+// X is the Io of a block of a gmw computation, with the triples of BGW.
+type X struct {
+	gmw.Io
+	t           int
+	lambda      []byte // see lagrange, in GF256
+	triples32   []triple
+	triples8    []struct{ a, b, c uint8 }
+	triples1    []struct{ a, b, c bool }
+	maskTriples []maskTriple
+}
+
+// NewX returns the Io of bgw on io, which must have at least 3 parties.
+// The threshold t is (n-1)/2.
+func NewX(io gmw.Io) *X {
+	n := io.N()
+	if n < 3 || n > 255 {
+		io.Abort(fmt.Errorf("bgw: needs from 3 to 255 parties, not %d", n))
+	}
+	return &X{Io: io, t: (n - 1) / 2, lambda: lagrange[byte](GF256{}, n)}
+}
+
+func (x *X) T() int {
+	return x.t
+}
+
+// wrap runs runPeer on the Xs of the blocks of gmw
+func wrap(runPeer func(gmw.Io, []gmw.Io)) func(gmw.Io, []gmw.Io) {
+	return func(io gmw.Io, ios []gmw.Io) {
+		xs := make([]gmw.Io, len(ios))
+		for i := range ios {
+			xs[i] = NewX(ios[i])
+		}
+		runPeer(NewX(io), xs)
+	}
+}
+
+// SetupPeer runs a party of bgw, see gmw.SetupPeer.  The Ios of runPeer
+// are Xs.
+func SetupPeer(ctx context.Context, inputs *input.Source, numBlocks int, numParties int, id int, runPeer func(gmw.Io, []gmw.Io)) (*gmw.Results, error) {
+	return gmw.SetupPeer(ctx, inputs, numBlocks, numParties, id, wrap(runPeer))
+}
+
+// Simulation runs all of the parties of bgw in this process, see
+// gmw.Simulation.
+func Simulation(ctx context.Context, inputs []*input.Source, numBlocks int, runPeer func(gmw.Io, []gmw.Io)) (*gmw.Results, error) {
+	return gmw.Simulation(ctx, inputs, numBlocks, wrap(runPeer))
+}
+
+// Run runs a party of bgw according to the command-line flags, see
+// gmw.Run, so a program of gmw runs on bgw by calling bgw.Run instead.
+func Run(ctx context.Context, numBlocks int, runPeer func(gmw.Io, []gmw.Io)) (*gmw.Results, error) {
+	return gmw.Run(ctx, numBlocks, wrap(runPeer))
+}
+
+// exchange sends out[j] to each party j, and returns what each party
+// sent, with in[Id()] = out[Id()].  The pairs of parties exchange in
+// order, the lower party first, so that no two parties wait to send to
+// each other.
+func exchange[E any](io gmw.Io, f spdz.Field[E], out [][]E) [][]E {
+	id := io.Id()
+	in := make([][]E, io.N())
+	in[id] = out[id]
+	w := make([]uint64, f.Words())
+	send := func(j int) {
+		for _, v := range out[j] {
+			f.ToWords(v, w)
+			for _, u := range w {
+				io.Send64(j, u)
+			}
+		}
+	}
+	receive := func(j int) {
+		in[j] = make([]E, len(out[j]))
+		for i := range in[j] {
+			for k := range w {
+				w[k] = io.Receive64(j)
+			}
+			v, err := f.FromWords(w)
+			if err != nil {
+				io.Abort(fmt.Errorf("bgw: party %d: %v", j, err))
+			}
+			in[j][i] = v
+		}
+	}
+	for lo := 0; lo < io.N(); lo++ {
+		for hi := lo + 1; hi < io.N(); hi++ {
+			switch id {
+			case lo:
+				send(hi)
+				receive(hi)
+			case hi:
+				receive(lo)
+				send(lo)
+			}
+		}
+	}
+	return in
+}
+
+// deal shares each of secrets with degree T(), and returns the shares of
+// each party
+func deal[E any](io Io, f spdz.Field[E], secrets []E) [][]E {
+	out := make([][]E, io.N())
+	for j := range out {
+		out[j] = make([]E, len(secrets))
+	}
+	for i, s := range secrets {
+		for j, v := range share(f, s, io.T(), io.N()) {
+			out[j][i] = v
+		}
+	}
+	return out
+}
+
+// sum returns shares of the sums of the secrets of the parties, which
+// each party deals
+func sum[E any](io Io, f spdz.Field[E], secrets []E) []E {
+	in := exchange(io, f, deal(io, f, secrets))
+	result := make([]E, len(secrets))
+	for i := range result {
+		result[i] = f.Zero()
+		for j := range in {
+			result[i] = f.Add(result[i], in[j][i])
+		}
+	}
+	return result
+}
+
+// multiply returns shares of degree T() of the products of as and bs
+func multiply[E any](io Io, f spdz.Field[E], as, bs []E) []E {
+	products := make([]E, len(as))
+	for i := range products {
+		products[i] = f.Mul(as[i], bs[i])
+	}
+	in := exchange(io, f, deal(io, f, products))
+	lambda := lagrange(f, io.N())
+	result := make([]E, len(as))
+	for i := range result {
+		result[i] = f.Zero()
+		for j := range in {
+			result[i] = f.Add(result[i], f.Mul(lambda[j], in[j][i]))
+		}
+	}
+	return result
+}
+
+// randomBits returns shares in GF256 of n random bits: each party deals
+// random bits, and the bits are their sum, that is, their XOR.
+func randomBits(io Io, n int) []byte {
+	bits := make([]byte, n)
+	if _, err := rand.Read(bits); err != nil {
+		io.Abort(errors.New("bgw: random number generation"))
+	}
+	for i := range bits {
+		bits[i] &= 1
+	}
+	return sum[byte](io, GF256{}, bits)
+}
+
+// xorShares returns the XOR shares of the bits of the shares s, the low
+// bits of the shares times their Lagrange coefficients, packed in 32-bit
+// words
+func (x *X) xorShares(s []byte) []uint32 {
+	result := make([]uint32, len(s)/32)
+	f := GF256{}
+	for i, v := range s {
+		result[i/32] |= uint32(f.Mul(x.lambda[x.Id()], v)&1) << uint(i%32)
+	}
+	return result
+}
+
+// triple32 returns NUM_TRIPLES triples of 32 bits
+func (x *X) triple32() []triple {
+	k := 32 * gmw.NUM_TRIPLES
+	s := randomBits(x, 2*k)
+	as, bs := x.xorShares(s[:k]), x.xorShares(s[k:])
+	cs := x.xorShares(multiply[byte](x, GF256{}, s[:k], s[k:]))
+	result := make([]triple, gmw.NUM_TRIPLES)
+	for i := range result {
+		result[i] = triple{as[i], bs[i], cs[i]}
+	}
+	return result
+}
+
+// maskTriple32 returns 32 mask triples: the 32 bits of B times the bit a.
+func (x *X) maskTriple32() []maskTriple {
+	s := randomBits(x, 32+32*32)
+	as := make([]byte, 32*32)
+	for i := range as {
+		as[i] = s[i/32]
+	}
+	a := x.xorShares(s[:32])[0]
+	Bs := x.xorShares(s[32:])
+	Cs := x.xorShares(multiply[byte](x, GF256{}, as, s[32:]))
+	result := make([]maskTriple, 32)
+	for i := range result {
+		result[i] = maskTriple{byte(a >> uint(i) & 1), Bs[i], Cs[i]}
+	}
+	return result
+}
+
+func (x *X) Triple1() (a, b, c bool) {
+	if len(x.triples1) == 0 {
+		a32, b32, c32 := x.Triple32()
+		x.triples1 = make([]struct{ a, b, c bool }, 32)
+		for i := range x.triples1 {
+			ui := uint(i)
+			x.triples1[i] = struct{ a, b, c bool }{a32>>ui&1 == 1, b32>>ui&1 == 1, c32>>ui&1 == 1}
+		}
+	}
+	result := x.triples1[0]
+	x.triples1 = x.triples1[1:]
+	return result.a, result.b, result.c
+}
+
+func (x *X) Triple8() (a, b, c uint8) {
+	if len(x.triples8) == 0 {
+		a32, b32, c32 := x.Triple32()
+		x.triples8 = make([]struct{ a, b, c uint8 }, 4)
+		for i := range x.triples8 {
+			ui := uint(8 * i)
+			x.triples8[i] = struct{ a, b, c uint8 }{uint8(a32 >> ui), uint8(b32 >> ui), uint8(c32 >> ui)}
+		}
+	}
+	result := x.triples8[0]
+	x.triples8 = x.triples8[1:]
+	return result.a, result.b, result.c
+}
+
+func (x *X) Triple32() (a, b, c uint32) {
+	if len(x.triples32) == 0 {
+		x.triples32 = x.triple32()
+	}
+	result := x.triples32[0]
+	x.triples32 = x.triples32[1:]
+	return result.a, result.b, result.c
+}
+
+func (x *X) Triple64() (a, b, c uint64) {
+	a0, b0, c0 := x.Triple32()
+	a1, b1, c1 := x.Triple32()
+	return uint64(a0)<<32 | uint64(a1), uint64(b0)<<32 | uint64(b1), uint64(c0)<<32 | uint64(c1)
+}
+
+func (x *X) MaskTriple32() (a byte, B uint32, C uint32) {
+	if len(x.maskTriples) == 0 {
+		x.maskTriples = x.maskTriple32()
+	}
+	result := x.maskTriples[0]
+	x.maskTriples = x.maskTriples[1:]
+	return result.a, result.B, result.C
+}
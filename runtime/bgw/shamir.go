@@ -0,0 +1,156 @@
+package bgw
+
+import (
+	"crypto/rand"
+	"github.com/tjim/smpcc/runtime/spdz"
+)
+
+// Shamir sharing over a Field.  Party i holds the value at x = i+1 of a
+// random polynomial of degree t whose value at 0 is the secret.
+
+// point returns the x of party i
+func point[E any](f spdz.Field[E], i int) E {
+	return f.FromUint64(uint64(i + 1))
+}
+
+// evaluate returns p(x), for the coefficients p, lowest first
+func evaluate[E any](f spdz.Field[E], p []E, x E) E {
+	result := f.Zero()
+	for i := len(p) - 1; i >= 0; i-- {
+		result = f.Add(f.Mul(result, x), p[i])
+	}
+	return result
+}
+
+// share returns the shares of s of n parties, of degree t
+func share[E any](f spdz.Field[E], s E, t, n int) []E {
+	p := make([]E, t+1)
+	p[0] = s
+	for i := 1; i <= t; i++ {
+		p[i] = f.Random(rand.Reader)
+	}
+	result := make([]E, n)
+	for i := range result {
+		result[i] = evaluate(f, p, point(f, i))
+	}
+	return result
+}
+
+// lagrange returns the coefficients that take the shares of n parties to
+// the secret, for polynomials of degree below n
+func lagrange[E any](f spdz.Field[E], n int) []E {
+	result := make([]E, n)
+	for i := range result {
+		num, den := f.One(), f.One()
+		for j := 0; j < n; j++ {
+			if j != i {
+				num = f.Mul(num, point(f, j))
+				den = f.Mul(den, f.Sub(point(f, j), point(f, i)))
+			}
+		}
+		result[i] = f.Mul(num, f.Inv(den))
+	}
+	return result
+}
+
+// decode returns the secret of the shares ys of degree t, of which at
+// most e are wrong, with the algorithm of Berlekamp and Welch: the error
+// locator E, of degree e, is 0 at the wrong shares, so Q = P*E has
+// Q(x_i) = y_i*E(x_i) for every share, which is linear in the
+// coefficients of Q and E.  It needs t+2e < n.  decode fails, rather than
+// return a wrong secret, when no polynomial of degree t agrees with all
+// but e of the shares.
+func decode[E any](f spdz.Field[E], ys []E, t, e int) (E, bool) {
+	n := len(ys)
+	m := t + 2*e + 1 // the coefficients of Q, and of E but its leading 1
+	a := make([][]E, n)
+	for i, y := range ys {
+		a[i] = make([]E, m+1)
+		x, power := point(f, i), f.One()
+		for k := 0; k <= t+e; k++ {
+			a[i][k] = power
+			if k < e {
+				a[i][t+e+1+k] = f.Sub(f.Zero(), f.Mul(y, power))
+			}
+			if k == e {
+				a[i][m] = f.Mul(y, power)
+			}
+			power = f.Mul(power, x)
+		}
+	}
+	coefficients, ok := solve(f, a, m)
+	if !ok {
+		return f.Zero(), false
+	}
+	q := coefficients[:t+e+1]
+	locator := append(coefficients[t+e+1:], f.One())
+	// long division of Q by E, which is monic
+	p := make([]E, t+1)
+	for k := t; k >= 0; k-- {
+		p[k] = q[k+e]
+		for j := 0; j <= e; j++ {
+			q[k+j] = f.Sub(q[k+j], f.Mul(p[k], locator[j]))
+		}
+	}
+	for _, r := range q {
+		if !f.Equal(r, f.Zero()) {
+			return f.Zero(), false
+		}
+	}
+	agree := 0
+	for i, y := range ys {
+		if f.Equal(evaluate(f, p, point(f, i)), y) {
+			agree++
+		}
+	}
+	if agree < n-e {
+		return f.Zero(), false
+	}
+	return p[0], true
+}
+
+// solve returns a solution of the linear equations a, of m unknowns, whose
+// rows end with the constant, by Gauss-Jordan elimination.  Unknowns that
+// the equations do not determine are 0.
+func solve[E any](f spdz.Field[E], a [][]E, m int) ([]E, bool) {
+	var pivots []int
+	row := 0
+	for col := 0; col < m && row < len(a); col++ {
+		p := row
+		for p < len(a) && f.Equal(a[p][col], f.Zero()) {
+			p++
+		}
+		if p == len(a) {
+			continue
+		}
+		a[row], a[p] = a[p], a[row]
+		inv := f.Inv(a[row][col])
+		for k := range a[row] {
+			a[row][k] = f.Mul(a[row][k], inv)
+		}
+		for r := range a {
+			if r == row || f.Equal(a[r][col], f.Zero()) {
+				continue
+			}
+			c := a[r][col]
+			for k := range a[r] {
+				a[r][k] = f.Sub(a[r][k], f.Mul(c, a[row][k]))
+			}
+		}
+		pivots = append(pivots, col)
+		row++
+	}
+	for _, r := range a[row:] {
+		if !f.Equal(r[m], f.Zero()) {
+			return nil, false
+		}
+	}
+	result := make([]E, m)
+	for i := range result {
+		result[i] = f.Zero()
+	}
+	for i, col := range pivots {
+		result[col] = a[i][m]
+	}
+	return result, true
+}
@@ -0,0 +1,142 @@
+// Package bmr garbles circuits for n parties, after Beaver, Micali, and
+// Rogaway, "The Round Complexity of Secure Protocols", STOC 1990, with
+// the free XOR of Ben-Efraim, Lindell, and Omri, "Optimizing
+// Semi-Honest Secure Multiparty Computation for the Internet", CCS 2016.
+//
+// Every wire w has a mask bit, XOR-shared by the parties, and every party
+// i has a key k_i for 0 on w, and k_i^R_i for 1, for an offset R_i of its
+// own.  In the offline phase (Garble), the parties compute the garbled
+// tables of the circuit jointly, with gmw on the Io of a block: the row
+// of a gate for the masked inputs a and b holds the keys of every party
+// for the output, encrypted under the keys of every party for a and b.
+// The tables of all of the gates are computed together once the program
+// has built its circuit, so garbling takes the same few rounds however
+// deep the circuit is.
+// In the online phase (Evaluate), each party sends its keys for the
+// inputs, and then every party evaluates the whole circuit on its own,
+// so the online phase takes two rounds for each call of Input, and none
+// for the gates, however deep the circuit is.
+//
+// A program is a function of a VM, which is an eval.VM, so the functions
+// of gc/eval (Add, Icmp_ugt, Select, and so on) build its circuits.  The
+// program runs twice, once to garble and once to evaluate, so it must
+// build the same circuit both times: it must not branch on the values of
+// Reveal, which are zero while garbling.
+package bmr
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/tjim/smpcc/runtime/gc"
+	"github.com/tjim/smpcc/runtime/gc/eval"
+	"github.com/tjim/smpcc/runtime/gmw"
+)
+
+const keySize = 16
+
+// A VM builds the circuits of a program of n parties.  ShareTo0(v, bits)
+// is the input v of party 1, and ShareTo1(bits) the next input of party
+// 0, as in the two-party programs of gc, where party 0 is the generator
+// and party 1 the evaluator.
+type VM interface {
+	eval.VM
+	Input(party, bits int) []gc.Key        // the next input of party, from its Io
+	Reveal(a []gc.Key) []bool              // reveal a to every party
+	RevealTo(party int, a []gc.Key) []bool // reveal a to party only; nil for the others
+}
+
+// Garbling is the material of a party from the offline phase.
+type Garbling struct {
+	r       gc.Key     // the offset of the keys of this party
+	tables  [][]uint64 // of each gate: four rows, each of n keys and the output mask bit
+	keys    []gc.Key   // of each gate: the key of this party for 0 on the output
+	inputs  []inputs   // of each call of Input
+	reveals [][]bool   // of each call of Reveal: the masks, if this party receives them
+}
+
+type inputs struct {
+	party int
+	keys  []gc.Key // the keys of this party for 0
+	masks []bool   // the masks, if this party is party
+}
+
+// Execute runs program on the parties of io: it garbles the circuit of
+// program, and then evaluates it.
+func Execute(io gmw.Io, program func(VM)) {
+	Evaluate(io, Garble(io, program), program)
+}
+
+// prf is the encryption of a row for the key of party j, or for the mask
+// bit if j = n, under the keys ka and kb of one party
+func prf(ka, kb []byte, gate, j int) []byte {
+	h := sha256.New()
+	h.Write(ka)
+	h.Write(kb)
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(gate))
+	binary.LittleEndian.PutUint64(b[8:], uint64(j))
+	h.Write(b[:])
+	return h.Sum(nil)[:keySize]
+}
+
+// rowSize is the number of words of a row of a garbled table
+func rowSize(n int) int {
+	return 2*n + 1
+}
+
+// exchange sends out[j] to each party j, and returns what each party
+// sent.  The pairs of parties exchange in order, the lower party first,
+// so that no two parties wait to send to each other.
+func exchange(io gmw.Io, out [][]uint64) [][]uint64 {
+	id := io.Id()
+	in := make([][]uint64, io.N())
+	in[id] = out[id]
+	send := func(j int) {
+		for _, w := range out[j] {
+			io.Send64(j, w)
+		}
+	}
+	receive := func(j int) {
+		in[j] = make([]uint64, len(out[j]))
+		for i := range in[j] {
+			in[j][i] = io.Receive64(j)
+		}
+	}
+	for lo := 0; lo < io.N(); lo++ {
+		for hi := lo + 1; hi < io.N(); hi++ {
+			switch id {
+			case lo:
+				send(hi)
+				receive(hi)
+			case hi:
+				receive(lo)
+				send(lo)
+			}
+		}
+	}
+	return in
+}
+
+// openTo returns the XOR of the shares of every party to party, and nil
+// to the others
+func openTo(io gmw.Io, party int, shares []bool) []bool {
+	if io.Id() != party {
+		for _, s := range shares {
+			io.Send1(party, s)
+		}
+		return nil
+	}
+	result := append([]bool{}, shares...)
+	for i := 0; i < io.N(); i++ {
+		if i == party {
+			continue
+		}
+		for j := range result {
+			result[j] = result[j] != io.Receive1(i)
+		}
+	}
+	return result
+}
+
+var errMismatch = errors.New("bmr: the program does not build the circuit that was garbled")
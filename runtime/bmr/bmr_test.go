@@ -0,0 +1,103 @@
+package bmr
+
+import (
+	"context"
+	"github.com/tjim/smpcc/runtime/gc/eval"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/input"
+	"testing"
+)
+
+func value(bits []bool) uint64 {
+	var result uint64
+	for i, b := range bits {
+		if b {
+			result |= 1 << uint(i)
+		}
+	}
+	return result
+}
+
+// TestVickrey runs a second-price auction of 3 parties: every party
+// learns the winner and the price, and party 2 learns the highest bid.
+func TestVickrey(t *testing.T) {
+	bids := []uint64{30, 70, 50}
+	inputs := make([]*input.Source, len(bids))
+	for i, b := range bids {
+		inputs[i] = input.NewSource([]input.Value{{X: b}})
+	}
+	results := make(chan [4]uint64, len(bids))
+	_, err := gmw.Simulation(context.Background(), inputs, 0, func(io gmw.Io, ios []gmw.Io) {
+		var winner, price, high uint64
+		var private []bool
+		Execute(io, func(vm VM) {
+			best := vm.Input(0, 8)
+			second := eval.Uint(vm, 0, 8)
+			index := eval.Uint(vm, 0, 2)
+			for p := 1; p < len(bids); p++ {
+				bid := vm.Input(p, 8)
+				gt := eval.Icmp_ugt(vm, bid, best)
+				second = eval.Select(vm, gt, best, eval.Select(vm, eval.Icmp_ugt(vm, bid, second), bid, second))
+				best = eval.Select(vm, gt, bid, best)
+				index = eval.Select(vm, gt, eval.Uint(vm, uint64(p), 2), index)
+			}
+			winner = value(vm.Reveal(index))
+			price = value(vm.Reveal(second))
+			private = vm.RevealTo(2, best)
+			high = value(private)
+		})
+		isNil := uint64(0)
+		if private == nil {
+			isNil = 1
+		}
+		results <- [4]uint64{uint64(io.Id()), winner, price, high<<1 | isNil}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range bids {
+		r := <-results
+		if r[1] != 1 || r[2] != 50 {
+			t.Errorf("party %d: winner %d at %d, want 1 at 50", r[0], r[1], r[2])
+		}
+		want := uint64(1) // nil
+		if r[0] == 2 {
+			want = 70 << 1
+		}
+		if r[3] != want {
+			t.Errorf("party %d: the private output is %d, want %d", r[0], r[3], want)
+		}
+	}
+}
+
+// TestGates checks the free gates, Or, the constants, and Random, for 4
+// parties.
+func TestGates(t *testing.T) {
+	inputs := []*input.Source{
+		input.NewSource([]input.Value{{X: 0xa5}}),
+		input.NewSource([]input.Value{{X: 0x0f}}),
+		input.NewSource(nil),
+		input.NewSource(nil),
+	}
+	results := make(chan uint64, len(inputs))
+	_, err := gmw.Simulation(context.Background(), inputs, 0, func(io gmw.Io, ios []gmw.Io) {
+		var result uint64
+		Execute(io, func(vm VM) {
+			a, b := vm.Input(0, 8), vm.Input(1, 8)
+			r := vm.Random(8)
+			x := vm.Xor(vm.Xor(a, r), vm.Xor(r, b))
+			x = eval.Sub(vm, eval.Not(vm, x), eval.Uint(vm, 3, 8))
+			x = append(x, vm.Or(a, b)...)
+			result = value(vm.Reveal(append(x, append(vm.True(), vm.False()...)...)))
+		})
+		results <- result
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range inputs {
+		if r, want := <-results, uint64(0xff^0xa5^0x0f-3)|(0xa5|0x0f)<<8|1<<16; r != want {
+			t.Errorf("result 0x%x, want 0x%x", r, want)
+		}
+	}
+}
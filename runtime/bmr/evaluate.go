@@ -0,0 +1,206 @@
+package bmr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/gc"
+	"github.com/tjim/smpcc/runtime/gmw"
+)
+
+// A key of the evaluator is the masked value of a wire, in byte 0, and
+// the keys of every party for it.
+type evaluator struct {
+	io                     gmw.Io
+	g                      *Garbling
+	gates, inputs, reveals int // the next of each in g
+}
+
+// Evaluate runs the online phase of program, with the garbling g from
+// Garble, see Execute.
+func Evaluate(io gmw.Io, g *Garbling, program func(VM)) {
+	x := &evaluator{io: io, g: g}
+	program(x)
+	if x.gates != len(g.tables) || x.inputs != len(g.inputs) || x.reveals != len(g.reveals) {
+		io.Abort(errMismatch)
+	}
+}
+
+func (x *evaluator) wire() gc.Key {
+	return make(gc.Key, 1+keySize*x.io.N())
+}
+
+// gate decrypts the row of the next gate for the masked values of a and
+// b, and checks that the key of this party is one of its keys
+func (x *evaluator) gate(a, b gc.Key) gc.Key {
+	if x.gates == len(x.g.tables) {
+		x.io.Abort(errMismatch)
+	}
+	id, n := x.io.Id(), x.io.N()
+	gate := x.gates
+	x.gates++
+	row := x.g.tables[gate][int(2*a[0]+b[0])*rowSize(n):][:rowSize(n)]
+	result := x.wire()
+	for j := 0; j < n; j++ {
+		binary.LittleEndian.PutUint64(result[1+keySize*j:], row[2*j])
+		binary.LittleEndian.PutUint64(result[1+keySize*j+8:], row[2*j+1])
+	}
+	result[0] = byte(row[2*n])
+	for i := 0; i < n; i++ {
+		ka, kb := a[1+keySize*i:][:keySize], b[1+keySize*i:][:keySize]
+		for j := 0; j < n; j++ {
+			copy(result[1+keySize*j:], gc.XorKey(result[1+keySize*j:][:keySize], prf(ka, kb, gate, j)))
+		}
+		result[0] ^= prf(ka, kb, gate, n)[0] & 1
+	}
+	key := x.g.keys[gate]
+	if result[0] == 1 {
+		key = gc.XorKey(key, x.g.r)
+	}
+	if result[0] > 1 || string(result[1+keySize*id:][:keySize]) != string(key) {
+		x.io.Abort(fmt.Errorf("bmr: gate %d does not decrypt to a key of party %d", gate, id))
+	}
+	return result
+}
+
+func (x *evaluator) And(a, b []gc.Key) []gc.Key {
+	result := make([]gc.Key, len(a))
+	for i := range result {
+		result[i] = x.gate(a[i], b[i])
+	}
+	return result
+}
+
+func (x *evaluator) Or(a, b []gc.Key) []gc.Key {
+	return x.And(a, b)
+}
+
+func (x *evaluator) Xor(a, b []gc.Key) []gc.Key {
+	result := make([]gc.Key, len(a))
+	for i := range result {
+		result[i] = gc.XorKey(a[i], b[i])
+	}
+	return result
+}
+
+// True and False have the masked value 0 and the keys 0, see garbler.
+func (x *evaluator) True() []gc.Key {
+	return []gc.Key{x.wire()}
+}
+
+func (x *evaluator) False() []gc.Key {
+	return []gc.Key{x.wire()}
+}
+
+func (x *evaluator) Random(bits int) []gc.Key {
+	result := make([]gc.Key, bits)
+	for i := range result {
+		result[i] = x.wire()
+	}
+	return result
+}
+
+// input sends the masked value of the input of party, and then every
+// party sends its keys for it.  Only party calls value.
+func (x *evaluator) input(party, bits int, value func() uint64) []gc.Key {
+	if x.inputs == len(x.g.inputs) {
+		x.io.Abort(errMismatch)
+	}
+	in := x.g.inputs[x.inputs]
+	x.inputs++
+	if in.party != party || len(in.keys) != bits {
+		x.io.Abort(errMismatch)
+	}
+	id, n := x.io.Id(), x.io.N()
+	var masked uint64
+	if id == party {
+		masked = value()
+		for i, m := range in.masks {
+			if m {
+				masked ^= 1 << uint(i)
+			}
+		}
+		for j := 0; j < n; j++ {
+			if j != party {
+				x.io.Send64(j, masked)
+			}
+		}
+	} else {
+		masked = x.io.Receive64(party)
+	}
+	out := make([]uint64, 2*bits)
+	for i, k := range in.keys {
+		if masked>>uint(i)&1 == 1 {
+			k = gc.XorKey(k, x.g.r)
+		}
+		out[2*i] = binary.LittleEndian.Uint64(k)
+		out[2*i+1] = binary.LittleEndian.Uint64(k[8:])
+	}
+	outs := make([][]uint64, n)
+	for j := range outs {
+		outs[j] = out
+	}
+	keys := exchange(x.io, outs)
+	result := make([]gc.Key, bits)
+	for i := range result {
+		result[i] = x.wire()
+		result[i][0] = byte(masked >> uint(i) & 1)
+		for j := 0; j < n; j++ {
+			binary.LittleEndian.PutUint64(result[i][1+keySize*j:], keys[j][2*i])
+			binary.LittleEndian.PutUint64(result[i][1+keySize*j+8:], keys[j][2*i+1])
+		}
+	}
+	return result
+}
+
+func (x *evaluator) Input(party, bits int) []gc.Key {
+	return x.input(party, bits, func() uint64 { return x.io.GetInput(bits) })
+}
+
+func (x *evaluator) ShareTo0(v uint64, bits int) []gc.Key {
+	return x.input(1, bits, func() uint64 { return v })
+}
+
+func (x *evaluator) ShareTo1(bits int) []gc.Key {
+	return x.Input(0, bits)
+}
+
+// reveal returns the values of a, for the masks of the next Reveal, or
+// nil if this party does not receive them
+func (x *evaluator) reveal(a []gc.Key) []bool {
+	if x.reveals == len(x.g.reveals) {
+		x.io.Abort(errMismatch)
+	}
+	ms := x.g.reveals[x.reveals]
+	x.reveals++
+	if ms == nil {
+		return nil
+	}
+	if len(ms) != len(a) {
+		x.io.Abort(errMismatch)
+	}
+	result := make([]bool, len(a))
+	for i, k := range a {
+		result[i] = (k[0] == 1) != ms[i]
+	}
+	return result
+}
+
+func (x *evaluator) Reveal(a []gc.Key) []bool {
+	return x.reveal(a)
+}
+
+func (x *evaluator) RevealTo(party int, a []gc.Key) []bool {
+	return x.reveal(a)
+}
+
+func (x *evaluator) RevealTo0(a []gc.Key) {
+	x.reveal(a)
+}
+
+func (x *evaluator) RevealTo1(a []gc.Key) []bool {
+	return x.reveal(a)
+}
+
+func (x *evaluator) Abort(err error) {
+	x.io.Abort(err)
+}
@@ -0,0 +1,350 @@
+package bmr
+
+import (
+	"encoding/binary"
+	"github.com/tjim/smpcc/runtime/gc"
+	"github.com/tjim/smpcc/runtime/gmw"
+)
+
+// A key of the garbler is the share of this party of the mask of a wire,
+// in byte 0, and its key for 0, so that XOR of keys is XOR of wires.
+type garbler struct {
+	io    gmw.Io
+	g     *Garbling
+	gates []gate // to garble, see garble
+}
+
+// A gate is an AND or an OR of the wires a and b, with the mask lc of
+// its output.
+type gate struct {
+	a, b gc.Key
+	lc   bool
+	or   bool
+}
+
+// Garble runs the offline phase of program, see Execute.
+func Garble(io gmw.Io, program func(VM)) *Garbling {
+	r := make(gc.Key, keySize)
+	gc.GenKey(r)
+	x := &garbler{io: io, g: &Garbling{r: r}}
+	program(x)
+	x.garble()
+	return x.g
+}
+
+func (x *garbler) wire(mask bool, key gc.Key) gc.Key {
+	result := make(gc.Key, 1+keySize)
+	if mask {
+		result[0] = 1
+	}
+	copy(result[1:], key)
+	return result
+}
+
+func randomBits(n int) []bool {
+	b := make([]byte, n)
+	gc.GenKey(b)
+	result := make([]bool, n)
+	for i := range result {
+		result[i] = b[i]&1 == 1
+	}
+	return result
+}
+
+// offset returns key, or key^R if b
+func (x *garbler) offset(key []byte, b bool) []byte {
+	if !b {
+		return key
+	}
+	return gc.XorKey(key, x.g.r)
+}
+
+// gate adds a gate of the wires a and b, an AND or an OR, whose output
+// gets a random mask and key now, and its table in garble.
+func (x *garbler) gate(a, b gc.Key, or bool) gc.Key {
+	lc := randomBits(1)[0]
+	kc := make(gc.Key, keySize)
+	gc.GenKey(kc)
+	x.gates = append(x.gates, gate{a, b, lc, or})
+	x.g.keys = append(x.g.keys, kc)
+	return x.wire(lc, kc)
+}
+
+// garble computes the tables of the gates: each party encrypts the rows
+// under its keys, and adds its share of the keys of the output, which
+// gmw computes from the masks.  The products of the masks, the keys of
+// the outputs, and the tables of all of the gates take one exchange
+// each, however many gates there are.
+func (x *garbler) garble() {
+	io, id, n := x.io, x.io.Id(), x.io.N()
+	la, lb := make([]bool, len(x.gates)), make([]bool, len(x.gates))
+	for i, g := range x.gates {
+		la[i], lb[i] = g.a[0] == 1, g.b[0] == 1
+	}
+	p := andBits(io, la, lb)
+
+	// the mask of the output for each row, and the words of R of each
+	// party, to mask by it
+	var vs []bool
+	var rs []uint64
+	for i, g := range x.gates {
+		for row := range [4]int{} {
+			alpha, beta := row>>1 == 1, row&1 == 1
+			// the shares of x = alpha^la, y = beta^lb, and xy
+			sx, sy := la[i], lb[i]
+			if id == 0 {
+				sx, sy = sx != alpha, sy != beta
+			}
+			xy := p[i] != (beta && la[i]) != (alpha && lb[i]) != (id == 0 && alpha && beta)
+			v := xy != g.lc // the mask of the output, the row for the masked values
+			if g.or {
+				v = v != sx != sy
+			}
+			for j := 0; j < n; j++ {
+				for h := 0; h < 2; h++ {
+					var r uint64
+					if j == id {
+						r = binary.LittleEndian.Uint64(x.g.r[8*h:])
+					}
+					vs = append(vs, v)
+					rs = append(rs, r)
+				}
+			}
+		}
+	}
+	masked := maskWords(io, vs, rs)
+
+	shares := make([]uint64, 4*rowSize(n)*len(x.gates))
+	for i, g := range x.gates {
+		kc := x.g.keys[i]
+		for row := range [4]int{} {
+			alpha, beta := row>>1 == 1, row&1 == 1
+			ka, kb := x.offset(g.a[1:], alpha), x.offset(g.b[1:], beta)
+			words := shares[(4*i+row)*rowSize(n):]
+			for j := 0; j < n; j++ {
+				pad := prf(ka, kb, i, j)
+				if j == id {
+					pad = gc.XorKey(pad, kc)
+				}
+				for h := 0; h < 2; h++ {
+					words[2*j+h] = binary.LittleEndian.Uint64(pad[8*h:]) ^ masked[0]
+					masked = masked[1:]
+				}
+			}
+			words[2*n] = uint64(prf(ka, kb, i, n)[0] & 1)
+			if vs[(4*i+row)*2*n] {
+				words[2*n] ^= 1
+			}
+		}
+	}
+	table := openWords(io, shares)
+	for i := range x.gates {
+		x.g.tables = append(x.g.tables, table[4*rowSize(n)*i:][:4*rowSize(n)])
+	}
+	x.gates = nil
+}
+
+// andBits returns shares of x[i] AND y[i] for each i, as gmw.And1, with
+// one exchange for all of them.
+func andBits(io gmw.Io, x, y []bool) []bool {
+	a, b, c := make([]bool, len(x)), make([]bool, len(x)), make([]bool, len(x))
+	de := make([]bool, 2*len(x))
+	for i := range x {
+		a[i], b[i], c[i] = io.Triple1()
+		de[2*i], de[2*i+1] = x[i] != a[i], y[i] != b[i]
+	}
+	de = unpackBits(openWords(io, packBits(de)), len(de))
+	result := make([]bool, len(x))
+	for i := range result {
+		d, e := de[2*i], de[2*i+1]
+		result[i] = c[i] != (d && b[i]) != (e && a[i]) != (io.Id() == 0 && d && e)
+	}
+	return result
+}
+
+// maskWords returns shares of y[i] if s[i], and of 0 if not, for each i,
+// as gmw.Mask64, with one exchange for all of them.
+func maskWords(io gmw.Io, s []bool, y []uint64) []uint64 {
+	m := len(s)
+	A, B, C := make([]uint64, m), make([]uint64, m), make([]uint64, m)
+	ds := make([]bool, 2*m)
+	es := make([]uint64, m, m+(2*m+63)/64)
+	for i := range s {
+		var a [2]byte
+		var b, c [2]uint32
+		a[0], b[0], c[0] = io.MaskTriple32()
+		a[1], b[1], c[1] = io.MaskTriple32()
+		A[i] = expand(a[0] != 0) | expand(a[1] != 0)<<32
+		B[i] = uint64(b[0]) | uint64(b[1])<<32
+		C[i] = uint64(c[0]) | uint64(c[1])<<32
+		ds[2*i], ds[2*i+1] = s[i] != (a[0] != 0), s[i] != (a[1] != 0)
+		es[i] = y[i] ^ B[i]
+	}
+	opened := openWords(io, append(es, packBits(ds)...))
+	ds = unpackBits(opened[m:], 2*m)
+	result := make([]uint64, m)
+	for i := range result {
+		D := expand(ds[2*i]) | expand(ds[2*i+1])<<32
+		E := opened[i]
+		result[i] = C[i] ^ D&B[i] ^ E&A[i]
+		if io.Id() == 0 {
+			result[i] ^= D & E
+		}
+	}
+	return result
+}
+
+// expand returns 32 ones if b, and 0 if not
+func expand(b bool) uint64 {
+	if b {
+		return 0xffffffff
+	}
+	return 0
+}
+
+// openWords returns the XOR of the shares of every party of each word,
+// with one exchange.
+func openWords(io gmw.Io, shares []uint64) []uint64 {
+	out := make([][]uint64, io.N())
+	for j := range out {
+		out[j] = shares
+	}
+	result := append([]uint64{}, shares...)
+	for j, in := range exchange(io, out) {
+		if j == io.Id() {
+			continue
+		}
+		for k := range result {
+			result[k] ^= in[k]
+		}
+	}
+	return result
+}
+
+func packBits(bits []bool) []uint64 {
+	result := make([]uint64, (len(bits)+63)/64)
+	for i, b := range bits {
+		if b {
+			result[i/64] |= 1 << uint(i%64)
+		}
+	}
+	return result
+}
+
+func unpackBits(words []uint64, n int) []bool {
+	result := make([]bool, n)
+	for i := range result {
+		result[i] = words[i/64]>>uint(i%64)&1 == 1
+	}
+	return result
+}
+
+func (x *garbler) And(a, b []gc.Key) []gc.Key {
+	result := make([]gc.Key, len(a))
+	for i := range result {
+		result[i] = x.gate(a[i], b[i], false)
+	}
+	return result
+}
+
+func (x *garbler) Or(a, b []gc.Key) []gc.Key {
+	result := make([]gc.Key, len(a))
+	for i := range result {
+		result[i] = x.gate(a[i], b[i], true)
+	}
+	return result
+}
+
+func (x *garbler) Xor(a, b []gc.Key) []gc.Key {
+	result := make([]gc.Key, len(a))
+	for i := range result {
+		result[i] = gc.XorKey(a[i], b[i])
+	}
+	return result
+}
+
+// True and False have the key 0 for every party, which every party
+// knows, as the value is public; the mask of True is 1.
+func (x *garbler) True() []gc.Key {
+	return []gc.Key{x.wire(x.io.Id() == 0, nil)}
+}
+
+func (x *garbler) False() []gc.Key {
+	return []gc.Key{x.wire(false, nil)}
+}
+
+// Random returns wires whose value is their random mask, with the key 0,
+// so they need nothing online.
+func (x *garbler) Random(bits int) []gc.Key {
+	result := make([]gc.Key, bits)
+	for i, m := range randomBits(bits) {
+		result[i] = x.wire(m, nil)
+	}
+	return result
+}
+
+// Input makes the wires of an input of party, whose masks party learns
+func (x *garbler) Input(party, bits int) []gc.Key {
+	if party < 0 || party >= x.io.N() {
+		x.io.Abort(errMismatch)
+	}
+	masks := randomBits(bits)
+	in := inputs{party, make([]gc.Key, bits), openTo(x.io, party, masks)}
+	result := make([]gc.Key, bits)
+	for i := range result {
+		in.keys[i] = make(gc.Key, keySize)
+		gc.GenKey(in.keys[i])
+		result[i] = x.wire(masks[i], in.keys[i])
+	}
+	x.g.inputs = append(x.g.inputs, in)
+	return result
+}
+
+func (x *garbler) ShareTo0(v uint64, bits int) []gc.Key {
+	return x.Input(1, bits)
+}
+
+func (x *garbler) ShareTo1(bits int) []gc.Key {
+	return x.Input(0, bits)
+}
+
+func masks(a []gc.Key) []bool {
+	result := make([]bool, len(a))
+	for i, k := range a {
+		result[i] = k[0] == 1
+	}
+	return result
+}
+
+func (x *garbler) Reveal(a []gc.Key) []bool {
+	ms := masks(a)
+	for i := range ms {
+		ms[i] = x.io.Open1(ms[i])
+	}
+	x.g.reveals = append(x.g.reveals, ms)
+	return make([]bool, len(a))
+}
+
+func (x *garbler) RevealTo(party int, a []gc.Key) []bool {
+	if party < 0 || party >= x.io.N() {
+		x.io.Abort(errMismatch)
+	}
+	ms := openTo(x.io, party, masks(a))
+	x.g.reveals = append(x.g.reveals, ms)
+	if ms == nil {
+		return nil
+	}
+	return make([]bool, len(a))
+}
+
+func (x *garbler) RevealTo0(a []gc.Key) {
+	x.RevealTo(0, a)
+}
+
+func (x *garbler) RevealTo1(a []gc.Key) []bool {
+	return x.RevealTo(1, a)
+}
+
+func (x *garbler) Abort(err error) {
+	x.io.Abort(err)
+}
@@ -0,0 +1,270 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/apcera/nats"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A Broker carries the messages of the chat system: between clients,
+// the secretary, and the commodity server.  Subjects are dot-separated
+// tokens; a subscription subject may use * for one token and > for the
+// rest of the subject, as in NATS.  Handlers of one subscription are
+// called in order, one at a time.
+//
+// The chat uses a NATS server (connectNats) but tests and demos can run
+// the whole system in one process with a MemoryServer.
+type Broker interface {
+	Publish(subject string, data []byte) error
+	Subscribe(subject string, handler func(m *Msg)) (Subscription, error)
+	// BindSendChan publishes the values sent on channel, gob encoded,
+	// until channel is closed
+	BindSendChan(subject string, channel interface{}) error
+	// BindRecvChan sends the values published on subject on channel
+	BindRecvChan(subject string, channel interface{}) (Subscription, error)
+	Close()
+}
+
+type Msg struct {
+	Subject string
+	Data    []byte
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// NATS
+
+type natsBroker struct {
+	nc *nats.Conn
+	ec *nats.EncodedConn
+}
+
+func NewNatsBroker(nc *nats.Conn) (Broker, error) {
+	ec, err := nats.NewEncodedConn(nc, "gob")
+	if err != nil {
+		return nil, err
+	}
+	return &natsBroker{nc, ec}, nil
+}
+
+func (b *natsBroker) Publish(subject string, data []byte) error {
+	return b.nc.Publish(subject, data)
+}
+
+func (b *natsBroker) Subscribe(subject string, handler func(m *Msg)) (Subscription, error) {
+	sub, err := b.nc.Subscribe(subject, func(m *nats.Msg) {
+		handler(&Msg{m.Subject, m.Data})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (b *natsBroker) BindSendChan(subject string, channel interface{}) error {
+	return b.ec.BindSendChan(subject, channel)
+}
+
+func (b *natsBroker) BindRecvChan(subject string, channel interface{}) (Subscription, error) {
+	sub, err := b.ec.BindRecvChan(subject, channel)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (b *natsBroker) Close() {
+	b.nc.Close()
+}
+
+// MemoryServer is an in-process stand-in for a NATS server.  Every
+// Broker returned by Connect sees the messages published by the others.
+type MemoryServer struct {
+	mu   sync.Mutex
+	subs map[*memSub]bool
+}
+
+func NewMemoryServer() *MemoryServer {
+	return &MemoryServer{subs: make(map[*memSub]bool)}
+}
+
+func (s *MemoryServer) Connect() Broker {
+	return &memConn{server: s, subs: make(map[*memSub]bool)}
+}
+
+type memConn struct {
+	server *MemoryServer
+	mu     sync.Mutex
+	subs   map[*memSub]bool
+	closed bool
+}
+
+// memSub delivers the messages of a subscription in order, from its
+// own goroutine, buffering as many as necessary
+type memSub struct {
+	conn    *memConn
+	subject []string
+	handler func(m *Msg)
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*Msg
+	done    bool
+}
+
+var errClosed = errors.New("chat: broker connection closed")
+
+// matchSubject reports whether subject matches the subscription pattern
+func matchSubject(pattern []string, subject string) bool {
+	tokens := strings.Split(subject, ".")
+	for i, p := range pattern {
+		switch {
+		case p == ">":
+			return len(tokens) > i
+		case i >= len(tokens):
+			return false
+		case p != "*" && p != tokens[i]:
+			return false
+		}
+	}
+	return len(tokens) == len(pattern)
+}
+
+func (c *memConn) Publish(subject string, data []byte) error {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return errClosed
+	}
+	m := &Msg{subject, append([]byte(nil), data...)}
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subs {
+		if matchSubject(sub.subject, subject) {
+			sub.mu.Lock()
+			sub.pending = append(sub.pending, m)
+			sub.mu.Unlock()
+			sub.cond.Signal()
+		}
+	}
+	return nil
+}
+
+func (c *memConn) Subscribe(subject string, handler func(m *Msg)) (Subscription, error) {
+	sub := &memSub{conn: c, subject: strings.Split(subject, "."), handler: handler}
+	sub.cond = sync.NewCond(&sub.mu)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errClosed
+	}
+	c.subs[sub] = true
+	c.mu.Unlock()
+	c.server.mu.Lock()
+	c.server.subs[sub] = true
+	c.server.mu.Unlock()
+	go sub.deliver()
+	return sub, nil
+}
+
+func (sub *memSub) deliver() {
+	for {
+		sub.mu.Lock()
+		for len(sub.pending) == 0 && !sub.done {
+			sub.cond.Wait()
+		}
+		if sub.done {
+			sub.mu.Unlock()
+			return
+		}
+		m := sub.pending[0]
+		sub.pending = sub.pending[1:]
+		sub.mu.Unlock()
+		sub.handler(m)
+	}
+}
+
+func (sub *memSub) Unsubscribe() error {
+	c := sub.conn
+	c.server.mu.Lock()
+	delete(c.server.subs, sub)
+	c.server.mu.Unlock()
+	c.mu.Lock()
+	delete(c.subs, sub)
+	c.mu.Unlock()
+	sub.mu.Lock()
+	sub.done = true
+	sub.pending = nil
+	sub.mu.Unlock()
+	sub.cond.Signal()
+	return nil
+}
+
+func (c *memConn) BindSendChan(subject string, channel interface{}) error {
+	chVal := reflect.ValueOf(channel)
+	if chVal.Kind() != reflect.Chan {
+		return fmt.Errorf("chat: can only bind channels")
+	}
+	go func() {
+		for {
+			val, ok := chVal.Recv()
+			if !ok {
+				return
+			}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).EncodeValue(val); err != nil {
+				log.Println("BindSendChan:", err)
+				continue
+			}
+			if err := c.Publish(subject, buf.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *memConn) BindRecvChan(subject string, channel interface{}) (Subscription, error) {
+	chVal := reflect.ValueOf(channel)
+	if chVal.Kind() != reflect.Chan {
+		return nil, fmt.Errorf("chat: can only bind channels")
+	}
+	elemType := chVal.Type().Elem()
+	var sub Subscription
+	sub, err := c.Subscribe(subject, func(m *Msg) {
+		val := reflect.New(elemType)
+		if err := gob.NewDecoder(bytes.NewBuffer(m.Data)).DecodeValue(val); err != nil {
+			log.Println("BindRecvChan:", err)
+			return
+		}
+		// As in NATS, the receiver may close channel without
+		// unsubscribing first; then we unsubscribe
+		defer func() {
+			if r := recover(); r != nil {
+				sub.Unsubscribe()
+			}
+		}()
+		chVal.Send(val.Elem())
+	})
+	return sub, err
+}
+
+func (c *memConn) Close() {
+	c.mu.Lock()
+	c.closed = true
+	subs := c.subs
+	c.subs = make(map[*memSub]bool)
+	c.mu.Unlock()
+	for sub := range subs {
+		sub.Unsubscribe()
+	}
+}
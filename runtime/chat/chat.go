@@ -2,47 +2,41 @@ package chat
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"encoding/gob"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/apcera/nats"
 	"github.com/tjim/smpcc/runtime/ot"
+	"github.com/tjim/smpcc/runtime/secure"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/sha3"
 	"golang.org/x/crypto/ssh/terminal"
 	"log"
 	"math/big"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 )
 
 var p2pAuth bool = true // temporary debugging flag, set to false to disable authentication and encryption
 
+// Keys use the format of secure.MarshalPublicKey, so a chat party and a
+// party in a direct network run can share a key pair.
 func MarshalPublicKey(c *[32]byte) string {
-	return hex.EncodeToString((*c)[:])
+	return secure.MarshalPublicKey(c)
 }
 
 func UnmarshalPublicKey(s string) *[32]byte {
-	if len(s) != 64 {
-		panic("Malformed public key (wrong length)")
-	}
-	for _, v := range s {
-		switch v {
-		default:
-			panic("Malformed public key (not lowercase hexidecimal)")
-		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f':
-		}
+	result, err := secure.UnmarshalPublicKey(s)
+	if err != nil {
+		panic(fmt.Sprintf("Malformed public key: %v", err))
 	}
-	var result [32]byte
-	byteVal, err := hex.DecodeString(s)
-	checkError(err)
-	copy(result[:], byteVal)
-	return &result
+	return result
 }
 
 type Room struct {
@@ -50,26 +44,56 @@ type Room struct {
 }
 
 type Party struct {
-	Nick string
-	Key  string
+	Nick string `json:"nick"`
+	Key  string `json:"key"`
 }
 
 // messages from clients to secretary
 type JoinRequest struct {
 	Party
+	Role Role
 }
 
 type LeaveRequest struct {
 	Party
 }
 
+// A FuncRequest proposes a computation, see consent.go
 type FuncRequest struct {
 	Party
-	FunctionName string
+	Descriptor Descriptor
+	Signature  Signature
 }
 
 type StartRequest struct {
 	Party
+	Session string
+}
+
+// A BarrierResult is the answer of the secretary to the StartRequests of
+// session: whether all of the members are ready
+type BarrierResult struct {
+	Session string
+	Start   bool
+}
+
+// A CancelRequest stops a computation, see jobs.go; it goes to the
+// clients of the room, which stop the computation only if the member
+// signed it, see cancelDigest.  The secretary ignores it.
+type CancelRequest struct {
+	Party
+	Session   string
+	Signature Signature
+}
+
+// A RoleRequest changes the role of a member, see roles.go
+type RoleRequest struct {
+	Party
+	Role Role
+}
+
+type Heartbeat struct {
+	Party
 }
 
 // messages from secretary to clients
@@ -80,11 +104,25 @@ type Message struct {
 
 type Members struct {
 	Parties []Party
+	Roles   []Role // of each party
+}
+
+// message between the members of a pair, see pairInit
+type KeyAgreement struct {
+	Digest []byte // of the computation
+	Nonce  [24]byte
+	Box    []byte // our half of the key of the pair, sealed
 }
 
 // messages from clients to commodity server
+
+// StartCommodity carries the descriptor of the computation, and the
+// signatures of each of the parties on its digest, so the commodity
+// server serves only computations that all of their members agreed to.
 type StartCommodity struct {
-	Parties []Party
+	Parties    []Party
+	Descriptor Descriptor
+	Signatures []Signature // of each of Parties
 }
 
 type EndCommodity struct {
@@ -98,12 +136,62 @@ type MaskTripleCommodity struct {
 	NumBytesTriple int
 }
 
-// NATS connection datatypes
+// ClientState is a chat client: its identity, its connection to the
+// broker, and the room it is in.  A process can run many clients.
+type ClientState struct {
+	Broker       Broker
+	Party        Party
+	PrivateKey   *[32]byte
+	Room         *RoomState
+	Identities   *IdentityStore // optional, checks the keys of other parties
+	Role         Role           // in the computations of the rooms we join, see roles.go
+	CommodityKey string         // public key of the commodity server, needed by runco
+	Events       func(Event)    // optional, called with the events of the client, see daemon.go
+	jobsMu       sync.Mutex
+	jobs         map[string]*job // by session ID, see jobs.go
+}
+
+// NewClientState returns a client with a fresh key pair.
+func NewClientState(b Broker, nick string) *ClientState {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	checkError(err)
+	return &ClientState{Broker: b, Party: Party{nick, MarshalPublicKey(publicKey)}, PrivateKey: privateKey}
+}
+
+// newClientState returns a client with the identity of the process, see
+// Initialize
+func newClientState() *ClientState {
+	return &ClientState{Broker: connectNats(), Party: MyParty, PrivateKey: MyPrivateKey, Identities: MyIdentities, Role: MyRole, CommodityKey: CommodityKey}
+}
+
+func (c *ClientState) event(e Event) {
+	if c.Events != nil {
+		c.Events(e)
+	}
+}
+
+func (c *ClientState) keys() *secure.Keys {
+	return &secure.Keys{Public: UnmarshalPublicKey(c.Party.Key), Private: c.PrivateKey}
+}
+
+func (c *ClientState) changeNick(nick string) {
+	c.Party = Party{nick, c.Party.Key}
+	if c.Identities != nil {
+		if err := c.Identities.SetNick(nick); err != nil {
+			log.Println("Saving nickname:", err)
+		}
+	}
+}
+
+// Pairwise connection datatypes
 type PairConn struct {
-	Nc            *nats.Conn
+	Client        *ClientState
 	ChanMasterPRF cipher.Block
 	counter       int
 	notMe         Party
+	room          string
+	session       string
+	abort         func(error) // aborts the computation on a bad message
 }
 
 type ChannelCrypto struct {
@@ -139,13 +227,10 @@ func (c *ChannelCrypto) Encrypt(plaintext []byte) []byte {
 	return ciphertext
 }
 
-func (c *ChannelCrypto) Decrypt(ciphertext []byte) []byte {
+func (c *ChannelCrypto) Decrypt(ciphertext []byte) ([]byte, error) {
 	nonce := make([]byte, c.BlockCipher.NonceSize())
 	c.PRG.XORKeyStream(nonce, nonce)
-	plaintext, err := c.BlockCipher.Open(nil, nonce, ciphertext, nil)
-	checkError(err)
-
-	return plaintext
+	return c.BlockCipher.Open(nil, nonce, ciphertext, nil)
 }
 
 func xorBytes(a, b, c []byte) {
@@ -157,16 +242,22 @@ func xorBytes(a, b, c []byte) {
 	}
 }
 
-func pairSubscribe(nc *nats.Conn, notMe Party) chan []byte {
-	recvChan := make(chan []byte)
-	ec, err := nats.NewEncodedConn(nc, "gob")
+// pairSubscribe receives the KeyAgreement of notMe for session, see
+// pairInit.  Only the first message on the subject counts.
+func (c *ClientState) pairSubscribe(session string, notMe Party) (chan []byte, Subscription) {
+	recvChan := make(chan []byte, 1)
+	sub, err := c.Broker.Subscribe(fmt.Sprintf("KEY-AGREEMENT-%s-%s-%s", session, c.Party.Key, notMe.Key), func(m *Msg) {
+		select {
+		case recvChan <- m.Data:
+		default:
+		}
+	})
 	checkError(err)
-
-	ec.BindRecvChan(fmt.Sprintf("KEY-AGREEMENT-%s-%s", MyPublicKey, notMe.Key), recvChan)
-	return recvChan
+	return recvChan, sub
 }
 
-func pairInit(pc *PairConn, notMe Party, recvChan chan []byte, done chan bool) {
+func pairInit(ctx context.Context, pc *PairConn, notMe Party, digest []byte, recvChan chan []byte, done chan error) {
+	me := pc.Client
 	//log.Printf("Marshalled peerPK: %v\n", notMe.Key)
 	//log.Printf("Marshalled MyPK: %v\n", MyPublicKey)
 	peerPk := UnmarshalPublicKey(notMe.Key)
@@ -176,34 +267,47 @@ func pairInit(pc *PairConn, notMe Party, recvChan chan []byte, done chan bool) {
 	rand.Read(nonce[:])
 
 	ciphertext := []byte{}
-	ciphertext = box.Seal(ciphertext, encapsulatedKey, &nonce, peerPk, MyPrivateKey)
+	ciphertext = box.Seal(ciphertext, encapsulatedKey, &nonce, peerPk, me.PrivateKey)
 
 	//log.Printf("Out:\n%v\n%v\n%v\n%v\n\n", ciphertext, &nonce, peerPk, MyPrivateKey)
 
-	ec, err := nats.NewEncodedConn(pc.Nc, "gob")
-	checkError(err)
-
-	sendChan := make(chan []byte)
-	ec.BindSendChan(fmt.Sprintf("KEY-AGREEMENT-%s-%s", notMe.Key, MyPublicKey), sendChan)
-	sendChan <- []byte(MyRoom.MpcFunc)
-	sendChan <- nonce[:]
-	sendChan <- ciphertext
-	oMpcFunc := <-recvChan
-	if MyRoom.MpcFunc != string(oMpcFunc) {
-		panic("Disagreement on MPC function.")
+	err := publish(me.Broker, fmt.Sprintf("KEY-AGREEMENT-%s-%s-%s", pc.session, notMe.Key, me.Party.Key), KeyAgreement{digest, nonce, ciphertext})
+	if err != nil {
+		done <- fmt.Errorf("key agreement with %s: %v", notMe.Nick, err)
+		return
+	}
+	var data []byte
+	select {
+	case data = <-recvChan:
+	case <-ctx.Done():
+		done <- context.Cause(ctx)
+		return
+	}
+	p, err := decode(data)
+	if err != nil {
+		done <- fmt.Errorf("key agreement with %s: %v", notMe.Nick, err)
+		return
+	}
+	other, ok := p.(KeyAgreement)
+	if !ok {
+		done <- fmt.Errorf("key agreement with %s: unexpected %T", notMe.Nick, p)
+		return
+	}
+	if !bytes.Equal(digest, other.Digest) {
+		done <- fmt.Errorf("%s disagrees on the computation", notMe.Nick)
+		return
 	}
-	oNonceArr := <-recvChan
-	var oNonce [24]byte
-	copy(oNonce[:], oNonceArr)
-	oCiphertext := <-recvChan
-	oEncapsulatedKey := []byte{}
 
-	//log.Printf("In:\n%v\n%v\n%v\n%v\n\n", oCiphertext, oNonce, peerPk, MyPrivateKey)
+	//log.Printf("In:\n%v\n%v\n%v\n%v\n\n", other.Box, other.Nonce, peerPk, MyPrivateKey)
 
-	oEncapsulatedKey, isValid := box.Open(oEncapsulatedKey, oCiphertext, &oNonce, peerPk, MyPrivateKey)
+	oEncapsulatedKey, isValid := box.Open(nil, other.Box, &other.Nonce, peerPk, me.PrivateKey)
 
 	if p2pAuth && !isValid {
-		panic("Ciphertext not valid!!!")
+		done <- fmt.Errorf("key agreement with %s: sealed key not valid", notMe.Nick)
+		return
+	}
+	if !isValid {
+		oEncapsulatedKey = make([]byte, 32) // no authentication
 	}
 
 	seedBytes := make([]byte, 32)
@@ -211,48 +315,37 @@ func pairInit(pc *PairConn, notMe Party, recvChan chan []byte, done chan bool) {
 	pc.ChanMasterPRF, err = aes.NewCipher(seedBytes)
 	checkError(err)
 
-	done <- true
+	done <- nil
 }
 
+// Init prepares the package.  Messages need no registration since the
+// wire format carries their types, see wire.go, so there is nothing left
+// to do, but callers should still call it first.
 func Init() {
-	gob.Register(JoinRequest{})
-	gob.Register(LeaveRequest{})
-	gob.Register(StartRequest{})
-	gob.Register(FuncRequest{})
-	gob.Register(Message{})
-	gob.Register(Members{})
-	gob.Register(big.NewInt(0))
-	gob.Register(ot.HashedElGamalCiph{})
-	gob.Register(ot.MessagePair{})
-	gob.Register(StartCommodity{})
-	gob.Register(EndCommodity{})
-	gob.Register(TripleCommodity{})
-	gob.Register(MaskTripleCommodity{})
 }
 
 type RoomState struct {
-	Name    string
-	Sub     *nats.Subscription
-	Members []Party
-	Hash    []byte
-	MpcFunc string
-}
-
-func encode(p interface{}) []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&p)
-	if err != nil {
-		log.Fatal("encode:", err)
-	}
-	return buf.Bytes()
+	Name          string
+	Sub           Subscription
+	Members       []Party
+	Roles         map[string]Role // by public key; missing for input parties
+	Hash          []byte
+	stopHeartbeat chan bool                // closed when we leave the room
+	mu            sync.Mutex               // guards Members, Roles, Hash, proposals, latest, and proposed
+	proposals     map[string]*consentState // by session ID
+	latest        string                   // session ID of the latest proposal
+	proposed      map[string]bool          // nonces of our proposals, until they come back
 }
 
 var MyPrivateKey *[32]byte
 var MyPublicKey string
 var MyParty Party
-var MyRoom *RoomState
 var MyNick string
+var MyIdentities *IdentityStore // nil if the identity is not saved
+var MyRole Role
+var CommodityKey string    // public key of the commodity server
+var DaemonAddress string   // where the daemon serves its HTTP API
+var DaemonTokenFile string // where the daemon writes the token of its API
 var natsOptions nats.Options
 var Args []string // holds command line arguments after flag parsing
 
@@ -291,6 +384,14 @@ var names []string = []string{
 	"Toby",
 }
 
+func randomNick() string {
+	nameIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(names))))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return names[int(nameIndex.Int64())]
+}
+
 func Initialize() {
 	Init()
 
@@ -300,19 +401,46 @@ func Initialize() {
 	natsOptions.ReconnectedCB = handleNats("Reconnect")
 	natsOptions.AsyncErrorCB = handleError
 
-	rawPublicKey, rawPrivateKey, _ := box.GenerateKey(rand.Reader)
-	MyPrivateKey = rawPrivateKey
-	MyPublicKey = MarshalPublicKey(rawPublicKey)
-	nameIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(names))))
-	if err != nil {
-		log.Fatal(err)
-	}
-	MyNick = names[int(nameIndex.Int64())]
-	MyParty = Party{MyNick, MyPublicKey}
-
 	var serverAddress string
+	var identityDir string
 	flag.StringVar(&serverAddress, "server", "localhost:4222", "NATS server address (default localhost:4222)")
+	flag.DurationVar(&HeartbeatInterval, "heartbeat", HeartbeatInterval, "time between heartbeats to the secretary")
+	flag.DurationVar(&HeartbeatTimeout, "timeout", HeartbeatTimeout, "secretary: remove a member after this long without a heartbeat")
+	flag.StringVar(&identityDir, "identity", DefaultIdentityDir(), "directory of the keys and contacts of this party; empty for a new identity each run")
+	flag.StringVar(&MyNick, "nick", "", "nickname (default the saved nickname, or a random one)")
+	flag.TextVar(&MyRole, "role", RoleInput, "role in computations: input, compute, or observer")
+	flag.StringVar(&CommodityKey, "commodity-key", "", "public key of the commodity server, as logged when it starts")
+	flag.StringVar(&DaemonAddress, "http", "localhost:7070", "daemon: address of the HTTP API, which must be a loopback address")
+	flag.StringVar(&DaemonTokenFile, "token-file", "", "daemon: file to write the token of the HTTP API to (default daemon-token in the identity directory, or in a new temporary directory)")
 	flag.Parse()
+	if CommodityKey != "" {
+		if _, err := secure.UnmarshalPublicKey(CommodityKey); err != nil {
+			log.Fatal("-commodity-key: ", err)
+		}
+	}
+	if identityDir != "" {
+		store, err := OpenIdentityStore(identityDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		MyIdentities = store
+		if DaemonTokenFile == "" {
+			DaemonTokenFile = filepath.Join(identityDir, "daemon-token")
+		}
+		MyPrivateKey = store.Keys.Private
+		MyPublicKey = MarshalPublicKey(store.Keys.Public)
+		if MyNick == "" {
+			MyNick = store.Nick()
+		}
+	} else {
+		rawPublicKey, rawPrivateKey, _ := box.GenerateKey(rand.Reader)
+		MyPrivateKey = rawPrivateKey
+		MyPublicKey = MarshalPublicKey(rawPublicKey)
+	}
+	if MyNick == "" {
+		MyNick = randomNick()
+	}
+	MyParty = Party{MyNick, MyPublicKey}
 	if strings.Contains(serverAddress, ":") {
 		natsOptions.Url = "nats://" + serverAddress
 	} else {
@@ -333,21 +461,12 @@ func InitializeExternal() {
 	rawPublicKey, rawPrivateKey, _ := box.GenerateKey(rand.Reader)
 	MyPrivateKey = rawPrivateKey
 	MyPublicKey = MarshalPublicKey(rawPublicKey)
-	nameIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(names))))
-	if err != nil {
-		log.Fatal(err)
-	}
-	MyNick = names[int(nameIndex.Int64())]
+	MyNick = randomNick()
 	MyParty = Party{MyNick, MyPublicKey}
 
 	natsOptions.Url = "nats://10.0.1.54:4222"
 }
 
-func changeNick(nick string) {
-	MyNick = nick
-	MyParty = Party{MyNick, MyPublicKey}
-}
-
 func escape(s string) []byte {
 	in := []byte(s)
 	var out []byte
@@ -379,10 +498,10 @@ func (pc *PairConn) tag() string {
 }
 
 func (pc *PairConn) bindSend(channel interface{}) {
-	nc := pc.Nc
+	b := pc.Client.Broker
 	tag := pc.tag()
 	cc := pc.CryptoFromTag(tag)
-	subject := fmt.Sprintf("%s.%s.%s.%s", MyRoom.Name, MyParty.Key, pc.notMe.Key, tag)
+	subject := fmt.Sprintf("%s.%s.%s.%s.%s", pc.room, pc.session, pc.Client.Party.Key, pc.notMe.Key, tag)
 	//log.Println("bindSend", subject)
 	// goroutine forwards values from channel over nats
 	go func() {
@@ -396,66 +515,91 @@ func (pc *PairConn) bindSend(channel interface{}) {
 			if !ok {
 				return // channel closed so we don't need goroutine any more
 			}
-			if !val.CanInterface() {
-				log.Println("Error: failure due to unexported fields")
+			plaintext, err := encodeValue(val)
+			if err != nil {
+				pc.abort(err) // and keep draining channel
+				continue
 			}
-			plaintext := encode(val.Interface())
 			var msg []byte
 			if p2pAuth {
 				msg = cc.Encrypt(plaintext)
 			} else {
 				msg = plaintext
 			}
-			nc.Publish(subject, msg)
+			b.Publish(subject, msg)
 			counter++
 		}
 	}()
 }
 
 // TODO: ought to return subscription so we can close the subscription
-func (pc *PairConn) bindRecv(channel interface{}) *nats.Subscription {
-	nc := pc.Nc
+func (pc *PairConn) bindRecv(channel interface{}) Subscription {
+	b := pc.Client.Broker
 	tag := pc.tag()
 	cc := pc.CryptoFromTag(tag)
-	subject := fmt.Sprintf("%s.%s.%s.%s", MyRoom.Name, pc.notMe.Key, MyParty.Key, tag)
+	subject := fmt.Sprintf("%s.%s.%s.%s.%s", pc.room, pc.session, pc.notMe.Key, pc.Client.Party.Key, tag)
 	//log.Println("bindRecv", subject)
 	chVal := reflect.ValueOf(channel)
 	if chVal.Kind() != reflect.Chan {
 		panic("Can only bind channels")
 	}
-	sub, err := nc.Subscribe(subject, func(m *nats.Msg) {
-		var decoderInput []byte
-		ciphertext := m.Data
+	elemType := chVal.Type().Elem()
+	failed := false
+	sub, err := b.Subscribe(subject, func(m *Msg) {
+		if failed {
+			return
+		}
+		decoderInput := m.Data
+		var err error
 		if p2pAuth {
-			decoderInput = cc.Decrypt(ciphertext)
-		} else {
-			decoderInput = ciphertext
+			decoderInput, err = cc.Decrypt(m.Data)
+		}
+		var val reflect.Value
+		if err == nil {
+			val, err = decodeValue(decoderInput, elemType)
 		}
-		dec := gob.NewDecoder(bytes.NewBuffer(decoderInput))
-		var p interface{}
-		err := dec.Decode(&p)
 		if err != nil {
-			log.Fatal("decode:", err)
+			// the stream of the channel is broken from here on
+			failed = true
+			pc.abort(fmt.Errorf("bad message from %s: %v", pc.notMe.Nick, err))
+			return
 		}
-		chVal.Send(reflect.ValueOf(p)) // NB this is a blocking send.  NATS maintains a buffer before this
+		chVal.Send(val) // NB this is a blocking send.  NATS maintains a buffer before this
 	})
 	checkError(err)
 	return sub
 }
 
-func barrier(nc *nats.Conn) bool {
-	okChan := make(chan bool)
-	ec, err := nats.NewEncodedConn(nc, "gob")
+// barrier waits until all members of room are ready for session, and
+// reports whether the secretary started it.
+func (c *ClientState) barrier(ctx context.Context, room, session string) bool {
+	okChan := make(chan bool, 1)
+	sub, err := c.Broker.Subscribe(fmt.Sprintf("%s.secretary.barrier.%s", room, session), func(m *Msg) {
+		p, err := decode(m.Data)
+		if err != nil {
+			log.Println("Error: barrier:", err)
+			return
+		}
+		if r, ok := p.(BarrierResult); ok && r.Session == session {
+			select {
+			case okChan <- r.Start:
+			default:
+			}
+		}
+	})
 	checkError(err)
-	ec.BindRecvChan(fmt.Sprintf("%s.secretary.barrier", MyRoom.Name), okChan)
-	err = nc.Publish(fmt.Sprintf("secretary.%s", MyRoom.Name), encode(StartRequest{MyParty}))
+	defer sub.Unsubscribe()
+	err = publish(c.Broker, fmt.Sprintf("secretary.%s", room), StartRequest{c.Party, session})
 	checkError(err)
-	result := <-okChan
-	close(okChan)
-	return result
+	select {
+	case result := <-okChan:
+		return result
+	case <-ctx.Done():
+		return false
+	}
 }
 
-func connectNats() *nats.Conn {
+func connectNats() Broker {
 	nc, err := natsOptions.Connect()
 	for i := 0; err != nil && i < 3; i++ {
 		log.Printf("Error connecting to NATS server: %s\n", err)
@@ -464,7 +608,9 @@ func connectNats() *nats.Conn {
 		nc, err = natsOptions.Connect()
 	}
 	checkError(err)
-	return nc
+	b, err := NewNatsBroker(nc)
+	checkError(err)
+	return b
 }
 
 func checkError(err error) {
@@ -0,0 +1,599 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/secure"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient runs a client on its own channels, like the mobile client
+type testClient struct {
+	*ClientState
+	typing chan string
+	lines  chan string
+}
+
+func startClients(t *testing.T, s *MemoryServer, n int) []*testClient {
+	clients := make([]*testClient, n)
+	for i := range clients {
+		c := &testClient{
+			NewClientState(s.Connect(), fmt.Sprintf("party%d", i)),
+			make(chan string),
+			make(chan string, 1000),
+		}
+		go c.RunChannels(c.typing, c.lines)
+		clients[i] = c
+	}
+	return clients
+}
+
+// expect reads the output of c until a line containing want, and
+// returns the line
+func (c *testClient) expect(t *testing.T, want string) string {
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case line := <-c.lines:
+			if strings.Contains(line, want) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("%s: timed out waiting for %q", c.Party.Nick, want)
+		}
+	}
+}
+
+func TestMaxEndToEnd(t *testing.T) {
+	Init()
+	s := NewMemoryServer()
+	ServeSecretary(s.Connect())
+	commodity, err := secure.GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ServeCommodity(s.Connect(), commodity)
+	clients := startClients(t, s, 3)
+	for _, c := range clients {
+		c.CommodityKey = MarshalPublicKey(commodity.Public)
+	}
+
+	for i, c := range clients {
+		c.typing <- "join #max"
+		c.expect(t, fmt.Sprintf("party%d has joined #max", i))
+	}
+	last := clients[len(clients)-1]
+	for _, c := range clients[:len(clients)-1] {
+		c.expect(t, fmt.Sprintf("%s has joined #max", last.Party.Nick))
+	}
+
+	inputs := []string{"3", "9", "5"}
+	for _, run := range []string{"run", "runco"} {
+		clients[0].typing <- "func max"
+		for _, c := range clients {
+			c.expect(t, "All members have agreed to compute max")
+		}
+		for i, c := range clients {
+			go func(c *testClient, input string) {
+				c.typing <- run + " " + input
+			}(c, inputs[i])
+		}
+		for _, c := range clients {
+			c.expect(t, "Output: 0 ") // the result of main
+		}
+		// parties are numbered in the order of the members of the room
+		members, _ := clients[0].Room.members()
+		winner := -1
+		for i, m := range members {
+			if m == clients[1].Party {
+				winner = i
+			}
+		}
+		want := fmt.Sprintf("Participant %d had max value 9\n", winner)
+		for range clients {
+			select {
+			case msg := <-gmw.MpcPrintsChan:
+				if msg != want {
+					t.Errorf("%s: got %q", run, msg)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatalf("%s: timed out waiting for the result", run)
+			}
+		}
+	}
+
+	// two computations at once
+	sessions := make([]string, 2)
+	for i := range sessions {
+		clients[0].typing <- "func max"
+		line := clients[0].expect(t, "All members have agreed to compute max")
+		sessions[i] = strings.TrimSpace(line[strings.LastIndex(line, " "):])
+		for _, c := range clients[1:] {
+			c.expect(t, "All members have agreed to compute max, computation "+sessions[i])
+		}
+	}
+	for i, c := range clients {
+		go func(c *testClient, input string) {
+			for _, session := range sessions {
+				c.typing <- "run @" + session + " " + input
+			}
+		}(c, inputs[i])
+	}
+	for _, c := range clients {
+		for done := map[string]bool{}; len(done) < len(sessions); {
+			line := c.expect(t, ": Output: 0 ")
+			done[line[:strings.Index(line, ":")]] = true
+		}
+	}
+	for range sessions {
+		for range clients {
+			select {
+			case <-gmw.MpcPrintsChan:
+			case <-time.After(30 * time.Second):
+				t.Fatalf("timed out waiting for the results")
+			}
+		}
+	}
+
+	// a member cancels a computation that another has started
+	clients[0].typing <- "func max"
+	line := clients[0].expect(t, "All members have agreed to compute max")
+	session := strings.TrimSpace(line[strings.LastIndex(line, " "):])
+	clients[1].expect(t, "All members have agreed to compute max, computation "+session)
+	clients[0].typing <- "run 3"
+	clients[0].expect(t, "Starting computation "+session)
+	clients[1].typing <- "cancel " + session[:6]
+	clients[0].expect(t, session+": Computation aborted: cancelled by party1")
+
+	// an observer learns the output but has no input
+	observer := clients[2]
+	observer.typing <- "role observer"
+	for _, c := range clients {
+		c.expect(t, "party2 now has the role observer")
+	}
+	clients[0].typing <- "func max"
+	for _, c := range clients {
+		c.expect(t, "All members have agreed to compute max")
+	}
+	observer.typing <- "run 5"
+	observer.expect(t, "supply no inputs")
+	for i, c := range clients[:2] {
+		go func(c *testClient, input string) {
+			c.typing <- "run " + input
+		}(c, inputs[i])
+	}
+	observer.typing <- "run"
+	for _, c := range clients {
+		c.expect(t, "Output: 0 ")
+	}
+	observer.Room.mu.Lock()
+	parties, numInputs := observer.Room.parties()
+	observer.Room.mu.Unlock()
+	if numInputs != 2 || parties[2] != observer.Party {
+		t.Errorf("parties %v with %d inputs", parties, numInputs)
+	}
+	winner := -1
+	for i, p := range parties {
+		if p == clients[1].Party {
+			winner = i
+		}
+	}
+	want := fmt.Sprintf("Participant %d had max value 9\n", winner)
+	for range clients {
+		select {
+		case msg := <-gmw.MpcPrintsChan:
+			if msg != want {
+				t.Errorf("observer: got %q", msg)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatalf("observer: timed out waiting for the result")
+		}
+	}
+
+	for _, c := range clients {
+		c.typing <- "END"
+	}
+}
+
+// TestNonMember runs a computation whose members no longer include the
+// party, as when the room changes between the consent and the run.
+func TestNonMember(t *testing.T) {
+	c := &ClientState{Party: Party{"me", "key0"}}
+	j := &job{Function: &Function{Name: "max"}, members: []Party{{"other", "key1"}}}
+	if _, err := c.runSession(context.Background(), j, nil); err == nil {
+		t.Error("runSession: no error for a non-member")
+	}
+	if _, err := c.runCommoditySession(context.Background(), j, nil); err == nil {
+		t.Error("runCommoditySession: no error for a non-member")
+	}
+}
+
+// TestProposalInOurName rejects a proposal that another member makes in
+// our name, and a replay of one of our own.
+func TestProposalInOurName(t *testing.T) {
+	me := NewClientState(nil, "me")
+	other := NewClientState(nil, "other")
+	room := &RoomState{Name: "room", Members: []Party{me.Party, other.Party}}
+	me.Room = room
+	other.Room = &RoomState{Name: "room", Members: room.Members}
+	f, _ := LookupFunction("max")
+
+	r := me.propose(f)
+	forged := other.propose(f)
+	forged.Party = me.Party
+	if _, _, err := me.receiveProposal(forged); err == nil {
+		t.Error("forged proposal accepted")
+	}
+	forged.Descriptor = r.Descriptor
+	if _, _, err := me.receiveProposal(forged); err == nil {
+		t.Error("forged signature of our proposal accepted")
+	}
+	if _, _, err := me.receiveProposal(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := me.receiveProposal(r); err == nil {
+		t.Error("replayed proposal accepted")
+	}
+}
+
+// TestCancelSignature stops a computation only for a cancel request
+// that the member signed.
+func TestCancelSignature(t *testing.T) {
+	me, other := NewClientState(nil, "me"), NewClientState(nil, "other")
+	me.Room = &RoomState{Name: "room", Members: []Party{me.Party, other.Party}}
+	other.Room = &RoomState{Name: "room", Members: me.Room.Members}
+	f, _ := LookupFunction("max")
+	cs, _, err := me.receiveProposal(me.propose(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if me.receiveCancel(CancelRequest{other.Party, cs.ID, Signature{}}) {
+		t.Error("unsigned cancel accepted")
+	}
+	if me.receiveCancel(CancelRequest{other.Party, cs.ID, other.sign(cancelDigest("0123456789abcdef"))}) {
+		t.Error("cancel of another computation accepted")
+	}
+	if !me.receiveCancel(CancelRequest{other.Party, cs.ID, other.sign(cancelDigest(cs.ID))}) {
+		t.Error("signed cancel not accepted")
+	}
+}
+
+// barrierResults returns the answers of the secretary at the barrier of
+// session in room.
+func barrierResults(t *testing.T, b Broker, room, session string) chan BarrierResult {
+	results := make(chan BarrierResult, 10)
+	_, err := b.Subscribe(fmt.Sprintf("%s.secretary.barrier.%s", room, session), func(m *Msg) {
+		if p, err := decode(m.Data); err == nil {
+			results <- p.(BarrierResult)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func expectBarrier(t *testing.T, results chan BarrierResult, start bool) {
+	t.Helper()
+	select {
+	case r := <-results:
+		if r.Start != start {
+			t.Errorf("barrier result %v, want %v", r.Start, start)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the barrier")
+	}
+}
+
+// TestSecretaryIgnoresCancel checks that a cancel request, whose
+// signature the secretary cannot check, does not release the barrier.
+func TestSecretaryIgnoresCancel(t *testing.T) {
+	s := NewMemoryServer()
+	ServeSecretary(s.Connect())
+	b := s.Connect()
+	alice, bob, mallory := NewClientState(nil, "alice"), NewClientState(nil, "bob"), NewClientState(nil, "mallory")
+	mallory.Room = &RoomState{Name: "#cancel", Members: []Party{alice.Party, bob.Party}}
+	const session = "0123456789abcdef"
+	results := barrierResults(t, b, "#cancel", session)
+	for _, p := range []interface{}{
+		JoinRequest{alice.Party, RoleInput},
+		JoinRequest{bob.Party, RoleInput},
+		StartRequest{alice.Party, session},
+		CancelRequest{bob.Party, session, mallory.sign(cancelDigest(session))},
+		StartRequest{bob.Party, session},
+	} {
+		if err := publish(b, "secretary.#cancel", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectBarrier(t, results, true)
+}
+
+// TestHeartbeatTimeout checks that the secretary removes a member that
+// stops sending heartbeats, cancels the computation waiting to start, and
+// lets only a member that it removed rejoin with a heartbeat.
+func TestHeartbeatTimeout(t *testing.T) {
+	s := NewMemoryServer()
+	serveSecretary(s.Connect(), 20*time.Millisecond, 200*time.Millisecond)
+	b := s.Connect()
+	alice, bob, mallory := NewClientState(nil, "alice").Party, NewClientState(nil, "bob").Party, NewClientState(nil, "mallory").Party
+	const room, session = "#live", "0123456789abcdef"
+	send := func(p interface{}) {
+		if err := publish(b, "secretary."+room, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members := make(chan Members, 100)
+	b.Subscribe(room, func(m *Msg) {
+		if p, err := decode(m.Data); err == nil {
+			if r, ok := p.(Members); ok {
+				members <- r
+			}
+		}
+	})
+	expectMembers := func(want ...Party) Members {
+		t.Helper()
+		for {
+			select {
+			case r := <-members:
+				if len(r.Parties) == len(want) {
+					found := 0
+					for _, p := range r.Parties {
+						for _, w := range want {
+							if p == w {
+								found++
+							}
+						}
+					}
+					if found == len(want) {
+						return r
+					}
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for the members %v", want)
+			}
+		}
+	}
+	results := barrierResults(t, b, room, session)
+
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				publish(b, "secretary."+room, Heartbeat{alice})
+			}
+		}
+	}()
+	send(JoinRequest{alice, RoleInput})
+	send(JoinRequest{bob, RoleObserver})
+	expectMembers(alice, bob)
+	send(StartRequest{alice, session})
+
+	// bob sends no heartbeats
+	expectMembers(alice)
+	expectBarrier(t, results, false)
+
+	// and comes back, as an observer
+	send(Heartbeat{bob})
+	r := expectMembers(alice, bob)
+	for i, p := range r.Parties {
+		if p == bob && r.Roles[i] != RoleObserver {
+			t.Errorf("bob rejoined with the role %v", r.Roles[i])
+		}
+	}
+
+	// a heartbeat does not bring back a party that left, nor add one
+	send(LeaveRequest{bob})
+	expectMembers(alice)
+	send(Heartbeat{bob})
+	send(Heartbeat{mallory})
+	send(RoleRequest{alice, RoleObserver})
+	select {
+	case r := <-members:
+		if len(r.Parties) != 1 {
+			t.Errorf("members %v after heartbeats of parties that are not members", r.Parties)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the members")
+	}
+}
+
+// TestCheckConsent accepts a StartCommodity only with the signatures of
+// all of its parties.
+func TestCheckConsent(t *testing.T) {
+	server, _ := secure.GenerateKeys()
+	a, b := NewClientState(nil, "a"), NewClientState(nil, "b")
+	room := &RoomState{Name: "room", Members: []Party{a.Party, b.Party}}
+	for _, c := range []*ClientState{a, b} {
+		c.Room, c.CommodityKey = room, MarshalPublicKey(server.Public)
+	}
+	f, _ := LookupFunction("max")
+	d := a.describe(f, []byte("nonce"))
+	digest := d.Digest()
+	block := sessionID(digest) + ".0"
+	r := StartCommodity{room.Members, d, []Signature{a.sign(digest), b.sign(digest)}}
+	if err := checkConsent(r, digest, block, server); err != nil {
+		t.Fatal(err)
+	}
+	r.Signatures[1] = a.sign(digest)
+	if err := checkConsent(r, digest, block, server); err == nil {
+		t.Error("StartCommodity without the signature of b accepted")
+	}
+	r.Signatures[1] = b.sign(digest)
+	if err := checkConsent(r, digest, "0123456789abcdef.0", server); err == nil {
+		t.Error("StartCommodity for another computation accepted")
+	}
+	r.Parties = r.Parties[:1]
+	if err := checkConsent(r, digest, block, server); err == nil {
+		t.Error("StartCommodity without all of the members accepted")
+	}
+}
+
+func TestMatchSubject(t *testing.T) {
+	tests := []struct {
+		pattern, subject string
+		match            bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{"secretary.>", "secretary.#general", true},
+	}
+	for _, test := range tests {
+		if got := matchSubject(strings.Split(test.pattern, "."), test.subject); got != test.match {
+			t.Errorf("matchSubject(%q, %q) = %v", test.pattern, test.subject, got)
+		}
+	}
+}
+
+func TestIdentityStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenIdentityStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetNick("alice"); err != nil {
+		t.Fatal(err)
+	}
+	bob := NewClientState(nil, "bob").Party
+	mallory := NewClientState(nil, "bob").Party
+	for _, test := range []struct {
+		p    Party
+		want KeyStatus
+	}{
+		{bob, KeyNew},
+		{bob, KeyPinned},
+		{mallory, KeyChanged},
+	} {
+		if got, err := s.Check(test.p); err != nil || got != test.want {
+			t.Errorf("Check(%v) = %v, %v; want %v", test.p, got, err, test.want)
+		}
+	}
+	if err := s.Trust(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new run
+	s2, err := OpenIdentityStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s2.Keys.Private != *s.Keys.Private || s2.Nick() != "alice" {
+		t.Errorf("identity not saved")
+	}
+	if got := s2.Status(bob); got != KeyVerified {
+		t.Errorf("Status(bob) = %v after trust", got)
+	}
+	if got := s2.Status(mallory); got != KeyChanged {
+		t.Errorf("Status(mallory) = %v", got)
+	}
+}
+
+func TestSealCommodity(t *testing.T) {
+	server, _ := secure.GenerateKeys()
+	party, _ := secure.GenerateKeys()
+	other, _ := secure.GenerateKeys()
+	subject := "commodity.abcd.0"
+	sealed, err := sealCommodity(commodityFrame{subject, []byte("digest"), 3, []byte("seed")}, server, MarshalPublicKey(party.Public))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, frame, err := openCommodity(sealed, subject, party.Private)
+	if err != nil || sender != MarshalPublicKey(server.Public) || string(frame.Data) != "seed" {
+		t.Fatalf("openCommodity = %q, %v, %v", sender, frame, err)
+	}
+	if err := frame.check([]byte("digest"), 3); err != nil {
+		t.Error(err)
+	}
+	if err := frame.check([]byte("digest"), 4); err == nil {
+		t.Error("replayed message accepted")
+	}
+	if err := frame.check([]byte("other"), 3); err == nil {
+		t.Error("message of another computation accepted")
+	}
+	if _, _, err := openCommodity(sealed, "commodity.abcd.1", party.Private); err == nil {
+		t.Error("message for another block accepted")
+	}
+	if _, _, err := openCommodity(sealed, subject, other.Private); err == nil {
+		t.Error("message opened by another party")
+	}
+}
+
+func mustEncode(t *testing.T, p interface{}) []byte {
+	data, err := encode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestWire(t *testing.T) {
+	alice := NewClientState(nil, "alice").Party
+	join := mustEncode(t, JoinRequest{alice, RoleObserver})
+	if p, err := decode(join); err != nil || p != (JoinRequest{alice, RoleObserver}) {
+		t.Fatalf("decode = %v, %v", p, err)
+	}
+	value, err := encodeValue(reflect.ValueOf(uint32(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encode(make(chan int)); err == nil {
+		t.Error("encoded a channel")
+	}
+	version := append([]byte{}, join...)
+	version[0] = WireVersion + 1
+	unknown := append([]byte{}, join...)
+	unknown[1] = 200
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"version":   version,
+		"tag":       unknown,
+		"truncated": join[:len(join)-3],
+		"trailing":  append(append([]byte{}, join...), 0),
+		"oversized": make([]byte, MaxMessageSize+1),
+		"bad key":   mustEncode(t, JoinRequest{Party{"alice", "not a key"}, RoleInput}),
+		"bad nick":  mustEncode(t, Message{Party{"two words", alice.Key}, "hi"}),
+		"bad role":  mustEncode(t, RoleRequest{alice, Role(7)}),
+		"value":     value,
+	} {
+		if p, err := decode(data); err == nil {
+			t.Errorf("%s: decoded %v", name, p)
+		}
+	}
+
+	// the secretary survives bad messages
+	s := NewMemoryServer()
+	ServeSecretary(s.Connect())
+	b := s.Connect()
+	members := make(chan *Msg, 10)
+	b.Subscribe("#wire", func(m *Msg) { members <- m })
+	b.Publish("secretary.#wire", []byte("garbage"))
+	b.Publish("secretary.#wire", unknown)
+	b.Publish("secretary.#wire", join)
+	for {
+		select {
+		case m := <-members:
+			if p, err := decode(m.Data); err == nil {
+				if r, ok := p.(Members); ok && len(r.Parties) == 1 && r.Roles[0] == RoleObserver {
+					return
+				}
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the members")
+		}
+	}
+}
@@ -1,14 +1,12 @@
 package chat
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/apcera/nats"
 	"github.com/tjim/smpcc/runtime/gmw"
-	"github.com/tjim/smpcc/runtime/max"
-	"github.com/tjim/smpcc/runtime/sum"
-	"github.com/tjim/smpcc/runtime/vickrey"
+	"github.com/tjim/smpcc/runtime/input"
+	"github.com/tjim/smpcc/runtime/ot"
 	"golang.org/x/crypto/sha3"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
@@ -16,30 +14,41 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 )
 
 func ClientChannels(userTyping, msgReceiving chan string) {
+	newClientState().RunChannels(userTyping, msgReceiving)
+}
 
-	nc := connectNats()
-
-	msgReceiving <- fmt.Sprintf("Greetings, %s!\n", MyNick)
+// RunChannels runs the client, reading commands from userTyping and
+// sending what it has to say to msgReceiving, until it reads "END".
+func (c *ClientState) RunChannels(userTyping, msgReceiving chan string) {
+	msgReceiving <- fmt.Sprintf("Greetings, %s!\n", c.Party.Nick)
 	msgReceiving <- fmt.Sprintf("Commands:\n")
 	msgReceiving <- fmt.Sprintf("join foo      	(join the chatroom named foo)\n")
 	msgReceiving <- fmt.Sprintf("nick foo      	(change your nickname to foo)\n")
 	msgReceiving <- fmt.Sprintf("members       	(list the parties in the current room)\n")
+	msgReceiving <- fmt.Sprintf("verify [foo]  	(show the key fingerprints of you and of member foo)\n")
+	msgReceiving <- fmt.Sprintf("trust foo     	(accept the key of member foo as verified)\n")
 	msgReceiving <- fmt.Sprintf("func <function>  (propose a function for computation)\n")
-	msgReceiving <- fmt.Sprintf("run <number>  	(run max with input <number>)\n")
+	msgReceiving <- fmt.Sprintf("funcs         	(list the functions that can be proposed)\n")
+	msgReceiving <- fmt.Sprintf("run [@id] <inputs>  (run the agreed function, in the background)\n")
+	msgReceiving <- fmt.Sprintf("runco [@id] <inputs>  (run with triples from the commodity server)\n")
+	msgReceiving <- fmt.Sprintf("jobs          	(list the proposed and running computations)\n")
+	msgReceiving <- fmt.Sprintf("cancel <id>   	(stop a computation for all members)\n")
+	msgReceiving <- fmt.Sprintf("role [role]   	(show the roles, or become an input, compute, or observer party)\n")
 	msgReceiving <- fmt.Sprintf("^D            	(buh-bye)\n")
 	msgReceiving <- fmt.Sprintf("anything else 	(send anything else to your current chatroom)\n")
 
-	joinRoomChannels(nc, msgReceiving, "#general")
+	c.joinRoomChannels(msgReceiving, "#general")
 
 	for {
 		line := <-userTyping
 		if line == "END" {
 			log.Println("Goodbye!")
-			leaveRoom(nc, msgReceiving)
-			nc.Close()
+			c.leaveRoom(msgReceiving)
+			c.Broker.Close()
 			return // exit
 		}
 		words := strings.Fields(line)
@@ -52,8 +61,8 @@ func ClientChannels(userTyping, msgReceiving chan string) {
 			msgReceiving <- fmt.Sprintf("AUTHORIZATION DISABLED\n")
 		case "nick":
 			if len(words) == 2 {
-				changeNick(words[1])
-				msgReceiving <- fmt.Sprintf("Your nickname is now %s\n", MyNick)
+				c.changeNick(words[1])
+				msgReceiving <- fmt.Sprintf("Your nickname is now %s\n", c.Party.Nick)
 
 			} else {
 				msgReceiving <- fmt.Sprintf("Nicknames must be one word\n")
@@ -64,41 +73,56 @@ func ClientChannels(userTyping, msgReceiving chan string) {
 				msgReceiving <- fmt.Sprintf("You must say what room to join\n")
 			case len(words) == 2:
 				roomName := words[1]
-				joinRoomChannels(nc, msgReceiving, roomName)
+				c.joinRoomChannels(msgReceiving, roomName)
 			default:
 				msgReceiving <- fmt.Sprintf("You can only join one room at once\n")
 			}
 		case "members":
-			for _, member := range MyRoom.Members {
-				msgReceiving <- fmt.Sprintf("%s (%s)\n", member.Key, member.Nick)
+			members, hash := c.Room.members()
+			for _, member := range members {
+				msgReceiving <- c.memberLine(member)
 			}
-			msgReceiving <- fmt.Sprintf("Hash: %x\n", MyRoom.Hash)
+			msgReceiving <- fmt.Sprintf("Hash: %x\n", hash)
+		case "verify":
+			msgReceiving <- c.verifyCommand(words[1:])
+		case "trust":
+			msgReceiving <- c.trustCommand(words[1:])
 		case "func":
 			switch {
 			case len(words) == 1:
 				msgReceiving <- fmt.Sprintf("You must say what function you want to compute\n")
 			case len(words) == 2:
 				funcName := words[1]
-				proposeFunc(nc, funcName)
+				if err := c.checkFunction(funcName); err != nil {
+					msgReceiving <- fmt.Sprintf("%v\n", err)
+					break
+				}
+				c.proposeFunc(funcName)
 			default:
 				msgReceiving <- fmt.Sprintf("You can only propose one function at once\n")
 			}
-		case "run":
-			msgReceiving <- fmt.Sprintf("Starting computation\n")
-			session(nc, msgReceiving, words[1:])
-			MyRoom.MpcFunc = ""
-			// term.SetPrompt(fmt.Sprintf("%s> ", MyRoom.Name))
-		case "runco":
-			msgReceiving <- fmt.Sprintf("Starting commodity computation\n")
-			commoditySession(nc, msgReceiving, words[1:])
-			MyRoom.MpcFunc = ""
-			// term.SetPrompt(fmt.Sprintf("%s> ", MyRoom.Name))
+		case "funcs":
+			for _, f := range Functions() {
+				msgReceiving <- fmt.Sprintf("%v\n", f)
+			}
+		case "run", "runco":
+			c.runCommand(msgReceiving, words[0] == "runco", words[1:])
+		case "jobs":
+			msgReceiving <- c.jobsCommand()
+		case "cancel":
+			if len(words) != 2 {
+				msgReceiving <- fmt.Sprintf("You must say which computation to cancel\n")
+			} else if err := c.cancel(words[1]); err != nil {
+				msgReceiving <- fmt.Sprintf("%v\n", err)
+			}
+		case "role":
+			msgReceiving <- c.roleCommand(words[1:])
 		case "test_crypto":
 			msgReceiving <- fmt.Sprintf("Testing crypto\n")
 			// test crypto here
 		default:
 			msg := strings.TrimSpace(line)
-			err := nc.Publish(MyRoom.Name, encode(Message{MyParty, msg}))
+			err := publish(c.Broker, c.Room.Name, Message{c.Party, msg})
 			checkError(err)
 		}
 	}
@@ -117,16 +141,23 @@ func Client() {
 		panic(fmt.Sprintf("Signal: %v", s))
 	}()
 
-	nc := connectNats()
+	c := newClientState()
 	term := terminal.NewTerminal(os.Stdin, "> ")
 
-	Tprintf(term, "Greetings, %s!\n", MyNick)
+	Tprintf(term, "Greetings, %s!\n", c.Party.Nick)
 	Tprintf(term, "Commands:\n")
 	Tprintf(term, "join foo      	(join the chatroom named foo)\n")
 	Tprintf(term, "nick foo      	(change your nickname to foo)\n")
 	Tprintf(term, "members       	(list the parties in the current room)\n")
+	Tprintf(term, "verify [foo]  	(show the key fingerprints of you and of member foo)\n")
+	Tprintf(term, "trust foo     	(accept the key of member foo as verified)\n")
 	Tprintf(term, "func <function>  (propose a function for computation)\n")
-	Tprintf(term, "run <number>  	(run max with input <number>)\n")
+	Tprintf(term, "funcs         	(list the functions that can be proposed)\n")
+	Tprintf(term, "run [@id] <inputs>  (run the agreed function, in the background)\n")
+	Tprintf(term, "runco [@id] <inputs>  (run with triples from the commodity server)\n")
+	Tprintf(term, "jobs          	(list the proposed and running computations)\n")
+	Tprintf(term, "cancel <id>   	(stop a computation for all members)\n")
+	Tprintf(term, "role [role]   	(show the roles, or become an input, compute, or observer party)\n")
 	Tprintf(term, "^D            	(buh-bye)\n")
 	Tprintf(term, "anything else 	(send anything else to your current chatroom)\n")
 
@@ -144,7 +175,7 @@ func Client() {
 			Tprintf(term, "(Received on channel) %s", msg)
 		}
 	}()
-	joinRoomChannels(nc, printToTermChan, "#general")
+	c.joinRoomChannels(printToTermChan, "#general")
 
 	for {
 		line, err := term.ReadLine()
@@ -154,8 +185,8 @@ func Client() {
 			} else {
 				log.Println("Goodbye!")
 			}
-			leaveRoom(nc, printToTermChan)
-			nc.Close()
+			c.leaveRoom(printToTermChan)
+			c.Broker.Close()
 			return // exit
 		}
 		words := strings.Fields(line)
@@ -168,8 +199,8 @@ func Client() {
 			Tprintf(term, "AUTHORIZATION DISABLED\n")
 		case "nick":
 			if len(words) == 2 {
-				changeNick(words[1])
-				Tprintf(term, "Your nickname is now %s\n", MyNick)
+				c.changeNick(words[1])
+				Tprintf(term, "Your nickname is now %s\n", c.Party.Nick)
 
 			} else {
 				Tprintf(term, "Nicknames must be one word\n")
@@ -180,88 +211,87 @@ func Client() {
 				Tprintf(term, "You must say what room to join\n")
 			case len(words) == 2:
 				roomName := words[1]
-				joinRoomChannels(nc, printToTermChan, roomName)
+				c.joinRoomChannels(printToTermChan, roomName)
 			default:
 				Tprintf(term, "You can only join one room at once\n")
 			}
 		case "members":
-			for _, member := range MyRoom.Members {
-				Tprintf(term, "%s (%s)\n", member.Key, member.Nick)
+			members, hash := c.Room.members()
+			for _, member := range members {
+				Tprintf(term, "%s", c.memberLine(member))
 			}
-			Tprintf(term, "Hash: %x\n", MyRoom.Hash)
+			Tprintf(term, "Hash: %x\n", hash)
+		case "verify":
+			Tprintf(term, "%s", c.verifyCommand(words[1:]))
+		case "trust":
+			Tprintf(term, "%s", c.trustCommand(words[1:]))
 		case "func":
 			switch {
 			case len(words) == 1:
 				Tprintf(term, "You must say what function you want to compute\n")
 			case len(words) == 2:
 				funcName := words[1]
-				proposeFunc(nc, funcName)
+				if err := c.checkFunction(funcName); err != nil {
+					Tprintf(term, "%v\n", err)
+					break
+				}
+				c.proposeFunc(funcName)
 			default:
 				Tprintf(term, "You can only propose one function at once\n")
 			}
-		case "run":
-			Tprintf(term, "Starting computation\n")
-			session(nc, printToTermChan, words[1:])
-			MyRoom.MpcFunc = ""
-			term.SetPrompt(fmt.Sprintf("%s> ", MyRoom.Name))
-		case "runco":
-			Tprintf(term, "Starting commodity computation\n")
-			commoditySession(nc, printToTermChan, words[1:])
-			MyRoom.MpcFunc = ""
-			term.SetPrompt(fmt.Sprintf("%s> ", MyRoom.Name))
+		case "funcs":
+			for _, f := range Functions() {
+				Tprintf(term, "%v\n", f)
+			}
+		case "run", "runco":
+			c.runCommand(printToTermChan, words[0] == "runco", words[1:])
+		case "jobs":
+			Tprintf(term, "%s", c.jobsCommand())
+		case "cancel":
+			if len(words) != 2 {
+				Tprintf(term, "You must say which computation to cancel\n")
+			} else if err := c.cancel(words[1]); err != nil {
+				Tprintf(term, "%v\n", err)
+			}
+		case "role":
+			Tprintf(term, "%s", c.roleCommand(words[1:]))
 		case "test_crypto":
 			Tprintf(term, "Testing crypto\n")
 			// test crypto here
 		default:
 			msg := strings.TrimSpace(line)
-			err = nc.Publish(MyRoom.Name, encode(Message{MyParty, msg}))
+			err = publish(c.Broker, c.Room.Name, Message{c.Party, msg})
 			checkError(err)
 		}
 	}
 }
 
-func session(nc *nats.Conn, msgReceived chan string, args []string) {
-	inputs := make([]uint32, len(args))
-	for i, v := range args {
-		input := 0
-		fmt.Sscanf(v, "%d", &input)
-		inputs[i] = uint32(input)
-	}
-	// var Handle
-	var Handle gmw.MPC
-	switch MyRoom.MpcFunc {
-	case "max":
-		Handle = max.Handle
-	case "vickrey":
-		Handle = vickrey.Handle
-	case "sum":
-		Handle = sum.Handle
-	case "":
-		msgReceived <- fmt.Sprintf("Before running a computation you must specify a function (use the 'func' command)\n")
-		return
-	default:
-		msgReceived <- fmt.Sprintf("Regular: Unknown function '%s'\n", MyRoom.MpcFunc)
-		return
-	}
+func (c *ClientState) runSession(ctx context.Context, j *job, values []input.Value) ([]gmw.Output, error) {
+	inputs := input.NewSource(values)
+	members, digest := j.members, j.digest
+	Handle := j.Function.MPC
 
 	numBlocks := Handle.NumBlocks
 	id := -1
 
-	//	log.Printf("Starting session. Members=\n%+v\n", MyRoom.Members)
+	//	log.Printf("Starting session. Members=\n%+v\n", members)
 
-	for i, v := range MyRoom.Members {
-		if v == MyParty {
+	for i, v := range members {
+		if v == c.Party {
 			id = i
 			break
 		}
 	}
 	if id == -1 {
-		panic("Non-member trying to start a computation in a room")
+		// the members of the room changed since the consent
+		return nil, errors.New("Computation setup failed: not a member of the computation")
 	}
 
-	numParties := len(MyRoom.Members)
-	io := gmw.NewPeerIO(numBlocks, numParties, id)
+	numParties := len(members)
+	io := gmw.NewPeerIO(ctx, numBlocks, numParties, id)
+	defer io.Cancel(nil)
 	io.Inputs = inputs
+	io.SetInputParties(j.inputs)
 	blocks := io.Blocks
 	numBlocks = len(blocks) // increased by one by NewPeerIo
 
@@ -270,29 +300,35 @@ func session(nc *nats.Conn, msgReceived chan string, args []string) {
 		if p == id {
 			continue
 		}
-		notMe := MyRoom.Members[p]
-		recvChans[p] = pairSubscribe(nc, notMe)
+		notMe := members[p]
+		var sub Subscription
+		recvChans[p], sub = c.pairSubscribe(j.ID, notMe)
+		defer sub.Unsubscribe()
 	}
-	if !barrier(nc) {
-		log.Println("Computation halted on error")
-		return
+	if !c.barrier(ctx, j.Room.Name, j.ID) {
+		return nil, halted(ctx)
 	}
 	pcs := make([]*PairConn, numParties)
-	done := make(chan bool)
+	done := make(chan error, numParties)
 	for p := 0; p < numParties; p++ {
 		if p == id {
 			continue
 		}
-		notMe := MyRoom.Members[p]
-		pc := &PairConn{nc, nil, 0, notMe}
+		notMe := members[p]
+		pc := &PairConn{c, nil, 0, notMe, j.Room.Name, j.ID, io.Cancel}
 		pcs[p] = pc
-		go pairInit(pc, notMe, recvChans[p], done)
+		go pairInit(ctx, pc, notMe, digest, recvChans[p], done)
 	}
 	for p := 0; p < numParties; p++ {
 		if p == id {
 			continue
 		}
-		<-done
+		if err := <-done; err != nil {
+			if ctx.Err() != nil {
+				return nil, halted(ctx)
+			}
+			return nil, fmt.Errorf("Computation setup failed: %v", err)
+		}
 	}
 
 	xs := make([]*gmw.PerNodePair, numParties)
@@ -367,13 +403,13 @@ func session(nc *nats.Conn, msgReceived chan string, args []string) {
 			}
 		}
 	}
-	if !barrier(nc) {
-		log.Println("Computation halted on error")
-		return
+	if !c.barrier(ctx, j.Room.Name, j.ID) {
+		return nil, halted(ctx)
 	}
 
 	//	log.Printf("I am party %d of %d\n", id, numParties)
-	//	log.Printf("%s (%s)\n", MyParty.Key, MyParty.Nick)
+	//	log.Printf("%s (%s)\n", c.Party.Key, c.Party.Nick)
+	setupDone := make(chan error, numParties)
 	for p := 0; p < numParties; p++ {
 		if p == id {
 			continue
@@ -382,85 +418,119 @@ func session(nc *nats.Conn, msgReceived chan string, args []string) {
 		x := xs[p]
 		if io.Leads(p) {
 			//log.Println("Starting server side for", p)
-			go gmw.ServerSideIOSetup(io, p, x, done)
+			go gmw.ServerSideIOSetup(io, p, x, setupDone)
 		} else {
 			//log.Println("Starting client side for", p)
-			go gmw.ClientSideIOSetup(io, p, x, false, done)
+			go gmw.ClientSideIOSetup(io, p, x, false, setupDone)
 		}
 	}
 	for p := 0; p < numParties; p++ {
 		if p == id {
 			continue
 		}
-		<-done
+		if err := <-setupDone; err != nil {
+			return nil, fmt.Errorf("Computation setup failed: %v", err)
+		}
 	}
 	//	log.Println("Done setup")
 
-	numBlocks = Handle.NumBlocks // make sure we have the right numBlocks
-	// copy io.blocks[1:] to make an []Io; []BlockIO is not []Io
-	x := make([]gmw.Io, numBlocks)
-	for j := 0; j < numBlocks; j++ {
-		x[j] = io.Blocks[j+1]
+	if err := io.Run(Handle.Main); err != nil {
+		return nil, fmt.Errorf("Computation aborted: %v", err)
 	}
-	Handle.Main(io.Blocks[0], x)
+	return io.Results().Party(id), nil
 }
 
-type natsCommodityRequester struct {
-	nc          *nats.Conn
-	natsSubject string
+// commodityRequester sends the requests of party 0 for one block to the
+// commodity server, see commodity.go
+type commodityRequester struct {
+	c       *ClientState
+	subject string
+	digest  []byte
+	seq     int
 }
 
-func (ncr *natsCommodityRequester) RequestTripleCorrection() {
-	err := ncr.nc.Publish(ncr.natsSubject, encode(TripleCommodity{}))
-	checkError(err)
+func (cr *commodityRequester) request(p interface{}) error {
+	data, err := encode(p)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealCommodity(commodityFrame{cr.subject, cr.digest, cr.seq, data}, cr.c.keys(), cr.c.CommodityKey)
+	if err != nil {
+		return err
+	}
+	cr.seq++
+	return cr.c.Broker.Publish(cr.subject, sealed)
 }
 
-func (ncr *natsCommodityRequester) RequestMaskTripleCorrection(numTriples, numBytesTriple int) {
-	err := ncr.nc.Publish(ncr.natsSubject, encode(MaskTripleCommodity{numTriples, numBytesTriple}))
-	checkError(err)
+// A failure to publish aborts the computation (see gmw.CommodityClientState)
+
+func (cr *commodityRequester) RequestTripleCorrection() {
+	err := cr.request(TripleCommodity{})
+	if err != nil {
+		panic(ot.Abort{Err: err})
+	}
 }
 
-func commoditySession(nc *nats.Conn, msgReceived chan string, args []string) {
-	inputs := make([]uint32, len(args))
-	for i, v := range args {
-		input := 0
-		fmt.Sscanf(v, "%d", &input)
-		inputs[i] = uint32(input)
-	}
-	var Handle gmw.MPC
-	switch MyRoom.MpcFunc {
-	case "max":
-		Handle = max.Handle
-	case "vickrey":
-		Handle = vickrey.Handle
-	case "sum":
-		Handle = sum.Handle
-	case "":
-		msgReceived <- fmt.Sprintf("Before running a computation you must specify a function (use the 'func' command)\n")
-		return
-	default:
-		msgReceived <- fmt.Sprintf("Commodity: Unknown function '%s'\n", MyRoom.MpcFunc)
-		return
+func (cr *commodityRequester) RequestMaskTripleCorrection(numTriples, numBytesTriple int) {
+	err := cr.request(MaskTripleCommodity{numTriples, numBytesTriple})
+	if err != nil {
+		panic(ot.Abort{Err: err})
 	}
+}
+
+// commoditySubscribe sends the messages of the commodity server on
+// subject to ch.  A message that is not from the server, or is not the
+// next message of the computation with digest, aborts the computation.
+func (c *ClientState) commoditySubscribe(io *gmw.PeerIO, subject string, digest []byte, ch chan []byte) Subscription {
+	seq := 0
+	sub, err := c.Broker.Subscribe(subject, func(m *Msg) {
+		sender, frame, err := openCommodity(m.Data, subject, c.PrivateKey)
+		if err == nil && sender != c.CommodityKey {
+			err = errors.New("message not from the commodity server")
+		}
+		if err == nil {
+			err = frame.check(digest, seq)
+		}
+		if err != nil {
+			io.Cancel(fmt.Errorf("commodity server: %v", err))
+			return
+		}
+		seq++
+		select {
+		case ch <- frame.Data:
+		case <-io.Context().Done():
+		}
+	})
+	checkError(err)
+	return sub
+}
+
+func (c *ClientState) runCommoditySession(ctx context.Context, j *job, values []input.Value) ([]gmw.Output, error) {
+	inputs := input.NewSource(values)
+	members, digest := j.members, j.digest
+	Handle := j.Function.MPC
 
 	numBlocks := Handle.NumBlocks
 	id := -1
 
-	//	log.Printf("Starting session. Members=\n%+v\n", MyRoom.Members)
+	//	log.Printf("Starting session. Members=\n%+v\n", members)
 
-	for i, v := range MyRoom.Members {
-		if v == MyParty {
+	for i, v := range members {
+		if v == c.Party {
 			id = i
 			break
 		}
 	}
 	if id == -1 {
-		panic("Non-member trying to start a computation in a room")
+		// the members of the room changed since the consent
+		return nil, errors.New("Computation setup failed: not a member of the computation")
 	}
 
-	numParties := len(MyRoom.Members)
-	io := gmw.NewPeerIO(numBlocks, numParties, id)
+	numParties := len(members)
+	io := gmw.NewPeerIO(ctx, numBlocks, numParties, id)
+	defer io.Cancel(nil)
 	io.Inputs = inputs
+	io.SetInputParties(j.inputs)
 	blocks := io.Blocks
 	numBlocks = len(blocks) // increased by one by NewPeerIo
 
@@ -469,29 +539,35 @@ func commoditySession(nc *nats.Conn, msgReceived chan string, args []string) {
 		if p == id {
 			continue
 		}
-		notMe := MyRoom.Members[p]
-		recvChans[p] = pairSubscribe(nc, notMe)
+		notMe := members[p]
+		var sub Subscription
+		recvChans[p], sub = c.pairSubscribe(j.ID, notMe)
+		defer sub.Unsubscribe()
 	}
-	if !barrier(nc) {
-		log.Println("Computation halted on error")
-		return
+	if !c.barrier(ctx, j.Room.Name, j.ID) {
+		return nil, halted(ctx)
 	}
 	pcs := make([]*PairConn, numParties)
-	done := make(chan bool)
+	done := make(chan error, numParties)
 	for p := 0; p < numParties; p++ {
 		if p == id {
 			continue
 		}
-		notMe := MyRoom.Members[p]
-		pc := &PairConn{nc, nil, 0, notMe}
+		notMe := members[p]
+		pc := &PairConn{c, nil, 0, notMe, j.Room.Name, j.ID, io.Cancel}
 		pcs[p] = pc
-		go pairInit(pc, notMe, recvChans[p], done)
+		go pairInit(ctx, pc, notMe, digest, recvChans[p], done)
 	}
 	for p := 0; p < numParties; p++ {
 		if p == id {
 			continue
 		}
-		<-done
+		if err := <-done; err != nil {
+			if ctx.Err() != nil {
+				return nil, halted(ctx)
+			}
+			return nil, fmt.Errorf("Computation setup failed: %v", err)
+		}
 	}
 
 	for _, block := range blocks {
@@ -520,111 +596,296 @@ func commoditySession(nc *nats.Conn, msgReceived chan string, args []string) {
 		}
 	}
 
+	requesters := make([]*commodityRequester, len(blocks))
 	for i, block := range blocks {
-		for p := 0; p < numParties; p++ {
-			if p == id {
-				continue
-			}
-			natsSubjectFrom := fmt.Sprintf("%s.commodity.%x.%d", MyPublicKey, MyRoom.Hash, i)
-			natsSubjectTo := fmt.Sprintf("commodity.%x.%d", MyRoom.Hash, i)
-
-			correctionCh := make(chan []byte)
-			ncr := &natsCommodityRequester{nc, natsSubjectTo}
-			block.Source = gmw.NewCommodityClientState(correctionCh, ncr)
+		natsSubjectFrom := fmt.Sprintf("%s.commodity.%s.%d", c.Party.Key, j.ID, i)
+		natsSubjectTo := fmt.Sprintf("commodity.%s.%d", j.ID, i)
 
-			ec, err := nats.NewEncodedConn(nc, "gob")
-			checkError(err)
-			sub, err := ec.BindRecvChan(natsSubjectFrom, correctionCh)
-			checkError(err)
+		correctionCh := make(chan []byte)
+		requesters[i] = &commodityRequester{c, natsSubjectTo, digest, 0}
+		block.Source = gmw.NewCommodityClientState(io.Context(), correctionCh, requesters[i])
 
-			// non-distinguished parties could close earlier
-			defer close(correctionCh)
-			defer sub.Unsubscribe()
-		}
+		sub := c.commoditySubscribe(io, natsSubjectFrom, digest, correctionCh)
+		defer sub.Unsubscribe()
 	}
 
-	if !barrier(nc) {
-		log.Println("Computation halted on error")
-		return
+	if !c.barrier(ctx, j.Room.Name, j.ID) {
+		return nil, halted(ctx)
 	}
 
 	// Distinguished party sends StartCommodity message
 	if id == 0 {
-		for i, _ := range blocks {
-			err := nc.Publish(fmt.Sprintf("commodity.%x.%d", MyRoom.Hash, i), encode(StartCommodity{MyRoom.Members}))
-			checkError(err)
+		for _, cr := range requesters {
+			if err := cr.request(j.consent); err != nil {
+				return nil, fmt.Errorf("Computation setup failed: %v", err)
+			}
 		}
 	}
 
 	for _, block := range blocks {
 		distinguished := id == 0
-		gmw.InitCommodityClientState(block.Source.(*gmw.CommodityClientState), distinguished)
+		err := gmw.InitCommodityClientState(block.Source.(*gmw.CommodityClientState), distinguished)
+		if err != nil {
+			return nil, fmt.Errorf("Computation setup failed: %v", err)
+		}
 	}
 
-	numBlocks = Handle.NumBlocks // make sure we have the right numBlocks
-	// copy io.blocks[1:] to make an []Io; []BlockIO is not []Io
-	x := make([]gmw.Io, numBlocks)
-	for j := 0; j < numBlocks; j++ {
-		x[j] = io.Blocks[j+1]
-	}
-	Handle.Main(io.Blocks[0], x)
+	err := io.Run(Handle.Main)
 	// Distinguished party sends EndCommodity message
 	if id == 0 {
-		for i, _ := range blocks {
-			err := nc.Publish(fmt.Sprintf("commodity.%x.%d", MyRoom.Hash, i), encode(EndCommodity{}))
+		for _, cr := range requesters {
+			err := cr.request(EndCommodity{})
 			checkError(err)
 		}
 	}
+	if err != nil {
+		return nil, fmt.Errorf("Computation aborted: %v", err)
+	}
+	return io.Results().Party(id), nil
 }
 
-func leaveRoom(nc *nats.Conn, msgReceived chan string) {
-	if MyRoom != nil { // leave current room; can be nil on startup only
-		msgReceived <- fmt.Sprintf("You are leaving room %s\n", MyRoom.Name)
-		err := nc.Publish(fmt.Sprintf("secretary.%s", MyRoom.Name), encode(LeaveRequest{MyParty}))
+var errHalted = errors.New("Computation halted on error")
+
+func (c *ClientState) leaveRoom(msgReceived chan string) {
+	if c.Room != nil { // leave current room; can be nil on startup only
+		msgReceived <- fmt.Sprintf("You are leaving room %s\n", c.Room.Name)
+		err := publish(c.Broker, fmt.Sprintf("secretary.%s", c.Room.Name), LeaveRequest{c.Party})
 		checkError(err)
-		err = MyRoom.Sub.Unsubscribe()
+		err = c.Room.Sub.Unsubscribe()
 		checkError(err)
+		close(c.Room.stopHeartbeat)
+		c.cancelJobs(c.Room, errors.New("left the room"))
+		c.event(Event{Type: "left", Room: c.Room.Name})
+	}
+}
+
+// Send heartbeats for party to the secretary of room until stop is
+// closed, so the secretary knows that we are still in the room.
+func heartbeat(b Broker, room string, party Party, stop chan bool) {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := publish(b, fmt.Sprintf("secretary.%s", room), Heartbeat{party})
+			if err != nil {
+				log.Println("Heartbeat:", err)
+			}
+		}
+	}
+}
+
+// memberLine describes a member for the members command, noting a key
+// that is new or has changed.
+func (c *ClientState) memberLine(member Party) string {
+	line := fmt.Sprintf("%s (%s)", member.Key, member.Nick)
+	c.Room.mu.Lock()
+	role := c.Room.role(member)
+	c.Room.mu.Unlock()
+	if role != RoleInput {
+		line += fmt.Sprintf(" [%s]", role)
+	}
+	if c.Identities != nil && member.Key != c.Party.Key {
+		switch status := c.Identities.Status(member); status {
+		case KeyNew, KeyChanged:
+			line += fmt.Sprintf(" [%v, use 'verify %s']", status, member.Nick)
+		case KeyVerified:
+			line += " [verified]"
+		}
+	}
+	return line + "\n"
+}
+
+// checkKeys pins the keys of new members and warns about changed keys.
+func (c *ClientState) checkKeys(msgReceived chan string, room string, parties []Party) {
+	if c.Identities == nil {
+		return
+	}
+	for _, p := range parties {
+		if p.Key == c.Party.Key {
+			continue
+		}
+		status, err := c.Identities.Check(p)
+		if err != nil {
+			log.Println("Saving contacts:", err)
+		}
+		switch {
+		case status == KeyNew:
+			msgReceived <- fmt.Sprintf("%s: First time meeting %s, key fingerprint %s\n", room, p.Nick, Fingerprint(p.Key))
+		case status == KeyChanged && c.Identities.warnOnce(p):
+			msgReceived <- fmt.Sprintf("%s: WARNING: %s has a different key than before! Check it with 'verify %s'\n", room, p.Nick, p.Nick)
+		}
+	}
+}
+
+func (c *ClientState) findMember(nick string) (Party, bool) {
+	members, _ := c.Room.members()
+	for _, member := range members {
+		if member.Nick == nick {
+			return member, true
+		}
+	}
+	return Party{}, false
+}
+
+func (c *ClientState) verifyCommand(nicks []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Your key fingerprint: %s\n", Fingerprint(c.Party.Key))
+	for _, nick := range nicks {
+		member, ok := c.findMember(nick)
+		if !ok {
+			fmt.Fprintf(&b, "%s is not a member of %s\n", nick, c.Room.Name)
+			continue
+		}
+		if c.Identities == nil {
+			fmt.Fprintf(&b, "%s: key fingerprint %s\n", nick, Fingerprint(member.Key))
+			continue
+		}
+		fmt.Fprintf(&b, "%s: key fingerprint %s (%v)\n", nick, Fingerprint(member.Key), c.Identities.Status(member))
+		if contact, ok := c.Identities.Lookup(nick); ok && contact.Key != member.Key {
+			fmt.Fprintf(&b, "%s: previous key fingerprint %s\n", nick, Fingerprint(contact.Key))
+		}
+	}
+	return b.String()
+}
+
+func (c *ClientState) trustCommand(nicks []string) string {
+	switch {
+	case c.Identities == nil:
+		return "Keys are not saved, so they cannot be trusted (see the -identity flag)\n"
+	case len(nicks) != 1:
+		return "You must say whose key to trust\n"
+	}
+	member, ok := c.findMember(nicks[0])
+	if !ok {
+		return fmt.Sprintf("%s is not a member of %s\n", nicks[0], c.Room.Name)
+	}
+	if err := c.Identities.Trust(member); err != nil {
+		return fmt.Sprintf("Saving contacts: %v\n", err)
+	}
+	return fmt.Sprintf("Trusted the key of %s, fingerprint %s\n", member.Nick, Fingerprint(member.Key))
+}
+
+// checkFunction returns an error if funcName is not registered or
+// cannot run with the input parties of the current room.
+func (c *ClientState) checkFunction(funcName string) error {
+	f, ok := LookupFunction(funcName)
+	if !ok {
+		return fmt.Errorf("Unknown function '%s' (use the 'funcs' command to list functions)", funcName)
+	}
+	c.Room.mu.Lock()
+	_, inputs := c.Room.parties()
+	c.Room.mu.Unlock()
+	if inputs == 0 {
+		return fmt.Errorf("No member of %s is an input party (use the 'role' command)", c.Room.Name)
+	}
+	return f.CheckParties(inputs)
+}
+
+// roomFunction returns the function of the proposal cs after checking it
+// against the room and the inputs of this party, which has role.
+func (c *ClientState) roomFunction(cs *consentState, values []input.Value, role Role) (*Function, error) {
+	if err := c.checkFunction(cs.Function); err != nil {
+		return nil, err
+	}
+	f, _ := LookupFunction(cs.Function)
+	if !role.Inputs() {
+		if len(values) > 0 {
+			return nil, fmt.Errorf("Your role is %s, so you supply no inputs (use 'role input' to supply them)", role)
+		}
+		return f, nil
+	}
+	if err := f.CheckInputs(values); err != nil {
+		return nil, err
 	}
+	return f, nil
 }
 
-func proposeFunc(nc *nats.Conn, funcName string) {
-	err := nc.Publish(MyRoom.Name, encode(FuncRequest{MyParty, funcName}))
+func (c *ClientState) proposeFunc(funcName string) {
+	f, _ := LookupFunction(funcName)
+	err := publish(c.Broker, c.Room.Name, c.propose(f))
 	checkError(err)
 }
 
-func joinRoomChannels(nc *nats.Conn, msgReceiveing chan string, roomName string) {
-	leaveRoom(nc, msgReceiveing)
-	MyRoom = &RoomState{roomName, nil, nil, nil, ""}
+func (c *ClientState) joinRoomChannels(msgReceiveing chan string, roomName string) {
+	c.leaveRoom(msgReceiveing)
+	c.Room = &RoomState{Name: roomName, stopHeartbeat: make(chan bool)}
 	// term.SetPrompt(fmt.Sprintf("%s> ", roomName))
-	err := nc.Publish(fmt.Sprintf("secretary.%s", roomName), encode(JoinRequest{MyParty}))
-	checkError(err)
-	msgReceiveing <- fmt.Sprintf("You have joined room %s\n", roomName)
-	sub, err := nc.Subscribe(roomName, func(m *nats.Msg) {
+	// subscribe before joining, so we see the members of the room
+	sub, err := c.Broker.Subscribe(roomName, func(m *Msg) {
 		// Tprintf(term, "Received\n")
-		dec := gob.NewDecoder(bytes.NewBuffer(m.Data))
-		var p interface{}
-		err := dec.Decode(&p)
+		p, err := decode(m.Data)
 		if err != nil {
-			log.Fatal("decode:", err)
+			log.Println("Dropping a message in", roomName, "-", err)
+			return
 		}
 		switch r := p.(type) {
 		case Message:
-			if r.Party != MyParty {
+			if r.Party != c.Party {
 				msgReceiveing <- fmt.Sprintf("%s: %s -- (%s)\n", roomName, r.Message, r.Party.Nick)
+				c.event(Event{Type: "message", Room: roomName, From: &r.Party, Text: r.Message})
 			}
 		case Members:
-			MyRoom.Members = r.Parties
 			h := sha3.New256()
-			for _, member := range MyRoom.Members {
+			for _, member := range r.Parties {
 				io.WriteString(h, member.Key)
 			}
-			MyRoom.Hash = h.Sum(nil)
+			roles := make(map[string]Role)
+			for i, role := range r.Roles {
+				if role != RoleInput && i < len(r.Parties) {
+					roles[r.Parties[i].Key] = role
+				}
+			}
+			c.Room.mu.Lock()
+			c.Room.Members = r.Parties
+			c.Room.Roles = roles
+			c.Room.Hash = h.Sum(nil)
+			c.Room.mu.Unlock()
+			c.event(Event{Type: "members", Room: roomName, Members: r.Parties})
+			c.checkKeys(msgReceiveing, roomName, r.Parties)
+			if c.membersChanged() {
+				msgReceiveing <- fmt.Sprintf("%s: The members or their roles have changed, functions must be proposed again\n", roomName)
+				c.event(Event{Type: "dropped", Room: roomName})
+			}
 		case FuncRequest:
-			MyRoom.MpcFunc = r.FunctionName
-			// term.SetPrompt(fmt.Sprintf("%s [%s]> ", MyRoom.Name, MyRoom.MpcFunc))
-			msgReceiveing <- fmt.Sprintf("%s: Function proposed: %s -- (%s)\n", roomName, MyRoom.MpcFunc, r.Party.Nick)
+			cs, consent, err := c.receiveProposal(r)
+			if err != nil {
+				msgReceiveing <- fmt.Sprintf("%s: %v\n", roomName, err)
+				return
+			}
+			msgReceiveing <- fmt.Sprintf("%s: Function proposed: %s, computation %s -- (%s)\n", roomName, cs.Function, cs.ID, r.Party.Nick)
+			c.event(Event{Type: "proposal", Room: roomName, From: &r.Party, Function: cs.Function, Session: cs.ID})
+			if consent != nil {
+				err = publish(c.Broker, roomName, *consent)
+				checkError(err)
+			}
+			if _, err := c.agreed(cs.ID); err == nil {
+				msgReceiveing <- fmt.Sprintf("%s: All members have agreed to compute %s, computation %s\n", roomName, cs.Function, cs.ID)
+				c.event(Event{Type: "agreed", Room: roomName, Function: cs.Function, Session: cs.ID})
+			}
+		case Consent:
+			cs, err := c.receiveConsent(r)
+			if err != nil {
+				msgReceiveing <- fmt.Sprintf("%s: %v\n", roomName, err)
+			}
+			if cs != nil {
+				msgReceiveing <- fmt.Sprintf("%s: All members have agreed to compute %s, computation %s\n", roomName, cs.Function, cs.ID)
+				c.event(Event{Type: "agreed", Room: roomName, Function: cs.Function, Session: cs.ID})
+			}
+		case CancelRequest:
+			if c.receiveCancel(r) {
+				msgReceiveing <- fmt.Sprintf("%s: %s cancelled computation %s\n", roomName, r.Party.Nick, r.Session)
+				c.event(Event{Type: "cancelled", Room: roomName, From: &r.Party, Session: r.Session})
+			}
 		}
 	})
 	checkError(err)
-	MyRoom.Sub = sub
+	c.Room.Sub = sub
+	err = publish(c.Broker, fmt.Sprintf("secretary.%s", roomName), JoinRequest{c.Party, c.Role})
+	checkError(err)
+	msgReceiveing <- fmt.Sprintf("You have joined room %s\n", roomName)
+	c.event(Event{Type: "joined", Room: roomName})
+	go heartbeat(c.Broker, roomName, c.Party, c.Room.stopHeartbeat)
 }
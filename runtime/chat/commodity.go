@@ -2,12 +2,16 @@ package chat
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"github.com/apcera/nats"
 	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/secure"
+	"golang.org/x/crypto/nacl/box"
+	"io"
 	"log"
 	"runtime"
+	"strings"
 )
 
 // The GMW commodity server
@@ -15,65 +19,184 @@ import (
 // Commodity Protocol Specification:
 //
 // CS == commodity server
-// CHASH == computation hash
+// SESSION == session ID of the computation, see jobs.go
 //
 //        MESSAGE                            NATS SUBJECT
 //
-// P[0]   >-- (StartCommodity) ------> CS    commodity.CHASH.BLOCKNUM
-// P[0]   <----------------- SEED ---< CS    P[0].commodity.CHASH.BLOCKNUM
+// P[0]   >-- (StartCommodity) ------> CS    commodity.SESSION.BLOCKNUM
+// P[0]   <----------------- SEED ---< CS    P[0].commodity.SESSION.BLOCKNUM
 //        ...
-// P[n-1] <----------------- SEED ---< CS    P[n-1].commodity.CHASH.BLOCKNUM
+// P[n-1] <----------------- SEED ---< CS    P[n-1].commodity.SESSION.BLOCKNUM
 //
-// P[0]   >-- (TripleRequest) -------> CS    commodity.CHASH.BLOCKNUM
-// P[0]   <------ (TripleMaterial) --< CS    P[0].commodity.CHASH.BLOCKNUM
+// P[0]   >-- (TripleRequest) -------> CS    commodity.SESSION.BLOCKNUM
+// P[0]   <------ (TripleMaterial) --< CS    P[0].commodity.SESSION.BLOCKNUM
 //
-// P[0]   >-- (MaskTripleRequest) ---> CS    commodity.CHASH.BLOCKNUM
-// P[0]   <-- (MaskTripleMaterial) --< CS    P[0].commodity.CHASH.BLOCKNUM
+// P[0]   >-- (MaskTripleRequest) ---> CS    commodity.SESSION.BLOCKNUM
+// P[0]   <-- (MaskTripleMaterial) --< CS    P[0].commodity.SESSION.BLOCKNUM
 //
-// P[0]   >-- (EndCommodity) --------> CS    commodity.CHASH.BLOCKNUM
+// P[0]   >-- (EndCommodity) --------> CS    commodity.SESSION.BLOCKNUM
+//
+// The commodity server has a long-term key pair, and the parties know its
+// public key (the -commodity-key flag).  Every message is a
+// SealedCommodity: a commodityFrame boxed from the sender to the
+// recipient.  The frame carries the subject it was published on, the
+// digest of the computation that the members agreed to (see consent.go),
+// and a sequence number, so a message cannot be moved to another
+// computation, block, or party, nor replayed or reordered.  The server
+// learns the digest from the StartCommodity request, which must carry the
+// descriptor of the computation and the signatures of every party on its
+// digest (see consent.go), and accepts requests for the block only from
+// the party that sent it, which must be P[0].  A second StartCommodity
+// for a block is ignored, so it cannot stop the computation.
+
+type SealedCommodity struct {
+	Key   string // public key of the sender
+	Nonce [24]byte
+	Box   []byte
+}
+
+type commodityFrame struct {
+	Subject string
+	Digest  []byte
+	Seq     int
+	Data    []byte
+}
+
+// sealCommodity boxes frame from keys to the party with public key peer.
+func sealCommodity(frame commodityFrame, keys *secure.Keys, peer string) ([]byte, error) {
+	sealed := SealedCommodity{Key: MarshalPublicKey(keys.Public)}
+	_, err := io.ReadFull(rand.Reader, sealed.Nonce[:])
+	checkError(err)
+	data, err := encode(frame)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Box = box.Seal(nil, data, &sealed.Nonce, UnmarshalPublicKey(peer), keys.Private)
+	return encode(sealed)
+}
+
+// openCommodity opens a SealedCommodity published on subject.  It returns
+// the public key of the sender and the frame, after checking that the
+// frame was meant for subject.
+func openCommodity(data []byte, subject string, privateKey *[32]byte) (string, *commodityFrame, error) {
+	p, err := decode(data)
+	if err != nil {
+		return "", nil, err
+	}
+	sealed, ok := p.(SealedCommodity)
+	if !ok {
+		return "", nil, fmt.Errorf("unexpected %T", p)
+	}
+	plaintext, ok := box.Open(nil, sealed.Box, &sealed.Nonce, UnmarshalPublicKey(sealed.Key), privateKey)
+	if !ok {
+		return "", nil, errors.New("message does not authenticate")
+	}
+	if p, err = decode(plaintext); err != nil {
+		return "", nil, err
+	}
+	frame, ok := p.(commodityFrame)
+	if !ok {
+		return "", nil, fmt.Errorf("unexpected %T in a sealed message", p)
+	}
+	if frame.Subject != subject {
+		return "", nil, fmt.Errorf("message for %s published on %s", frame.Subject, subject)
+	}
+	return sealed.Key, &frame, nil
+}
+
+// check returns an error unless f is message seq of the computation with
+// digest.
+func (f *commodityFrame) check(digest []byte, seq int) error {
+	if !bytes.Equal(f.Digest, digest) {
+		return errors.New("message for another computation")
+	}
+	if f.Seq != seq {
+		return fmt.Errorf("message %d out of order, expected %d", f.Seq, seq)
+	}
+	return nil
+}
+
+// commodityState is a computation block served by the commodity server
+type commodityState struct {
+	*gmw.CommodityServerState
+	party  string // public key of party 0
+	digest []byte
+	seq    int // of the next request
+}
+
+// Commodity runs a commodity server with the key pair of the process.
 func Commodity() {
-	log.Println("Starting commodity server")
-	// TODO: how to authenticate commodity server to chat participants
-	//	initialize()
-	nc := connectNats()
-	states := make(map[string]*gmw.CommodityServerState) // maintain one state computation hash + blocknum
-	nc.Subscribe("commodity.>", func(m *nats.Msg) {
-		dec := gob.NewDecoder(bytes.NewBuffer(m.Data))
-		var p interface{}
-		err := dec.Decode(&p)
+	keys := secure.KeysFromPrivate(MyPrivateKey)
+	if MyIdentities != nil {
+		keys = MyIdentities.Keys
+	}
+	ServeCommodity(connectNats(), keys)
+	runtime.Goexit()
+}
+
+// ServeCommodity runs the commodity server on b, in the background, with
+// the key pair keys.
+func ServeCommodity(b Broker, keys *secure.Keys) {
+	log.Println("Starting commodity server with key", MarshalPublicKey(keys.Public))
+	states := make(map[string]*commodityState) // maintain one state per session + blocknum
+	b.Subscribe("commodity.>", func(m *Msg) {
+		hashAndBlocknum := m.Subject[len("commodity."):]
+		sender, frame, err := openCommodity(m.Data, m.Subject, keys.Private)
 		if err != nil {
-			log.Println("decode:", err)
+			log.Println("Error:", hashAndBlocknum, err)
 			return
 		}
-		hashAndBlocknum := m.Subject[len("commodity."):]
-		// TODO: check that all messages are from party 0
+		s, ok := states[hashAndBlocknum]
+		if ok && sender != s.party {
+			log.Println("Error: message not from party 0,", hashAndBlocknum)
+			return
+		}
+		if ok {
+			err = frame.check(s.digest, s.seq)
+		} else {
+			err = frame.check(frame.Digest, 0)
+		}
+		if err != nil {
+			log.Println("Error:", hashAndBlocknum, err)
+			return
+		}
+		p, err := decode(frame.Data)
+		if err != nil {
+			log.Println("Error:", hashAndBlocknum, err)
+			return
+		}
+		if ok {
+			s.seq++
+		}
 		switch r := p.(type) {
 		case StartCommodity:
-			log.Println("StartCommodity", r)
-			_, ok := states[hashAndBlocknum]
+			log.Println("StartCommodity", r.Parties)
 			if ok {
-				// more than one StartCommodity message for a hashAndBlocknum; error, stop the computation
 				log.Println("Error: multiple StartCommodity messages for", hashAndBlocknum)
-				delete(states, hashAndBlocknum)
+				break
+			}
+			if len(r.Parties) == 0 || r.Parties[0].Key != sender {
+				log.Println("Error: StartCommodity not from party 0,", hashAndBlocknum)
+				break
+			}
+			if err := checkConsent(r, frame.Digest, hashAndBlocknum, keys); err != nil {
+				log.Println("Error:", hashAndBlocknum, err)
 				break
 			}
 			chs := make([]chan []byte, len(r.Parties))
 			for i, _ := range chs {
 				chs[i] = make(chan []byte)
+				go sendCommodity(b, fmt.Sprintf("%s.commodity.%s", r.Parties[i].Key, hashAndBlocknum), frame.Digest, keys, r.Parties[i].Key, chs[i])
 			}
-			ec, _ := nats.NewEncodedConn(nc, "gob")
-			for i, ch := range chs {
-				// TODO: all channels need authenticated encryption,
-				// first channel needs secure session
-				ec.BindSendChan(fmt.Sprintf("%s.commodity.%s", r.Parties[i].Key, hashAndBlocknum), ch)
-			}
-			states[hashAndBlocknum] = gmw.NewCommodityServerState(chs)
+			states[hashAndBlocknum] = &commodityState{gmw.NewCommodityServerState(chs), sender, frame.Digest, 1}
 		case EndCommodity:
 			log.Println("EndCommodity", r)
-			delete(states, hashAndBlocknum)
+			if ok {
+				close(s.CorrectionCh)
+				delete(states, hashAndBlocknum)
+			}
 		case TripleCommodity:
 			log.Println("TripleCommodity", r)
-			s, ok := states[hashAndBlocknum]
 			if !ok {
 				log.Println("Error: TripleCommodity without StartCommodity,", hashAndBlocknum)
 			} else {
@@ -81,7 +204,6 @@ func Commodity() {
 			}
 		case MaskTripleCommodity:
 			log.Println("MaskTripleCommodity", r)
-			s, ok := states[hashAndBlocknum]
 			if !ok {
 				log.Println("Error: MaskTripleCommodity without StartCommodity,", hashAndBlocknum)
 			} else {
@@ -91,5 +213,41 @@ func Commodity() {
 			log.Println("Error: unknown message", p)
 		}
 	})
-	runtime.Goexit()
+}
+
+// checkConsent returns an error unless r is the agreement of all of its
+// parties to the computation with digest, which hashAndBlocknum names.
+func checkConsent(r StartCommodity, digest []byte, hashAndBlocknum string, keys *secure.Keys) error {
+	if !strings.HasPrefix(hashAndBlocknum, sessionID(digest)+".") {
+		return errors.New("digest of another computation")
+	}
+	if !bytes.Equal(r.Descriptor.Digest(), digest) {
+		return errors.New("descriptor does not match the digest")
+	}
+	if !sameKeys(memberKeys(r.Parties), r.Descriptor.Members) {
+		return errors.New("parties are not the members of the computation")
+	}
+	me := MarshalPublicKey(keys.Public)
+	for i, p := range r.Parties {
+		if !verifySeal(p.Key, digest, r.Signatures[i], me, keys.Private) {
+			return fmt.Errorf("no signature of %s on the computation", p.Nick)
+		}
+	}
+	return nil
+}
+
+// sendCommodity seals the messages of ch to party and publishes them on
+// subject, until ch is closed
+func sendCommodity(b Broker, subject string, digest []byte, keys *secure.Keys, party string, ch chan []byte) {
+	seq := 0
+	for x := range ch {
+		sealed, err := sealCommodity(commodityFrame{subject, digest, seq, x}, keys, party)
+		if err == nil {
+			err = b.Publish(subject, sealed)
+		}
+		if err != nil {
+			log.Println("Error:", err) // keep draining ch, the server state blocks on it
+		}
+		seq++
+	}
 }
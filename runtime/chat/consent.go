@@ -0,0 +1,363 @@
+package chat
+
+// Consent to a computation.
+//
+// Naming a function is not enough for the parties of a room to agree on
+// a computation: each party runs the program it has registered under the
+// name, with the members it believes are in the room.  So the proposer
+// of a function publishes a Descriptor of the whole computation: the room
+// and its members with their roles, the function, a hash of its program,
+// its input types, and the parties that learn its outputs.  Every member builds the same
+// descriptor from its own registry and, if the digests match, signs the
+// digest and publishes its signature.  A session starts only after a
+// member holds valid signatures of one digest from all of the members,
+// and paired members compare the digest again when they set up their
+// channel, so no party can swap the function under the room.
+//
+// Parties are identified by nacl box keys, which cannot make ordinary
+// signatures.  Instead a Signature seals the digest from the signer to
+// each of the members, the signer included, and to the commodity server
+// if the signer knows its key.  Only the signer and the recipient can
+// make the seal for a recipient, so it convinces the recipient, which is
+// all that the consent round needs.  The party that starts a computation
+// with the commodity server passes the signatures of all of the members
+// on to it, see ServeCommodity.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/sha3"
+	"io"
+	"sort"
+	"strings"
+)
+
+type Descriptor struct {
+	Room     string
+	Members  []string // public keys, sorted
+	Roles    []string // of each member, see roles.go
+	Function string
+	Program  []byte   // hash of the program, see Function.ProgramHash
+	Inputs   []string // input types of each party
+	Outputs  []int    // parties that learn the outputs; empty for all
+	Nonce    []byte   // fresh for each proposal
+}
+
+// Digest is what members sign.
+func (d *Descriptor) Digest() []byte {
+	h := sha3.New256()
+	field := func(b []byte) {
+		binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	strs := func(ss []string) {
+		binary.Write(h, binary.BigEndian, uint32(len(ss)))
+		for _, s := range ss {
+			field([]byte(s))
+		}
+	}
+	field([]byte(d.Room))
+	strs(d.Members)
+	strs(d.Roles)
+	field([]byte(d.Function))
+	field(d.Program)
+	strs(d.Inputs)
+	binary.Write(h, binary.BigEndian, uint32(len(d.Outputs)))
+	for _, p := range d.Outputs {
+		binary.Write(h, binary.BigEndian, int32(p))
+	}
+	field(d.Nonce)
+	return h.Sum(nil)
+}
+
+type Signature struct {
+	Nonce [24]byte
+	Seals map[string][]byte // the sealed digest, by public key of recipient
+}
+
+// messages from clients to the clients of a room
+type Consent struct {
+	Party
+	Digest    []byte
+	Signature Signature
+}
+
+// consentState is a proposal that a room is considering.
+type consentState struct {
+	Descriptor
+	ID     string // of the session, see sessionID
+	digest []byte
+	signed map[string]bool      // public keys of the members that have signed
+	sigs   map[string]Signature // their signatures, by public key
+}
+
+// sessionID names the computation with digest.  It scopes the subjects
+// of the computation, so the computations of a room can run at once.
+func sessionID(digest []byte) string {
+	return hex.EncodeToString(digest[:8])
+}
+
+// memberKeys returns the sorted public keys of parties.
+func memberKeys(parties []Party) []string {
+	result := make([]string, len(parties))
+	for i, p := range parties {
+		result[i] = p.Key
+	}
+	sort.Strings(result)
+	return result
+}
+
+func sameKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describe returns the descriptor of running f with the current members
+// of the room; c.Room.mu must be held
+func (c *ClientState) describe(f *Function, nonce []byte) Descriptor {
+	return Descriptor{
+		Room:     c.Room.Name,
+		Members:  memberKeys(c.Room.Members),
+		Roles:    c.Room.memberRoles(c.Room.Members),
+		Function: f.Name,
+		Program:  f.ProgramHash(),
+		Inputs:   f.Inputs,
+		Outputs:  f.Outputs,
+		Nonce:    nonce,
+	}
+}
+
+// sign seals digest to each member of the room, us included, so that a
+// message in our name that we did not send fails verify like any other,
+// and to the commodity server.
+func (c *ClientState) sign(digest []byte) Signature {
+	var sig Signature
+	_, err := io.ReadFull(rand.Reader, sig.Nonce[:])
+	checkError(err)
+	sig.Seals = make(map[string][]byte)
+	for _, member := range c.Room.Members {
+		sig.Seals[member.Key] = box.Seal(nil, digest, &sig.Nonce, UnmarshalPublicKey(member.Key), c.PrivateKey)
+	}
+	if c.CommodityKey != "" {
+		sig.Seals[c.CommodityKey] = box.Seal(nil, digest, &sig.Nonce, UnmarshalPublicKey(c.CommodityKey), c.PrivateKey)
+	}
+	return sig
+}
+
+// verifySeal reports whether sig is the signature of digest by the party
+// with public key signer, for the recipient with privateKey.
+func verifySeal(signer string, digest []byte, sig Signature, recipient string, privateKey *[32]byte) bool {
+	opened, ok := box.Open(nil, sig.Seals[recipient], &sig.Nonce, UnmarshalPublicKey(signer), privateKey)
+	return ok && bytes.Equal(opened, digest)
+}
+
+// verify reports whether sig is the signature of digest by signer.
+func (c *ClientState) verify(signer Party, digest []byte, sig Signature) bool {
+	if !p2pAuth {
+		return true
+	}
+	return verifySeal(signer.Key, digest, sig, c.Party.Key, c.PrivateKey)
+}
+
+// propose returns a signed proposal to compute f in the current room.
+func (c *ClientState) propose(f *Function) FuncRequest {
+	c.Room.mu.Lock()
+	defer c.Room.mu.Unlock()
+	nonce := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	checkError(err)
+	d := c.describe(f, nonce)
+	if c.Room.proposed == nil {
+		c.Room.proposed = make(map[string]bool)
+	}
+	c.Room.proposed[hex.EncodeToString(nonce)] = true
+	return FuncRequest{c.Party, d, c.sign(d.Digest())}
+}
+
+// receiveProposal checks a proposal against our registry and the room.
+// If it matches, the proposal becomes the latest of the room, and we
+// return our consent to publish.
+func (c *ClientState) receiveProposal(r FuncRequest) (*consentState, *Consent, error) {
+	c.Room.mu.Lock()
+	defer c.Room.mu.Unlock()
+	f, ok := LookupFunction(r.Descriptor.Function)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s proposed unknown function '%s', not agreeing", r.Party.Nick, r.Descriptor.Function)
+	}
+	local := c.describe(f, r.Descriptor.Nonce)
+	digest := local.Digest()
+	if !bytes.Equal(digest, r.Descriptor.Digest()) {
+		return nil, nil, fmt.Errorf("%s proposed %s with a different program, inputs, outputs, members, or roles, not agreeing", r.Party.Nick, f.Name)
+	}
+	if !c.verify(r.Party, digest, r.Signature) {
+		return nil, nil, fmt.Errorf("bad signature on the proposal of %s by %s, not agreeing", f.Name, r.Party.Nick)
+	}
+	if r.Party.Key == c.Party.Key {
+		// our own proposal comes back once; a replay is not a proposal
+		nonce := hex.EncodeToString(r.Descriptor.Nonce)
+		if !c.Room.proposed[nonce] {
+			return nil, nil, fmt.Errorf("a proposal of %s in our name that we did not make, not agreeing", f.Name)
+		}
+		delete(c.Room.proposed, nonce)
+	}
+	cs := &consentState{local, sessionID(digest), digest, map[string]bool{r.Party.Key: true, c.Party.Key: true}, map[string]Signature{r.Party.Key: r.Signature}}
+	if c.Room.proposals == nil {
+		c.Room.proposals = make(map[string]*consentState)
+	}
+	c.Room.proposals[cs.ID] = cs
+	c.Room.latest = cs.ID
+	if r.Party.Key == c.Party.Key {
+		return cs, nil, nil
+	}
+	consent := &Consent{c.Party, digest, c.sign(digest)}
+	cs.sigs[c.Party.Key] = consent.Signature
+	return cs, consent, nil
+}
+
+// receiveConsent records the signature of another member.  It returns
+// the proposal when the last signature arrives.
+func (c *ClientState) receiveConsent(r Consent) (*consentState, error) {
+	c.Room.mu.Lock()
+	defer c.Room.mu.Unlock()
+	if len(r.Digest) < 8 {
+		return nil, fmt.Errorf("malformed agreement from %s", r.Party.Nick)
+	}
+	cs := c.Room.proposals[sessionID(r.Digest)]
+	if cs == nil || !bytes.Equal(cs.digest, r.Digest) {
+		return nil, nil // for a proposal we did not agree to, or an old one
+	}
+	if !c.verify(r.Party, cs.digest, r.Signature) {
+		return nil, fmt.Errorf("bad signature on the agreement of %s to %s", r.Party.Nick, cs.Function)
+	}
+	if i := sort.SearchStrings(cs.Members, r.Party.Key); i == len(cs.Members) || cs.Members[i] != r.Party.Key {
+		return nil, fmt.Errorf("%s agreed to %s but is not a member", r.Party.Nick, cs.Function)
+	}
+	if cs.signed[r.Party.Key] {
+		return nil, nil
+	}
+	cs.signed[r.Party.Key] = true
+	cs.sigs[r.Party.Key] = r.Signature
+	if len(cs.signed) < len(cs.Members) {
+		return nil, nil
+	}
+	return cs, nil
+}
+
+// membersChanged drops the proposals made for other members or roles,
+// and reports whether it did.
+func (c *ClientState) membersChanged() bool {
+	c.Room.mu.Lock()
+	defer c.Room.mu.Unlock()
+	keys := memberKeys(c.Room.Members)
+	roles := c.Room.memberRoles(c.Room.Members)
+	dropped := false
+	for id, cs := range c.Room.proposals {
+		if !sameKeys(cs.Members, keys) || !sameKeys(cs.Roles, roles) {
+			c.Room.drop(id)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// agreed returns the proposal of the room with session ID id, or the
+// latest proposal if id is "", if all members of the room have signed it.
+// A unique prefix of an ID will do.
+func (c *ClientState) agreed(id string) (*consentState, error) {
+	c.Room.mu.Lock()
+	defer c.Room.mu.Unlock()
+	return c.Room.agreed(id, c.Room.Members)
+}
+
+func (r *RoomState) agreed(id string, members []Party) (*consentState, error) {
+	cs, err := r.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	if !sameKeys(cs.Members, memberKeys(members)) || !sameKeys(cs.Roles, r.memberRoles(members)) {
+		return nil, fmt.Errorf("The members of the room or their roles have changed since %s was proposed", cs.Function)
+	}
+	var waiting []string
+	for _, member := range members {
+		if !cs.signed[member.Key] {
+			waiting = append(waiting, member.Nick)
+		}
+	}
+	if len(waiting) > 0 {
+		return nil, fmt.Errorf("Still waiting for %s to agree to %s", strings.Join(waiting, ", "), cs.Function)
+	}
+	return cs, nil
+}
+
+// lookup finds a proposal as for agreed; r.mu must be held
+func (r *RoomState) lookup(id string) (*consentState, error) {
+	if id == "" {
+		id = r.latest
+	}
+	var found *consentState
+	for key, cs := range r.proposals {
+		if id != "" && strings.HasPrefix(key, id) {
+			if found != nil {
+				return nil, fmt.Errorf("More than one computation starts with %s", id)
+			}
+			found = cs
+		}
+	}
+	switch {
+	case found != nil:
+		return found, nil
+	case id == "" || id == r.latest:
+		return nil, fmt.Errorf("Before running a computation you must specify a function (use the 'func' command)")
+	}
+	return nil, fmt.Errorf("There is no proposed computation %s (use the 'jobs' command to list them)", id)
+}
+
+// take removes the agreed proposal cs from the room, so that it runs
+// only once, and reports whether it was still there.
+func (c *ClientState) take(cs *consentState) bool {
+	c.Room.mu.Lock()
+	defer c.Room.mu.Unlock()
+	return c.Room.drop(cs.ID)
+}
+
+// drop forgets the proposal with session ID id; r.mu must be held
+func (r *RoomState) drop(id string) bool {
+	if _, ok := r.proposals[id]; !ok {
+		return false
+	}
+	delete(r.proposals, id)
+	if r.latest == id {
+		r.latest = ""
+	}
+	return true
+}
+
+// pending returns the proposals of the room, sorted by session ID.
+func (r *RoomState) pending() []*consentState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]*consentState, 0, len(r.proposals))
+	for _, cs := range r.proposals {
+		result = append(result, cs)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// members returns the members of the room and their hash.
+func (r *RoomState) members() ([]Party, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Members, r.Hash
+}
@@ -0,0 +1,702 @@
+package chat
+
+// The chat daemon.
+//
+// A Daemon runs a client without a terminal and serves it over HTTP, so
+// that web UIs and scripts can drive the chat.  Requests and responses
+// are JSON:
+//
+//     GET  /api/status        the party, its role and room, and the current runs
+//     GET  /api/room          the room: members and roles, proposals, and agreement
+//     POST /api/room          join a room: {"name": "#max"}
+//     POST /api/role          change our role: {"role": "observer"}
+//     GET  /api/functions     the functions that can be proposed
+//     POST /api/messages      send a message to the room: {"text": "hi"}
+//     POST /api/proposals     propose a function: {"function": "max"}
+//     GET  /api/runs          the runs so far
+//     POST /api/runs          run an agreed function: {"inputs": [9]}
+//     GET  /api/runs/ID       one run, with its outputs when it is done
+//     DELETE /api/runs/ID     cancel a run for all of the members
+//     GET  /api/events        the events of the client, as a stream
+//
+// The inputs of a run are read by input.ReadJSON; add "commodity": true
+// to get triples from the commodity server, like the runco command, and
+// "session": ID to run a proposal other than the latest (see jobs.go).
+// Compute parties and observers run with no inputs (see roles.go).
+// Runs go in the background, and their progress is reported in the
+// event stream and by /api/runs/ID.
+//
+// The event stream is a text/event-stream: each event is sent as
+//
+//     id: SEQ
+//     data: JSON
+//
+// A client that reconnects with a Last-Event-ID header (or ?since=SEQ)
+// first gets the events that it missed, as far back as the daemon keeps
+// them.  The types of events are
+//
+//     text       a line that the terminal client would print
+//     joined     we joined Room
+//     left       we left Room
+//     message    a message from another member, or one we sent
+//     members    the members of Room changed
+//     proposal   a member proposed Function
+//     dropped    the proposal was dropped because the members or roles changed
+//     agreed     all members agreed to compute Function in Session
+//     cancelled  a member cancelled Session
+//     run        Run changed state
+//     print      the program printed Text
+//
+// Anyone who can use the API can act as the party, so the daemon serves
+// it only on a loopback address, and requires on every request
+//
+//     Authorization: Bearer TOKEN
+//
+// where TOKEN is made afresh each time the daemon starts and written to
+// DaemonTokenFile, which only the user can read.  An EventSource, which
+// cannot set headers, may pass ?token=TOKEN to /api/events instead.  To
+// stop web pages in a browser from using the API, the daemon also
+// rejects a request whose Host is not a loopback name or address, as in
+// DNS rebinding, or that has an Origin on another host, and a request
+// with a body must be of type application/json, which a page cannot send
+// to another origin without the consent of the daemon.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/input"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Event struct {
+	Seq      int       `json:"seq"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Room     string    `json:"room,omitempty"`
+	From     *Party    `json:"from,omitempty"`
+	Text     string    `json:"text,omitempty"`
+	Function string    `json:"function,omitempty"`
+	Members  []Party   `json:"members,omitempty"`
+	Session  string    `json:"session,omitempty"`
+	Run      *Run      `json:"run,omitempty"`
+}
+
+// A Run is a computation started by the daemon.
+type Run struct {
+	ID        int          `json:"id"`
+	Session   string       `json:"session"`
+	Room      string       `json:"room"`
+	Function  string       `json:"function"`
+	Commodity bool         `json:"commodity"`
+	Role      Role         `json:"role"`
+	State     string       `json:"state"` // running, done, or failed
+	Error     string       `json:"error,omitempty"`
+	Outputs   []gmw.Output `json:"outputs,omitempty"`
+	Started   time.Time    `json:"started"`
+	Finished  *time.Time   `json:"finished,omitempty"`
+}
+
+type MemberInfo struct {
+	Party
+	Role        Role   `json:"role"`
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status,omitempty"` // of the key, see KeyStatus
+}
+
+type ProposalInfo struct {
+	Session  string `json:"session"`
+	Function string `json:"function"`
+	Latest   bool   `json:"latest"` // run by a run without a session
+	Agreed   bool   `json:"agreed"`
+	Waiting  string `json:"waiting,omitempty"` // why the function cannot run yet
+}
+
+type RoomInfo struct {
+	Name      string         `json:"name"`
+	Hash      string         `json:"hash"`
+	Members   []MemberInfo   `json:"members"`
+	Proposals []ProposalInfo `json:"proposals"`
+}
+
+type FunctionJSON struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Inputs      []string `json:"inputs"`
+	MinParties  int      `json:"minParties,omitempty"`
+	MaxParties  int      `json:"maxParties,omitempty"`
+}
+
+// eventHistory is the number of events kept for clients that reconnect
+const eventHistory = 1000
+
+type Daemon struct {
+	c     *ClientState
+	token string // of the API, see ServeHTTP
+	mux   *http.ServeMux
+	lines chan string // the text of the client
+	done  chan bool   // closed by Close
+
+	cmd sync.Mutex // serializes commands on c
+
+	mu       sync.Mutex // guards the fields below
+	seq      int
+	history  []Event
+	watchers map[chan Event]bool
+	runs     []*Run
+}
+
+// RunDaemon runs a daemon for the identity of the process, see
+// Initialize, serving on DaemonAddress, which must be a loopback address.
+// It writes the token of the API to DaemonTokenFile.
+func RunDaemon() {
+	host, _, err := net.SplitHostPort(DaemonAddress)
+	if err != nil {
+		log.Fatal("-http: ", err)
+	}
+	if !loopback(host) {
+		log.Fatalf("-http: %s is not a loopback address, and anyone who can reach the daemon can act as the party", host)
+	}
+	if DaemonTokenFile == "" {
+		dir, err := os.MkdirTemp("", "smpcc-chat")
+		if err != nil {
+			log.Fatal(err)
+		}
+		DaemonTokenFile = filepath.Join(dir, "daemon-token")
+	}
+	d := NewDaemon(newClientState())
+	if err := writeToken(DaemonTokenFile, d.Token()); err != nil {
+		log.Fatal("-token-file: ", err)
+	}
+	log.Printf("Chat daemon for %s serving on http://%s/api/ with the token in %s\n", d.c.Party.Nick, DaemonAddress, DaemonTokenFile)
+	log.Fatal(http.ListenAndServe(DaemonAddress, d))
+}
+
+// writeToken writes token to a file that only the user can read.
+func writeToken(filename, token string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Chmod(0600); err != nil { // if it already existed
+		return err
+	}
+	_, err = fmt.Fprintln(f, token)
+	return err
+}
+
+// loopback reports whether host, a name or an address without a port,
+// is on the loopback interface.
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// NewDaemon serves c, which should not be used otherwise.  Like the
+// terminal client, it starts in #general.
+func NewDaemon(c *ClientState) *Daemon {
+	token := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, token)
+	checkError(err)
+	d := &Daemon{
+		c:        c,
+		token:    hex.EncodeToString(token),
+		mux:      http.NewServeMux(),
+		lines:    make(chan string, 100),
+		done:     make(chan bool),
+		watchers: make(map[chan Event]bool),
+	}
+	c.Events = d.event
+	d.mux.HandleFunc("/api/status", d.serveStatus)
+	d.mux.HandleFunc("/api/room", d.serveRoom)
+	d.mux.HandleFunc("/api/role", d.serveRole)
+	d.mux.HandleFunc("/api/functions", d.serveFunctions)
+	d.mux.HandleFunc("/api/messages", d.serveMessages)
+	d.mux.HandleFunc("/api/proposals", d.serveProposals)
+	d.mux.HandleFunc("/api/runs", d.serveRuns)
+	d.mux.HandleFunc("/api/runs/", d.serveRun)
+	d.mux.HandleFunc("/api/events", d.serveEvents)
+	go func() {
+		for {
+			select {
+			case line := <-d.lines:
+				d.event(Event{Type: "text", Text: strings.TrimRight(line, "\n")})
+			case msg := <-gmw.MpcPrintsChan:
+				d.event(Event{Type: "print", Text: strings.TrimRight(msg, "\n")})
+			case <-d.done:
+				return
+			}
+		}
+	}()
+	d.join("#general")
+	return d
+}
+
+// Token returns the token that requests to d must carry.
+func (d *Daemon) Token() string {
+	return d.token
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if !loopback(host) {
+		httpError(w, http.StatusForbidden, fmt.Errorf("host %s is not a loopback address", r.Host))
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !loopback(u.Hostname()) {
+			httpError(w, http.StatusForbidden, fmt.Errorf("requests from %s are not allowed", origin))
+			return
+		}
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if r.Header.Get("Authorization") == "" && r.URL.Path == "/api/events" {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(d.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		httpError(w, http.StatusUnauthorized, errors.New("missing or wrong token"))
+		return
+	}
+	d.mux.ServeHTTP(w, r)
+}
+
+// Close leaves the room and disconnects the client.
+func (d *Daemon) Close() {
+	d.cmd.Lock()
+	defer d.cmd.Unlock()
+	d.c.leaveRoom(d.lines)
+	d.c.Broker.Close()
+	close(d.done)
+}
+
+// event records e and sends it to the event streams.  A stream that
+// cannot keep up is closed; its client can reconnect for the events it
+// missed.
+func (d *Daemon) event(e Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seq++
+	e.Seq = d.seq
+	e.Time = time.Now()
+	d.history = append(d.history, e)
+	if len(d.history) > eventHistory {
+		d.history = d.history[len(d.history)-eventHistory:]
+	}
+	for ch := range d.watchers {
+		select {
+		case ch <- e:
+		default:
+			close(ch)
+			delete(d.watchers, ch)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Daemon:", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// readJSON decodes the body of r, which must be application/json, into
+// v, or reports an error to w.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		httpError(w, http.StatusUnsupportedMediaType, errors.New("the body must be application/json"))
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	return false
+}
+
+// copyRun returns a copy of run for the API; d.mu must be held
+func copyRun(run *Run) *Run {
+	x := *run
+	return &x
+}
+
+func (d *Daemon) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	d.cmd.Lock()
+	status := struct {
+		Party   Party  `json:"party"`
+		Role    Role   `json:"role"`
+		Room    string `json:"room"`
+		Running []*Run `json:"running"`
+	}{Party: d.c.Party, Role: d.c.Role, Room: d.c.Room.Name, Running: []*Run{}}
+	d.cmd.Unlock()
+	d.mu.Lock()
+	for _, run := range d.runs {
+		if run.State == "running" {
+			status.Running = append(status.Running, copyRun(run))
+		}
+	}
+	d.mu.Unlock()
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (d *Daemon) serveRoom(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Name == "" || strings.ContainsAny(req.Name, " \t\n.*>") {
+			httpError(w, http.StatusBadRequest, fmt.Errorf("bad room name %q", req.Name))
+			return
+		}
+		if err := d.join(req.Name); err != nil {
+			httpError(w, http.StatusConflict, err)
+			return
+		}
+	}
+	d.cmd.Lock()
+	info := d.roomInfo()
+	d.cmd.Unlock()
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (d *Daemon) serveRole(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "POST") {
+		return
+	}
+	var req struct {
+		Role *Role `json:"role"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Role == nil {
+		httpError(w, http.StatusBadRequest, errors.New("missing role"))
+		return
+	}
+	d.cmd.Lock()
+	defer d.cmd.Unlock()
+	if err := d.c.setRole(*req.Role); err != nil {
+		httpError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (d *Daemon) join(room string) error {
+	d.cmd.Lock()
+	defer d.cmd.Unlock()
+	for _, j := range d.c.jobList() {
+		if j.Room == d.c.Room {
+			return fmt.Errorf("cannot change rooms while computation %s is running", j.ID)
+		}
+	}
+	d.c.joinRoomChannels(d.lines, room)
+	return nil
+}
+
+// roomInfo describes the room of the client; d.cmd must be held
+func (d *Daemon) roomInfo() RoomInfo {
+	c := d.c
+	members, hash := c.Room.members()
+	info := RoomInfo{Name: c.Room.Name, Hash: hex.EncodeToString(hash), Members: []MemberInfo{}}
+	c.Room.mu.Lock()
+	roles := make([]Role, len(members))
+	for i, m := range members {
+		roles[i] = c.Room.role(m)
+	}
+	c.Room.mu.Unlock()
+	for i, m := range members {
+		member := MemberInfo{Party: m, Role: roles[i], Fingerprint: Fingerprint(m.Key)}
+		if c.Identities != nil && m.Key != c.Party.Key {
+			member.Status = c.Identities.Status(m).String()
+		}
+		info.Members = append(info.Members, member)
+	}
+	c.Room.mu.Lock()
+	latest := c.Room.latest
+	c.Room.mu.Unlock()
+	info.Proposals = []ProposalInfo{}
+	for _, cs := range c.Room.pending() {
+		p := ProposalInfo{Session: cs.ID, Function: cs.Function, Latest: cs.ID == latest}
+		if _, err := c.agreed(cs.ID); err != nil {
+			p.Waiting = err.Error()
+		} else {
+			p.Agreed = true
+		}
+		info.Proposals = append(info.Proposals, p)
+	}
+	return info
+}
+
+func (d *Daemon) serveFunctions(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	result := []FunctionJSON{}
+	for _, f := range Functions() {
+		result = append(result, FunctionJSON{f.Name, f.Description, f.Inputs, f.MinParties, f.MaxParties})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (d *Daemon) serveMessages(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "POST") {
+		return
+	}
+	var req struct {
+		Text string `json:"text"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	d.cmd.Lock()
+	defer d.cmd.Unlock()
+	c := d.c
+	msg := strings.TrimSpace(req.Text)
+	if err := publish(c.Broker, c.Room.Name, Message{c.Party, msg}); err != nil {
+		httpError(w, http.StatusBadGateway, err)
+		return
+	}
+	party := c.Party
+	d.event(Event{Type: "message", Room: c.Room.Name, From: &party, Text: msg})
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (d *Daemon) serveProposals(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "POST") {
+		return
+	}
+	var req struct {
+		Function string `json:"function"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	d.cmd.Lock()
+	defer d.cmd.Unlock()
+	if err := d.c.checkFunction(req.Function); err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.c.proposeFunc(req.Function)
+	writeJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func (d *Daemon) serveRuns(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "GET" {
+		d.mu.Lock()
+		runs := make([]*Run, len(d.runs))
+		for i, run := range d.runs {
+			runs[i] = copyRun(run)
+		}
+		d.mu.Unlock()
+		writeJSON(w, http.StatusOK, runs)
+		return
+	}
+	var req struct {
+		Inputs    json.RawMessage `json:"inputs"`
+		Commodity bool            `json:"commodity"`
+		Session   string          `json:"session"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	values, err := input.ReadJSON(bytes.NewReader(req.Inputs))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	run, status, err := d.start(req.Session, values, req.Commodity)
+	if err != nil {
+		httpError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, run)
+}
+
+// start runs the agreed proposal session of the room in the background.
+// If it cannot, it returns an HTTP status and an error.
+func (d *Daemon) start(session string, values []input.Value, commodity bool) (*Run, int, error) {
+	d.cmd.Lock()
+	defer d.cmd.Unlock()
+	c := d.c
+	if _, err := c.agreed(session); err != nil {
+		return nil, http.StatusConflict, err
+	}
+	j, err := c.newJob(session, values, commodity)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	d.mu.Lock()
+	run := &Run{ID: len(d.runs) + 1, Session: j.ID, Room: j.Room.Name, Function: j.Function.Name, Commodity: commodity, Role: j.Role, State: "running", Started: j.Started}
+	d.runs = append(d.runs, run)
+	started := copyRun(run)
+	d.mu.Unlock()
+	d.event(Event{Type: "run", Room: run.Room, Session: run.Session, Run: started})
+
+	go func() {
+		outputs, err := c.runJob(j, values)
+		d.mu.Lock()
+		now := time.Now()
+		run.Finished = &now
+		if err != nil {
+			run.State = "failed"
+			run.Error = err.Error()
+		} else {
+			run.State = "done"
+			run.Outputs = outputs
+		}
+		finished := copyRun(run)
+		d.mu.Unlock()
+		d.event(Event{Type: "run", Room: run.Room, Session: run.Session, Run: finished})
+	}()
+	return started, 0, nil
+}
+
+func (d *Daemon) serveRun(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET", "DELETE") {
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/runs/"))
+	d.mu.Lock()
+	if err != nil || id < 1 || id > len(d.runs) {
+		d.mu.Unlock()
+		httpError(w, http.StatusNotFound, fmt.Errorf("no run %s", strings.TrimPrefix(r.URL.Path, "/api/runs/")))
+		return
+	}
+	run := copyRun(d.runs[id-1])
+	d.mu.Unlock()
+	if r.Method == "DELETE" {
+		if run.State != "running" {
+			httpError(w, http.StatusConflict, fmt.Errorf("run %d is %s", id, run.State))
+			return
+		}
+		d.cmd.Lock()
+		err := d.c.cancel(run.Session)
+		d.cmd.Unlock()
+		if err != nil {
+			httpError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, run)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+func (d *Daemon) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, "GET") {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	after, _ := strconv.Atoi(since)
+
+	ch := make(chan Event, 100)
+	d.mu.Lock()
+	var backlog []Event
+	for _, e := range d.history {
+		if e.Seq > after {
+			backlog = append(backlog, e)
+		}
+	}
+	d.watchers[ch] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.watchers, ch)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(e Event) bool {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Println("Daemon:", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Seq, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	for _, e := range backlog {
+		if !send(e) {
+			return
+		}
+	}
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok || !send(e) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-d.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func call(t *testing.T, method, url, token string, body interface{}, result interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// eventually calls f every 10ms until it returns true
+func eventually(t *testing.T, what string, f func() bool) {
+	for deadline := time.Now().Add(30 * time.Second); !f(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	Init()
+	s := NewMemoryServer()
+	ServeSecretary(s.Connect())
+	urls := make([]string, 2)
+	tokens := make(map[string]string) // by url
+	for i := range urls {
+		d := NewDaemon(NewClientState(s.Connect(), fmt.Sprintf("daemon%d", i)))
+		server := httptest.NewServer(d)
+		defer d.Close()
+		defer server.Close()
+		urls[i] = server.URL + "/api"
+		tokens[urls[i]] = d.Token()
+	}
+
+	for _, url := range urls {
+		if status := call(t, "POST", url+"/room", tokens[url], map[string]string{"name": "#daemon"}, nil); status != http.StatusOK {
+			t.Fatalf("join: status %d", status)
+		}
+	}
+	for _, url := range urls {
+		eventually(t, "members", func() bool {
+			var room RoomInfo
+			call(t, "GET", url+"/room", tokens[url], nil, &room)
+			return len(room.Members) == 2
+		})
+	}
+	if status := call(t, "POST", urls[0]+"/runs", tokens[urls[0]], map[string]interface{}{"inputs": []int{3}}, nil); status != http.StatusConflict {
+		t.Errorf("run without a proposal: status %d", status)
+	}
+	if status := call(t, "POST", urls[0]+"/proposals", tokens[urls[0]], map[string]string{"function": "max"}, nil); status != http.StatusAccepted {
+		t.Fatalf("proposal: status %d", status)
+	}
+	for _, url := range urls {
+		eventually(t, "agreement", func() bool {
+			var room RoomInfo
+			call(t, "GET", url+"/room", tokens[url], nil, &room)
+			return len(room.Proposals) == 1 && room.Proposals[0].Agreed && room.Proposals[0].Function == "max"
+		})
+	}
+	for i, url := range urls {
+		var run Run
+		if status := call(t, "POST", url+"/runs", tokens[url], map[string]interface{}{"inputs": []int{3 + 6*i}}, &run); status != http.StatusAccepted {
+			t.Fatalf("run: status %d", status)
+		}
+	}
+	for _, url := range urls {
+		var run Run
+		eventually(t, "the run", func() bool {
+			call(t, "GET", url+"/runs/1", tokens[url], nil, &run)
+			return run.State != "running"
+		})
+		if run.State != "done" || len(run.Outputs) != 1 {
+			t.Errorf("run: %+v", run)
+		}
+	}
+
+	// the event stream replays the history
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", urls[0]+"/events?since=0&token="+tokens[urls[0]], nil)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var types []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal([]byte(line[len("data: "):]), &e); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, e.Type)
+		if e.Type == "run" && e.Run.State != "running" {
+			break
+		}
+	}
+	want := []string{"joined", "members", "proposal", "agreed", "run"}
+	for _, typ := range want {
+		found := false
+		for _, got := range types {
+			found = found || got == typ
+		}
+		if !found {
+			t.Errorf("no %s event in %v", typ, types)
+		}
+	}
+}
+
+// TestDaemonRequests rejects requests without the token, from other
+// hosts or origins, and with bodies that are not JSON.
+func TestDaemonRequests(t *testing.T) {
+	Init()
+	s := NewMemoryServer()
+	ServeSecretary(s.Connect())
+	d := NewDaemon(NewClientState(s.Connect(), "daemon"))
+	server := httptest.NewServer(d)
+	defer d.Close()
+	defer server.Close()
+	url := server.URL + "/api/status"
+	if status := call(t, "GET", url, d.Token(), nil, nil); status != http.StatusOK {
+		t.Errorf("with the token: status %d", status)
+	}
+	if status := call(t, "GET", url, "wrong", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("with a wrong token: status %d", status)
+	}
+	for _, h := range []struct{ host, origin string }{{"attacker.example", ""}, {"", "http://attacker.example"}} {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+d.Token())
+		if h.host != "" {
+			req.Host = h.host
+		}
+		if h.origin != "" {
+			req.Header.Set("Origin", h.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("host %q, origin %q: status %d", h.host, h.origin, resp.StatusCode)
+		}
+	}
+	req, _ := http.NewRequest("POST", server.URL+"/api/messages", strings.NewReader(`{"text": "hi"}`))
+	req.Header.Set("Authorization", "Bearer "+d.Token())
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("text/plain: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,243 @@
+package chat
+
+// Identities.
+//
+// A client keeps its identity in a directory (the -identity flag): its
+// key pair, its nickname, and a contact book that pins the key of each
+// nickname it has met.  The first key seen for a nickname is trusted on
+// first use; a later, different key for the nickname is reported as a
+// changed key until the user checks its fingerprint out of band and
+// trusts it.
+//
+// The directory holds the files
+//
+//     key        the private key, as written by secure.WriteKeys
+//     nick       the nickname
+//     contacts   one contact per line: nick key [verified]
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/secure"
+	"golang.org/x/crypto/sha3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type KeyStatus int
+
+const (
+	KeyNew      KeyStatus = iota // first seen, now pinned
+	KeyPinned                    // matches the pinned key
+	KeyVerified                  // matches the pinned key, which the user has verified
+	KeyChanged                   // differs from the pinned key
+)
+
+func (s KeyStatus) String() string {
+	switch s {
+	case KeyNew:
+		return "new key"
+	case KeyPinned:
+		return "pinned"
+	case KeyVerified:
+		return "verified"
+	case KeyChanged:
+		return "KEY CHANGED"
+	}
+	return "unknown"
+}
+
+type Contact struct {
+	Nick     string
+	Key      string
+	Verified bool
+}
+
+type IdentityStore struct {
+	dir      string
+	Keys     *secure.Keys
+	mu       sync.Mutex
+	nick     string
+	contacts map[string]*Contact // by nick
+	warned   map[Party]bool      // changed keys already reported
+}
+
+// DefaultIdentityDir is $HOME/.smpcc/chat.
+func DefaultIdentityDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".smpcc-chat"
+	}
+	return filepath.Join(home, ".smpcc", "chat")
+}
+
+// OpenIdentityStore reads the identity in dir, creating dir and a new
+// key pair if necessary.
+func OpenIdentityStore(dir string) (*IdentityStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &IdentityStore{dir: dir, contacts: make(map[string]*Contact), warned: make(map[Party]bool)}
+	keyfile := filepath.Join(dir, "key")
+	keys, err := secure.ReadKeys(keyfile)
+	if os.IsNotExist(err) {
+		keys, err = secure.GenerateKeys()
+		if err == nil {
+			err = secure.WriteKeys(keyfile, keys)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Keys = keys
+	if b, err := os.ReadFile(filepath.Join(dir, "nick")); err == nil {
+		s.nick = strings.TrimSpace(string(b))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := s.readContacts(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *IdentityStore) readContacts() error {
+	name := filepath.Join(s.dir, "contacts")
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "verified") {
+			return fmt.Errorf("%s:%d: expected nick key [verified]", name, line)
+		}
+		if _, err := secure.UnmarshalPublicKey(fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: %v", name, line, err)
+		}
+		s.contacts[fields[0]] = &Contact{fields[0], fields[1], len(fields) == 3}
+	}
+	return scanner.Err()
+}
+
+// writeContacts saves the contact book; s.mu must be held
+func (s *IdentityStore) writeContacts() error {
+	var b strings.Builder
+	for _, c := range s.contactList() {
+		fmt.Fprintf(&b, "%s %s", c.Nick, c.Key)
+		if c.Verified {
+			b.WriteString(" verified")
+		}
+		b.WriteString("\n")
+	}
+	return os.WriteFile(filepath.Join(s.dir, "contacts"), []byte(b.String()), 0600)
+}
+
+// contactList returns the contacts sorted by nick; s.mu must be held
+func (s *IdentityStore) contactList() []Contact {
+	result := make([]Contact, 0, len(s.contacts))
+	for _, c := range s.contacts {
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Nick < result[j].Nick })
+	return result
+}
+
+// Nick returns the saved nickname, or "" if there is none.
+func (s *IdentityStore) Nick() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nick
+}
+
+func (s *IdentityStore) SetNick(nick string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nick = nick
+	return os.WriteFile(filepath.Join(s.dir, "nick"), []byte(nick+"\n"), 0600)
+}
+
+// Status returns the status of the key of p.
+func (s *IdentityStore) Status(p Party) KeyStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status(p)
+}
+
+func (s *IdentityStore) status(p Party) KeyStatus {
+	c, ok := s.contacts[p.Nick]
+	switch {
+	case !ok:
+		return KeyNew
+	case c.Key != p.Key:
+		return KeyChanged
+	case c.Verified:
+		return KeyVerified
+	}
+	return KeyPinned
+}
+
+// Check returns the status of the key of p, pinning it if p is new.
+func (s *IdentityStore) Check(p Party) (KeyStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status(p)
+	if status == KeyNew {
+		s.contacts[p.Nick] = &Contact{p.Nick, p.Key, false}
+		return status, s.writeContacts()
+	}
+	return status, nil
+}
+
+// Trust pins the key of p and marks it verified.
+func (s *IdentityStore) Trust(p Party) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contacts[p.Nick] = &Contact{p.Nick, p.Key, true}
+	delete(s.warned, p)
+	return s.writeContacts()
+}
+
+// Lookup returns the contact pinned for nick.
+func (s *IdentityStore) Lookup(nick string) (Contact, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.contacts[nick]
+	if !ok {
+		return Contact{}, false
+	}
+	return *c, true
+}
+
+// warnOnce reports whether p has a changed key that has not been
+// reported yet
+func (s *IdentityStore) warnOnce(p Party) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.warned[p] {
+		return false
+	}
+	s.warned[p] = true
+	return true
+}
+
+// Fingerprint is a short digest of a public key, for comparing keys
+// out of band.
+func Fingerprint(key string) string {
+	h := sha3.Sum256([]byte(key))
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%02x%02x", h[2*i], h[2*i+1])
+	}
+	return strings.Join(groups, " ")
+}
@@ -0,0 +1,261 @@
+package chat
+
+// Jobs.
+//
+// Every agreed proposal of a room is a computation with its own session
+// ID (see sessionID).  The ID scopes the subjects of the pairwise
+// channels of the computation, its barriers at the secretary, and its
+// blocks at the commodity server, so the computations of a room do not
+// collide and a client can run several at once.  The run and runco
+// commands take an agreed proposal, the latest one unless the first
+// argument is @ID, and run it in the background as a job.  The jobs
+// command lists the proposals and jobs of the room, and the cancel
+// command stops a computation for all of the members.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/input"
+	"golang.org/x/crypto/sha3"
+	"sort"
+	"strings"
+	"time"
+)
+
+type job struct {
+	ID        string // session ID
+	Room      *RoomState
+	Function  *Function
+	Commodity bool // triples from the commodity server
+	Started   time.Time
+	Role      Role    // of this party, see roles.go
+	members   []Party // in the order of the parties
+	inputs    int     // number of input parties, the first of members
+	digest    []byte
+	consent   StartCommodity // the agreement of the members, for the commodity server
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+}
+
+// newJob takes the agreed proposal session (see agreed) of the room,
+// checks values against it, and registers a job to run it.
+func (c *ClientState) newJob(session string, values []input.Value, commodity bool) (*job, error) {
+	room := c.Room
+	room.mu.Lock()
+	cs, err := room.agreed(session, room.Members)
+	members, inputs := room.parties()
+	role := room.role(c.Party)
+	var consent StartCommodity
+	if err == nil {
+		consent = StartCommodity{members, cs.Descriptor, make([]Signature, len(members))}
+		for i, m := range members {
+			consent.Signatures[i] = cs.sigs[m.Key]
+		}
+	}
+	room.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.roomFunction(cs, values, role)
+	if err != nil {
+		return nil, err
+	}
+	if commodity && c.CommodityKey == "" {
+		return nil, errors.New("The key of the commodity server is unknown (use the -commodity-key flag)")
+	}
+	if !c.take(cs) {
+		return nil, fmt.Errorf("Computation %s has already started", cs.ID)
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	j := &job{cs.ID, room, f, commodity, time.Now(), role, members, inputs, cs.digest, consent, ctx, cancel}
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	if c.jobs == nil {
+		c.jobs = make(map[string]*job)
+	}
+	c.jobs[j.ID] = j
+	return j, nil
+}
+
+// runJob runs j and returns the outputs that we receive, none if we are
+// a compute party.
+func (c *ClientState) runJob(j *job, values []input.Value) ([]gmw.Output, error) {
+	defer func() {
+		c.jobsMu.Lock()
+		delete(c.jobs, j.ID)
+		c.jobsMu.Unlock()
+		j.cancel(nil)
+	}()
+	var outputs []gmw.Output
+	var err error
+	if j.Commodity {
+		outputs, err = c.runCommoditySession(j.ctx, j, values)
+	} else {
+		outputs, err = c.runSession(j.ctx, j, values)
+	}
+	if err != nil || !j.Role.Outputs() {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// halted is the error of a computation that did not start
+func halted(ctx context.Context) error {
+	if err := context.Cause(ctx); err != nil {
+		return fmt.Errorf("Computation aborted: %v", err)
+	}
+	return errHalted
+}
+
+// jobList returns the running jobs, sorted by session ID.
+func (c *ClientState) jobList() []*job {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	result := make([]*job, 0, len(c.jobs))
+	for _, j := range c.jobs {
+		result = append(result, j)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// cancelJobs stops the jobs of room.
+func (c *ClientState) cancelJobs(room *RoomState, err error) {
+	for _, j := range c.jobList() {
+		if j.Room == room {
+			j.cancel(err)
+		}
+	}
+}
+
+// cancel asks the members of the room to stop the computation whose
+// session ID starts with id, whether it is running or only proposed.  The
+// members check the signature, and a member waiting at the barrier stops
+// waiting; the secretary cannot check it, so it is not asked.
+func (c *ClientState) cancel(id string) error {
+	if id == "" {
+		return errors.New("You must say which computation to cancel (use the 'jobs' command to list them)")
+	}
+	var found []string
+	for _, j := range c.jobList() {
+		if j.Room == c.Room && strings.HasPrefix(j.ID, id) {
+			found = append(found, j.ID)
+		}
+	}
+	for _, cs := range c.Room.pending() {
+		if strings.HasPrefix(cs.ID, id) {
+			found = append(found, cs.ID)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return fmt.Errorf("There is no computation %s in %s (use the 'jobs' command to list them)", id, c.Room.Name)
+	case len(found) > 1:
+		return fmt.Errorf("More than one computation starts with %s", id)
+	}
+	c.Room.mu.Lock()
+	sig := c.sign(cancelDigest(found[0]))
+	c.Room.mu.Unlock()
+	r, err := encode(CancelRequest{c.Party, found[0], sig})
+	if err != nil {
+		return err
+	}
+	return c.Broker.Publish(c.Room.Name, r)
+}
+
+// cancelDigest is what a member signs to cancel the computation with
+// session ID session.
+func cancelDigest(session string) []byte {
+	h := sha3.Sum256([]byte("cancel " + session))
+	return h[:]
+}
+
+// receiveCancel stops the computation of a CancelRequest signed by a
+// member of the room, and reports whether there was one to stop.
+func (c *ClientState) receiveCancel(r CancelRequest) bool {
+	room := c.Room
+	room.mu.Lock()
+	member := false
+	for _, p := range room.Members {
+		member = member || p == r.Party
+	}
+	member = member && c.verify(r.Party, cancelDigest(r.Session), r.Signature)
+	found := member && room.drop(r.Session)
+	room.mu.Unlock()
+	if !member {
+		return false
+	}
+	c.jobsMu.Lock()
+	j, ok := c.jobs[r.Session]
+	c.jobsMu.Unlock()
+	if ok && j.Room == room {
+		j.cancel(fmt.Errorf("cancelled by %s", r.Party.Nick))
+		found = true
+	}
+	return found
+}
+
+// jobsCommand lists the proposals and the jobs of the room.
+func (c *ClientState) jobsCommand() string {
+	var b strings.Builder
+	for _, cs := range c.Room.pending() {
+		status := "all members agreed"
+		if _, err := c.agreed(cs.ID); err != nil {
+			status = err.Error()
+		}
+		fmt.Fprintf(&b, "%s  %-10s proposed: %s\n", cs.ID, cs.Function, status)
+	}
+	for _, j := range c.jobList() {
+		if j.Room != c.Room {
+			continue
+		}
+		kind := "running"
+		if j.Commodity {
+			kind = "running with the commodity server"
+		}
+		fmt.Fprintf(&b, "%s  %-10s %s as %s party for %v\n", j.ID, j.Function.Name, kind, j.Role, time.Since(j.Started).Round(time.Second))
+	}
+	if b.Len() == 0 {
+		return fmt.Sprintf("No computations in %s\n", c.Room.Name)
+	}
+	return b.String()
+}
+
+// runCommand starts the run or runco command with args, and reports the
+// outputs that we receive when the job is done.
+func (c *ClientState) runCommand(msgReceived chan string, commodity bool, args []string) {
+	session := ""
+	if len(args) > 0 && strings.HasPrefix(args[0], "@") {
+		session, args = args[0][1:], args[1:]
+	}
+	values, err := input.ParseArgs(args)
+	if err != nil {
+		msgReceived <- fmt.Sprintf("%v\n", err)
+		return
+	}
+	j, err := c.newJob(session, values, commodity)
+	if err != nil {
+		msgReceived <- fmt.Sprintf("%v\n", err)
+		return
+	}
+	if commodity {
+		msgReceived <- fmt.Sprintf("Starting commodity computation %s (%s)\n", j.ID, j.Function.Name)
+	} else {
+		msgReceived <- fmt.Sprintf("Starting computation %s (%s)\n", j.ID, j.Function.Name)
+	}
+	go func() {
+		outputs, err := c.runJob(j, values)
+		if err != nil {
+			msgReceived <- fmt.Sprintf("%s: %v\n", j.ID, err)
+			return
+		}
+		if !j.Role.Outputs() {
+			msgReceived <- fmt.Sprintf("%s: Computation done\n", j.ID)
+		}
+		for _, out := range outputs {
+			msgReceived <- fmt.Sprintf("%s: Output: %d (%d bits)\n", j.ID, out.Value, out.Bits)
+		}
+	}()
+}
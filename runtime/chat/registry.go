@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"fmt"
+	"github.com/tjim/smpcc/runtime/gmw"
+	"github.com/tjim/smpcc/runtime/input"
+	"github.com/tjim/smpcc/runtime/max"
+	"github.com/tjim/smpcc/runtime/sum"
+	"github.com/tjim/smpcc/runtime/vickrey"
+	"golang.org/x/crypto/sha3"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FunctionInfo describes a function that rooms can compute.
+type FunctionInfo struct {
+	Description string
+	Inputs      []string // types of the inputs of each party, in order, see input.Value.Check
+	MinParties  int      // of input parties; 0 means no minimum
+	MaxParties  int      // of input parties; 0 means no maximum
+	Outputs     []int    // parties that learn the outputs; nil for all
+	Program     []byte   // hash of the program text, see HashProgram
+}
+
+// A Function is a registered MPC program.
+type Function struct {
+	Name string
+	MPC  gmw.MPC
+	FunctionInfo
+}
+
+var registry struct {
+	sync.Mutex
+	functions map[string]*Function
+}
+
+// RegisterFunction makes an MPC program available to the func and run
+// commands under name.  Call it before starting the client.  It panics
+// if name is already registered, or if info has no program hash, which
+// the members of a room compare before they run the function.
+func RegisterFunction(name string, mpc gmw.MPC, info FunctionInfo) {
+	registry.Lock()
+	defer registry.Unlock()
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		panic(fmt.Sprintf("RegisterFunction: bad name %q", name))
+	}
+	if err := validDigest(info.Program); err != nil {
+		panic(fmt.Sprintf("RegisterFunction: %s has no program hash: %v", name, err))
+	}
+	if registry.functions == nil {
+		registry.functions = make(map[string]*Function)
+	}
+	if _, ok := registry.functions[name]; ok {
+		panic(fmt.Sprintf("RegisterFunction: %s is already registered", name))
+	}
+	registry.functions[name] = &Function{name, mpc, info}
+}
+
+// LookupFunction returns the function registered under name.
+func LookupFunction(name string) (*Function, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	f, ok := registry.functions[name]
+	return f, ok
+}
+
+// Functions returns the registered functions, sorted by name.
+func Functions() []*Function {
+	registry.Lock()
+	defer registry.Unlock()
+	result := make([]*Function, 0, len(registry.functions))
+	for _, f := range registry.functions {
+		result = append(result, f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// CheckParties returns an error if the function cannot run with n input
+// parties.
+func (f *Function) CheckParties(n int) error {
+	if f.MinParties > 0 && n < f.MinParties {
+		return fmt.Errorf("%s needs at least %d input parties, the room has %d", f.Name, f.MinParties, n)
+	}
+	if f.MaxParties > 0 && n > f.MaxParties {
+		return fmt.Errorf("%s allows at most %d input parties, the room has %d", f.Name, f.MaxParties, n)
+	}
+	return nil
+}
+
+// CheckInputs returns an error if values do not match the input types of
+// the function.  A function without input types accepts any values.
+func (f *Function) CheckInputs(values []input.Value) error {
+	if f.Inputs == nil {
+		return nil
+	}
+	if len(values) != len(f.Inputs) {
+		return fmt.Errorf("%s takes %d inputs (%s), got %d", f.Name, len(f.Inputs), strings.Join(f.Inputs, " "), len(values))
+	}
+	for i, v := range values {
+		if err := v.Check(f.Inputs[i]); err != nil {
+			return fmt.Errorf("%s input %d: %v", f.Name, i+1, err)
+		}
+	}
+	return nil
+}
+
+// HashProgram returns the hash of the text of a program, for
+// FunctionInfo.Program.
+func HashProgram(text []byte) []byte {
+	h := sha3.Sum256(text)
+	return h[:]
+}
+
+// ProgramHash identifies the program of f in a consent Descriptor.
+func (f *Function) ProgramHash() []byte {
+	h := sha3.New256()
+	fmt.Fprintf(h, "%s\n%d\n", f.Name, f.MPC.NumBlocks)
+	h.Write(f.Program)
+	return h.Sum(nil)
+}
+
+// String gives the one-line summary shown by the funcs command.
+func (f *Function) String() string {
+	parties := "any number of parties"
+	switch {
+	case f.MinParties > 0 && f.MaxParties > 0:
+		parties = fmt.Sprintf("%d to %d parties", f.MinParties, f.MaxParties)
+	case f.MinParties > 0:
+		parties = fmt.Sprintf("%d or more parties", f.MinParties)
+	case f.MaxParties > 0:
+		parties = fmt.Sprintf("at most %d parties", f.MaxParties)
+	}
+	inputs := "any inputs"
+	if f.Inputs != nil {
+		inputs = "inputs: " + strings.Join(f.Inputs, " ")
+	}
+	return fmt.Sprintf("%-10s %s (%s; %s)", f.Name, f.Description, inputs, parties)
+}
+
+func init() {
+	RegisterFunction("max", max.Handle, FunctionInfo{
+		Program:     HashProgram(max.Source),
+		Description: "the largest input and the party that gave it",
+		Inputs:      []string{"uint32"},
+		MinParties:  2,
+	})
+	RegisterFunction("vickrey", vickrey.Handle, FunctionInfo{
+		Program:     HashProgram(vickrey.Source),
+		Description: "second price auction: the highest bidder pays the second highest bid",
+		Inputs:      []string{"uint32"},
+		MinParties:  2,
+	})
+	RegisterFunction("sum", sum.Handle, FunctionInfo{
+		Program:     HashProgram(sum.Source),
+		Description: "total salaries of men and women; input gender (0 male, 1 female) and salary",
+		Inputs:      []string{"uint32", "uint32"},
+		MinParties:  2,
+	})
+}
@@ -0,0 +1,142 @@
+package chat
+
+// Roles.
+//
+// Each member of a room has a role in its computations:
+//
+//     input      supplies inputs, computes, and learns the outputs
+//     compute    computes, but supplies no inputs and reports no outputs
+//     observer   supplies no inputs, but learns the outputs
+//
+// Every member is a gmw party.  The input parties come first, in the
+// order of the members of the room, then the compute parties and the
+// observers, and the program reads inputs from the input parties only
+// (see gmw.GlobalIO.InputParties).  So an auditor or a dashboard can
+// watch the result of an auction without bidding in it.
+//
+// A member sets its role with the role command or the -role flag, and the
+// secretary publishes the roles with the members.  The roles are part of
+// the consent Descriptor, so a proposal is dropped when a role changes.
+//
+// Roles do not hide anything from a party.  A compute party holds shares
+// of every value, like any other party, and a program that opens its
+// outputs to all parties opens them to the compute parties too: their
+// clients just do not report them.  To keep an output from a compute
+// party the program must open it with gmw.OutputTo*.
+
+import (
+	"fmt"
+)
+
+type Role int
+
+const (
+	RoleInput Role = iota
+	RoleCompute
+	RoleObserver
+)
+
+var roleNames = []string{"input", "compute", "observer"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return "unknown"
+	}
+	return roleNames[r]
+}
+
+func ParseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if s == name {
+			return Role(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q (use input, compute, or observer)", s)
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(b []byte) error {
+	role, err := ParseRole(string(b))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// Inputs reports whether a party with role r supplies inputs.
+func (r Role) Inputs() bool {
+	return r == RoleInput
+}
+
+// Outputs reports whether a party with role r reports the outputs.
+func (r Role) Outputs() bool {
+	return r != RoleCompute
+}
+
+// role returns the role of p in the room; r.mu must be held
+func (r *RoomState) role(p Party) Role {
+	return r.Roles[p.Key]
+}
+
+// parties returns the members of the room in the order of their gmw
+// party ids, and the number of input parties; r.mu must be held
+func (r *RoomState) parties() ([]Party, int) {
+	result := make([]Party, 0, len(r.Members))
+	inputs := 0
+	for _, role := range []Role{RoleInput, RoleCompute, RoleObserver} {
+		for _, p := range r.Members {
+			if r.role(p) == role {
+				result = append(result, p)
+			}
+		}
+		if role == RoleInput {
+			inputs = len(result)
+		}
+	}
+	return result, inputs
+}
+
+// memberRoles returns the roles of parties in the order of
+// memberKeys(parties); r.mu must be held
+func (r *RoomState) memberRoles(parties []Party) []string {
+	keys := memberKeys(parties)
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = r.Roles[key].String()
+	}
+	return result
+}
+
+// setRole changes the role of the client, in the room and for the rooms
+// it joins later.
+func (c *ClientState) setRole(role Role) error {
+	c.Role = role
+	return publish(c.Broker, fmt.Sprintf("secretary.%s", c.Room.Name), RoleRequest{c.Party, role})
+}
+
+// roleCommand shows the roles of the room, or sets our role to args[0].
+func (c *ClientState) roleCommand(args []string) string {
+	if len(args) > 0 {
+		role, err := ParseRole(args[0])
+		if err != nil {
+			return fmt.Sprintf("%v\n", err)
+		}
+		if err := c.setRole(role); err != nil {
+			return fmt.Sprintf("%v\n", err)
+		}
+		return fmt.Sprintf("Your role is now %s\n", role)
+	}
+	c.Room.mu.Lock()
+	defer c.Room.mu.Unlock()
+	result := fmt.Sprintf("Your role is %s\n", c.Role)
+	for _, p := range c.Room.Members {
+		if p != c.Party {
+			result += fmt.Sprintf("%s: %s\n", p.Nick, c.Room.role(p))
+		}
+	}
+	return result
+}
@@ -1,38 +1,128 @@
 package chat
 
 import (
-	"bytes"
-	"encoding/gob"
+	"crypto/rand"
 	"fmt"
-	"github.com/apcera/nats"
+	"golang.org/x/crypto/nacl/box"
 	"log"
 	"runtime"
+	"sync"
 	"time"
 )
 
+// Clients send a Heartbeat to the secretary of their room every
+// HeartbeatInterval.  The secretary removes a member that it has not
+// heard from in HeartbeatTimeout, as if it had sent a LeaveRequest, and
+// cancels any computation that the room is waiting to start.  A member
+// removed this way rejoins with its role at its next heartbeat; the
+// heartbeats of other parties are ignored.
+var HeartbeatInterval = 2 * time.Second
+var HeartbeatTimeout = 10 * time.Second
+
 func Secretary() {
+	ServeSecretary(connectNats())
+	runtime.Goexit()
+}
+
+// ServeSecretary runs the secretary on b, in the background.
+func ServeSecretary(b Broker) {
+	serveSecretary(b, HeartbeatInterval, HeartbeatTimeout)
+}
+
+// serveSecretary is ServeSecretary, checking the heartbeats every interval
+// and removing a member after timeout.
+func serveSecretary(b Broker, interval, timeout time.Duration) {
 	log.Println("starting secretary")
-	changeNick("ChatAdministrator")
+	key := MyPublicKey
+	if key == "" { // without Initialize, as in tests; messages need a valid key
+		public, _, err := box.GenerateKey(rand.Reader)
+		checkError(err)
+		key = MarshalPublicKey(public)
+	}
+	admin := Party{"ChatAdministrator", key}
+	var mu sync.Mutex // guards the maps, used by the subscription and the reaper
 	rooms := make(map[string]bool)
 	members := make(map[string](map[Party]bool))
-	starters := make(map[string](map[Party]bool))
-	nc := connectNats()
+	roles := make(map[string](map[Party]Role))                 // kept after a timeout, for the rejoin
+	timedOut := make(map[string](map[Party]bool))              // removed by the reaper, may rejoin
+	starters := make(map[string](map[string](map[Party]bool))) // by room, then session
+	lastSeen := make(map[string](map[Party]time.Time))
+
+	// Answer the parties waiting at the barrier of session in room
+	release := func(room, session string, result bool) {
+		delete(starters[room], session)
+		_ = publish(b, fmt.Sprintf("%s.secretary.barrier.%s", room, session), BarrierResult{session, result})
+	}
+
+	publishMembers := func(room string) {
+		numMembers := len(members[room])
+		parties := make([]Party, 0, numMembers)
+		partyRoles := make([]Role, 0, numMembers)
+		for party, _ := range members[room] {
+			parties = append(parties, party)
+			partyRoles = append(partyRoles, roles[room][party])
+		}
+		_ = publish(b, room, Members{parties, partyRoles})
+		log.Println("Members", room, members[room])
+	}
+
+	join := func(room string, party Party, role Role) {
+		if _, ok := members[room]; !ok {
+			members[room] = make(map[Party]bool)
+			roles[room] = make(map[Party]Role)
+			lastSeen[room] = make(map[Party]time.Time)
+		}
+		members[room][party] = true
+		roles[room][party] = role
+		lastSeen[room][party] = time.Now()
+		_ = publish(b, room, Message{admin, fmt.Sprintf("%s has joined %s", party.Nick, room)})
+		publishMembers(room)
+	}
+
+	leave := func(room string, party Party, reason string) {
+		wasMember := members[room][party]
+		delete(members[room], party)
+		delete(lastSeen[room], party)
+		_ = publish(b, room, Message{admin, fmt.Sprintf("%s %s", party.Nick, reason)})
+		if wasMember {
+			for session := range starters[room] {
+				log.Println("Cancelling computation", session, "in", room, "because", party, "left")
+				release(room, session, false)
+			}
+		}
+		publishMembers(room)
+	}
 
-	// Go routine to ping room members to see if they're still there.
+	// Go routine to remove room members that have stopped sending heartbeats.
 	go func() {
 		for {
-			time.Sleep(time.Second)
-			// pinging code will go here
+			time.Sleep(interval)
+			mu.Lock()
+			now := time.Now()
+			for room, seen := range lastSeen {
+				for party, t := range seen {
+					if now.Sub(t) > timeout {
+						log.Println("Timeout", room, party)
+						leave(room, party, "has stopped responding and was removed from the room")
+						if timedOut[room] == nil {
+							timedOut[room] = make(map[Party]bool)
+						}
+						timedOut[room][party] = true
+					}
+				}
+			}
+			mu.Unlock()
 		}
 	}()
 
-	nc.Subscribe("secretary.>", func(m *nats.Msg) {
-		dec := gob.NewDecoder(bytes.NewBuffer(m.Data))
-		var p interface{}
-		err := dec.Decode(&p)
+	b.Subscribe("secretary.>", func(m *Msg) {
+		p, err := decode(m.Data)
 		if err != nil {
-			log.Fatal("decode:", err)
+			log.Println("Dropping a message on", m.Subject, "-", err)
+			return
 		}
+		mu.Lock()
+		defer mu.Unlock()
 		room := m.Subject[len("secretary."):]
 		if !rooms[room] {
 			rooms[room] = true
@@ -52,60 +142,69 @@ func Secretary() {
 				return
 			}
 			if _, ok := starters[room]; !ok {
-				log.Println("Allocating starters for", room)
-				starters[room] = make(map[Party]bool)
+				starters[room] = make(map[string](map[Party]bool))
+			}
+			if _, ok := starters[room][r.Session]; !ok {
+				log.Println("Allocating starters for", r.Session, "in", room)
+				starters[room][r.Session] = make(map[Party]bool)
 				for k, _ := range members[room] {
-					starters[room][k] = false
+					starters[room][r.Session][k] = false
 				}
 			}
-			if starters[room][r.Party] {
-				log.Println("Warning:", r.Party, "has already requested to run in room", room, ", aborting")
+			if starters[room][r.Session][r.Party] {
+				log.Println("Warning:", r.Party, "has already requested to run", r.Session, "in room", room, ", aborting")
 				goto finish
 			}
-			starters[room][r.Party] = true
-			for k, v := range starters[room] {
+			starters[room][r.Session][r.Party] = true
+			for k, v := range starters[room][r.Session] {
 				if !v {
-					log.Println("Still waiting for", k, "to run the computation in", room)
+					log.Println("Still waiting for", k, "to run the computation", r.Session, "in", room)
 					return
 				}
 			}
-			log.Println("Starting computation in", room)
+			log.Println("Starting computation", r.Session, "in", room)
 			result = true
 		finish:
-			delete(starters, room)
-			ec, _ := nats.NewEncodedConn(nc, "gob")
-			okChan := make(chan bool)
-			ec.BindSendChan(fmt.Sprintf("%s.secretary.barrier", room), okChan)
-			okChan <- result
-			close(okChan)
+			release(room, r.Session, result)
+		case CancelRequest:
+			// the signature is sealed to the members, so only they can
+			// check it, and a forged request must not release the barrier
+			log.Println("Ignoring a cancel request of", r.Party, "for", r.Session, "in", room)
 		case LeaveRequest:
-			delete(members[room], r.Party)
-			_ = nc.Publish(room, encode(Message{MyParty, fmt.Sprintf("%s has left the room", r.Party.Nick)}))
 			log.Println("Leave", room, r)
-			numMembers := len(members[room])
-			parties := make([]Party, 0, numMembers)
-			for party, _ := range members[room] {
-				parties = append(parties, party)
-			}
-			_ = nc.Publish(room, encode(Members{parties}))
-			log.Println("Members", room, members[room])
+			leave(room, r.Party, "has left the room")
+			delete(roles[room], r.Party)
+			delete(timedOut[room], r.Party)
 		case JoinRequest:
-			if _, ok := members[room]; !ok {
-				members[room] = make(map[Party]bool)
-			}
-			members[room][r.Party] = true
-			_ = nc.Publish(room, encode(Message{MyParty, fmt.Sprintf("%s has joined %s", r.Party.Nick, room)}))
 			log.Println("Join", room, r)
-			numMembers := len(members[room])
-			parties := make([]Party, 0, numMembers)
-			for party, _ := range members[room] {
-				parties = append(parties, party)
+			delete(timedOut[room], r.Party)
+			join(room, r.Party, r.Role)
+		case RoleRequest:
+			if !members[room][r.Party] {
+				log.Println("Warning:", r.Party, "is not a member of room", room, ", ignoring")
+				return
+			}
+			log.Println("Role", room, r)
+			roles[room][r.Party] = r.Role
+			for session := range starters[room] {
+				log.Println("Cancelling computation", session, "in", room, "because", r.Party, "changed roles")
+				release(room, session, false)
+			}
+			_ = publish(b, room, Message{admin, fmt.Sprintf("%s now has the role %s", r.Party.Nick, r.Role)})
+			publishMembers(room)
+		case Heartbeat:
+			if members[room][r.Party] {
+				lastSeen[room][r.Party] = time.Now()
+			} else if timedOut[room][r.Party] {
+				// removed after a timeout, but it is still alive
+				log.Println("Rejoin", room, r)
+				delete(timedOut[room], r.Party)
+				join(room, r.Party, roles[room][r.Party])
+			} else {
+				log.Println("Warning:", r.Party, "is not a member of room", room, ", ignoring")
 			}
-			_ = nc.Publish(room, encode(Members{parties}))
-			log.Println("Members", room, members[room])
 		case Message:
 			log.Println("Message", r.Message)
 		}
 	})
-	runtime.Goexit()
 }
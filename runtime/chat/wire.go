@@ -0,0 +1,371 @@
+package chat
+
+// Wire format.
+//
+// Every message that the clients, the secretary, and the commodity server
+// publish is an envelope:
+//
+//     byte      the version of the wire format, WireVersion
+//     byte      the type of the message, see wireTypes
+//     rest      the gob encoding of the message
+//
+// The receiver checks the size of the envelope and its version before
+// reading it, decodes the body into the type of the tag and nothing else,
+// and validates the message (see the validate methods), so a malformed
+// message is dropped instead of taking down the secretary or a client.
+// The values on the channels of a computation use the same envelope, with
+// the tag wireValue, and are decoded into the element type of the channel.
+//
+// Tags are never reused.  A change to a message that older parties cannot
+// read gets a new WireVersion; a party drops envelopes of versions that it
+// does not know, and logs them so that the operator knows to upgrade.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/secure"
+	"golang.org/x/crypto/nacl/box"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+const WireVersion = 1
+
+// Limits on messages.  NATS itself limits payloads to 1MB by default.
+const (
+	MaxMessageSize = 256 << 10 // of an envelope, but see MaxValueSize
+	MaxValueSize   = 16 << 20  // of the values on the channels of a computation
+	maxNick        = 64
+	maxParties     = 256 // in a room
+	maxText        = 16 << 10
+	maxTriples     = 1 << 12 // in one MaskTripleCommodity
+	maxTripleBytes = 16
+)
+
+const wireValue = 255 // tag of the values on the channels of a computation
+
+// wireTypes are the messages, by tag
+var wireTypes = map[byte]reflect.Type{
+	1:  reflect.TypeOf(JoinRequest{}),
+	2:  reflect.TypeOf(LeaveRequest{}),
+	3:  reflect.TypeOf(FuncRequest{}),
+	4:  reflect.TypeOf(StartRequest{}),
+	5:  reflect.TypeOf(CancelRequest{}),
+	6:  reflect.TypeOf(RoleRequest{}),
+	7:  reflect.TypeOf(Heartbeat{}),
+	8:  reflect.TypeOf(Message{}),
+	9:  reflect.TypeOf(Members{}),
+	10: reflect.TypeOf(Consent{}),
+	11: reflect.TypeOf(StartCommodity{}),
+	12: reflect.TypeOf(EndCommodity{}),
+	13: reflect.TypeOf(TripleCommodity{}),
+	14: reflect.TypeOf(MaskTripleCommodity{}),
+	15: reflect.TypeOf(KeyAgreement{}),
+	16: reflect.TypeOf(SealedCommodity{}),
+	17: reflect.TypeOf(commodityFrame{}),
+	18: reflect.TypeOf(BarrierResult{}),
+}
+
+var wireTags = func() map[reflect.Type]byte {
+	result := make(map[reflect.Type]byte)
+	for tag, t := range wireTypes {
+		result[t] = tag
+	}
+	return result
+}()
+
+type validator interface {
+	validate() error
+}
+
+// encode wraps the message p in an envelope.
+func encode(p interface{}) ([]byte, error) {
+	tag, ok := wireTags[reflect.TypeOf(p)]
+	if !ok {
+		return nil, fmt.Errorf("encode: %T is not a chat message", p)
+	}
+	return envelope(tag, reflect.ValueOf(p))
+}
+
+// publish encodes the message p and publishes it on subject.
+func publish(b Broker, subject string, p interface{}) error {
+	data, err := encode(p)
+	if err != nil {
+		return err
+	}
+	return b.Publish(subject, data)
+}
+
+// encodeValue wraps a value sent on the channel of a computation.
+func encodeValue(v reflect.Value) ([]byte, error) {
+	return envelope(wireValue, v)
+}
+
+func envelope(tag byte, v reflect.Value) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{WireVersion, tag})
+	if err := gob.NewEncoder(buf).EncodeValue(v); err != nil {
+		return nil, fmt.Errorf("encode: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decode opens an envelope and returns its message, after validating it.
+func decode(data []byte) (interface{}, error) {
+	if len(data) > MaxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", len(data))
+	}
+	tag, body, err := openEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := wireTypes[tag]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %d", tag)
+	}
+	v, err := decodeBody(body, t)
+	if err != nil {
+		return nil, err
+	}
+	p := v.Interface()
+	if m, ok := p.(validator); ok {
+		if err := m.validate(); err != nil {
+			return nil, fmt.Errorf("bad %s: %v", t.Name(), err)
+		}
+	}
+	return p, nil
+}
+
+// decodeValue opens the envelope of a value of type t sent on the channel
+// of a computation.
+func decodeValue(data []byte, t reflect.Type) (reflect.Value, error) {
+	if len(data) > MaxValueSize {
+		return reflect.Value{}, fmt.Errorf("value of %d bytes is too large", len(data))
+	}
+	tag, body, err := openEnvelope(data)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if tag != wireValue {
+		return reflect.Value{}, fmt.Errorf("message type %d on the channel of a computation", tag)
+	}
+	return decodeBody(body, t)
+}
+
+func openEnvelope(data []byte) (byte, []byte, error) {
+	switch {
+	case len(data) < 2:
+		return 0, nil, errors.New("message too short")
+	case data[0] != WireVersion:
+		return 0, nil, fmt.Errorf("unsupported wire version %d, this party speaks version %d", data[0], WireVersion)
+	}
+	return data[1], data[2:], nil
+}
+
+func decodeBody(body []byte, t reflect.Type) (reflect.Value, error) {
+	r := bytes.NewReader(body)
+	v := reflect.New(t)
+	if err := gob.NewDecoder(r).DecodeValue(v); err != nil {
+		return reflect.Value{}, fmt.Errorf("decoding %v: %v", t, err)
+	}
+	if r.Len() > 0 {
+		return reflect.Value{}, fmt.Errorf("%d bytes after %v", r.Len(), t)
+	}
+	return v.Elem(), nil
+}
+
+func (p Party) validate() error {
+	switch {
+	case p.Nick == "":
+		return errors.New("empty nickname")
+	case len(p.Nick) > maxNick:
+		return fmt.Errorf("nickname longer than %d bytes", maxNick)
+	case strings.IndexFunc(p.Nick, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0:
+		return fmt.Errorf("nickname %q is not one printable word", p.Nick)
+	}
+	if _, err := secure.UnmarshalPublicKey(p.Key); err != nil {
+		return fmt.Errorf("%s: %v", p.Nick, err)
+	}
+	return nil
+}
+
+func validParties(parties []Party) error {
+	if len(parties) > maxParties {
+		return fmt.Errorf("more than %d parties", maxParties)
+	}
+	for _, p := range parties {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r Role) validate() error {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Errorf("unknown role %d", int(r))
+	}
+	return nil
+}
+
+func validSession(session string) error {
+	if b, err := hex.DecodeString(session); err != nil || len(b) != 8 {
+		return fmt.Errorf("malformed session ID %q", session)
+	}
+	return nil
+}
+
+func validDigest(digest []byte) error {
+	if len(digest) != 32 {
+		return fmt.Errorf("digest of %d bytes", len(digest))
+	}
+	return nil
+}
+
+func (r JoinRequest) validate() error {
+	if err := r.Party.validate(); err != nil {
+		return err
+	}
+	return r.Role.validate()
+}
+
+func (r RoleRequest) validate() error {
+	if err := r.Party.validate(); err != nil {
+		return err
+	}
+	return r.Role.validate()
+}
+
+func (r StartRequest) validate() error {
+	if err := r.Party.validate(); err != nil {
+		return err
+	}
+	return validSession(r.Session)
+}
+
+func (r BarrierResult) validate() error {
+	return validSession(r.Session)
+}
+
+func (r CancelRequest) validate() error {
+	if err := r.Party.validate(); err != nil {
+		return err
+	}
+	if err := validSession(r.Session); err != nil {
+		return err
+	}
+	return r.Signature.validate()
+}
+
+func (r Message) validate() error {
+	if len(r.Message) > maxText {
+		return fmt.Errorf("message longer than %d bytes", maxText)
+	}
+	return r.Party.validate()
+}
+
+func (r Members) validate() error {
+	if len(r.Roles) != len(r.Parties) {
+		return fmt.Errorf("%d roles for %d parties", len(r.Roles), len(r.Parties))
+	}
+	for _, role := range r.Roles {
+		if err := role.validate(); err != nil {
+			return err
+		}
+	}
+	return validParties(r.Parties)
+}
+
+func (d Descriptor) validate() error {
+	switch {
+	case len(d.Members) > maxParties:
+		return fmt.Errorf("more than %d members", maxParties)
+	case len(d.Roles) != len(d.Members):
+		return fmt.Errorf("%d roles for %d members", len(d.Roles), len(d.Members))
+	case len(d.Inputs) > maxParties || len(d.Outputs) > maxParties:
+		return errors.New("too many inputs or outputs")
+	case len(d.Nonce) > 64:
+		return errors.New("nonce too long")
+	}
+	return validDigest(d.Program)
+}
+
+func (s Signature) validate() error {
+	if len(s.Seals) > maxParties+1 { // one for each member and the commodity server
+		return fmt.Errorf("more than %d seals", maxParties+1)
+	}
+	return nil
+}
+
+func (r FuncRequest) validate() error {
+	if err := r.Party.validate(); err != nil {
+		return err
+	}
+	if err := r.Descriptor.validate(); err != nil {
+		return err
+	}
+	return r.Signature.validate()
+}
+
+func (r Consent) validate() error {
+	if err := r.Party.validate(); err != nil {
+		return err
+	}
+	if err := validDigest(r.Digest); err != nil {
+		return err
+	}
+	return r.Signature.validate()
+}
+
+func (r StartCommodity) validate() error {
+	if len(r.Parties) == 0 {
+		return errors.New("no parties")
+	}
+	if len(r.Signatures) != len(r.Parties) {
+		return fmt.Errorf("%d signatures for %d parties", len(r.Signatures), len(r.Parties))
+	}
+	for _, s := range r.Signatures {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	if err := r.Descriptor.validate(); err != nil {
+		return err
+	}
+	return validParties(r.Parties)
+}
+
+func (r MaskTripleCommodity) validate() error {
+	switch {
+	case r.NumTriples <= 0 || r.NumTriples > maxTriples || r.NumTriples%8 != 0:
+		return fmt.Errorf("%d triples", r.NumTriples)
+	case r.NumBytesTriple <= 0 || r.NumBytesTriple > maxTripleBytes:
+		return fmt.Errorf("triples of %d bytes", r.NumBytesTriple)
+	}
+	return nil
+}
+
+func (r KeyAgreement) validate() error {
+	if err := validDigest(r.Digest); err != nil {
+		return err
+	}
+	if len(r.Box) != 32+box.Overhead {
+		return fmt.Errorf("sealed key of %d bytes", len(r.Box))
+	}
+	return nil
+}
+
+func (r SealedCommodity) validate() error {
+	_, err := secure.UnmarshalPublicKey(r.Key)
+	return err
+}
+
+func (f commodityFrame) validate() error {
+	if f.Seq < 0 {
+		return fmt.Errorf("sequence number %d", f.Seq)
+	}
+	return nil
+}
@@ -10,6 +10,8 @@ func main() {
 		chat.Secretary()
 	} else if len(chat.Args) > 0 && chat.Args[0] == "commodity" {
 		chat.Commodity()
+	} else if len(chat.Args) > 0 && chat.Args[0] == "daemon" {
+		chat.RunDaemon()
 	} else {
 		chat.Client()
 	}
@@ -0,0 +1,29 @@
+package main
+
+// Generate a key pair for secure channels (see the -key flags of the
+// gc and gmw runtimes).  The private key is written to the named file
+// and the public key, for the config file of the other parties, is
+// printed.
+
+import (
+	"fmt"
+	"github.com/tjim/smpcc/runtime/secure"
+	"os"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s keyfile\n", os.Args[0])
+		os.Exit(1)
+	}
+	keys, err := secure.GenerateKeys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+	if err := secure.WriteKeys(os.Args[1], keys); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: ", err)
+		os.Exit(1)
+	}
+	fmt.Println(secure.MarshalPublicKey(keys.Public))
+}
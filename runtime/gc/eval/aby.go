@@ -0,0 +1,30 @@
+package eval
+
+// Conversions between garbled wires and the shares of two parties, see
+// gc/gen/aby.go.
+
+import base "github.com/tjim/smpcc/runtime/gc"
+
+// B2Y returns the keys of the value XOR-shared by share and the share of
+// the generator.
+func B2Y(io VM, share uint64, bits int) []base.Key {
+	return Xor(io, ShareTo1(io, bits), ShareTo0(io, share, bits))
+}
+
+// A2Y returns the keys of the value additively shared by share and the
+// share of the generator.
+func A2Y(io VM, share uint64, bits int) []base.Key {
+	return Add(io, ShareTo1(io, bits), ShareTo0(io, share, bits))
+}
+
+// Y2B returns a XOR share of the value of a: a XOR the random share of
+// the generator.
+func Y2B(io VM, a []base.Key) uint64 {
+	return bits2Uint64(RevealTo1(io, Xor(io, a, ShareTo1(io, len(a)))))
+}
+
+// Y2A returns an additive share of the value of a: a minus the random
+// share of the generator.
+func Y2A(io VM, a []base.Key) uint64 {
+	return bits2Uint64(RevealTo1(io, Sub(io, a, ShareTo1(io, len(a)))))
+}
@@ -1,8 +1,10 @@
 package eval
 
 import base "github.com/tjim/smpcc/runtime/gc"
+import "github.com/tjim/smpcc/runtime/input"
 import "fmt"
 import "math"
+import "github.com/tjim/smpcc/runtime/results"
 
 type VM interface {
 	And(a, b []base.Key) []base.Key
@@ -15,6 +17,7 @@ type VM interface {
 	ShareTo0(v uint64, bits int) []base.Key
 	ShareTo1(bits int) []base.Key
 	Random(bits int) []base.Key
+	Abort(err error) // abort the computation with err
 }
 
 func Mul(io VM, a, b []base.Key) []base.Key {
@@ -300,23 +303,70 @@ func Printf(io VM, mask []base.Key, f string, args ...[]base.Key) {
 	}
 }
 
-// NB Input32() reveals the active block
-func Input32(io VM, mask []base.Key, party []base.Key, next_arg func() uint64) []base.Key {
+// NB the Input functions reveal the active block
+func Input8(io VM, mask []base.Key, party []base.Key, inputs *input.Source) []base.Key {
+	return inputN(io, mask, party, 8, inputs)
+}
+
+func Input16(io VM, mask []base.Key, party []base.Key, inputs *input.Source) []base.Key {
+	return inputN(io, mask, party, 16, inputs)
+}
+
+func Input32(io VM, mask []base.Key, party []base.Key, inputs *input.Source) []base.Key {
+	return inputN(io, mask, party, 32, inputs)
+}
+
+func Input64(io VM, mask []base.Key, party []base.Key, inputs *input.Source) []base.Key {
+	return inputN(io, mask, party, 64, inputs)
+}
+
+func inputN(io VM, mask []base.Key, party []base.Key, bits int, inputs *input.Source) []base.Key {
 	if len(mask) != 1 {
-		panic("Input32")
+		panic("Input")
 	}
 	if !Reveal(io, mask)[0] {
-		return Uint(io, 0, 32)
+		return Uint(io, 0, bits)
 	}
 	if 0 == RevealUint32(io, party) {
 		// input from party 0 == gen
-		return ShareTo1(io, 32)
+		return ShareTo1(io, bits)
 	} else {
 		// input from party 1 == eval
-		return ShareTo0(io, next_arg(), 32)
+		x, err := inputs.Next(bits)
+		if err != nil {
+			io.Abort(err)
+		}
+		return ShareTo0(io, x, bits)
 	}
 }
 
+// InputBytes returns an input of n bytes as 8*n keys, byte i in keys 8*i to 8*i+7.
+func InputBytes(io VM, mask []base.Key, party []base.Key, n int, inputs *input.Source) []base.Key {
+	if len(mask) != 1 {
+		panic("InputBytes")
+	}
+	if !Reveal(io, mask)[0] {
+		return Uint(io, 0, 8*n)
+	}
+	result := make([]base.Key, 0, 8*n)
+	if 0 == RevealUint32(io, party) {
+		// input from party 0 == gen
+		for i := 0; i < n; i++ {
+			result = append(result, ShareTo1(io, 8)...)
+		}
+	} else {
+		// input from party 1 == eval
+		x, err := inputs.NextBytes(n)
+		if err != nil {
+			io.Abort(err)
+		}
+		for _, b := range x {
+			result = append(result, ShareTo0(io, uint64(b), 8)...)
+		}
+	}
+	return result
+}
+
 // Switch(io, s, dflt, c0, c1, ...) tests s.
 // If s == 0 it returns c0, if s == 1 it returns c1, etc.
 // If s is not the index of any c, it returns dflt.
@@ -460,6 +510,54 @@ func RevealTo1(io VM, a []base.Key) []bool {
 	return io.RevealTo1(a)
 }
 
+// RevealEach reveals a0 to gen and a1 to eval, so each party gets a
+// different output.  It returns the value of a1.  The keys of a0 sent
+// to gen are the proof of its output, see gc.Resolve.
+func RevealEach(io VM, a0, a1 []base.Key) []bool {
+	result := RevealTo1(io, a1)
+	RevealTo0(io, a0)
+	return result
+}
+
+func RevealEachUint64(io VM, a0, a1 []base.Key) uint64 {
+	if len(a0) > 64 || len(a1) > 64 {
+		panic("RevealEachUint64: argument too large")
+	}
+	return bits2Uint64(RevealEach(io, a0, a1))
+}
+
+// Output reveals x only to party (0 == gen, 1 == eval), if the block is
+// active.  The party that receives x adds it to outputs, and Output
+// returns it there; elsewhere Output returns 0.
+func Output(io VM, mask []base.Key, party []base.Key, x []base.Key, outputs *results.Results) uint64 {
+	if len(mask) != 1 {
+		panic("Output")
+	}
+	if len(x) > 64 {
+		panic("Output: argument too large")
+	}
+	if !Reveal(io, mask)[0] {
+		return 0
+	}
+	if 0 == RevealUint32(io, party) {
+		RevealTo0(io, x)
+		return 0
+	}
+	result := bits2Uint64(RevealTo1(io, x))
+	outputs.Add(results.Output{Party: 1, Bits: len(x), Value: result})
+	return result
+}
+
+func bits2Uint64(bits []bool) uint64 {
+	var result uint64
+	for i := 0; i < len(bits); i++ {
+		if bits[i] {
+			result |= 1 << uint(i)
+		}
+	}
+	return result
+}
+
 func RevealUint32(io VM, a []base.Key) uint32 {
 	if len(a) > 32 {
 		panic("RevealUint32: argument too large")
@@ -1,10 +1,12 @@
 package eval
 
 import (
+	"context"
+	"fmt"
 	"github.com/tjim/fatchan"
 	. "github.com/tjim/smpcc/runtime/gc"
 	"github.com/tjim/smpcc/runtime/ot"
-	"log"
+	"github.com/tjim/smpcc/runtime/secure"
 	"net"
 )
 
@@ -13,73 +15,166 @@ type IO interface {
 	RecvT() GarbledTable
 	RecvK() Key
 	SendK2(t Key)
+	Abort(err error)
 }
 
 /* TODO: instead of exposing IOX make it private and use IO externally */
 type IOX struct {
 	CircuitChans
 	ot.Receiver
+	*Session
 }
 
-func NewIOX(io Chanio) *IOX {
+func NewIOX(s *Session, io Chanio) *IOX {
 	return &IOX{
 		io.CircuitChans,
-		ot.NewOTChansReceiver(io.NPChans, io.ExtChans),
+		ot.NewOTChansReceiver(s.Context(), io.NPChans, io.ExtChans),
+		s,
 	}
 }
 
-func Server(addr string, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("listen(%q): %s", addr, err)
+func (io IOX) RecvT() GarbledTable {
+	select {
+	case result, ok := <-io.Tchan:
+		if !ok {
+			io.Abort(ot.ErrClosed)
+		}
+		return result
+	case <-io.Done():
+		io.Exit()
 	}
+	panic("unreachable")
+}
 
+func (io IOX) RecvK() Key {
+	select {
+	case result, ok := <-io.Kchan:
+		if !ok {
+			io.Abort(ot.ErrClosed)
+		}
+		return result
+	case <-io.Done():
+		io.Exit()
+	}
+	panic("unreachable")
+}
+
+func (io IOX) SendK2(x Key) {
+	select {
+	case io.Kchan2 <- x:
+	case <-io.Done():
+		io.Exit()
+	}
+}
+
+func (io IOX) Receive(s ot.Selector) ot.Message {
+	defer io.Recover()
+	return io.Receiver.Receive(s)
+}
+
+func (io IOX) ReceiveM(r []byte) []ot.Message {
+	defer io.Recover()
+	return io.Receiver.ReceiveM(r)
+}
+
+func (io IOX) ReceiveMBits(r []byte) []byte {
+	defer io.Recover()
+	return io.Receiver.ReceiveMBits(r)
+}
+
+// Accept one connection from the generator on addr.  The connection is
+// closed when s ends, and a failure of the connection aborts s.
+// If peer is non-nil the connection runs over a secure channel that
+// authenticates the generator by its public key, peer, and the evaluator by me.
+func accept(s *Session, addr string, me *secure.Keys, peer *[32]byte) (*fatchan.Transport, error) {
+	var lc net.ListenConfig
+	listener, err := lc.Listen(s.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-s.Done()
+		listener.Close()
+	}()
 	conn, err := listener.Accept()
 	if err != nil {
-		log.Fatalf("accept(): %s", err)
+		if s.Err() != nil {
+			return nil, s.Err()
+		}
+		return nil, err
+	}
+	go func() {
+		<-s.Done()
+		conn.Close()
+	}()
+	client := conn
+	if peer != nil {
+		client, err = secure.Server(conn, me, peer)
+		if err != nil {
+			return nil, fmt.Errorf("secure channel on %q: %s", addr, err)
+		}
+	}
+	return fatchan.New(client, s.Cancel), nil
+}
+
+func Server(ctx context.Context, addr string, me *secure.Keys, peer *[32]byte, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) (err error) {
+	s := NewSession(ctx)
+	defer s.Cancel(nil)
+	defer ot.Recover(&err)
+	xport, err := accept(s, addr, me, peer)
+	if err != nil {
+		return err
 	}
-	xport := fatchan.New(conn, nil)
 	nu := make(chan Chanio)
 	xport.ToChan(nu)
 
 	vms := make([]VM, numBlocks)
 	for i := range vms {
-		io := <-nu
-		vms[i] = newVM(NewIOX(io), ConcurrentId(i))
+		var io Chanio
+		select {
+		case io = <-nu:
+		case <-s.Done():
+			return s.Err()
+		}
+		vms[i] = newVM(NewIOX(s, io), ConcurrentId(i))
 	}
-	main(vms)
+	return s.Run(func() { main(vms) })
 }
 
-func Server2(addr string, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("listen(%q): %s", addr, err)
-	}
-
-	conn, err := listener.Accept()
+func Server2(ctx context.Context, addr string, me *secure.Keys, peer *[32]byte, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) error {
+	s := NewSession(ctx)
+	defer s.Cancel(nil)
+	xport, err := accept(s, addr, me, peer)
 	if err != nil {
-		log.Fatalf("accept(): %s", err)
+		return err
 	}
-	xport := fatchan.New(conn, nil)
 	nu := make(chan PerNodePair)
 	xport.ToChan(nu)
 
-	x := <-nu
+	var x PerNodePair
+	select {
+	case x = <-nu:
+	case <-s.Done():
+		return s.Err()
+	}
 	if numBlocks != len(x.BlockChans) {
-		panic("Block mismatch")
+		return fmt.Errorf("block mismatch: %d blocks, generator has %d", numBlocks, len(x.BlockChans))
 	}
 
-	baseSender := ot.NewNPSender(x.NPChans.ParamChan, x.NPChans.NpRecvPk, x.NPChans.NpSendEncs)
-	receiver0 := ot.NewStreamReceiver(baseSender, x.BlockChans[0].CAS.R2S, x.BlockChans[0].CAS.S2R)
+	baseSender := ot.NewNPSender(s.Context(), x.NPChans.ParamChan, x.NPChans.NpRecvPk, x.NPChans.NpSendEncs)
+	receiver0, err := ot.NewStreamReceiver(s.Context(), baseSender, x.BlockChans[0].CAS.R2S, x.BlockChans[0].CAS.S2R)
+	if err != nil {
+		return err
+	}
 	ios := make([]IO, numBlocks)
 	for i := 0; i < numBlocks; i++ {
 		tchan := x.BlockChans[i].Tchan
 		kchan := x.BlockChans[i].Kchan
 		kchan2 := x.BlockChans[i].Kchan2
 		if i == 0 {
-			ios[i] = IOX{CircuitChans{tchan, kchan, kchan2}, receiver0}
+			ios[i] = IOX{CircuitChans{tchan, kchan, kchan2}, receiver0, s}
 		} else {
-			ios[i] = IOX{CircuitChans{tchan, kchan, kchan2}, receiver0.Fork(x.BlockChans[i].CAS.R2S, x.BlockChans[i].CAS.S2R)}
+			ios[i] = IOX{CircuitChans{tchan, kchan, kchan2}, receiver0.Fork(x.BlockChans[i].CAS.R2S, x.BlockChans[i].CAS.S2R), s}
 		}
 	}
 
@@ -87,5 +182,5 @@ func Server2(addr string, main func([]VM), numBlocks int, newVM func(io IO, id C
 	for i := range vms {
 		vms[i] = newVM(ios[i], ConcurrentId(i))
 	}
-	main(vms)
+	return s.Run(func() { main(vms) })
 }
@@ -1,6 +1,7 @@
 package eval
 
 import (
+	"errors"
 	"github.com/tjim/smpcc/runtime/base"
 	"github.com/tjim/smpcc/runtime/bit"
 	"github.com/tjim/smpcc/runtime/gc"
@@ -136,7 +137,7 @@ func (y vm) RevealTo1(a []gc.Key) []bool {
 		} else if b[0] == 1 {
 			result[i] = true
 		} else {
-			panic("eval.Reveal(): invalid response")
+			y.io.Abort(errors.New("eval.Reveal(): invalid response"))
 		}
 	}
 	return result
@@ -196,3 +197,8 @@ func (y vm) ShareTo1(bits int) []gc.Key {
 	}
 	return result
 }
+
+// Abort aborts the computation with err.
+func (y vm) Abort(err error) {
+	y.io.Abort(err)
+}
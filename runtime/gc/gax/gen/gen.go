@@ -1,8 +1,6 @@
 package gen
 
 import (
-	"bytes"
-	"fmt"
 	"github.com/tjim/smpcc/runtime/base"
 	"github.com/tjim/smpcc/runtime/bit"
 	"github.com/tjim/smpcc/runtime/gc"
@@ -177,14 +175,13 @@ func (y vm) False() []gc.Wire {
 
 /* Reveal to party 0 = gen */
 func (y vm) RevealTo0(a []gc.Wire) []bool {
-	result := make([]bool, len(a))
+	keys := make([]gc.Key, len(a))
 	for i := 0; i < len(a); i++ {
-		bit := resolveKey(a[i], y.io.RecvK2())
-		if bit == 0 {
-			result[i] = false
-		} else {
-			result[i] = true
-		}
+		keys[i] = y.io.RecvK2()
+	}
+	result, err := gc.Resolve(a, keys) // authenticates the output, see gc/output.go
+	if err != nil {
+		y.io.Abort(err)
 	}
 	return result
 }
@@ -254,13 +251,7 @@ func (y vm) Random(bits int) []gc.Wire {
 	return result
 }
 
-func resolveKey(w gc.Wire, k gc.Key) int {
-	if bytes.Equal(k, w[0]) {
-		return 0
-	} else if bytes.Equal(k, w[1]) {
-		return 1
-	} else {
-		panic(fmt.Sprintf("resolveKey(): key and wire mismatch\nKey: %v\nWire: %v\n", k, w))
-	}
-	panic("unreachable")
+// Abort aborts the computation with err.
+func (y vm) Abort(err error) {
+	y.io.Abort(err)
 }
@@ -0,0 +1,49 @@
+package gen
+
+// Conversions between garbled wires and the shares of two parties, as in
+// ABY (Demmler, Schneider, and Zohner, "ABY - A Framework for Efficient
+// Mixed-Protocol Secure Two-Party Computation", NDSS 2015).  The
+// generator is party 0 and the evaluator party 1.  A value is XOR-shared
+// (B) if the shares of the parties XOR to it, as in gmw, and additively
+// shared (A) if they add to it modulo 2^bits.  Each conversion runs with
+// the one of the same name on the eval side, see gmw.GenIO.
+
+import "encoding/binary"
+import base "github.com/tjim/smpcc/runtime/gc"
+
+// B2Y returns the wires of the value XOR-shared by share and the share
+// of the evaluator.
+func B2Y(io VM, share uint64, bits int) []base.Wire {
+	return Xor(io, ShareTo1(io, share, bits), ShareTo0(io, bits))
+}
+
+// A2Y returns the wires of the value additively shared by share and the
+// share of the evaluator.
+func A2Y(io VM, share uint64, bits int) []base.Wire {
+	return Add(io, ShareTo1(io, share, bits), ShareTo0(io, bits))
+}
+
+// Y2B returns a XOR share of the value of a.  The share of the generator
+// is random, and the evaluator learns a XOR the share.
+func Y2B(io VM, a []base.Wire) uint64 {
+	r := randomShare(len(a))
+	RevealTo1(io, Xor(io, a, ShareTo1(io, r, len(a))))
+	return r
+}
+
+// Y2A returns an additive share of the value of a.  The share of the
+// generator is random, and the evaluator learns a minus the share.
+func Y2A(io VM, a []base.Wire) uint64 {
+	r := randomShare(len(a))
+	RevealTo1(io, Sub(io, a, ShareTo1(io, r, len(a))))
+	return r
+}
+
+func randomShare(bits int) uint64 {
+	if bits > 64 {
+		panic("randomShare: bits > 64")
+	}
+	b := make([]byte, 8)
+	base.GenKey(b)
+	return binary.LittleEndian.Uint64(b) >> uint(64-bits)
+}
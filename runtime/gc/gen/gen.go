@@ -2,7 +2,9 @@ package gen
 
 import "fmt"
 import base "github.com/tjim/smpcc/runtime/gc"
+import "github.com/tjim/smpcc/runtime/input"
 import "math"
+import "github.com/tjim/smpcc/runtime/results"
 
 type VM interface {
 	And(a, b []base.Wire) []base.Wire
@@ -15,6 +17,7 @@ type VM interface {
 	ShareTo0(bits int) []base.Wire
 	ShareTo1(a uint64, bits int) []base.Wire
 	Random(bits int) []base.Wire
+	Abort(err error) // abort the computation with err
 }
 
 func Mul(io VM, a, b []base.Wire) []base.Wire {
@@ -303,21 +306,68 @@ func Printf(io VM, mask []base.Wire, f string, args ...[]base.Wire) {
 	fmt.Printf(f, fargs...)
 }
 
-// NB Input32() reveals the active block
-func Input32(io VM, mask []base.Wire, party []base.Wire, next_arg func() uint64) []base.Wire {
+// NB the Input functions reveal the active block
+func Input8(io VM, mask []base.Wire, party []base.Wire, inputs *input.Source) []base.Wire {
+	return inputN(io, mask, party, 8, inputs)
+}
+
+func Input16(io VM, mask []base.Wire, party []base.Wire, inputs *input.Source) []base.Wire {
+	return inputN(io, mask, party, 16, inputs)
+}
+
+func Input32(io VM, mask []base.Wire, party []base.Wire, inputs *input.Source) []base.Wire {
+	return inputN(io, mask, party, 32, inputs)
+}
+
+func Input64(io VM, mask []base.Wire, party []base.Wire, inputs *input.Source) []base.Wire {
+	return inputN(io, mask, party, 64, inputs)
+}
+
+func inputN(io VM, mask []base.Wire, party []base.Wire, bits int, inputs *input.Source) []base.Wire {
+	if len(mask) != 1 {
+		panic("Input")
+	}
+	if !Reveal(io, mask)[0] {
+		return Uint(io, 0, bits)
+	}
+	if 0 == RevealUint32(io, party) {
+		// input from party 0 == gen
+		x, err := inputs.Next(bits)
+		if err != nil {
+			io.Abort(err)
+		}
+		return ShareTo1(io, x, bits)
+	} else {
+		// input from party 1 == eval
+		return ShareTo0(io, bits)
+	}
+}
+
+// InputBytes returns an input of n bytes as 8*n wires, byte i in wires 8*i to 8*i+7.
+func InputBytes(io VM, mask []base.Wire, party []base.Wire, n int, inputs *input.Source) []base.Wire {
 	if len(mask) != 1 {
-		panic("Input32")
+		panic("InputBytes")
 	}
 	if !Reveal(io, mask)[0] {
-		return Uint(io, 0, 32)
+		return Uint(io, 0, 8*n)
 	}
+	result := make([]base.Wire, 0, 8*n)
 	if 0 == RevealUint32(io, party) {
 		// input from party 0 == gen
-		return ShareTo1(io, next_arg(), 32)
+		x, err := inputs.NextBytes(n)
+		if err != nil {
+			io.Abort(err)
+		}
+		for _, b := range x {
+			result = append(result, ShareTo1(io, uint64(b), 8)...)
+		}
 	} else {
 		// input from party 1 == eval
-		return ShareTo0(io, 32)
+		for i := 0; i < n; i++ {
+			result = append(result, ShareTo0(io, 8)...)
+		}
 	}
+	return result
 }
 
 // Switch(io, s, dflt, c0, c1, ...) tests s.
@@ -460,6 +510,43 @@ func RevealTo1(io VM, a []base.Wire) {
 	io.RevealTo1(a)
 }
 
+// RevealEach reveals a0 to gen and a1 to eval, so each party gets a
+// different output.  It returns the value of a0.  The output of gen is
+// authenticated, see gc.Resolve.
+func RevealEach(io VM, a0, a1 []base.Wire) []bool {
+	RevealTo1(io, a1)
+	return RevealTo0(io, a0)
+}
+
+func RevealEachUint64(io VM, a0, a1 []base.Wire) uint64 {
+	if len(a0) > 64 || len(a1) > 64 {
+		panic("RevealEachUint64: argument too large")
+	}
+	return bits2Uint64(RevealEach(io, a0, a1))
+}
+
+// Output reveals x only to party (0 == gen, 1 == eval), if the block is
+// active.  The party that receives x adds it to outputs, and Output
+// returns it there; elsewhere Output returns 0.
+func Output(io VM, mask []base.Wire, party []base.Wire, x []base.Wire, outputs *results.Results) uint64 {
+	if len(mask) != 1 {
+		panic("Output")
+	}
+	if len(x) > 64 {
+		panic("Output: argument too large")
+	}
+	if !Reveal(io, mask)[0] {
+		return 0
+	}
+	if 0 == RevealUint32(io, party) {
+		result := bits2Uint64(RevealTo0(io, x))
+		outputs.Add(results.Output{Party: 0, Bits: len(x), Value: result})
+		return result
+	}
+	RevealTo1(io, x)
+	return 0
+}
+
 func bits2Uint32(bits []bool) uint32 {
 	var result uint32
 	for i := 0; i < len(bits); i++ {
@@ -1,10 +1,12 @@
 package gen
 
 import (
+	"context"
+	"fmt"
 	"github.com/tjim/fatchan"
 	. "github.com/tjim/smpcc/runtime/gc"
 	"github.com/tjim/smpcc/runtime/ot"
-	"log"
+	"github.com/tjim/smpcc/runtime/secure"
 	"math/big"
 	"net"
 	"time"
@@ -15,57 +17,133 @@ type IO interface {
 	SendT(t GarbledTable)
 	SendK(t Key)
 	RecvK2() Key
+	Abort(err error)
 }
 
 /* TODO: instead of exposing IOX make it private and use IO externally */
 type IOX struct {
 	CircuitChans
 	ot.Sender
+	*Session
 }
 
-func NewIOX(io Chanio) *IOX {
+func NewIOX(s *Session, io Chanio) *IOX {
 	result := &IOX{
 		io.CircuitChans,
-		ot.NewOTChansSender(io.NPChans, io.ExtChans),
+		ot.NewOTChansSender(s.Context(), io.NPChans, io.ExtChans),
+		s,
 	}
 	return result
 }
 
-func NewIO(nu chan Chanio) IO {
+func NewIO(s *Session, nu chan Chanio) IO {
 	io := NewChanio()
-	nu <- *io
-	return NewIOX(*io)
+	select {
+	case nu <- *io:
+	case <-s.Done():
+		panic(ot.Abort{Err: s.Err()})
+	}
+	return NewIOX(s, *io)
+}
+
+func (io IOX) SendT(x GarbledTable) {
+	select {
+	case io.Tchan <- x:
+	case <-io.Done():
+		io.Exit()
+	}
+}
+
+func (io IOX) SendK(x Key) {
+	select {
+	case io.Kchan <- x:
+	case <-io.Done():
+		io.Exit()
+	}
+}
+
+func (io IOX) RecvK2() Key {
+	select {
+	case result, ok := <-io.Kchan2:
+		if !ok {
+			io.Abort(ot.ErrClosed)
+		}
+		return result
+	case <-io.Done():
+		io.Exit()
+	}
+	panic("unreachable")
+}
+
+func (io IOX) Send(m0, m1 ot.Message) {
+	defer io.Recover()
+	io.Sender.Send(m0, m1)
 }
 
-func Client(addr string, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) {
-	server, err := net.Dial("tcp", addr)
+func (io IOX) SendM(a, b []ot.Message) {
+	defer io.Recover()
+	io.Sender.SendM(a, b)
+}
+
+func (io IOX) SendMBits(a, b []byte) {
+	defer io.Recover()
+	io.Sender.SendMBits(a, b)
+}
+
+// Connect to the evaluator at addr.  The connection is closed when s
+// ends, and a failure of the connection aborts s.
+// If peer is non-nil the connection runs over a secure channel that
+// authenticates the evaluator by its public key, peer, and the generator by me.
+func dial(s *Session, addr string, me *secure.Keys, peer *[32]byte) (*fatchan.Transport, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(s.Context(), "tcp", addr)
 	if err != nil {
-		log.Fatalf("dial(%q): %s", addr, err)
+		return nil, err
 	}
+	go func() {
+		<-s.Done()
+		conn.Close()
+	}()
+	server := conn
+	if peer != nil {
+		server, err = secure.Client(server, me, peer)
+		if err != nil {
+			return nil, fmt.Errorf("secure channel with %q: %s", addr, err)
+		}
+	}
+	return fatchan.New(server, s.Cancel), nil
+}
 
-	xport := fatchan.New(server, nil)
+func Client(ctx context.Context, addr string, me *secure.Keys, peer *[32]byte, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) (err error) {
+	s := NewSession(ctx)
+	defer s.Cancel(nil)
+	defer ot.Recover(&err)
+	xport, err := dial(s, addr, me, peer)
+	if err != nil {
+		return err
+	}
 	nu := make(chan Chanio)
 	xport.FromChan(nu)
 
 	defer close(nu)
 	vms := make([]VM, numBlocks)
 	for i := range vms {
-		io := NewIO(nu)
+		io := NewIO(s, nu)
 		vms[i] = newVM(io, ConcurrentId(i))
 	}
 	// temporary hack to avoid a fatchan deadlock
 	// (this allows the eval side to finish registering channels and start block goroutines before we send on the channels)
 	time.Sleep(time.Second)
-	main(vms)
+	return s.Run(func() { main(vms) })
 }
 
-func Client2(addr string, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) {
-	server, err := net.Dial("tcp", addr)
+func Client2(ctx context.Context, addr string, me *secure.Keys, peer *[32]byte, main func([]VM), numBlocks int, newVM func(io IO, id ConcurrentId) VM) error {
+	s := NewSession(ctx)
+	defer s.Cancel(nil)
+	xport, err := dial(s, addr, me, peer)
 	if err != nil {
-		log.Fatalf("dial(%q): %s", addr, err)
+		return err
 	}
-
-	xport := fatchan.New(server, nil)
 	nu := make(chan PerNodePair)
 	xport.FromChan(nu)
 
@@ -76,7 +154,7 @@ func Client2(addr string, main func([]VM), numBlocks int, newVM func(io IO, id C
 	NpSendEncs := make(chan ot.HashedElGamalCiph)
 	x := PerNodePair{ot.NPChans{ParamChan, NpRecvPk, NpSendEncs}, make([]PerBlock, numBlocks)}
 
-	baseReceiver := ot.NewNPReceiver(ParamChan, NpRecvPk, NpSendEncs)
+	baseReceiver := ot.NewNPReceiver(s.Context(), ParamChan, NpRecvPk, NpSendEncs)
 
 	ios := make([]IO, len(x.BlockChans))
 	for i := 0; i < numBlocks; i++ {
@@ -87,8 +165,15 @@ func Client2(addr string, main func([]VM), numBlocks int, newVM func(io IO, id C
 		Kchan2 := make(chan Key)
 		x.BlockChans[i] = PerBlock{ClientAsSender{S2R, R2S}, CircuitChans{Tchan, Kchan, Kchan2}}
 	}
-	nu <- x
-	sender0 := ot.NewStreamSender(baseReceiver, x.BlockChans[0].CAS.S2R, x.BlockChans[0].CAS.R2S)
+	select {
+	case nu <- x:
+	case <-s.Done():
+		return s.Err()
+	}
+	sender0, err := ot.NewStreamSender(s.Context(), baseReceiver, x.BlockChans[0].CAS.S2R, x.BlockChans[0].CAS.R2S)
+	if err != nil {
+		return err
+	}
 	for i := 0; i < numBlocks; i++ {
 		var sender ot.Sender
 		if i == 0 {
@@ -96,7 +181,7 @@ func Client2(addr string, main func([]VM), numBlocks int, newVM func(io IO, id C
 		} else {
 			sender = sender0.Fork(x.BlockChans[i].CAS.S2R, x.BlockChans[i].CAS.R2S)
 		}
-		ios[i] = IOX{x.BlockChans[i].CircuitChans, sender}
+		ios[i] = IOX{x.BlockChans[i].CircuitChans, sender, s}
 	}
 
 	vms := make([]VM, numBlocks)
@@ -106,5 +191,5 @@ func Client2(addr string, main func([]VM), numBlocks int, newVM func(io IO, id C
 	// temporary hack to avoid a fatchan deadlock
 	// (this allows the eval side to finish registering channels and start block goroutines before we send on the channels)
 	time.Sleep(time.Second)
-	main(vms)
+	return s.Run(func() { main(vms) })
 }
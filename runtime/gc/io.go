@@ -1,10 +1,88 @@
 package gc
 
 import (
+	"context"
 	"github.com/tjim/smpcc/runtime/ot"
 	"math/big"
+	"runtime"
 )
 
+// A Session is shared by the IOs of all of the blocks of one party in a
+// computation.  Aborting the session wakes every block that is waiting
+// to communicate and ends its goroutine, and the computation returns
+// the error.  A session is aborted when its context is done, when the
+// connection to the other party fails, or when a block calls Abort.
+type Session struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+func NewSession(ctx context.Context) *Session {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &Session{ctx, cancel}
+}
+
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+func (s *Session) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Err returns the reason the session was aborted, or nil if it has not been.
+func (s *Session) Err() error {
+	if s.ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(s.ctx)
+}
+
+// Cancel aborts the session from outside of the blocks.
+func (s *Session) Cancel(err error) {
+	s.cancel(err)
+}
+
+// Abort aborts the session and ends the calling block.
+func (s *Session) Abort(err error) {
+	s.cancel(err)
+	runtime.Goexit()
+}
+
+// Exit ends the calling block once the session has been aborted.
+func (s *Session) Exit() {
+	s.Abort(s.Err())
+}
+
+// Recover is deferred by operations that use OT, and turns an OT
+// failure into an abort of the session.
+func (s *Session) Recover() {
+	if r := recover(); r != nil {
+		a, ok := r.(ot.Abort)
+		if !ok {
+			panic(r)
+		}
+		s.Abort(a.Err)
+	}
+}
+
+// Run runs main in a new goroutine and waits until it returns or the
+// session is aborted.  After an abort, blocks that are not waiting on
+// communication are left to finish on their own.
+func (s *Session) Run(main func()) error {
+	done := make(chan bool, 1)
+	go func() {
+		main()
+		done <- true
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-s.ctx.Done():
+		return s.Err()
+	}
+}
+
 type CircuitChans struct {
 	Tchan  chan GarbledTable `fatchan:"request"`
 	Kchan  chan Key          `fatchan:"request"`
@@ -0,0 +1,41 @@
+/* output.go
+
+   Authenticated outputs
+
+   The generator knows both keys of every wire, and the evaluator knows
+   only the key for the value it computed.  So when the evaluator sends
+   the key of an output wire to the generator (RevealTo0), the key is a
+   proof of the output: the evaluator cannot produce the key for the
+   other value, and a key that matches neither is a forgery.
+
+*/
+
+package gc
+
+import (
+	"bytes"
+	"errors"
+)
+
+var ErrForgedOutput = errors.New("gc: output key matches neither key of its wire")
+
+// Resolve returns the bits that the output keys ks of the evaluator
+// stand for on the wires ws, or ErrForgedOutput if any key is not one
+// of the keys of its wire.
+func Resolve(ws []Wire, ks []Key) ([]bool, error) {
+	if len(ws) != len(ks) {
+		return nil, errors.New("gc: number of output keys and wires differ")
+	}
+	result := make([]bool, len(ws))
+	for i := range ws {
+		switch {
+		case bytes.Equal(ks[i], ws[i][0]):
+			result[i] = false
+		case bytes.Equal(ks[i], ws[i][1]):
+			result[i] = true
+		default:
+			return nil, ErrForgedOutput
+		}
+	}
+	return result, nil
+}
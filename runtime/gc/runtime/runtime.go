@@ -1,13 +1,19 @@
 package runtime
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/tjim/smpcc/runtime/gc"
 	"github.com/tjim/smpcc/runtime/gc/eval"
 	"github.com/tjim/smpcc/runtime/gc/gen"
 	vmeval "github.com/tjim/smpcc/runtime/gc/yao/eval"
 	vmgen "github.com/tjim/smpcc/runtime/gc/yao/gen"
 	"github.com/tjim/smpcc/runtime/gc/yao/sim"
+	"github.com/tjim/smpcc/runtime/input"
+	"github.com/tjim/smpcc/runtime/results"
+	"github.com/tjim/smpcc/runtime/secure"
 	"os"
 	"runtime/pprof"
 )
@@ -18,6 +24,10 @@ var args []string
 var do_old bool
 var do_sim bool
 var do_pprof bool
+var keyfile string
+var peerkey string
+var inputfile string
+var resultfile string
 
 func init_args() {
 	flag.BoolVar(&do_pprof, "pprof", false, "run for profiling")
@@ -25,22 +35,69 @@ func init_args() {
 	flag.BoolVar(&do_sim, "sim", false, "run in simulation mode, single process (default false)")
 	flag.IntVar(&id, "id", 0, "identity (default 0)")
 	flag.StringVar(&addr, "addr", "127.0.0.1:3042", "network address (default 127.0.0.1:3042)")
+	flag.StringVar(&keyfile, "key", "", "private key file of this party")
+	flag.StringVar(&peerkey, "peer", "", "public key of the other party; if given, use a secure channel")
+	flag.StringVar(&inputfile, "input", "", "file of inputs, JSON or CSV, - for stdin; read before the inputs on the command line")
+	flag.StringVar(&resultfile, "results", "", "write the outputs as JSON to this file, - for stdout")
 	flag.Parse()
 	args = flag.Args()
 }
 
-func next_arg() uint64 {
-	if len(args) <= 0 {
-		panic("Not enough command-line arguments")
+// The inputs of this party, from the -input file and the command line.
+// Generated programs pass Inputs to the Input functions of gen and eval.
+var Inputs *input.Source
+
+// Generated programs pass Results to the Output functions of gen and
+// eval, which collect the outputs of this party in it.
+var Results = results.NewResults()
+
+// Read the keys for a secure channel, or return nils if neither key was
+// given.  A key without the other is an error, rather than a run in the
+// clear.
+func init_keys() (*secure.Keys, *[32]byte, error) {
+	if peerkey == "" {
+		if keyfile != "" {
+			return nil, nil, errors.New("-key requires -peer")
+		}
+		return nil, nil, nil
+	}
+	if keyfile == "" {
+		return nil, nil, errors.New("-peer requires -key")
 	}
-	arg := 0
-	fmt.Sscanf(args[0], "%d", &arg)
-	args = args[1:]
-	return uint64(arg)
+	me, err := secure.ReadKeys(keyfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, err := secure.UnmarshalPublicKey(peerkey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-peer: %v", err)
+	}
+	return me, peer, nil
 }
 
-func Run(numBlocks int, gen_main func([]gen.VM), eval_main func([]eval.VM)) {
+// Run the generator or evaluator, according to the command-line flags.
+// Run returns when the computation finishes, or with an error when it
+// is aborted: ctx is done, the connection fails, or a block aborts.
+func Run(ctx context.Context, numBlocks int, gen_main func([]gen.VM), eval_main func([]eval.VM)) error {
 	init_args()
+	me, peer, err := init_keys()
+	if err != nil {
+		return err
+	}
+	Inputs, err = input.Load(inputfile, args)
+	if err != nil {
+		return err
+	}
+	if err := run(ctx, numBlocks, gen_main, eval_main, me, peer); err != nil {
+		return err
+	}
+	if resultfile != "" {
+		return Results.WriteFile(resultfile)
+	}
+	return nil
+}
+
+func run(ctx context.Context, numBlocks int, gen_main func([]gen.VM), eval_main func([]eval.VM), me *secure.Keys, peer *[32]byte) error {
 	if do_pprof {
 		file := "cpu.pprof"
 		f, err := os.Create(file)
@@ -51,17 +108,27 @@ func Run(numBlocks int, gen_main func([]gen.VM), eval_main func([]eval.VM)) {
 		defer pprof.StopCPUProfile()
 	}
 	if do_sim {
-		gvms, evms := sim.VMs(numBlocks + 1)
-		go gen_main(gvms)
-		eval_main(evms)
+		s := gc.NewSession(ctx)
+		defer s.Cancel(nil)
+		gvms, evms := sim.VMs(s, numBlocks+1)
+		done := make(chan bool)
+		go func() {
+			gen_main(gvms)
+			close(done)
+		}()
+		if err := s.Run(func() { eval_main(evms) }); err != nil {
+			return err
+		}
+		<-done // so the outputs of gen are in Results
 		fmt.Println("Done")
+		return nil
 	} else if id == 0 && do_old {
-		gen.Client(addr, gen_main, numBlocks+1, vmgen.NewVM)
+		return gen.Client(ctx, addr, me, peer, gen_main, numBlocks+1, vmgen.NewVM)
 	} else if id == 0 {
-		gen.Client2(addr, gen_main, numBlocks+1, vmgen.NewVM)
+		return gen.Client2(ctx, addr, me, peer, gen_main, numBlocks+1, vmgen.NewVM)
 	} else if do_old {
-		eval.Server(addr, eval_main, numBlocks+1, vmeval.NewVM)
+		return eval.Server(ctx, addr, me, peer, eval_main, numBlocks+1, vmeval.NewVM)
 	} else {
-		eval.Server2(addr, eval_main, numBlocks+1, vmeval.NewVM)
+		return eval.Server2(ctx, addr, me, peer, eval_main, numBlocks+1, vmeval.NewVM)
 	}
 }
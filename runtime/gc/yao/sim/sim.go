@@ -8,26 +8,26 @@ import (
 	"github.com/tjim/smpcc/runtime/gc/yao/gen"
 )
 
-func pairVM(id gc.ConcurrentId) (basegen.VM, baseeval.VM) {
+func pairVM(s *gc.Session, id gc.ConcurrentId) (basegen.VM, baseeval.VM) {
 	io := gc.NewChanio()
 	gchan := make(chan basegen.IOX, 1)
 	echan := make(chan baseeval.IOX, 1)
 	go func() {
-		echan <- *baseeval.NewIOX(*io)
+		echan <- *baseeval.NewIOX(s, *io)
 	}()
 	go func() {
-		gchan <- *basegen.NewIOX(*io)
+		gchan <- *basegen.NewIOX(s, *io)
 	}()
 	gio := <-gchan
 	eio := <-echan
 	return gen.NewVM(&gio, id), eval.NewVM(&eio, id)
 }
 
-func VMs(n int) ([]basegen.VM, []baseeval.VM) {
+func VMs(s *gc.Session, n int) ([]basegen.VM, []baseeval.VM) {
 	result1 := make([]basegen.VM, n)
 	result2 := make([]baseeval.VM, n)
 	for i := 0; i < n; i++ {
-		gio, eio := pairVM(gc.ConcurrentId(i))
+		gio, eio := pairVM(s, gc.ConcurrentId(i))
 		result1[i] = gio
 		result2[i] = eio
 	}
@@ -2,6 +2,7 @@ package eval
 
 import (
 	"crypto/aes"
+	"errors"
 	"github.com/tjim/smpcc/runtime/bit"
 	"github.com/tjim/smpcc/runtime/gc"
 	baseeval "github.com/tjim/smpcc/runtime/gc/eval"
@@ -153,7 +154,7 @@ func (y vm) RevealTo1(a []gc.Key) []bool {
 		} else if b[0] == 1 {
 			result[i] = true
 		} else {
-			panic("eval.Reveal(): invalid response")
+			y.io.Abort(errors.New("eval.Reveal(): invalid response"))
 		}
 	}
 	return result
@@ -213,3 +214,8 @@ func (y vm) ShareTo1(bits int) []gc.Key {
 	}
 	return result
 }
+
+// Abort aborts the computation with err.
+func (y vm) Abort(err error) {
+	y.io.Abort(err)
+}
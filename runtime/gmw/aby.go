@@ -0,0 +1,155 @@
+package gmw
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/tjim/smpcc/runtime/gc"
+	"github.com/tjim/smpcc/runtime/gc/eval"
+	"github.com/tjim/smpcc/runtime/gc/gen"
+	"github.com/tjim/smpcc/runtime/ot"
+)
+
+// GenIO and EvalIO let a computation of two parties move values between
+// gmw and a garbled circuit of gc, with the conversions of gc/gen/aby.go
+// and gc/eval/aby.go: party 0 is the generator, and runs a gen.VM on
+// GenIO(io), and party 1 is the evaluator, and runs an eval.VM on
+// EvalIO(io).  The circuit runs over the channels of the block io to
+// the other party, and its OTs extend the OT session that the block uses
+// for its triples, so it needs no connection or base OTs of its own.
+//
+// For example, party 0 computes the maximum of the XOR shares x and y
+// with
+//
+//	vm := yaogen.NewVM(GenIO(io), 0)
+//	a, b := gen.B2Y(vm, uint64(x), 32), gen.B2Y(vm, uint64(y), 32)
+//	m := uint32(gen.Y2B(vm, gen.Select(vm, gen.Icmp_ugt(vm, a, b), a, b)))
+//
+// and party 1 does the same with eval.  The result is a XOR share again.
+// The VMs must be used by the goroutine of the block, as the block is.
+
+type genIO struct {
+	*BlockIO
+	sender *ot.StreamSender
+}
+
+type evalIO struct {
+	*BlockIO
+	receiver *ot.StreamReceiver
+}
+
+// GenIO returns the IO of the generator of a garbled circuit, for party 0
+// of two.
+func GenIO(io Io) gen.IO {
+	x, source := garbledBlock(io, 0)
+	return genIO{x, source.senders[1]}
+}
+
+// EvalIO returns the IO of the evaluator of a garbled circuit, for party
+// 1 of two.
+func EvalIO(io Io) eval.IO {
+	x, source := garbledBlock(io, 1)
+	return evalIO{x, source.receivers[0]}
+}
+
+func garbledBlock(io Io, id int) (*BlockIO, *OtState) {
+	if io.N() != 2 || io.Id() != id {
+		io.Abort(errors.New("garbled circuits: the generator is party 0 of two, and the evaluator party 1"))
+	}
+	x, ok := io.(*BlockIO)
+	if !ok {
+		io.Abort(errors.New("garbled circuits: not a block of a PeerIO"))
+	}
+	source, ok := x.Source.(*OtState)
+	if !ok {
+		io.Abort(errors.New("garbled circuits: the block has no OT session"))
+	}
+	return x, source
+}
+
+func (io genIO) Send(m0, m1 ot.Message) {
+	defer io.recoverAbort()
+	io.sender.Send(m0, m1)
+}
+
+func (io genIO) SendM(a, b []ot.Message) {
+	defer io.recoverAbort()
+	io.sender.SendM(a, b)
+}
+
+func (io genIO) SendMBits(a, b []byte) {
+	defer io.recoverAbort()
+	io.sender.SendMBits(a, b)
+}
+
+func (io genIO) SendT(t gc.GarbledTable) {
+	io.Send32(1, uint32(len(t)))
+	for _, c := range t {
+		io.sendBytes(1, c)
+	}
+}
+
+func (io genIO) SendK(k gc.Key) {
+	io.sendBytes(1, k)
+}
+
+func (io genIO) RecvK2() gc.Key {
+	return io.receiveBytes(1)
+}
+
+func (io evalIO) Receive(s ot.Selector) ot.Message {
+	defer io.recoverAbort()
+	return io.receiver.Receive(s)
+}
+
+func (io evalIO) ReceiveM(r []byte) []ot.Message {
+	defer io.recoverAbort()
+	return io.receiver.ReceiveM(r)
+}
+
+func (io evalIO) ReceiveMBits(r []byte) []byte {
+	defer io.recoverAbort()
+	return io.receiver.ReceiveMBits(r)
+}
+
+func (io evalIO) RecvT() gc.GarbledTable {
+	t := make(gc.GarbledTable, io.Receive32(0))
+	for i := range t {
+		t[i] = io.receiveBytes(0)
+	}
+	return t
+}
+
+func (io evalIO) RecvK() gc.Key {
+	return io.receiveBytes(0)
+}
+
+func (io evalIO) SendK2(k gc.Key) {
+	io.sendBytes(0, k)
+}
+
+// sendBytes sends the length of b and then b, in 32-bit words
+func (x *BlockIO) sendBytes(party int, b []byte) {
+	x.Send32(party, uint32(len(b)))
+	var w [4]byte
+	for i := 0; i < len(b); i += 4 {
+		w = [4]byte{}
+		copy(w[:], b[i:])
+		x.Send32(party, binary.LittleEndian.Uint32(w[:]))
+	}
+}
+
+func (x *BlockIO) receiveBytes(party int) []byte {
+	n := int(x.Receive32(party))
+	if n > maxBytes {
+		x.Abort(errors.New("garbled circuits: message too long"))
+	}
+	b := make([]byte, (n+3)/4*4)
+	for i := 0; i < n; i += 4 {
+		binary.LittleEndian.PutUint32(b[i:], x.Receive32(party))
+	}
+	return b[:n]
+}
+
+// maxBytes bounds the messages of receiveBytes: keys and ciphertexts are
+// a few blocks of AES
+const maxBytes = 1024
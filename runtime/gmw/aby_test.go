@@ -0,0 +1,49 @@
+package gmw
+
+import (
+	"context"
+	"github.com/tjim/smpcc/runtime/gc/eval"
+	"github.com/tjim/smpcc/runtime/gc/gen"
+	yaoeval "github.com/tjim/smpcc/runtime/gc/yao/eval"
+	yaogen "github.com/tjim/smpcc/runtime/gc/yao/gen"
+	"testing"
+)
+
+// TestConversions moves x, XOR-shared, and y, additively shared, into a
+// garbled circuit, which computes their maximum and difference, and back.
+func TestConversions(t *testing.T) {
+	const x, y = 1000, 777
+	xs := [2]uint64{0x12345678, 0x12345678 ^ x}
+	ys := [2]uint64{0x9abcdef0, y + 1<<32 - 0x9abcdef0}
+	shares := make(chan [3]uint64, 2)
+	_, err := Simulation(context.Background(), nil, 0, func(io Io, ios []Io) {
+		var m, d uint64
+		if io.Id() == 0 {
+			vm := yaogen.NewVM(GenIO(io), 0)
+			a, b := gen.B2Y(vm, xs[0], 32), gen.A2Y(vm, ys[0], 32)
+			m = gen.Y2B(vm, gen.Select(vm, gen.Icmp_ugt(vm, a, b), a, b))
+			d = gen.Y2A(vm, gen.Sub(vm, a, b))
+		} else {
+			vm := yaoeval.NewVM(EvalIO(io), 0)
+			a, b := eval.B2Y(vm, xs[1], 32), eval.A2Y(vm, ys[1], 32)
+			m = eval.Y2B(vm, eval.Select(vm, eval.Icmp_ugt(vm, a, b), a, b))
+			d = eval.Y2A(vm, eval.Sub(vm, a, b))
+		}
+		// m is a share of gmw
+		o := Output32(io, Add32(io, uint32(m), Uint32(io, 1)))
+		shares <- [3]uint64{m, d, uint64(o)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s0, s1 := <-shares, <-shares
+	if m := uint32(s0[0] ^ s1[0]); m != x {
+		t.Errorf("maximum %d, want %d", m, x)
+	}
+	if d := uint32(s0[1] + s1[1]); d != x-y {
+		t.Errorf("difference %d, want %d", d, x-y)
+	}
+	if s0[2] != x+1 || s1[2] != x+1 {
+		t.Errorf("outputs %d and %d, want %d", s0[2], s1[2], x+1)
+	}
+}
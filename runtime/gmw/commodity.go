@@ -1,7 +1,9 @@
 package gmw
 
 import (
+	"context"
 	"crypto/cipher"
+	"errors"
 	"github.com/tjim/smpcc/runtime/bit"
 	"github.com/tjim/smpcc/runtime/ot"
 )
@@ -92,23 +94,42 @@ type CommodityRequest interface {
 }
 
 type CommodityClientState struct {
+	ctx          context.Context
 	RandomStream cipher.Stream
 	CorrectionCh chan []byte
 	Requester    CommodityRequest
 }
 
-func NewCommodityClientState(ch chan []byte, requester CommodityRequest) *CommodityClientState {
-	s := &CommodityClientState{nil, ch, requester}
+// Waiting for the commodity server ends when ctx is done; pass the
+// Context of the PeerIO so that an abort of the computation ends it.
+func NewCommodityClientState(ctx context.Context, ch chan []byte, requester CommodityRequest) *CommodityClientState {
+	s := &CommodityClientState{ctx, nil, ch, requester}
 	return s
 }
 
-func InitCommodityClientState(s *CommodityClientState, distinguished bool) {
-	seed := <-s.CorrectionCh
+// Receive the next message from the commodity server, or panic with an
+// ot.Abort; a Requester may also panic with an ot.Abort if it fails.
+func (s *CommodityClientState) receive() []byte {
+	select {
+	case x, ok := <-s.CorrectionCh:
+		if !ok {
+			panic(ot.Abort{Err: errors.New("commodity server channel closed")})
+		}
+		return x
+	case <-s.ctx.Done():
+		panic(ot.Abort{Err: context.Cause(s.ctx)})
+	}
+}
+
+func InitCommodityClientState(s *CommodityClientState, distinguished bool) (err error) {
+	defer ot.Recover(&err)
+	seed := s.receive()
 	s.RandomStream = ot.NewPRG(seed)
 	if !distinguished {
 		s.CorrectionCh = nil
 		// we do not close the channel, in NATS this will be a subscription channel, we must unsubscribe as well, so caller closes
 	}
+	return nil
 }
 
 func (s *CommodityClientState) triple32() []Triple {
@@ -121,7 +142,7 @@ func (s *CommodityClientState) triple32() []Triple {
 	s.RandomStream.XORKeyStream(c, c)
 	if s.CorrectionCh != nil {
 		s.Requester.RequestTripleCorrection()
-		correction := <-s.CorrectionCh
+		correction := s.receive()
 		c = ot.XorBytes(c, correction)
 	}
 	result := make([]Triple, NUM_TRIPLES)
@@ -143,7 +164,7 @@ func (s *CommodityClientState) maskTriple(numTriples, numBytesTriple int) []Mask
 	s.RandomStream.XORKeyStream(c, c)
 	if s.CorrectionCh != nil {
 		s.Requester.RequestMaskTripleCorrection(numTriples, numBytesTriple)
-		correction := <-s.CorrectionCh
+		correction := s.receive()
 		c = ot.XorBytes(c, correction)
 	}
 	result := make([]MaskTriple, numTriples)
@@ -1,12 +1,15 @@
 package gmw
 
 import (
+	"context"
 	"fmt"
 	"github.com/tjim/fatchan"
+	"github.com/tjim/smpcc/runtime/input"
 	"github.com/tjim/smpcc/runtime/ot"
-	"log"
+	"github.com/tjim/smpcc/runtime/secure"
 	"math/big"
 	"net"
+	"runtime"
 	"time"
 )
 
@@ -36,8 +39,10 @@ const (
 
 type Io interface {
 	Id() int
-	N() int /* number of parties */
-	GetInput() uint32
+	N() int                   /* number of parties */
+	InputParties() int        /* number of parties with inputs, see SetInputParties */
+	GetInput(bits int) uint64 /* next input of this party, as a bits-wide integer */
+	GetInputBytes(n int) []byte
 
 	Open1(bool) bool
 	Open8(uint8) uint8
@@ -63,6 +68,10 @@ type Io interface {
 
 	InitRam([]byte)
 	Ram() []byte
+
+	Results() *Results /* outputs delivered to this party */
+
+	Abort(err error) // abort the computation with err, see GlobalIO.Abort
 }
 
 /* Share of a multiplication triple */
@@ -81,10 +90,14 @@ type TripleSource interface {
 }
 
 type GlobalIO struct {
-	n      int      /* number of parties */
-	id     int      /* id of party, range is 0..n-1 */
-	Inputs []uint32 /* inputs of this party */
-	ram    []byte
+	n       int           /* number of parties */
+	id      int           /* id of party, range is 0..n-1 */
+	inputs  int           /* parties 0..inputs-1 supply inputs; 0 for all */
+	Inputs  *input.Source /* inputs of this party */
+	ram     []byte
+	results *Results
+	ctx     context.Context /* done when the computation is aborted */
+	cancel  context.CancelCauseFunc
 }
 
 type BlockIO struct {
@@ -144,22 +157,33 @@ const (
 	base_port int = 3042
 )
 
-func (io *PeerIO) connect(party int, done chan bool) {
+func (io *PeerIO) connect(party int, done chan error) {
+	done <- io.connectErr(party)
+}
+
+func (io *PeerIO) connectErr(party int) error {
 	if io.id == party {
 		panic("connect0")
 	}
 	addr := fmt.Sprintf("%s:%d", Hosts[io.id], Ports[party]+io.id)
-	server, err := net.Dial("tcp", addr)
+	var d net.Dialer
+	server, err := d.DialContext(io.ctx, "tcp", addr)
 	if err != nil {
-		log.Fatalf("dial(%q): %s", addr, err)
+		return err
+	}
+	xport, err := io.transport(server, party, secure.Client)
+	if err != nil {
+		return err
 	}
-
-	xport := fatchan.New(server, nil)
 	nu := make(chan *PerNodePair)
 	xport.FromChan(nu)
 	x := NewPerNodePair(io)
-	nu <- x
-	ClientSideIOSetup(io, party, x, true, done)
+	select {
+	case nu <- x:
+	case <-io.ctx.Done():
+		return io.Err()
+	}
+	return clientSideIOSetup(io, party, x, true)
 }
 
 func NewPerNodePair(peer *PeerIO) *PerNodePair {
@@ -180,7 +204,12 @@ func NewPerNodePair(peer *PeerIO) *PerNodePair {
 	return &x
 }
 
-func ClientSideIOSetup(peer *PeerIO, party int, x *PerNodePair, wait bool, done chan bool) {
+// Set up the channels and OT with party on the client side, and send the result (nil on success) on done.
+func ClientSideIOSetup(peer *PeerIO, party int, x *PerNodePair, wait bool, done chan error) {
+	done <- clientSideIOSetup(peer, party, x, wait)
+}
+
+func clientSideIOSetup(peer *PeerIO, party int, x *PerNodePair, wait bool) error {
 	blocks := peer.Blocks
 	numBlocks := len(blocks)
 	ParamChan := x.ParamChan
@@ -188,16 +217,27 @@ func ClientSideIOSetup(peer *PeerIO, party int, x *PerNodePair, wait bool, done
 	NpSendEncs := x.NpSendEncs
 
 	if wait {
-		time.Sleep(3 * time.Second) // wait for fatchan channel setup at server to complete
+		// wait for fatchan channel setup at server to complete
+		select {
+		case <-time.After(3 * time.Second):
+		case <-peer.ctx.Done():
+			return peer.Err()
+		}
 	}
 	for i := 0; i < numBlocks; i++ {
 		blocks[i].Rchannels[party] = x.BlockChans[i].SAS.Rwchannel
 		blocks[i].Wchannels[party] = x.BlockChans[i].CAS.Rwchannel
 	}
 
-	baseReceiver := ot.NewNPReceiver(ParamChan, NpRecvPk, NpSendEncs)
-	sender0 := ot.NewStreamSender(baseReceiver, x.BlockChans[0].CAS.S2R, x.BlockChans[0].CAS.R2S)
-	receiver0 := ot.NewStreamReceiver(sender0, x.BlockChans[0].SAS.R2S, x.BlockChans[0].SAS.S2R)
+	baseReceiver := ot.NewNPReceiver(peer.ctx, ParamChan, NpRecvPk, NpSendEncs)
+	sender0, err := ot.NewStreamSender(peer.ctx, baseReceiver, x.BlockChans[0].CAS.S2R, x.BlockChans[0].CAS.R2S)
+	if err != nil {
+		return err
+	}
+	receiver0, err := ot.NewStreamReceiver(peer.ctx, sender0, x.BlockChans[0].SAS.R2S, x.BlockChans[0].SAS.S2R)
+	if err != nil {
+		return err
+	}
 
 	source := blocks[0].Source.(*OtState)
 	source.senders[party] = sender0
@@ -210,35 +250,96 @@ func ClientSideIOSetup(peer *PeerIO, party int, x *PerNodePair, wait bool, done
 		source.senders[party] = sender
 		source.receivers[party] = receiver
 	}
+	return nil
+}
 
-	done <- true
+func (io *PeerIO) listen(party int, done chan error) {
+	done <- io.listenErr(party)
 }
 
-func (io *PeerIO) listen(party int, done chan bool) {
+func (io *PeerIO) listenErr(party int) error {
 	if io.id == party {
 		panic("listen0")
 	}
 	addr := fmt.Sprintf("%s:%d", Hosts[io.id], Ports[io.id]+party)
-	listener, err := net.Listen("tcp", addr)
+	var lc net.ListenConfig
+	listener, err := lc.Listen(io.ctx, "tcp", addr)
 	if err != nil {
-		log.Fatalf("listen(%q): %s", addr, err)
+		return err
 	}
+	go func() {
+		<-io.ctx.Done()
+		listener.Close()
+	}()
 	conn, err := listener.Accept()
 	if err != nil {
-		log.Fatalf("accept(): %s", err)
+		if io.ctx.Err() != nil {
+			return io.Err()
+		}
+		return err
+	}
+	xport, err := io.transport(conn, party, secure.Server)
+	if err != nil {
+		return err
 	}
-	xport := fatchan.New(conn, nil)
 	nu := make(chan *PerNodePair)
 	xport.ToChan(nu)
-	ServerSideIOSetup(io, party, <-nu, done)
+	var x *PerNodePair
+	select {
+	case x = <-nu:
+	case <-io.ctx.Done():
+		return io.Err()
+	}
+	return serverSideIOSetup(io, party, x)
+}
+
+// Start a fatchan transport with party over conn.  The connection is
+// closed when the computation ends, and its failure aborts the computation.
+func (io *PeerIO) transport(conn net.Conn, party int, handshake func(net.Conn, *secure.Keys, *[32]byte) (*secure.Conn, error)) (*fatchan.Transport, error) {
+	go func() {
+		<-io.ctx.Done()
+		conn.Close()
+	}()
+	sconn, err := secureConn(conn, party, handshake)
+	if err != nil {
+		return nil, fmt.Errorf("secure channel with party %d: %v", party, err)
+	}
+	return fatchan.New(sconn, func(err error) {
+		io.Cancel(fmt.Errorf("connection to party %d: %v", party, err))
+	}), nil
 }
 
-func ServerSideIOSetup(peer *PeerIO, party int, x *PerNodePair, done chan bool) {
+// Wrap conn in a secure channel if the config file gave a key for party.
+// Either every party has a key or none does.
+func secureConn(conn net.Conn, party int, handshake func(net.Conn, *secure.Keys, *[32]byte) (*secure.Conn, error)) (net.Conn, error) {
+	peer, ok := Keys[party]
+	if !ok {
+		if len(Keys) > 0 {
+			return nil, fmt.Errorf("no key for party %d in config", party)
+		}
+		return conn, nil
+	}
+	if MyKeys == nil {
+		return nil, fmt.Errorf("config has keys but no private key was given")
+	}
+	sconn, err := handshake(conn, MyKeys, peer)
+	if err != nil {
+		return nil, err
+	}
+	return sconn, nil
+}
+
+// Set up the channels and OT with party on the server side, and send the result (nil on success) on done.
+func ServerSideIOSetup(peer *PeerIO, party int, x *PerNodePair, done chan error) {
+	done <- serverSideIOSetup(peer, party, x)
+}
+
+func serverSideIOSetup(peer *PeerIO, party int, x *PerNodePair) error {
 	blocks := peer.Blocks
 	numBlocks := len(blocks)
 
 	if numBlocks != len(x.BlockChans) {
-		panic("Block mismatch")
+		return fmt.Errorf("block mismatch: %d blocks, party %d has %d", numBlocks, party, len(x.BlockChans))
 	}
 
 	for i := 0; i < numBlocks; i++ {
@@ -246,9 +347,15 @@ func ServerSideIOSetup(peer *PeerIO, party int, x *PerNodePair, done chan bool)
 		blocks[i].Rchannels[party] = x.BlockChans[i].CAS.Rwchannel
 	}
 
-	baseSender := ot.NewNPSender(x.NPChans.ParamChan, x.NPChans.NpRecvPk, x.NPChans.NpSendEncs)
-	receiver0 := ot.NewStreamReceiver(baseSender, x.BlockChans[0].CAS.R2S, x.BlockChans[0].CAS.S2R)
-	sender0 := ot.NewStreamSender(receiver0, x.BlockChans[0].SAS.S2R, x.BlockChans[0].SAS.R2S)
+	baseSender := ot.NewNPSender(peer.ctx, x.NPChans.ParamChan, x.NPChans.NpRecvPk, x.NPChans.NpSendEncs)
+	receiver0, err := ot.NewStreamReceiver(peer.ctx, baseSender, x.BlockChans[0].CAS.R2S, x.BlockChans[0].CAS.S2R)
+	if err != nil {
+		return err
+	}
+	sender0, err := ot.NewStreamSender(peer.ctx, receiver0, x.BlockChans[0].SAS.S2R, x.BlockChans[0].SAS.R2S)
+	if err != nil {
+		return err
+	}
 
 	source := blocks[0].Source.(*OtState)
 	source.senders[party] = sender0
@@ -261,14 +368,16 @@ func ServerSideIOSetup(peer *PeerIO, party int, x *PerNodePair, done chan bool)
 		source.senders[party] = sender
 		source.receivers[party] = receiver
 	}
-
-	done <- true
+	return nil
 }
 
-func NewPeerIO(numBlocks int, numParties int, id int) *PeerIO {
+// The computation of the new PeerIO is aborted when ctx is done.
+func NewPeerIO(ctx context.Context, numBlocks int, numParties int, id int) *PeerIO {
 	var gio GlobalIO
 	gio.n = numParties
 	gio.id = id
+	gio.results = NewResults()
+	gio.ctx, gio.cancel = context.WithCancelCause(ctx)
 	var io PeerIO
 	io.GlobalIO = &gio
 	io.Blocks = make([]*BlockIO, numBlocks+1) // one extra BlockIO for the main loop
@@ -284,17 +393,49 @@ func NewPeerIO(numBlocks int, numParties int, id int) *PeerIO {
 	return &io
 }
 
-func SetupPeer(inputs []uint32, numBlocks int, numParties int, id int, runPeer func(Io, []Io)) {
-	io := NewPeerIO(numBlocks, numParties, id)
+// Run runs runPeer on the blocks of io and waits until it returns or
+// the computation is aborted.  After an abort, blocks that are not
+// waiting on communication are left to finish on their own.
+func (io *PeerIO) Run(runPeer func(Io, []Io)) error {
+	// copy io.blocks[1:] to make an []Io; []BlockIO is not []Io
+	x := make([]Io, len(io.Blocks)-1)
+	for j := range x {
+		x[j] = io.Blocks[j+1]
+	}
+	done := make(chan bool, 1)
+	go func() {
+		runPeer(io.Blocks[0], x)
+		done <- true
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-io.ctx.Done():
+		return io.Err()
+	}
+}
+
+// Connect to the other parties and run the computation.  SetupPeer
+// returns the outputs delivered to this party when the computation
+// finishes, or an error when it is aborted: ctx is done, a connection
+// fails, or a block aborts.
+func SetupPeer(ctx context.Context, inputs *input.Source, numBlocks int, numParties int, id int, runPeer func(Io, []Io)) (*Results, error) {
+	io := NewPeerIO(ctx, numBlocks, numParties, id)
+	defer io.Cancel(nil) // close the connections
 	io.Inputs = inputs
-	done := make(chan bool)
+	done := make(chan error, numParties)
 	// start listening for clients
 	for i := 0; i < numParties; i++ {
 		if io.id != i && !io.Leads(i) {
 			go io.listen(i, done)
 		}
 	}
-	time.Sleep(2 * time.Second) // wait for servers of other parties to start listening
+	// wait for servers of other parties to start listening
+	select {
+	case <-time.After(2 * time.Second):
+	case <-io.ctx.Done():
+		return nil, io.Err()
+	}
 	// start connecting to servers of other parties
 	for i := 0; i < numParties; i++ {
 		if io.id != i && io.Leads(i) {
@@ -303,18 +444,21 @@ func SetupPeer(inputs []uint32, numBlocks int, numParties int, id int, runPeer f
 	}
 	for i := 0; i < numParties; i++ {
 		if io.id != i {
-			<-done
+			if err := <-done; err != nil {
+				return nil, err
+			}
 		}
 	}
-	// copy io.blocks[1:] to make an []Io; []BlockIO is not []Io
-	x := make([]Io, numBlocks)
-	for j := 0; j < numBlocks; j++ {
-		x[j] = io.Blocks[j+1]
+	if err := io.Run(runPeer); err != nil {
+		return nil, err
 	}
-	runPeer(io.Blocks[0], x)
+	return io.results, nil
 }
 
-func Simulation(inputs []uint32, numBlocks int, runPeer func(Io, []Io)) {
+// Run the computation with all parties in this process.  Party i gets
+// inputs[i], and there are at least two parties.  The Results hold the
+// outputs delivered to all of the parties.
+func Simulation(ctx context.Context, inputs []*input.Source, numBlocks int, runPeer func(Io, []Io)) (*Results, error) {
 	if log_triples {
 		go log_triple_goroutine()
 	}
@@ -322,16 +466,22 @@ func Simulation(inputs []uint32, numBlocks int, runPeer func(Io, []Io)) {
 	if numParties == 0 { // for some test cases we may have no inputs
 		numParties = 2
 	}
+	// all parties share one context, so that an abort by any party aborts them all
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	results := NewResults()
 	ios := make([]*PeerIO, numParties)
 	for i := 0; i < numParties; i++ {
-		peer := NewPeerIO(numBlocks, numParties, i)
+		peer := NewPeerIO(ctx, numBlocks, numParties, i)
+		peer.ctx, peer.cancel = ctx, cancel
+		peer.results = results
 		if len(inputs) > i {
-			peer.Inputs = inputs[i : i+1]
+			peer.Inputs = inputs[i]
 		}
 		ios[i] = peer
 	}
 	xs := make([]*PerNodePair, numParties*numParties)
-	done := make(chan bool)
+	done := make(chan error, numParties*numParties)
 	for i := 0; i < numParties; i++ {
 		for j := 0; j < numParties; j++ {
 			if i != j && !ios[i].Leads(j) {
@@ -352,35 +502,57 @@ func Simulation(inputs []uint32, numBlocks int, runPeer func(Io, []Io)) {
 	for i := 0; i < numParties; i++ {
 		for j := 0; j < numParties; j++ {
 			if i != j {
-				<-done // wait for a setup to finish
+				// wait for a setup to finish
+				if err := <-done; err != nil {
+					cancel(err)
+					return nil, err
+				}
 			}
 		}
 	}
 	// all setup clients and servers have finished
-	peerDone := make(chan bool)
+	peerDone := make(chan error, numParties)
 	for i := 0; i < numParties; i++ {
-		// copy ios[i].blocks[1:] to make an []Io; []BlockIO is not []Io
-		x := make([]Io, numBlocks)
-		for j := 0; j < numBlocks; j++ {
-			x[j] = ios[i].Blocks[j+1]
-		}
-		go func(i int, x []Io) {
-			runPeer(ios[i].Blocks[0], x)
-			peerDone <- true
-		}(i, x)
+		go func(i int) {
+			peerDone <- ios[i].Run(runPeer)
+		}(i)
 	}
 	for i := 0; i < numParties; i++ {
-		<-peerDone // wait for all peers to complete
+		// wait for all peers to complete
+		if err := <-peerDone; err != nil {
+			return nil, err
+		}
 	}
 	if log_triples {
 		log_triple_output()
 	}
+	return results, nil
 }
 
 func (x *GlobalIO) N() int {
 	return x.n
 }
 
+// InputParties is the number of parties that supply inputs.  They are
+// parties 0..InputParties()-1; the rest compute and receive outputs but
+// have no inputs.
+func (x *GlobalIO) InputParties() int {
+	if x.inputs == 0 {
+		return x.n
+	}
+	return x.inputs
+}
+
+// SetInputParties sets the number of parties that supply inputs, all of
+// them by default.  Every party must set the same number before the
+// computation runs.
+func (x *GlobalIO) SetInputParties(n int) {
+	if n < 1 || n > x.n {
+		panic(fmt.Sprintf("SetInputParties: %d parties with inputs out of %d", n, x.n))
+	}
+	x.inputs = n
+}
+
 func (x *GlobalIO) Leads(y int) bool {
 	// Leader calculation
 	// We have N parties 0...N-1
@@ -418,6 +590,54 @@ func (x *GlobalIO) Id() int {
 	return x.id
 }
 
+// Results returns the outputs delivered to this party.
+func (x *GlobalIO) Results() *Results {
+	return x.results
+}
+
+// The context of the computation, which is done once it is aborted.
+func (x *GlobalIO) Context() context.Context {
+	return x.ctx
+}
+
+// Err returns the reason the computation was aborted, or nil if it has not been.
+func (x *GlobalIO) Err() error {
+	if x.ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(x.ctx)
+}
+
+// Cancel aborts the computation from outside of the blocks.
+func (x *GlobalIO) Cancel(err error) {
+	x.cancel(err)
+}
+
+// Abort aborts the computation and ends the calling block.  Every block
+// waiting to communicate wakes up and ends, the connections to the other
+// parties are closed (so they abort too), and Run returns err.
+func (x *GlobalIO) Abort(err error) {
+	x.cancel(err)
+	runtime.Goexit()
+}
+
+// End the calling block once the computation has been aborted.
+func (x *GlobalIO) exit() {
+	x.Abort(x.Err())
+}
+
+// Deferred by operations that use OT or another triple source; turns
+// a failure into an abort.
+func (x *GlobalIO) recoverAbort() {
+	if r := recover(); r != nil {
+		a, ok := r.(ot.Abort)
+		if !ok {
+			panic(r)
+		}
+		x.Abort(a.Err)
+	}
+}
+
 func (x *BlockIO) Triple1() (a, b, c bool) {
 	if len(x.triples1) == 0 {
 		a32, b32, c32 := x.Triple32()
@@ -479,9 +699,19 @@ func combine(arr []byte) uint32 {
 	return result
 }
 
+func (x *BlockIO) triple32() []Triple {
+	defer x.recoverAbort()
+	return x.Source.triple32()
+}
+
+func (x *BlockIO) maskTriple(numTriples, numBytesTriple int) []MaskTriple {
+	defer x.recoverAbort()
+	return x.Source.maskTriple(numTriples, numBytesTriple)
+}
+
 func (x *BlockIO) MaskTriple32() (a byte, B uint32, C uint32) {
 	if len(x.maskTriples) == 0 {
-		x.maskTriples = x.Source.maskTriple(32, 4) // 32 triples, 4 bytes each
+		x.maskTriples = x.maskTriple(32, 4) // 32 triples, 4 bytes each
 	}
 	result := x.maskTriples[0]
 	x.maskTriples = x.maskTriples[1:]
@@ -490,7 +720,7 @@ func (x *BlockIO) MaskTriple32() (a byte, B uint32, C uint32) {
 
 func (x *BlockIO) Triple32() (a, b, c uint32) {
 	if len(x.triples32) == 0 {
-		x.triples32 = x.Source.triple32()
+		x.triples32 = x.triple32()
 		if log_triples && x.Id() == 0 {
 			stats_triple_chan <- true
 		}
@@ -593,7 +823,14 @@ func (x *BlockIO) Send32(party int, n32 uint32) {
 		return
 	}
 	ch := x.Wchannels[party]
-	ch <- n32
+	if x.ctx.Err() != nil {
+		x.exit()
+	}
+	select {
+	case ch <- n32:
+	case <-x.ctx.Done():
+		x.exit()
+	}
 	if log_communication {
 		fmt.Printf("%d -- 0x%1x -> %d\n", id, n32, party)
 	}
@@ -632,9 +869,15 @@ func (x *BlockIO) Receive32(party int) uint32 {
 		fmt.Printf("len(x.Rchannels) == %d, party == %d\n", len(x.Rchannels), party)
 	}
 	ch := x.Rchannels[party]
-	result, ok := <-ch
-	if !ok {
-		panic("channel closed")
+	var result uint32
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			x.Abort(fmt.Errorf("channel from party %d closed", party))
+		}
+		result = r
+	case <-x.ctx.Done():
+		x.exit()
 	}
 	if log_communication {
 		fmt.Printf("%d <- 0x%08x -- %d\n", id, result, party)
@@ -648,9 +891,25 @@ func (x *BlockIO) Receive64(party int) uint64 {
 	return (uint64(n0) << 32) | uint64(n1)
 }
 
-func (x *BlockIO) GetInput() uint32 {
-	result := x.Inputs[0]
-	x.Inputs = x.Inputs[1:]
+func (x *BlockIO) GetInput(bits int) uint64 {
+	if x.Inputs == nil {
+		x.Abort(input.ErrExhausted)
+	}
+	result, err := x.Inputs.Next(bits)
+	if err != nil {
+		x.Abort(err)
+	}
+	return result
+}
+
+func (x *BlockIO) GetInputBytes(n int) []byte {
+	if x.Inputs == nil {
+		x.Abort(input.ErrExhausted)
+	}
+	result, err := x.Inputs.NextBytes(n)
+	if err != nil {
+		x.Abort(err)
+	}
 	return result
 }
 
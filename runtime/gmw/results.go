@@ -0,0 +1,14 @@
+package gmw
+
+import (
+	"github.com/tjim/smpcc/runtime/results"
+)
+
+// Output and Results are those of package results, so the outputs of every
+// backend are collected, and written as JSON, in the same way.
+type Output = results.Output
+type Results = results.Results
+
+func NewResults() *Results {
+	return results.NewResults()
+}
@@ -2,8 +2,11 @@ package gmw
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"github.com/tjim/smpcc/runtime/input"
+	"github.com/tjim/smpcc/runtime/secure"
 	"os"
 	"runtime/pprof"
 	"strings"
@@ -17,32 +20,58 @@ type MPC struct {
 var Hosts map[int]string = make(map[int]string)
 var Ports map[int]int = make(map[int]int)
 
+// Static public keys of the parties, from the config file.
+// If a party has a key then all connections with it use a secure channel.
+var Keys map[int]*[32]byte = make(map[int]*[32]byte)
+
+// The static key pair of this party, see the -key flag of Run.
+var MyKeys *secure.Keys
+
 var MpcPrintsChan chan string = make(chan string, 100)
 
 // Read a configuration file, which consists a series lines of the form host:port, on per party, in order.
-// Return maps of hosts and ports, so hosts[i] is the host of party i and ports[i] is its base port.
-func ReadConfig(filename string) bool {
+// A line may also give the static public key of the party, host:port key, in the format of secure.MarshalPublicKey.
+// Fill in the maps Hosts, Ports, and Keys, so Hosts[i] is the host of party i, Ports[i] is its base port,
+// and Keys[i] is its public key.  ReadConfig returns false if the file cannot be opened, and an error if
+// it is malformed.
+func ReadConfig(filename string) (bool, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		return false
+		return false, nil
 	}
+	defer file.Close()
 	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanWords)
 	numParties := 0
-	for scanner.Scan() {
-		hostport := scanner.Bytes()
-		parts := strings.Split(string(hostport), ":")
-		if len(parts) != 2 {
-			panic("ReadConfig: input error")
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return true, fmt.Errorf("%s:%d: expected host:port [key]", filename, line)
+		}
+		var host string
+		var port int
+		parts := strings.Split(fields[0], ":")
+		if len(parts) == 2 {
+			host = parts[0]
+			fmt.Sscanf(parts[1], "%d", &port)
+		}
+		if host == "" || port <= 0 {
+			return true, fmt.Errorf("%s:%d: expected host:port [key]", filename, line)
 		}
-		host := parts[0]
-		port := 0
-		fmt.Sscanf(parts[1], "%d", &port)
 		Hosts[numParties] = host
 		Ports[numParties] = port
+		if len(fields) == 2 {
+			key, err := secure.UnmarshalPublicKey(fields[1])
+			if err != nil {
+				return true, fmt.Errorf("%s:%d: party %d: %v", filename, line, numParties, err)
+			}
+			Keys[numParties] = key
+		}
 		numParties++
 	}
-	return true
+	return true, scanner.Err()
 }
 
 func SetupHostsPorts(parties int) {
@@ -52,22 +81,36 @@ func SetupHostsPorts(parties int) {
 	}
 }
 
-func Run(numBlocks int, runPeer func(Io, []Io)) {
+// Run the computation as a party, according to the command-line flags.
+// Run returns the outputs of the computation when it finishes, or an
+// error when it is aborted: ctx is done, a connection fails, or a block
+// aborts.  With the -results flag the outputs are also written as JSON.
+func Run(ctx context.Context, numBlocks int, runPeer func(Io, []Io)) (*Results, error) {
 	var do_pprof bool
 	var id int
 	var parties int
 	var config string
+	var keyfile string
+	var inputfile string
+	var resultfile string
 	flag.BoolVar(&do_pprof, "pprof", false, "run for profiling")
 	flag.IntVar(&id, "id", 0, "id of this party")
 	flag.IntVar(&parties, "parties", 0, "number of parties")
 	flag.StringVar(&config, "config", "", "config file")
+	flag.StringVar(&keyfile, "key", "", "private key file of this party (required if the config file has keys)")
+	flag.StringVar(&inputfile, "input", "", "file of inputs, JSON or CSV, - for stdin; read before the inputs on the command line")
+	flag.StringVar(&resultfile, "results", "", "write the outputs as JSON to this file, - for stdout")
 	flag.Parse()
-	args := flag.Args()
-	inputs := make([]uint32, len(args))
-	for i, v := range args {
-		input := 0
-		fmt.Sscanf(v, "%d", &input)
-		inputs[i] = uint32(input)
+	if keyfile != "" {
+		keys, err := secure.ReadKeys(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		MyKeys = keys
+	}
+	inputs, err := input.Load(inputfile, flag.Args())
+	if err != nil {
+		return nil, err
 	}
 	if do_pprof {
 		file := "cpu.pprof"
@@ -78,14 +121,28 @@ func Run(numBlocks int, runPeer func(Io, []Io)) {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	if ReadConfig(config) {
+	var results *Results
+	found, err := ReadConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if found {
 		parties = len(Hosts)
-		SetupPeer(inputs, numBlocks, parties, id, runPeer)
+		results, err = SetupPeer(ctx, inputs, numBlocks, parties, id, runPeer)
 	} else if parties == 0 {
-		Simulation(inputs, numBlocks, runPeer)
+		// in simulation mode each input is the input of one party
+		results, err = Simulation(ctx, inputs.Split(), numBlocks, runPeer)
 	} else {
 		SetupHostsPorts(parties)
-		SetupPeer(inputs, numBlocks, parties, id, runPeer)
+		results, err = SetupPeer(ctx, inputs, numBlocks, parties, id, runPeer)
 	}
-
+	if err != nil {
+		return nil, err
+	}
+	if resultfile != "" {
+		if err := results.WriteFile(resultfile); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
 }
@@ -591,8 +591,10 @@ func Mask64(io Io, s bool, a uint64) uint64 {
 	return uint64(mlow) | (uint64(mhigh) << 32)
 }
 
+// NumPeers32 is the number of parties with inputs, see
+// GlobalIO.InputParties
 func NumPeers32(io Io) uint32 {
-	return Uint32(io, uint32(io.N()))
+	return Uint32(io, uint32(io.InputParties()))
 }
 
 func rand32() uint32 {
@@ -629,6 +631,31 @@ func split_uint32(x uint32, n int) []uint32 {
 	return result
 }
 
+// Input8, Input32, Input64, and InputBytes share the next input of party.
+// Shares of 8 and 64 bit inputs come from split_uint32; xor is bitwise.
+
+func Input8(io Io, mask bool, party uint32) uint8 {
+	if !io.Open1(mask) {
+		return 0
+	}
+	id := io.Id()
+	party = io.Open32(party)
+	if id == int(party) {
+		X := io.GetInput(8)
+		shares := split_uint32(uint32(X), io.N())
+		for i := range shares {
+			if i == id {
+				continue
+			}
+			io.Send8(i, uint8(shares[i]))
+		}
+		return uint8(shares[id])
+	} else {
+		X := io.Receive8(int(party))
+		return X
+	}
+}
+
 func Input32(io Io, mask bool, party uint32) uint32 {
 	if !io.Open1(mask) {
 		return 0
@@ -636,7 +663,7 @@ func Input32(io Io, mask bool, party uint32) uint32 {
 	id := io.Id()
 	party = io.Open32(party)
 	if id == int(party) {
-		X := io.GetInput()
+		X := uint32(io.GetInput(32))
 		shares := split_uint32(X, io.N())
 		for i := range shares {
 			if i == id {
@@ -651,29 +678,172 @@ func Input32(io Io, mask bool, party uint32) uint32 {
 	}
 }
 
+func Input64(io Io, mask bool, party uint32) uint64 {
+	if !io.Open1(mask) {
+		return 0
+	}
+	id := io.Id()
+	party = io.Open32(party)
+	if id == int(party) {
+		X := io.GetInput(64)
+		hi := split_uint32(uint32(X>>32), io.N())
+		lo := split_uint32(uint32(X), io.N())
+		for i := range hi {
+			if i == id {
+				continue
+			}
+			io.Send64(i, (uint64(hi[i])<<32)|uint64(lo[i]))
+		}
+		return (uint64(hi[id]) << 32) | uint64(lo[id])
+	} else {
+		X := io.Receive64(int(party))
+		return X
+	}
+}
+
+// InputBytes shares an input of n bytes, which must be the same in all parties.
+func InputBytes(io Io, mask bool, party uint32, n int) []uint8 {
+	result := make([]uint8, n)
+	if !io.Open1(mask) {
+		return result
+	}
+	id := io.Id()
+	party = io.Open32(party)
+	if id == int(party) {
+		X := io.GetInputBytes(n)
+		for j := range X {
+			shares := split_uint32(uint32(X[j]), io.N())
+			for i := range shares {
+				if i == id {
+					continue
+				}
+				io.Send8(i, uint8(shares[i]))
+			}
+			result[j] = uint8(shares[id])
+		}
+	} else {
+		for j := range result {
+			result[j] = io.Receive8(int(party))
+		}
+	}
+	return result
+}
+
+// InputPacked is InputBytes with the n bytes packed into one value,
+// byte 0 lowest, for input_bytes() in compiled programs.  n is at most 8.
+func InputPacked(io Io, mask bool, party uint32, n int) uint64 {
+	if n > 8 {
+		io.Abort(fmt.Errorf("InputPacked: %d bytes do not fit in 64 bits", n))
+	}
+	var result uint64 = 0
+	for j, b := range InputBytes(io, mask, party, n) {
+		result |= uint64(b) << uint(8*j)
+	}
+	return result
+}
+
+// The Output functions open a value to all parties, and the OutputTo
+// functions open a value only to the parties listed in to.  Parties not
+// in to get 0.  The list must be the same in all parties.  The value is
+// added to the Results of each party that receives it.
+
 func Output1(io Io, x bool) uint32 {
 	var result uint32 = 0
 	if io.Open1(x) {
 		result = 1
 	}
-	if log_results {
-		fmt.Printf("%d: RESULT 0x%1x\n", io.Id(), result)
-	}
+	output(io, 1, uint64(result))
 	return result
 }
 
 func Output8(io Io, x uint8) uint32 {
 	result := uint32(io.Open8(x))
-	if log_results {
-		fmt.Printf("%d: RESULT 0x%02x\n", io.Id(), result)
-	}
+	output(io, 8, uint64(result))
 	return result
 }
 
 func Output32(io Io, x uint32) uint32 {
 	result := io.Open32(x)
+	output(io, 32, uint64(result))
+	return result
+}
+
+func Output64(io Io, x uint64) uint64 {
+	result := io.Open64(x)
+	output(io, 64, result)
+	return result
+}
+
+func OutputTo1(io Io, x bool, to ...int) uint32 {
+	var x64 uint64 = 0
+	if x {
+		x64 = 1
+	}
+	return uint32(openTo(io, 1, x64, to))
+}
+
+func OutputTo8(io Io, x uint8, to ...int) uint32 {
+	return uint32(openTo(io, 8, uint64(x), to))
+}
+
+func OutputTo32(io Io, x uint32, to ...int) uint32 {
+	return uint32(openTo(io, 32, uint64(x), to))
+}
+
+func OutputTo64(io Io, x uint64, to ...int) uint64 {
+	return openTo(io, 64, x, to)
+}
+
+func output(io Io, bits int, result uint64) {
+	io.Results().Add(Output{Party: io.Id(), Bits: bits, Value: result})
 	if log_results {
-		fmt.Printf("%d: RESULT 0x%08x\n", io.Id(), result)
+		fmt.Printf("%d: RESULT 0x%0*x\n", io.Id(), (bits+3)/4, result)
+	}
+}
+
+// openTo sends the share of every party directly to each party in to,
+// so no other party learns anything.  The exchanges happen in the same
+// order in all parties, so they cannot deadlock.
+func openTo(io Io, bits int, x uint64, to []int) uint64 {
+	id := io.Id()
+	for i, p := range to {
+		if p < 0 || p >= io.N() {
+			io.Abort(fmt.Errorf("OutputTo: no party %d", p))
+		}
+		for _, q := range to[:i] {
+			if p == q {
+				io.Abort(fmt.Errorf("OutputTo: party %d listed twice", p))
+			}
+		}
+	}
+	var result uint64 = 0
+	received := false
+	for _, p := range to {
+		if p == id {
+			received = true
+			result = x
+		}
+		for i := 0; i < io.N(); i++ {
+			if i == p {
+				continue
+			}
+			if id == p {
+				if bits > 32 {
+					result ^= io.Receive64(i)
+				} else {
+					result ^= uint64(io.Receive32(i))
+				}
+			} else if id == i {
+				if bits > 32 {
+					io.Send64(p, x)
+				} else {
+					io.Send32(p, uint32(x))
+				}
+			}
+		}
+	}
+	if received {
+		output(io, bits, result)
 	}
 	return result
 }
@@ -941,11 +1111,14 @@ func Load(io Io, loc uint64, eltsize uint32) uint64 {
 	}
 	switch bytes {
 	default:
-		panic(fmt.Sprintf("Load: bad element size %d", bytes))
+		io.Abort(fmt.Errorf("Load: bad element size %d", bytes))
 	case 1, 2, 4, 8:
 	}
 	x := uint64(0)
 	ram := io.Ram()
+	if address < 0 || address+bytes > len(ram) {
+		io.Abort(fmt.Errorf("Load: address 0x%08x out of range", address))
+	}
 	for j := 0; j < bytes; j++ {
 		byte_j := uint64(ram[address+j])
 		x += byte_j << uint(j*8)
@@ -969,10 +1142,13 @@ func Store(io Io, loc uint64, eltsize uint32, x uint32) {
 	}
 	switch bytes {
 	default:
-		panic(fmt.Sprintf("Store: bad element size %d", bytes))
+		io.Abort(fmt.Errorf("Store: bad element size %d", bytes))
 	case 1, 2, 4, 8:
 	}
 	ram := io.Ram()
+	if address < 0 || address+bytes > len(ram) {
+		io.Abort(fmt.Errorf("Store: address 0x%08x out of range", address))
+	}
 	if log_mem {
 		y := Reveal32(io, x)
 		if io.Id() == 0 {
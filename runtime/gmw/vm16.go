@@ -0,0 +1,163 @@
+package gmw
+
+// The 16 bit functions, for input16() and i16 values in compiled
+// programs.  Xor shares of a 16 bit value zero extend to shares of the
+// same value in 32 bits, and sign extend to shares of its sign
+// extension, so most of these run the 32 bit circuits and truncate.
+
+func sext16(a uint16) uint32 {
+	return uint32(int32(int16(a)))
+}
+
+func Xor16(io Io, x, y uint16) uint16 {
+	return x ^ y
+}
+
+func And16(io Io, x, y uint16) uint16 {
+	return uint16(And32(io, uint32(x), uint32(y)))
+}
+
+func Or16(io Io, a, b uint16) uint16 {
+	return uint16(Or32(io, uint32(a), uint32(b)))
+}
+
+func Not16(io Io, a uint16) uint16 {
+	if io.Id() == 0 {
+		return 0xffff ^ a
+	}
+	return a
+}
+
+func Icmp_eq16(io Io, a, b uint16) bool {
+	return Icmp_eq32(io, uint32(a), uint32(b))
+}
+
+func Icmp_ugt16(io Io, a, b uint16) bool {
+	return Icmp_ugt32(io, uint32(a), uint32(b))
+}
+
+func Icmp_ult16(io Io, a, b uint16) bool {
+	return Icmp_ugt16(io, b, a)
+}
+
+func Icmp_sgt16(io Io, a, b uint16) bool {
+	return Icmp_sgt32(io, sext16(a), sext16(b))
+}
+
+func Icmp_slt16(io Io, a, b uint16) bool {
+	return Icmp_sgt16(io, b, a)
+}
+
+func Icmp_uge16(io Io, a, b uint16) bool {
+	return Icmp_uge32(io, uint32(a), uint32(b))
+}
+
+func Icmp_ule16(io Io, a, b uint16) bool {
+	return Icmp_uge16(io, b, a)
+}
+
+func Add16(io Io, a, b uint16) uint16 {
+	return uint16(Add32(io, uint32(a), uint32(b)))
+}
+
+func Sub16(io Io, a, b uint16) uint16 {
+	return uint16(Sub32(io, uint32(a), uint32(b)))
+}
+
+func Uint16(io Io, a uint16) uint16 {
+	if io.Id() == 0 {
+		return a
+	}
+	return 0
+}
+
+func Select16(io Io, s bool, a, b uint16) uint16 {
+	return b ^ Mask16(io, s, a^b)
+}
+
+func Mul16(io Io, a, b uint16) uint16 {
+	return uint16(Mul32(io, uint32(a), uint32(b)))
+}
+
+func Shl16(io Io, a uint16, b uint) uint16 {
+	return a << b
+}
+
+func Lshr16(io Io, a uint16, b uint) uint16 {
+	return a >> b
+}
+
+func Ashr16(io Io, a uint16, b uint) uint16 {
+	return uint16(int16(a) >> b)
+}
+
+func Mask16(io Io, s bool, a uint16) uint16 {
+	return uint16(Mask32(io, s, uint32(a)))
+}
+
+func Input16(io Io, mask bool, party uint32) uint16 {
+	if !io.Open1(mask) {
+		return 0
+	}
+	id := io.Id()
+	party = io.Open32(party)
+	if id == int(party) {
+		X := io.GetInput(16)
+		shares := split_uint32(uint32(X), io.N())
+		for i := range shares {
+			if i == id {
+				continue
+			}
+			io.Send32(i, uint32(uint16(shares[i])))
+		}
+		return uint16(shares[id])
+	} else {
+		X := io.Receive32(int(party))
+		return uint16(X)
+	}
+}
+
+func Output16(io Io, x uint16) uint32 {
+	result := io.Open32(uint32(x))
+	output(io, 16, uint64(result))
+	return result
+}
+
+func OutputTo16(io Io, x uint16, to ...int) uint32 {
+	return uint32(openTo(io, 16, uint64(x), to))
+}
+
+func TreeXor16(io Io, x ...uint16) uint16 {
+	if len(x) == 0 {
+		panic("TreeXor with no arguments")
+	}
+	var result uint16
+	for _, v := range x {
+		result ^= v
+	}
+	return result
+}
+
+func Reveal16(io Io, a uint16) uint16 {
+	return uint16(io.Open32(uint32(a)))
+}
+
+func Zext8_16(io Io, a uint8) uint16 {
+	return uint16(a)
+}
+
+func Zext16_32(io Io, a uint16) uint32 {
+	return uint32(a)
+}
+
+func Zext16_64(io Io, a uint16) uint64 {
+	return uint64(a)
+}
+
+func Switch16(io Io, s, dflt uint16, cases ...uint16) uint16 {
+	cases32 := make([]uint32, len(cases))
+	for i, c := range cases {
+		cases32[i] = uint32(c)
+	}
+	return uint16(Switch32(io, uint32(s), uint32(dflt), cases32...))
+}
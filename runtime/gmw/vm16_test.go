@@ -0,0 +1,41 @@
+package gmw
+
+import (
+	"context"
+	"github.com/tjim/smpcc/runtime/input"
+	"testing"
+)
+
+// TestVM16 runs the 16 bit functions on inputs of 3 parties, with a
+// negative value for the signed comparisons, and input_bytes.
+func TestVM16(t *testing.T) {
+	inputs := []*input.Source{
+		input.NewSource([]input.Value{{X: 0xfff0}}), // -16
+		input.NewSource([]input.Value{{X: 300}}),
+		input.NewSource([]input.Value{{Kind: input.Bytes, Data: []byte{0x34, 0x12}}}),
+	}
+	results, err := Simulation(context.Background(), inputs, 0, func(io Io, ios []Io) {
+		a := Input16(io, true, Uint32(io, 0))
+		b := Input16(io, true, Uint32(io, 1))
+		c := uint16(InputPacked(io, true, Uint32(io, 2), 2))
+		Output16(io, Add16(io, Mul16(io, a, b), c))
+		Output1(io, Icmp_slt16(io, a, b))
+		Output1(io, Icmp_ugt16(io, a, b))
+		Output16(io, Ashr16(io, Select16(io, Icmp_eq16(io, c, Uint16(io, 0x1234)), a, b), 2))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{0xff74, 1, 1, 0xfffc} // -16*300 + 0x1234 = -140
+	for p := range inputs {
+		outputs := results.Party(p)
+		if len(outputs) != len(want) {
+			t.Fatalf("party %d: %d outputs, want %d", p, len(outputs), len(want))
+		}
+		for i, o := range outputs {
+			if o.Value != want[i] {
+				t.Errorf("party %d: output %d is 0x%x, want 0x%x", p, i, o.Value, want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package input
+
+// Program inputs.
+//
+// A party supplies its inputs as a sequence of values, which the program
+// consumes in order with its input operations (Input8, Input32,
+// InputBytes, etc., in the gc and gmw runtimes).  A value is either an
+// integer or a byte array.  An integer may be typed with a width and
+// signedness, as in int8 or uint64; an untyped integer is accepted by an
+// input operation of any width that can hold it.
+//
+// Values are written as tokens, on the command line or in a CSV file:
+//
+//     42  -7  0xff            untyped integers (any base accepted by strconv)
+//     int16:-300  uint8:200   typed integers
+//     bytes:deadbeef          a byte array, in hex
+//     string:hello            a byte array, the text of the token
+//
+// See ReadJSON for the JSON format.
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrExhausted = errors.New("input: not enough inputs")
+
+type Kind int
+
+const (
+	Int Kind = iota
+	Bytes
+)
+
+type Value struct {
+	Kind   Kind
+	Bits   int    // width of a typed Int: 8, 16, 32, or 64; 0 if untyped
+	Signed bool   // a typed Int is signed, or an untyped Int is negative
+	X      uint64 // an Int, in two's complement
+	Data   []byte // a Bytes
+}
+
+func (v Value) String() string {
+	switch {
+	case v.Kind == Bytes:
+		return "bytes:" + hex.EncodeToString(v.Data)
+	case v.Bits == 0 && v.Signed:
+		return strconv.FormatInt(int64(v.X), 10)
+	case v.Bits == 0:
+		return strconv.FormatUint(v.X, 10)
+	case v.Signed:
+		return fmt.Sprintf("int%d:%d", v.Bits, int64(v.X))
+	default:
+		return fmt.Sprintf("uint%d:%d", v.Bits, v.X)
+	}
+}
+
+// Uint returns v as a bits-wide integer.  A typed Int narrower than bits
+// is sign or zero extended.  It is an error if v is not an Int or does
+// not fit.
+func (v Value) Uint(bits int) (uint64, error) {
+	if v.Kind != Int {
+		return 0, fmt.Errorf("input: expected a %d-bit integer, got %v", bits, v)
+	}
+	if bits <= 0 || bits > 64 {
+		return 0, fmt.Errorf("input: bad width %d", bits)
+	}
+	if v.Bits > bits || (v.Bits == 0 && !fits(v.X, v.Signed, bits)) {
+		return 0, fmt.Errorf("input: %v does not fit in %d bits", v, bits)
+	}
+	return v.X & mask(bits), nil
+}
+
+// Check returns an error unless v can be read as a value of type typ:
+// int8 through uint64 (the width of an input operation), bytes, or string.
+func (v Value) Check(typ string) error {
+	if typ == "bytes" || typ == "string" {
+		if v.Kind != Bytes {
+			return fmt.Errorf("input: expected %s, got %v", typ, v)
+		}
+		return nil
+	}
+	_, bits, err := parseType(typ)
+	if err != nil {
+		return err
+	}
+	_, err = v.Uint(bits)
+	return err
+}
+
+func mask(bits int) uint64 {
+	if bits == 64 {
+		return ^uint64(0)
+	}
+	return (1 << uint(bits)) - 1
+}
+
+// fits reports whether x, a negative number if signed, fits in bits,
+// as either a signed or unsigned integer
+func fits(x uint64, signed bool, bits int) bool {
+	if bits == 64 {
+		return true
+	}
+	if signed {
+		return int64(x) >= -(1 << uint(bits-1))
+	}
+	return x <= mask(bits)
+}
+
+// Source is a sequence of values, consumed in order.  It is safe for
+// concurrent use.
+type Source struct {
+	mu     sync.Mutex
+	values []Value
+}
+
+func NewSource(values []Value) *Source {
+	return &Source{values: values}
+}
+
+// Len returns the number of values not yet consumed.
+func (s *Source) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.values)
+}
+
+func (s *Source) pop() (Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.values) == 0 {
+		return Value{}, ErrExhausted
+	}
+	v := s.values[0]
+	s.values = s.values[1:]
+	return v, nil
+}
+
+// Next consumes the next value as a bits-wide integer, see Value.Uint.
+func (s *Source) Next(bits int) (uint64, error) {
+	v, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return v.Uint(bits)
+}
+
+// NextBytes consumes the next value as a byte array of length n.  A
+// shorter array is padded with zeros.
+func (s *Source) NextBytes(n int) ([]byte, error) {
+	v, err := s.pop()
+	if err != nil {
+		return nil, err
+	}
+	if v.Kind != Bytes {
+		return nil, fmt.Errorf("input: expected %d bytes, got %v", n, v)
+	}
+	if len(v.Data) > n {
+		return nil, fmt.Errorf("input: %d bytes do not fit in %d", len(v.Data), n)
+	}
+	result := make([]byte, n)
+	copy(result, v.Data)
+	return result, nil
+}
+
+// Split returns a Source for each remaining value of s.  In simulation
+// mode party i gets the i'th value.
+func (s *Source) Split() []*Source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]*Source, len(s.values))
+	for i, v := range s.values {
+		result[i] = NewSource([]Value{v})
+	}
+	s.values = nil
+	return result
+}
+
+// Parse parses a token; see the package comment.
+func Parse(token string) (Value, error) {
+	token = strings.TrimSpace(token)
+	typ := ""
+	if i := strings.Index(token, ":"); i >= 0 {
+		typ, token = token[:i], token[i+1:]
+	}
+	return parseTyped(typ, token)
+}
+
+// ParseArgs parses each of args as a token.
+func ParseArgs(args []string) ([]Value, error) {
+	result := make([]Value, 0, len(args))
+	for _, arg := range args {
+		v, err := Parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// parseTyped parses literal as a value of type typ, "" for untyped
+func parseTyped(typ, literal string) (Value, error) {
+	switch typ {
+	case "":
+		if strings.HasPrefix(literal, "-") {
+			x, err := strconv.ParseInt(literal, 0, 64)
+			if err != nil {
+				return Value{}, fmt.Errorf("input: %v", err)
+			}
+			return Value{Kind: Int, Signed: true, X: uint64(x)}, nil
+		}
+		x, err := strconv.ParseUint(literal, 0, 64)
+		if err != nil {
+			return Value{}, fmt.Errorf("input: %v", err)
+		}
+		return Value{Kind: Int, X: x}, nil
+	case "bytes":
+		data, err := hex.DecodeString(literal)
+		if err != nil {
+			return Value{}, fmt.Errorf("input: bytes: %v", err)
+		}
+		return Value{Kind: Bytes, Data: data}, nil
+	case "string":
+		return Value{Kind: Bytes, Data: []byte(literal)}, nil
+	}
+	signed, bits, err := parseType(typ)
+	if err != nil {
+		return Value{}, err
+	}
+	if signed {
+		x, err := strconv.ParseInt(literal, 0, bits)
+		if err != nil {
+			return Value{}, fmt.Errorf("input: %s: %v", typ, err)
+		}
+		return Value{Kind: Int, Bits: bits, Signed: true, X: uint64(x)}, nil
+	}
+	x, err := strconv.ParseUint(literal, 0, bits)
+	if err != nil {
+		return Value{}, fmt.Errorf("input: %s: %v", typ, err)
+	}
+	return Value{Kind: Int, Bits: bits, X: x}, nil
+}
+
+// parseType parses an integer type, int8 through uint64
+func parseType(typ string) (signed bool, bits int, err error) {
+	name := strings.TrimPrefix(typ, "u")
+	signed = name == typ
+	switch name {
+	case "int8":
+		bits = 8
+	case "int16":
+		bits = 16
+	case "int32":
+		bits = 32
+	case "int64":
+		bits = 64
+	default:
+		return false, 0, fmt.Errorf("input: unknown type %q", typ)
+	}
+	return signed, bits, nil
+}
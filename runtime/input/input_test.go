@@ -0,0 +1,65 @@
+package input
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNext(t *testing.T) {
+	values, err := ParseArgs([]string{"-1", "0xff", "int8:-2", "uint16:300", "bytes:0102", "string:hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSource(values)
+	check := func(bits int, want uint64) {
+		got, err := s.Next(bits)
+		if err != nil || got != want {
+			t.Errorf("Next(%d) = %x, %v; want %x", bits, got, err, want)
+		}
+	}
+	check(8, 0xff)
+	check(8, 0xff)
+	check(32, 0xfffffffe) // sign extended
+	check(64, 300)
+	if b, err := s.NextBytes(4); err != nil || !bytes.Equal(b, []byte{1, 2, 0, 0}) {
+		t.Errorf("NextBytes = %x, %v", b, err)
+	}
+	if b, err := s.NextBytes(1); err == nil {
+		t.Errorf("NextBytes(1) of 2 bytes = %x", b)
+	}
+	if _, err := s.Next(8); err != ErrExhausted {
+		t.Errorf("Next of empty source: %v", err)
+	}
+}
+
+func TestFit(t *testing.T) {
+	for _, token := range []string{"256", "-129", "int16:1", "bytes:00", "int8:128", "float:1", "12x"} {
+		v, err := Parse(token)
+		if err != nil {
+			continue
+		}
+		if x, err := v.Uint(8); err == nil {
+			t.Errorf("%s accepted as 8 bits: %x", token, x)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	json := `[1, -2, {"type": "uint8", "value": [3, 4]}, "ab", {"type": "bytes", "value": "ff00"}]`
+	csv := "1, -2\n# comment\nuint8:3,uint8:4,string:ab\nbytes:ff00\n"
+	for _, text := range []string{json, csv} {
+		values, err := Read(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, v := range values {
+			got = append(got, v.String())
+		}
+		want := "1 -2 uint8:3 uint8:4 bytes:6162 bytes:ff00"
+		if strings.Join(got, " ") != want {
+			t.Errorf("Read(%q) = %v; want %v", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package input
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadCSV reads values from CSV: each non-empty field is a token, read
+// row by row.  Lines starting with # are comments.
+func ReadCSV(r io.Reader) ([]Value, error) {
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = -1
+	c.TrimLeadingSpace = true
+	c.Comment = '#'
+	var result []Value
+	for {
+		record, err := c.Read()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("input: %v", err)
+		}
+		for _, field := range record {
+			if strings.TrimSpace(field) == "" {
+				continue
+			}
+			v, err := Parse(field)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+	}
+}
+
+// ReadJSON reads values from JSON.  A number is an untyped integer, true
+// and false are 1 and 0, a string is a byte array of its text, and an
+// array stands for its elements in order.  An object
+//
+//	{"type": "int16", "value": -300}
+//
+// gives a type to its value, which may also be an array of values of the
+// type.  The value of type "bytes" is a hex string or an array of
+// numbers, and the value of type "string" is a string.
+func ReadJSON(r io.Reader) ([]Value, error) {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	var result []Value
+	for {
+		var x interface{}
+		err := d.Decode(&x)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("input: %v", err)
+		}
+		result, err = appendJSON(result, "", x)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func appendJSON(result []Value, typ string, x interface{}) ([]Value, error) {
+	switch x := x.(type) {
+	case []interface{}:
+		if typ == "bytes" {
+			data := make([]byte, len(x))
+			for i, e := range x {
+				n, ok := e.(json.Number)
+				if !ok {
+					return nil, fmt.Errorf("input: bytes: %v is not a number", e)
+				}
+				v, err := parseTyped("uint8", n.String())
+				if err != nil {
+					return nil, err
+				}
+				data[i] = byte(v.X)
+			}
+			return append(result, Value{Kind: Bytes, Data: data}), nil
+		}
+		for _, e := range x {
+			var err error
+			result, err = appendJSON(result, typ, e)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case map[string]interface{}:
+		t, ok := x["type"].(string)
+		if !ok || typ != "" {
+			return nil, fmt.Errorf("input: bad object %v", x)
+		}
+		return appendJSON(result, t, x["value"])
+	case json.Number:
+		v, err := parseTyped(typ, x.String())
+		if err != nil {
+			return nil, err
+		}
+		return append(result, v), nil
+	case bool:
+		literal := "0"
+		if x {
+			literal = "1"
+		}
+		v, err := parseTyped(typ, literal)
+		if err != nil {
+			return nil, err
+		}
+		return append(result, v), nil
+	case string:
+		if typ == "" {
+			typ = "string"
+		}
+		if typ != "string" && typ != "bytes" {
+			return nil, fmt.Errorf("input: %s: %q is not a number", typ, x)
+		}
+		v, err := parseTyped(typ, x)
+		if err != nil {
+			return nil, err
+		}
+		return append(result, v), nil
+	}
+	return nil, fmt.Errorf("input: unexpected %v", x)
+}
+
+// Read reads values in JSON if the first character of r is [ or {, and
+// otherwise in CSV.
+func Read(r io.Reader) ([]Value, error) {
+	b := bufio.NewReader(r)
+	for {
+		c, _, err := b.ReadRune()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		b.UnreadRune()
+		if c == '[' || c == '{' {
+			return ReadJSON(b)
+		}
+		return ReadCSV(b)
+	}
+}
+
+// ReadFile reads values from the named file, or from standard input if
+// the name is "-".  The format is given by the extension, .json or .csv,
+// or else guessed as by Read.
+func ReadFile(name string) ([]Value, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return ReadJSON(r)
+	case ".csv":
+		return ReadCSV(r)
+	}
+	return Read(r)
+}
+
+// Load returns a Source of the values in the named file (none if name
+// is ""), followed by the values of the tokens args.
+func Load(name string, args []string) (*Source, error) {
+	var values []Value
+	if name != "" {
+		var err error
+		values, err = ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	more, err := ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return NewSource(append(values, more...)), nil
+}
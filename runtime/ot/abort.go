@@ -0,0 +1,158 @@
+package ot
+
+// abort.go
+// Aborting OT operations
+//
+// The OT interfaces do not return errors; an operation that cannot
+// complete panics with an Abort instead.  This happens when the context
+// of the sender or receiver is done (the computation was aborted, a peer
+// disconnected, or a deadline passed), when a channel to the peer is
+// closed, or when the peer sends a malformed message.  The runtimes
+// recover Aborts and turn them into errors, see Recover.
+
+import (
+	"context"
+	"errors"
+	"math/big"
+)
+
+var ErrClosed = errors.New("ot: channel to peer closed")
+
+// Abort is the panic value of an OT operation that cannot complete.
+type Abort struct {
+	Err error
+}
+
+func (a Abort) Error() string {
+	return a.Err.Error()
+}
+
+// Recover stops a panic caused by an Abort and stores its error in *err.
+// Any other panic continues.  Use it as
+//
+//	defer ot.Recover(&err)
+func Recover(err *error) {
+	if r := recover(); r != nil {
+		a, ok := r.(Abort)
+		if !ok {
+			panic(r)
+		}
+		*err = a.Err
+	}
+}
+
+func abort(err error) {
+	panic(Abort{err})
+}
+
+func abortDone(ctx context.Context) {
+	abort(context.Cause(ctx))
+}
+
+// The remaining functions are channel operations that abort when ctx is
+// done or the channel is closed.
+
+func sendBytes(ctx context.Context, ch chan<- []byte, x []byte) {
+	select {
+	case ch <- x:
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+}
+
+func recvBytes(ctx context.Context, ch <-chan []byte) []byte {
+	select {
+	case x, ok := <-ch:
+		if !ok {
+			abort(ErrClosed)
+		}
+		return x
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+	panic("unreachable")
+}
+
+func sendPair(ctx context.Context, ch chan<- MessagePair, x MessagePair) {
+	select {
+	case ch <- x:
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+}
+
+func recvPair(ctx context.Context, ch <-chan MessagePair) MessagePair {
+	select {
+	case x, ok := <-ch:
+		if !ok {
+			abort(ErrClosed)
+		}
+		return x
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+	panic("unreachable")
+}
+
+func sendSelector(ctx context.Context, ch chan<- Selector, x Selector) {
+	select {
+	case ch <- x:
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+}
+
+func recvSelector(ctx context.Context, ch <-chan Selector) Selector {
+	select {
+	case x, ok := <-ch:
+		if !ok {
+			abort(ErrClosed)
+		}
+		return x
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+	panic("unreachable")
+}
+
+func sendInt(ctx context.Context, ch chan<- *big.Int, x *big.Int) {
+	select {
+	case ch <- x:
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+}
+
+func recvInt(ctx context.Context, ch <-chan *big.Int) *big.Int {
+	select {
+	case x, ok := <-ch:
+		if !ok || x == nil {
+			abort(ErrClosed)
+		}
+		return x
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+	panic("unreachable")
+}
+
+func sendCiph(ctx context.Context, ch chan<- HashedElGamalCiph, x HashedElGamalCiph) {
+	select {
+	case ch <- x:
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+}
+
+func recvCiph(ctx context.Context, ch <-chan HashedElGamalCiph) HashedElGamalCiph {
+	select {
+	case x, ok := <-ch:
+		if !ok || x.C0 == nil {
+			abort(ErrClosed)
+		}
+		return x
+	case <-ctx.Done():
+		abortDone(ctx)
+	}
+	panic("unreachable")
+}
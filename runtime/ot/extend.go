@@ -10,8 +10,10 @@ package ot
 // Modified with preprocessing step
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/tjim/smpcc/runtime/bit"
 	"golang.org/x/crypto/sha3"
@@ -19,6 +21,7 @@ import (
 )
 
 type ExtendSender struct {
+	ctx          context.Context
 	R            Receiver
 	z0, z1       [][]byte
 	m            int
@@ -31,6 +34,7 @@ type ExtendSender struct {
 }
 
 type ExtendReceiver struct {
+	ctx          context.Context
 	S            Sender
 	r            []byte
 	m            int
@@ -41,7 +45,7 @@ type ExtendReceiver struct {
 	T            *bit.Matrix8
 }
 
-func NewExtendSender(c chan []byte, otExtSelChan chan Selector, R Receiver, k, m int) Sender {
+func NewExtendSender(ctx context.Context, c chan []byte, otExtSelChan chan Selector, R Receiver, k, m int) Sender {
 	if k%8 != 0 {
 		panic("k must be a multiple of 8")
 	}
@@ -49,6 +53,7 @@ func NewExtendSender(c chan []byte, otExtSelChan chan Selector, R Receiver, k, m
 		panic("m must be a multiple of 8")
 	}
 	sender := new(ExtendSender)
+	sender.ctx = ctx
 	sender.otExtSelChan = otExtSelChan
 	sender.k = k
 	sender.R = R
@@ -60,7 +65,7 @@ func NewExtendSender(c chan []byte, otExtSelChan chan Selector, R Receiver, k, m
 	return sender
 }
 
-func NewExtendReceiver(c chan []byte, otExtSelChan chan Selector, S Sender, k, m int) Receiver {
+func NewExtendReceiver(ctx context.Context, c chan []byte, otExtSelChan chan Selector, S Sender, k, m int) Receiver {
 	if k%8 != 0 {
 		panic("k must be a multiple of 8")
 	}
@@ -68,6 +73,7 @@ func NewExtendReceiver(c chan []byte, otExtSelChan chan Selector, S Sender, k, m
 		panic("m must be a multiple of 8")
 	}
 	receiver := new(ExtendReceiver)
+	receiver.ctx = ctx
 	receiver.otExtSelChan = otExtSelChan
 	receiver.k = k
 	receiver.S = S
@@ -91,7 +97,7 @@ func (self *ExtendSender) preProcessSender(m int) {
 	for i := 0; i < QT.NumRows; i++ {
 		recvd := self.R.Receive(Selector(bit.GetBit(s, i)))
 		if len(recvd) != self.m/8 {
-			panic(fmt.Sprintf("Incorrect column length received: %d != %d", len(recvd), self.m/8))
+			abort(fmt.Errorf("Incorrect column length received: %d != %d", len(recvd), self.m/8))
 		}
 		QT.SetRow(i, recvd)
 	}
@@ -165,7 +171,7 @@ func (self *ExtendSender) Send(m0, m1 Message) {
 	msglen := len(m0)
 	y0 := make([]byte, msglen)
 	y1 := make([]byte, msglen)
-	smod := <-self.otExtSelChan
+	smod := recvSelector(self.ctx, self.otExtSelChan)
 	if smod == 0 {
 		xorBytes(y0, m0, RO(self.z0[self.curPair], 8*msglen))
 		xorBytes(y1, m1, RO(self.z1[self.curPair], 8*msglen))
@@ -173,10 +179,10 @@ func (self *ExtendSender) Send(m0, m1 Message) {
 		xorBytes(y0, m1, RO(self.z0[self.curPair], 8*msglen))
 		xorBytes(y1, m0, RO(self.z1[self.curPair], 8*msglen))
 	} else {
-		panic("Sender: unexpected smod value")
+		abort(errors.New("Sender: unexpected smod value"))
 	}
-	self.otExtChan <- y0
-	self.otExtChan <- y1
+	sendBytes(self.ctx, self.otExtChan, y0)
+	sendBytes(self.ctx, self.otExtChan, y1)
 	self.curPair++
 	return
 }
@@ -186,11 +192,11 @@ func (self *ExtendReceiver) Receive(s Selector) Message {
 		self.preProcessReceiver(self.m)
 	}
 	smod := Selector(byte(s) ^ bit.GetBit(self.r, self.curPair))
-	self.otExtSelChan <- smod
-	y0 := <-self.otExtChan
-	y1 := <-self.otExtChan
+	sendSelector(self.ctx, self.otExtSelChan, smod)
+	y0 := recvBytes(self.ctx, self.otExtChan)
+	y1 := recvBytes(self.ctx, self.otExtChan)
 	if len(y0) != len(y1) {
-		panic("(*ot.ExtendReceiver).Receive: messages have different length")
+		abort(errors.New("(*ot.ExtendReceiver).Receive: messages have different length"))
 	}
 	msglen := len(y0)
 	w := make([]byte, msglen)
@@ -1,6 +1,9 @@
 package ot
 
-import "math/big"
+import (
+	"context"
+	"math/big"
+)
 
 type NPChans struct {
 	ParamChan  chan *big.Int          `fatchan:"reply"`
@@ -13,14 +16,14 @@ type ExtChans struct {
 	OtExtSelChan chan Selector `fatchan:"reply"`
 }
 
-func NewOTChansSender(npchans NPChans, extchans ExtChans) Sender {
-	baseReceiver := NewNPReceiver(npchans.ParamChan, npchans.NpRecvPk, npchans.NpSendEncs)
-	sender := NewExtendSender(extchans.OtExtChan, extchans.OtExtSelChan, baseReceiver, SEC_PARAM, NUM_PAIRS)
+func NewOTChansSender(ctx context.Context, npchans NPChans, extchans ExtChans) Sender {
+	baseReceiver := NewNPReceiver(ctx, npchans.ParamChan, npchans.NpRecvPk, npchans.NpSendEncs)
+	sender := NewExtendSender(ctx, extchans.OtExtChan, extchans.OtExtSelChan, baseReceiver, SEC_PARAM, NUM_PAIRS)
 	return sender
 }
 
-func NewOTChansReceiver(npchans NPChans, extchans ExtChans) Receiver {
-	baseSender := NewNPSender(npchans.ParamChan, npchans.NpRecvPk, npchans.NpSendEncs)
-	receiver := NewExtendReceiver(extchans.OtExtChan, extchans.OtExtSelChan, baseSender, SEC_PARAM, NUM_PAIRS)
+func NewOTChansReceiver(ctx context.Context, npchans NPChans, extchans ExtChans) Receiver {
+	baseSender := NewNPSender(ctx, npchans.ParamChan, npchans.NpRecvPk, npchans.NpSendEncs)
+	receiver := NewExtendReceiver(ctx, extchans.OtExtChan, extchans.OtExtSelChan, baseSender, SEC_PARAM, NUM_PAIRS)
 	return receiver
 }
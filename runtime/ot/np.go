@@ -11,7 +11,9 @@ package ot
 // This is the "basic oblivious transfer protocol" of section 2.3
 
 import (
+	"context"
 	"crypto/aes"
+	"errors"
 	"log"
 	"math/big"
 	"time"
@@ -31,6 +33,7 @@ type HashedElGamalCiph struct {
 }
 
 type NPSender struct {
+	ctx        context.Context
 	npRecvPk   chan *big.Int
 	npSendEncs chan HashedElGamalCiph
 	npC        chan *big.Int
@@ -38,6 +41,7 @@ type NPSender struct {
 }
 
 type NPReceiver struct {
+	ctx        context.Context
 	npRecvPk   chan *big.Int
 	npSendEncs chan HashedElGamalCiph
 	npC        chan *big.Int
@@ -57,11 +61,13 @@ func GenNPParam() *big.Int {
 	return C
 }
 
-func NewNPSender(npC chan *big.Int,
+func NewNPSender(ctx context.Context,
+	npC chan *big.Int,
 	npRecvPk chan *big.Int,
 	npSendEncs chan HashedElGamalCiph) *NPSender {
 
 	sender := new(NPSender)
+	sender.ctx = ctx
 	sender.npRecvPk = npRecvPk
 	sender.npSendEncs = npSendEncs
 	sender.npC = npC
@@ -69,11 +75,13 @@ func NewNPSender(npC chan *big.Int,
 	return sender
 }
 
-func NewNPReceiver(npC chan *big.Int,
+func NewNPReceiver(ctx context.Context,
+	npC chan *big.Int,
 	npRecvPk chan *big.Int,
 	npSendEncs chan HashedElGamalCiph) *NPReceiver {
 
 	receiver := new(NPReceiver)
+	receiver.ctx = ctx
 	receiver.npRecvPk = npRecvPk
 	receiver.npSendEncs = npSendEncs
 	receiver.npC = npC
@@ -81,13 +89,13 @@ func NewNPReceiver(npC chan *big.Int,
 	return receiver
 }
 
-func NewNP() (*NPSender, *NPReceiver) {
+func NewNP(ctx context.Context) (*NPSender, *NPReceiver) {
 	npC := make(chan *big.Int)
 	npRecvPk := make(chan *big.Int)
 	npSendEncs := make(chan HashedElGamalCiph)
 
-	return NewNPSender(npC, npRecvPk, npSendEncs),
-		NewNPReceiver(npC, npRecvPk, npSendEncs)
+	return NewNPSender(ctx, npC, npRecvPk, npSendEncs),
+		NewNPReceiver(ctx, npC, npRecvPk, npSendEncs)
 }
 
 func (self *NPSender) Send(m0, m1 Message) {
@@ -97,12 +105,12 @@ func (self *NPSender) Send(m0, m1 Message) {
 	}
 	if self.npC != nil {
 		self.C = GenNPParam()
-		self.npC <- self.C
+		sendInt(self.ctx, self.npC, self.C)
 		self.npC = nil
 	}
 	msglen := len(m0)
 	pks := make([]*big.Int, 2)
-	pks[0] = <-self.npRecvPk
+	pks[0] = recvInt(self.ctx, self.npRecvPk)
 	pks[1] = new(big.Int).ModInverse(pks[0], publicParams.P)
 	pks[1].Mul(pks[1], self.C).Mod(pks[1], publicParams.P)
 	r0 := generateNumNonce(publicParams.P)
@@ -114,15 +122,15 @@ func (self *NPSender) Send(m0, m1 Message) {
 	xorBytes(maskedVal1, RO(expModP(pks[1], r1).Bytes(), 8*msglen), m1)
 	e0 := HashedElGamalCiph{C0: gExpModP(r0), C1: maskedVal0}
 	e1 := HashedElGamalCiph{C0: gExpModP(r1), C1: maskedVal1}
-	self.npSendEncs <- e0
-	self.npSendEncs <- e1
+	sendCiph(self.ctx, self.npSendEncs, e0)
+	sendCiph(self.ctx, self.npSendEncs, e1)
 	//	log.Println("Completed run of OTNPSender.Send")
 }
 
 func (self *NPReceiver) Receive(s Selector) Message {
 	//	log.Printf("Starting run of OTNPSender.Receive.\n")
 	if self.npC != nil {
-		self.C = <-self.npC
+		self.C = recvInt(self.ctx, self.npC)
 		self.npC = nil
 	}
 	pks := make([]*big.Int, 2)
@@ -130,10 +138,12 @@ func (self *NPReceiver) Receive(s Selector) Message {
 	pks[s] = gExpModP(k)
 	pks[1-s] = new(big.Int).ModInverse(pks[s], publicParams.P)
 	pks[1-s].Mul(pks[1-s], self.C).Mod(pks[1-s], publicParams.P)
-	self.npRecvPk <- pks[0]
-	ciphs := []HashedElGamalCiph{<-self.npSendEncs, <-self.npSendEncs}
+	sendInt(self.ctx, self.npRecvPk, pks[0])
+	ciph0 := recvCiph(self.ctx, self.npSendEncs)
+	ciph1 := recvCiph(self.ctx, self.npSendEncs)
+	ciphs := []HashedElGamalCiph{ciph0, ciph1}
 	if len(ciphs[0].C1) != len(ciphs[1].C1) {
-		panic("(*ot.NPReceiver).Receive: messages have different lengths")
+		abort(errors.New("(*ot.NPReceiver).Receive: messages have different lengths"))
 	}
 	msglen := len(ciphs[0].C1)
 	res := make([]byte, msglen)
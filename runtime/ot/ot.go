@@ -37,7 +37,7 @@ type PrivateKey struct {
 
 func onError(err error, message string) {
 	if err != nil {
-		panic(fmt.Sprintf("%v: %s", err, message))
+		abort(fmt.Errorf("%s: %v", message, err))
 	}
 }
 
@@ -7,6 +7,7 @@
 package ot
 
 import "bytes"
+import "context"
 import "fmt"
 import "testing"
 
@@ -54,7 +55,7 @@ func receiverBench(x Receiver, b *testing.B) {
 
 // Naor-Pinkas OT
 func pairNaorPinkas(b *testing.B) {
-	s, r := NewNP()
+	s, r := NewNP(context.Background())
 	go senderBench(s, b)
 	go receiverBench(r, b)
 }
@@ -70,7 +71,7 @@ func BenchmarkNaorPinkas(b *testing.B) {
 }
 
 func pairNaorPinkasM(b *testing.B) {
-	s, r := NewNP()
+	s, r := NewNP(context.Background())
 	go senderBenchM(s, b)
 	go receiverBenchM(r, b)
 }
@@ -89,12 +90,12 @@ func BenchmarkNaorPinkasM(b *testing.B) {
 func pairExtend(b *testing.B) {
 	k := 80
 	m := 1024
-	baseSender, baseReceiver := NewNP()
+	baseSender, baseReceiver := NewNP(context.Background())
 	OtExtChan := make(chan []byte)
 	OtExtSelChan := make(chan Selector)
 
-	s := NewExtendSender(OtExtChan, OtExtSelChan, baseReceiver, k, m)
-	r := NewExtendReceiver(OtExtChan, OtExtSelChan, baseSender, k, m)
+	s := NewExtendSender(context.Background(), OtExtChan, OtExtSelChan, baseReceiver, k, m)
+	r := NewExtendReceiver(context.Background(), OtExtChan, OtExtSelChan, baseSender, k, m)
 
 	go senderBench(s, b)
 	go receiverBench(r, b)
@@ -123,7 +124,7 @@ func pairMplex(chS chan getRequest, chR chan nextRequest, b *testing.B) {
 func BenchmarkMplex(b *testing.B) {
 	k := 80
 	m := 1024
-	baseSender, baseReceiver := NewNP()
+	baseSender, baseReceiver := NewNP(context.Background())
 	refreshCh := make(chan int)
 
 	chS := PrimarySender(baseReceiver, refreshCh, k, m)
@@ -188,14 +189,17 @@ func BenchmarkStream(b *testing.B) {
 	// create sender and receiver
 	r2s := make(chan []byte)
 	s2r := make(chan MessagePair)
-	BaseS, BaseR := NewNP()
+	BaseS, BaseR := NewNP(context.Background())
 	var S *StreamSender
 	go func() {
-		S = NewStreamSender(BaseR, s2r, r2s)
+		S, _ = NewStreamSender(context.Background(), BaseR, s2r, r2s)
 		done <- true
 	}()
-	R := NewStreamReceiver(BaseS, r2s, s2r)
+	R, err := NewStreamReceiver(context.Background(), BaseS, r2s, s2r)
 	<-done
+	if err != nil || S == nil {
+		b.Fatal("stream OT setup failed")
+	}
 
 	for i := 0; i < PAIRS; i++ {
 		pairStream(b, S, R)
@@ -246,14 +250,17 @@ func BenchmarkStreamBits(b *testing.B) {
 	// create sender and receiver
 	r2s := make(chan []byte)
 	s2r := make(chan MessagePair)
-	BaseS, BaseR := NewNP()
+	BaseS, BaseR := NewNP(context.Background())
 	var S *StreamSender
 	go func() {
-		S = NewStreamSender(BaseR, s2r, r2s)
+		S, _ = NewStreamSender(context.Background(), BaseR, s2r, r2s)
 		done <- true
 	}()
-	R := NewStreamReceiver(BaseS, r2s, s2r)
+	R, err := NewStreamReceiver(context.Background(), BaseS, r2s, s2r)
 	<-done
+	if err != nil || S == nil {
+		b.Fatal("stream OT setup failed")
+	}
 
 	for i := 0; i < PAIRS; i++ {
 		pairStreamBits(b, S, R)
@@ -304,14 +311,17 @@ func BenchmarkRandomBits(b *testing.B) {
 	// create sender and receiver
 	r2s := make(chan []byte)
 	s2r := make(chan MessagePair)
-	BaseS, BaseR := NewNP()
+	BaseS, BaseR := NewNP(context.Background())
 	var S *StreamSender
 	go func() {
-		S = NewStreamSender(BaseR, s2r, r2s)
+		S, _ = NewStreamSender(context.Background(), BaseR, s2r, r2s)
 		done <- true
 	}()
-	R := NewStreamReceiver(BaseS, r2s, s2r)
+	R, err := NewStreamReceiver(context.Background(), BaseS, r2s, s2r)
 	<-done
+	if err != nil || S == nil {
+		b.Fatal("stream OT setup failed")
+	}
 
 	for i := 0; i < PAIRS; i++ {
 		pairRandomBits(b, S, R)
@@ -321,3 +331,38 @@ func BenchmarkRandomBits(b *testing.B) {
 		<-done
 	}
 }
+
+// A receiver whose sender has gone away must abort rather than block
+func TestStreamAbort(t *testing.T) {
+	r2s := make(chan []byte)
+	s2r := make(chan MessagePair)
+	ctx, cancel := context.WithCancel(context.Background())
+	BaseS, BaseR := NewNP(ctx)
+	var S *StreamSender
+	go func() {
+		S, _ = NewStreamSender(ctx, BaseR, s2r, r2s)
+		done <- true
+	}()
+	R, err := NewStreamReceiver(ctx, BaseS, r2s, s2r)
+	<-done
+	if err != nil || S == nil {
+		t.Fatal("stream OT setup failed")
+	}
+	go func() {
+		<-r2s // the sender reads the request and then disappears
+		cancel()
+	}()
+	err = func() (err error) {
+		defer Recover(&err)
+		R.ReceiveM(make([]byte, 1))
+		return nil
+	}()
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// setup fails with an error once the context is done
+	if _, err := NewStreamReceiver(ctx, BaseS, r2s, s2r); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
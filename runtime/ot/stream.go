@@ -56,9 +56,11 @@ the implementation might correspond to a "column" in the notes above.
 */
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/tjim/smpcc/runtime/bit"
 )
@@ -112,13 +114,17 @@ type MessagePair struct {
 }
 
 type StreamReceiver struct {
+	ctx     context.Context
 	tStream []cipher.Stream
 	vStream []cipher.Stream
 	to      chan<- []byte
 	from    <-chan MessagePair
 }
 
-func NewStreamReceiver(sender Sender, to chan<- []byte, from <-chan MessagePair) *StreamReceiver {
+// NewStreamReceiver runs the setup phase using sender for base OTs.
+// The receiver and its forks abort when ctx is done.
+func NewStreamReceiver(ctx context.Context, sender Sender, to chan<- []byte, from <-chan MessagePair) (result *StreamReceiver, err error) {
+	defer Recover(&err)
 	k := NumStreams
 	tStream := make([]cipher.Stream, k)
 	vStream := make([]cipher.Stream, k)
@@ -129,10 +135,11 @@ func NewStreamReceiver(sender Sender, to chan<- []byte, from <-chan MessagePair)
 		tStream[i] = NewPRG(tSeed)
 		vStream[i] = NewPRG(vSeed)
 	}
-	return &StreamReceiver{tStream, vStream, to, from}
+	return &StreamReceiver{ctx, tStream, vStream, to, from}, nil
 }
 
 type StreamSender struct {
+	ctx     context.Context
 	sPacked []byte // one byte per 8 bits of s
 	sWide   []byte // one byte per bit of s, either 0x00 or 0xff
 	wStream []cipher.Stream
@@ -140,7 +147,10 @@ type StreamSender struct {
 	from    <-chan []byte
 }
 
-func NewStreamSender(receiver Receiver, to chan<- MessagePair, from <-chan []byte) *StreamSender {
+// NewStreamSender runs the setup phase using receiver for base OTs.
+// The sender and its forks abort when ctx is done.
+func NewStreamSender(ctx context.Context, receiver Receiver, to chan<- MessagePair, from <-chan []byte) (result *StreamSender, err error) {
+	defer Recover(&err)
 	k := NumStreams
 	sPacked := randomBits(k)
 	sWide := make([]byte, k)
@@ -156,7 +166,7 @@ func NewStreamSender(receiver Receiver, to chan<- MessagePair, from <-chan []byt
 		wSeed := receiver.Receive(Selector(bit.GetBit(sPacked, i)))
 		wStream[i] = NewPRG(wSeed)
 	}
-	return &StreamSender{sPacked, sWide, wStream, to, from}
+	return &StreamSender{ctx, sPacked, sWide, wStream, to, from}, nil
 }
 
 // Bitwise MUX of byte sequences a and b, according to byte sequence c.
@@ -215,9 +225,9 @@ func (S *StreamSender) SendM(a, b []Message) {
 	if len(b) != m {
 		panic("SendM: must send pairs of messages")
 	}
-	u := &bit.Matrix8{k, m, <-S.from} // k rows, m columns
+	u := &bit.Matrix8{k, m, recvBytes(S.ctx, S.from)} // k rows, m columns
 	if len(u.Data) != k*(m/8) {
-		panic("SendM: wrong size matrix u")
+		abort(errors.New("SendM: wrong size matrix u"))
 	}
 	q := u // q starts off as u
 	for i := 0; i < k; i++ {
@@ -237,7 +247,7 @@ func (S *StreamSender) SendM(a, b []Message) {
 		m0 := XorBytes(a[j], RO(q.GetRow(j), l))
 		m1 := XorBytes(b[j],
 			RO(XorBytes(q.GetRow(j), S.sPacked), l))
-		S.to <- MessagePair{m0, m1}
+		sendPair(S.ctx, S.to, MessagePair{m0, m1})
 	}
 }
 
@@ -258,15 +268,15 @@ func (R *StreamReceiver) ReceiveM(r []byte) []Message { // r is a packed vector
 		R.vStream[i].XORKeyStream(u.GetRow(i), u.GetRow(i)) // u = t XOR v
 		XorBytesTo(r, u.GetRow(i), u.GetRow(i))             // u = (t XOR v) XOR r
 	}
-	R.to <- u.Data
+	sendBytes(R.ctx, R.to, u.Data)
 	result := make([]Message, m)
 	for j := 0; j < m; j++ {
-		msgs := <-R.from
+		msgs := recvPair(R.ctx, R.from)
 		m0 := msgs.M0
 		m1 := msgs.M1
 		l := 8 * len(m0)
 		if l != 8*len(m1) {
-			panic("ReceiveM: pairs must have the same length")
+			abort(errors.New("ReceiveM: pairs must have the same length"))
 		}
 		if bit.GetBit(r, j) == 0 {
 			result[j] = XorBytes(m0, RO(t.GetRow(j), l))
@@ -284,9 +294,9 @@ func (S *StreamSender) SendMBits(a, b []byte) { // messages are packed in bytes
 	if 8*len(b) != m {
 		panic("SendMBits: must send pairs of messages")
 	}
-	u := &bit.Matrix8{k, m, <-S.from} // k rows, m columns
+	u := &bit.Matrix8{k, m, recvBytes(S.ctx, S.from)} // k rows, m columns
 	if 8*len(u.Data) != k*m {
-		panic("SendMBits: wrong size matrix u")
+		abort(errors.New("SendMBits: wrong size matrix u"))
 	}
 	q := u // q starts off as u
 	for i := 0; i < k; i++ {
@@ -312,7 +322,7 @@ func (S *StreamSender) SendMBits(a, b []byte) { // messages are packed in bytes
 			m1[jByte] ^= mask & RO(XorBytes(q_j, S.sPacked), 8)[0]
 		}
 	}
-	S.to <- MessagePair{m0, m1}
+	sendPair(S.ctx, S.to, MessagePair{m0, m1})
 }
 
 func (R *StreamReceiver) ReceiveMBits(r []byte) []byte { // r is a packed vector of selections and result is packed as well
@@ -332,11 +342,14 @@ func (R *StreamReceiver) ReceiveMBits(r []byte) []byte { // r is a packed vector
 		R.vStream[i].XORKeyStream(u.GetRow(i), u.GetRow(i)) // u = t XOR v
 		XorBytesTo(r, u.GetRow(i), u.GetRow(i))             // u = (t XOR v) XOR r
 	}
-	R.to <- u.Data
+	sendBytes(R.ctx, R.to, u.Data)
 	result := make([]byte, m/8)
-	msgs := <-R.from
+	msgs := recvPair(R.ctx, R.from)
 	m0 := msgs.M0
 	m1 := msgs.M1
+	if len(m0) != len(result) || len(m1) != len(result) {
+		abort(errors.New("ReceiveMBits: wrong size messages"))
+	}
 	for jByte := range m0 {
 		// instead of unpacking and packing each message bit we just xor in place, using an appropriate bit of the hash
 		for jBit := 0; jBit < 8; jBit++ {
@@ -359,9 +372,9 @@ func (S *StreamSender) SendMRandomBits(m int) ([]byte, []byte) { // resulting bi
 	if m%8 != 0 {
 		panic("SendMRandomBits: number of messages must be a multiple of 8")
 	}
-	u := &bit.Matrix8{k, m, <-S.from} // k rows, m columns
+	u := &bit.Matrix8{k, m, recvBytes(S.ctx, S.from)} // k rows, m columns
 	if 8*len(u.Data) != k*m {
-		panic("SendMRandomBits: wrong size matrix u")
+		abort(errors.New("SendMRandomBits: wrong size matrix u"))
 	}
 	q := u // q starts off as u
 	for i := 0; i < k; i++ {
@@ -405,7 +418,7 @@ func (R *StreamReceiver) ReceiveMRandomBits(r []byte) []byte { // r is a packed
 		R.vStream[i].XORKeyStream(u.GetRow(i), u.GetRow(i)) // u = t XOR v
 		XorBytesTo(r, u.GetRow(i), u.GetRow(i))             // u = (t XOR v) XOR r
 	}
-	R.to <- u.Data
+	sendBytes(R.ctx, R.to, u.Data)
 	result := make([]byte, m/8)
 	for jByte := range result {
 		// instead of unpacking and packing each message bit we just xor in place, using an appropriate bit of the hash
@@ -429,7 +442,7 @@ func (S *StreamSender) Fork(to chan<- MessagePair, from chan []byte) *StreamSend
 		wSeed := bytesFrom(v, SeedBytes)
 		wStream[i] = NewPRG(wSeed)
 	}
-	return &StreamSender{sPacked, sWide, wStream, to, from}
+	return &StreamSender{S.ctx, sPacked, sWide, wStream, to, from}
 }
 
 // Create a new StreamReceiver that can operate independently of the parent StreamReceiver (concurrent operation).
@@ -445,7 +458,7 @@ func (R *StreamReceiver) Fork(to chan []byte, from chan MessagePair) *StreamRece
 		vSeed := bytesFrom(v, SeedBytes)
 		vStream[i] = NewPRG(vSeed)
 	}
-	return &StreamReceiver{tStream, vStream, to, from}
+	return &StreamReceiver{R.ctx, tStream, vStream, to, from}
 }
 
 func PrintBytes(r []byte) {
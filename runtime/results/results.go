@@ -0,0 +1,79 @@
+// Package results collects the outputs of a computation, for every
+// backend.
+package results
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// An Output is a value delivered to a party by one of the Output functions
+// of a backend.
+type Output struct {
+	Party int    `json:"party"` // the party that received the value
+	Bits  int    `json:"bits"`
+	Value uint64 `json:"value"`
+}
+
+// Results collects the outputs of a computation, in the order that they
+// were delivered.  Outputs delivered to several parties appear once for
+// each party that is part of the computation in this process.
+type Results struct {
+	mu      sync.Mutex
+	outputs []Output
+}
+
+func NewResults() *Results {
+	return &Results{}
+}
+
+// Add collects x.
+func (r *Results) Add(x Output) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs = append(r.outputs, x)
+}
+
+// Outputs returns all of the outputs collected so far.
+func (r *Results) Outputs() []Output {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Output{}, r.outputs...)
+}
+
+// Party returns the outputs delivered to party id.
+func (r *Results) Party(id int) []Output {
+	var result []Output
+	for _, x := range r.Outputs() {
+		if x.Party == id {
+			result = append(result, x)
+		}
+	}
+	return result
+}
+
+func (r *Results) MarshalJSON() ([]byte, error) {
+	outputs := r.Outputs()
+	if outputs == nil {
+		outputs = []Output{}
+	}
+	return json.Marshal(struct {
+		Outputs []Output `json:"outputs"`
+	}{outputs})
+}
+
+// WriteFile writes the results as JSON to the named file, or to standard
+// output if the name is "-".
+func (r *Results) WriteFile(name string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if name == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(name, b, 0644)
+}
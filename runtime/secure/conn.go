@@ -0,0 +1,276 @@
+package secure
+
+// A secure channel over a stream connection.
+//
+// Each party has a static curve25519 key pair, and each party knows the
+// static public key of its peer in advance (from a config file).  The
+// handshake is a triple Diffie-Hellman in the style of the Noise KK
+// pattern:
+//
+//     initiator -> responder   e_I
+//     responder -> initiator   e_R
+//
+// Both sides then compute
+//
+//     DH(e_I, e_R) || DH(s_I, e_R) || DH(e_I, s_R)
+//
+// and derive a pair of directional AES-GCM keys from it with HKDF, using
+// a hash of the transcript (both static and both ephemeral keys) as salt.
+// Only the holder of s_I can compute the second term and only the holder
+// of s_R can compute the third, so a peer that completes the handshake is
+// authenticated.  The ephemeral terms give forward secrecy.  Each side
+// finishes the handshake by sending an encrypted confirmation record,
+// which its peer must be able to open before any data is accepted.
+//
+// After the handshake every Write is sent as one or more records
+//
+//     length (4 bytes, big endian) || AES-GCM ciphertext
+//
+// with a per-direction counter as the nonce, so records cannot be
+// replayed, reordered, or dropped without detection.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/sha3"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	maxRecord     = 1 << 16 // maximum plaintext bytes per record
+	handshakeInfo = "smpcc secure channel v1"
+)
+
+var (
+	ErrAuthentication = errors.New("secure: peer authentication failed")
+	ErrRecordTooLarge = errors.New("secure: record too large")
+)
+
+// Conn is a net.Conn whose traffic is encrypted and authenticated.
+type Conn struct {
+	net.Conn
+
+	rmu     sync.Mutex
+	rcipher cipher.AEAD
+	rseq    uint64
+	rbuf    bytes.Buffer
+
+	wmu     sync.Mutex
+	wcipher cipher.AEAD
+	wseq    uint64
+}
+
+// Client runs the initiator side of the handshake over conn.
+func Client(conn net.Conn, me *Keys, peer *[32]byte) (*Conn, error) {
+	return handshake(conn, me, peer, true)
+}
+
+// Server runs the responder side of the handshake over conn.
+func Server(conn net.Conn, me *Keys, peer *[32]byte) (*Conn, error) {
+	return handshake(conn, me, peer, false)
+}
+
+func dh(scalar *[32]byte, point []byte) ([]byte, error) {
+	result, err := curve25519.X25519(scalar[:], point)
+	if err != nil {
+		return nil, ErrAuthentication // low-order point from peer
+	}
+	return result, nil
+}
+
+func handshake(conn net.Conn, me *Keys, peer *[32]byte, initiator bool) (*Conn, error) {
+	if me == nil || peer == nil {
+		return nil, errors.New("secure: missing keys")
+	}
+	ephemeral, err := GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	peerEphemeral := make([]byte, 32)
+	if initiator {
+		if _, err := conn.Write(ephemeral.Public[:]); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, peerEphemeral); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := io.ReadFull(conn, peerEphemeral); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(ephemeral.Public[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// terms are computed so that both sides arrive at the same order:
+	// DH(e_I, e_R), DH(s_I, e_R), DH(e_I, s_R)
+	ee, err := dh(ephemeral.Private, peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	var se, es []byte
+	var transcript []byte
+	if initiator {
+		se, err = dh(me.Private, peerEphemeral)
+		if err == nil {
+			es, err = dh(ephemeral.Private, peer[:])
+		}
+		transcript = concat(me.Public[:], peer[:], ephemeral.Public[:], peerEphemeral)
+	} else {
+		se, err = dh(ephemeral.Private, peer[:])
+		if err == nil {
+			es, err = dh(me.Private, peerEphemeral)
+		}
+		transcript = concat(peer[:], me.Public[:], peerEphemeral, ephemeral.Public[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	salt := sha3.Sum256(transcript)
+	kdf := hkdf.New(sha3.New256, concat(ee, se, es), salt[:], []byte(handshakeInfo))
+	i2r := make([]byte, 32)
+	r2i := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, i2r); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(kdf, r2i); err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: conn}
+	if initiator {
+		c.wcipher, err = newAEAD(i2r)
+		if err == nil {
+			c.rcipher, err = newAEAD(r2i)
+		}
+	} else {
+		c.wcipher, err = newAEAD(r2i)
+		if err == nil {
+			c.rcipher, err = newAEAD(i2r)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// key confirmation, initiator first so that unbuffered transports work
+	if initiator {
+		if err := c.writeRecord(salt[:]); err != nil {
+			return nil, err
+		}
+		if err := c.confirm(salt[:]); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := c.confirm(salt[:]); err != nil {
+			return nil, err
+		}
+		if err := c.writeRecord(salt[:]); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Conn) confirm(expected []byte) error {
+	confirmation, err := c.readRecord()
+	if err != nil || subtle.ConstantTimeCompare(confirmation, expected) != 1 {
+		return ErrAuthentication
+	}
+	return nil
+}
+
+func concat(xs ...[]byte) []byte {
+	var result []byte
+	for _, x := range xs {
+		result = append(result, x...)
+	}
+	return result
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(aead cipher.AEAD, seq uint64) []byte {
+	result := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(result[len(result)-8:], seq)
+	return result
+}
+
+// writeRecord must be called with wmu held (or before the Conn is shared)
+func (c *Conn) writeRecord(plaintext []byte) error {
+	ciphertext := c.wcipher.Seal(nil, nonce(c.wcipher, c.wseq), plaintext, nil)
+	c.wseq++
+	record := make([]byte, 4+len(ciphertext))
+	binary.BigEndian.PutUint32(record, uint32(len(ciphertext)))
+	copy(record[4:], ciphertext)
+	_, err := c.Conn.Write(record)
+	return err
+}
+
+// readRecord must be called with rmu held (or before the Conn is shared)
+func (c *Conn) readRecord() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxRecord+uint32(c.rcipher.Overhead()) {
+		return nil, ErrRecordTooLarge
+	}
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(c.Conn, ciphertext); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.rcipher.Open(nil, nonce(c.rcipher, c.rseq), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("secure: record %d: %v", c.rseq, err)
+	}
+	c.rseq++
+	return plaintext, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.rbuf.Len() == 0 {
+		plaintext, err := c.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf.Write(plaintext)
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxRecord {
+			chunk = chunk[:maxRecord]
+		}
+		if err := c.writeRecord(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
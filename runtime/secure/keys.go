@@ -0,0 +1,94 @@
+package secure
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"os"
+	"strings"
+)
+
+// Keys is the long-term (static) key pair of a party.  The keys are
+// curve25519 keys, the same kind that nacl/box uses, so a party can use
+// one key pair for both chat and the direct network runtimes.
+type Keys struct {
+	Public  *[32]byte
+	Private *[32]byte
+}
+
+var ErrMalformedKey = errors.New("malformed key")
+
+func GenerateKeys() (*Keys, error) {
+	var private [32]byte
+	if _, err := rand.Read(private[:]); err != nil {
+		return nil, err
+	}
+	return KeysFromPrivate(&private), nil
+}
+
+func KeysFromPrivate(private *[32]byte) *Keys {
+	var public [32]byte
+	curve25519.ScalarBaseMult(&public, private)
+	return &Keys{&public, private}
+}
+
+// MarshalPublicKey renders a key as 64 lowercase hexadecimal digits.
+// This is the format used for keys in chat and in config files.
+func MarshalPublicKey(c *[32]byte) string {
+	return hex.EncodeToString((*c)[:])
+}
+
+func UnmarshalPublicKey(s string) (*[32]byte, error) {
+	if len(s) != 64 {
+		return nil, fmt.Errorf("%v: wrong length", ErrMalformedKey)
+	}
+	for _, v := range s {
+		switch v {
+		default:
+			return nil, fmt.Errorf("%v: not lowercase hexadecimal", ErrMalformedKey)
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f':
+		}
+	}
+	var result [32]byte
+	byteVal, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	copy(result[:], byteVal)
+	return &result, nil
+}
+
+// ReadKeys reads a private key file, which holds the private key in the
+// same hexadecimal format as MarshalPublicKey, and derives the public key.
+func ReadKeys(filename string) (*Keys, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		private, err := UnmarshalPublicKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		return KeysFromPrivate(private), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%s: no key found", filename)
+}
+
+// WriteKeys writes the private key of k to filename, readable only by its owner.
+func WriteKeys(filename string, k *Keys) error {
+	contents := fmt.Sprintf("# public %s\n%s\n", MarshalPublicKey(k.Public), MarshalPublicKey(k.Private))
+	return os.WriteFile(filename, []byte(contents), 0600)
+}
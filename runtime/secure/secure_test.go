@@ -0,0 +1,73 @@
+package secure
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func pair(client, server *Keys, clientExpects, serverExpects *[32]byte) (*Conn, *Conn, error, error) {
+	a, b := net.Pipe()
+	type result struct {
+		c   *Conn
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		c, err := Server(b, server, serverExpects)
+		if err != nil {
+			b.Close()
+		}
+		done <- result{c, err}
+	}()
+	c, err := Client(a, client, clientExpects)
+	if err != nil {
+		a.Close()
+	}
+	r := <-done
+	return c, r.c, err, r.err
+}
+
+func TestRoundTrip(t *testing.T) {
+	alice, _ := GenerateKeys()
+	bob, _ := GenerateKeys()
+	c, s, err1, err2 := pair(alice, bob, bob.Public, alice.Public)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("handshake: %v, %v", err1, err2)
+	}
+	msg := bytes.Repeat([]byte("garbled table "), 10000) // spans several records
+	go func() {
+		c.Write(msg)
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("message corrupted in transit")
+	}
+}
+
+func TestWrongPeer(t *testing.T) {
+	alice, _ := GenerateKeys()
+	bob, _ := GenerateKeys()
+	mallory, _ := GenerateKeys()
+	// alice expects bob but is talking to mallory
+	_, _, err1, err2 := pair(alice, mallory, bob.Public, alice.Public)
+	if err1 == nil && err2 == nil {
+		t.Errorf("handshake with impostor succeeded")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	k, _ := GenerateKeys()
+	s := MarshalPublicKey(k.Public)
+	p, err := UnmarshalPublicKey(s)
+	if err != nil || *p != *k.Public {
+		t.Errorf("round trip failed: %v", err)
+	}
+	if _, err := UnmarshalPublicKey("ABCD"); err == nil {
+		t.Errorf("accepted malformed key")
+	}
+}
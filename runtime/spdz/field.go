@@ -0,0 +1,194 @@
+package spdz
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/bits"
+)
+
+// A Field is a finite field with elements of type E, for the shares of
+// FieldShare, which need a large prime field, and of bgw.  Elements are
+// values: the operations return new elements and do not change their
+// arguments.
+type Field[E any] interface {
+	Zero() E
+	One() E
+	FromUint64(v uint64) E
+	Add(a, b E) E
+	Sub(a, b E) E
+	Mul(a, b E) E
+	Inv(a E) E // panics if a is zero
+	Equal(a, b E) bool
+	Random(r io.Reader) E // uniform, reading randomness from r
+	Words() int           // the number of words of an element on the wire
+	ToWords(a E, w []uint64)
+	FromWords(w []uint64) (E, error) // rejects a value that is not reduced
+}
+
+// Mersenne61 is the field modulo the Mersenne prime 2^61-1, with elements
+// in uint64.  Its products reduce with shifts and adds.
+type Mersenne61 struct{}
+
+const p61 = 1<<61 - 1
+
+func (Mersenne61) reduce(x uint64) uint64 {
+	x = x&p61 + x>>61
+	if x >= p61 {
+		x -= p61
+	}
+	return x
+}
+
+func (Mersenne61) Zero() uint64 { return 0 }
+func (Mersenne61) One() uint64  { return 1 }
+
+func (f Mersenne61) FromUint64(v uint64) uint64 { return f.reduce(v) }
+func (f Mersenne61) Add(a, b uint64) uint64     { return f.reduce(a + b) }
+func (f Mersenne61) Sub(a, b uint64) uint64     { return f.reduce(a + p61 - b) }
+func (Mersenne61) Equal(a, b uint64) bool       { return a == b }
+func (Mersenne61) Words() int                   { return 1 }
+func (Mersenne61) ToWords(a uint64, w []uint64) { w[0] = a }
+
+func (f Mersenne61) Mul(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b) // < 2^122
+	return f.reduce(lo&p61 + (lo>>61 | hi<<3))
+}
+
+func (f Mersenne61) Inv(a uint64) uint64 {
+	if a == 0 {
+		panic("Inv: zero")
+	}
+	result := uint64(1)
+	for e := uint64(p61 - 2); e > 0; e >>= 1 {
+		if e&1 == 1 {
+			result = f.Mul(result, a)
+		}
+		a = f.Mul(a, a)
+	}
+	return result
+}
+
+func (Mersenne61) Random(r io.Reader) uint64 {
+	var b [8]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			panic("Error: random number generation")
+		}
+		if v := binary.BigEndian.Uint64(b[:]) >> 3; v < p61 {
+			return v
+		}
+	}
+}
+
+func (Mersenne61) FromWords(w []uint64) (uint64, error) {
+	if w[0] >= p61 {
+		return 0, fmt.Errorf("0x%x is not reduced modulo 2^61-1", w[0])
+	}
+	return w[0], nil
+}
+
+// PrimeField is the field modulo a prime of any size, with elements in
+// math/big.
+type PrimeField struct {
+	P     *big.Int
+	words int
+}
+
+// NewPrimeField returns the field modulo p, which must be prime.
+func NewPrimeField(p *big.Int) (*PrimeField, error) {
+	if p.Sign() <= 0 || !p.ProbablyPrime(20) {
+		return nil, fmt.Errorf("%v is not prime", p)
+	}
+	return &PrimeField{new(big.Int).Set(p), (p.BitLen() + 63) / 64}, nil
+}
+
+// P127 returns the field modulo the Mersenne prime 2^127-1.
+func P127() *PrimeField {
+	p := new(big.Int).Lsh(big.NewInt(1), 127)
+	f, err := NewPrimeField(p.Sub(p, big.NewInt(1)))
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (f *PrimeField) Zero() *big.Int { return new(big.Int) }
+func (f *PrimeField) One() *big.Int  { return big.NewInt(1) }
+func (f *PrimeField) Words() int     { return f.words }
+
+func (f *PrimeField) FromUint64(v uint64) *big.Int {
+	x := new(big.Int).SetUint64(v)
+	return x.Mod(x, f.P)
+}
+
+func (f *PrimeField) Add(a, b *big.Int) *big.Int {
+	x := new(big.Int).Add(a, b)
+	return x.Mod(x, f.P)
+}
+
+func (f *PrimeField) Sub(a, b *big.Int) *big.Int {
+	x := new(big.Int).Sub(a, b)
+	return x.Mod(x, f.P)
+}
+
+func (f *PrimeField) Mul(a, b *big.Int) *big.Int {
+	x := new(big.Int).Mul(a, b)
+	return x.Mod(x, f.P)
+}
+
+func (f *PrimeField) Inv(a *big.Int) *big.Int {
+	x := new(big.Int).ModInverse(a, f.P)
+	if x == nil {
+		panic("Inv: zero")
+	}
+	return x
+}
+
+func (f *PrimeField) Equal(a, b *big.Int) bool {
+	return a.Cmp(b) == 0
+}
+
+func (f *PrimeField) Random(r io.Reader) *big.Int {
+	x, err := rand.Int(r, f.P)
+	if err != nil {
+		panic("Error: random number generation")
+	}
+	return x
+}
+
+func (f *PrimeField) ToWords(a *big.Int, w []uint64) {
+	b := a.FillBytes(make([]byte, 8*f.words))
+	for i := range w {
+		w[i] = binary.BigEndian.Uint64(b[8*i:])
+	}
+}
+
+func (f *PrimeField) FromWords(w []uint64) (*big.Int, error) {
+	b := make([]byte, 8*len(w))
+	for i, v := range w {
+		binary.BigEndian.PutUint64(b[8*i:], v)
+	}
+	x := new(big.Int).SetBytes(b)
+	if x.Cmp(f.P) >= 0 {
+		return nil, errors.New("element is not reduced modulo the prime")
+	}
+	return x, nil
+}
+
+// prg is a reader of the pseudorandom stream of a cipher
+type prg struct {
+	s cipher.Stream
+}
+
+func (r prg) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	r.s.XORKeyStream(b, b)
+	return len(b), nil
+}
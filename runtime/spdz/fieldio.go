@@ -0,0 +1,405 @@
+package spdz
+
+// Prime-field SPDZ.
+//
+// The Field functions below are the online phase of SPDZ over a prime
+// field (see Field), as in the SPDZ paper, instead of over the ring of
+// Share.  Fields have inverses, so they suit statistics and fixed-point
+// programs, which divide by public constants.  A FieldX runs on an X,
+// sending each element as Words() words over the connections of the X,
+// so the fields use the same channels, networking, commitments, and
+// aborts (see SetupFieldPeer and FieldExample).
+//
+// The material comes from DealField; the offline phase of RunOffline is
+// for Share only.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/ot"
+	"os"
+)
+
+/* Shares of a value x of a field and of its MAC alpha*x */
+type FieldShare[E any] struct {
+	Val E
+	Mac E
+}
+
+/* Shares of a multiplication triple, C = A*B */
+type FieldTriple[E any] struct {
+	A, B, C FieldShare[E]
+}
+
+type FieldIo[E any] interface {
+	Id() int
+	Field() Field[E]
+	Alpha() E
+	Triple() (a, b, c FieldShare[E])
+	Mask(int) (r FieldShare[E])
+	MaskOpen() (r FieldShare[E], R E)
+	Open(FieldShare[E]) E
+	GetInput() E
+	Broadcast(E)
+	Receive(party int) E
+	MACCheck() bool
+	Abort(error)
+}
+
+// FieldPreprocessed is the material of one party for a field, see
+// Preprocessed.
+type FieldPreprocessed[E any] struct {
+	ID        []byte
+	Party     int
+	Parties   int
+	Alpha     E
+	Triples   []FieldTriple[E]
+	Masks     [][]FieldShare[E] // indexed by the party providing the input
+	OpenMasks []E
+}
+
+// DealField plays a trusted dealer for the field f, see Deal.
+func DealField[E any](f Field[E], n, numTriples, numMasks int) []*FieldPreprocessed[E] {
+	id := ot.RandomBytes(16)
+	alpha := f.Random(rand.Reader)
+	alphas := splitField(f, alpha, n)
+	result := make([]*FieldPreprocessed[E], n)
+	for i := range result {
+		result[i] = &FieldPreprocessed[E]{
+			ID:        id,
+			Party:     i,
+			Parties:   n,
+			Alpha:     alphas[i],
+			Triples:   make([]FieldTriple[E], numTriples),
+			Masks:     make([][]FieldShare[E], n),
+			OpenMasks: make([]E, numMasks),
+		}
+		for j := range result[i].Masks {
+			result[i].Masks[j] = make([]FieldShare[E], numMasks)
+		}
+	}
+	for k := 0; k < numTriples; k++ {
+		a, b := f.Random(rand.Reader), f.Random(rand.Reader)
+		as := fieldShares(f, a, n, alpha)
+		bs := fieldShares(f, b, n, alpha)
+		cs := fieldShares(f, f.Mul(a, b), n, alpha)
+		for i := range result {
+			result[i].Triples[k] = FieldTriple[E]{as[i], bs[i], cs[i]}
+		}
+	}
+	for k := 0; k < numMasks; k++ {
+		for i := range result {
+			R := f.Random(rand.Reader)
+			result[i].OpenMasks[k] = R
+			for j, r := range fieldShares(f, R, n, alpha) {
+				result[j].Masks[i][k] = r
+			}
+		}
+	}
+	return result
+}
+
+/* return a slice of n random elements that sum to x */
+func splitField[E any](f Field[E], x E, n int) []E {
+	result := make([]E, n)
+	for i := 1; i < n; i++ {
+		result[i] = f.Random(rand.Reader)
+		x = f.Sub(x, result[i])
+	}
+	result[0] = x
+	return result
+}
+
+func fieldShares[E any](f Field[E], x E, n int, alpha E) []FieldShare[E] {
+	vals := splitField(f, x, n)
+	macs := splitField(f, f.Mul(alpha, x), n)
+	result := make([]FieldShare[E], n)
+	for i := range result {
+		result[i] = FieldShare[E]{vals[i], macs[i]}
+	}
+	return result
+}
+
+// check returns an error if p is not the material of party id of n.
+func (p *FieldPreprocessed[E]) check(id, n int) error {
+	switch {
+	case p.Party != id:
+		return fmt.Errorf("preprocessed material of party %d, not %d", p.Party, id)
+	case p.Parties != n:
+		return fmt.Errorf("preprocessed material for %d parties, not %d", p.Parties, n)
+	case len(p.Masks) != n:
+		return fmt.Errorf("preprocessed material has masks for %d parties, not %d", len(p.Masks), n)
+	case len(p.OpenMasks) != len(p.Masks[id]):
+		return fmt.Errorf("preprocessed material has %d open masks for %d masks", len(p.OpenMasks), len(p.Masks[id]))
+	}
+	return nil
+}
+
+// WriteFieldPreprocessed writes p to filename, readable only by the owner.
+func WriteFieldPreprocessed[E any](filename string, p *FieldPreprocessed[E]) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+// ReadFieldPreprocessed reads material written by WriteFieldPreprocessed,
+// checks that it is the material of party id of n, and consumes it, as
+// ReadPreprocessed.
+func ReadFieldPreprocessed[E any](filename string, id, n int) (*FieldPreprocessed[E], error) {
+	var p FieldPreprocessed[E]
+	if err := readOnce(filename, &p, func() error { return p.check(id, n) }); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// FieldX is a party of a computation over a field, on the X x.
+type FieldX[E any] struct {
+	x         *X
+	f         Field[E]
+	alpha     E
+	triples   []FieldTriple[E]
+	masks     [][]FieldShare[E]
+	openmasks []E
+	inputs    []E
+	opened    []FieldShare[E] /* values opened since the last MAC check */
+}
+
+func newFieldX[E any](x *X, f Field[E], pre *FieldPreprocessed[E], inputs []E) *FieldX[E] {
+	return &FieldX[E]{
+		x:         x,
+		f:         f,
+		alpha:     pre.Alpha,
+		triples:   pre.Triples,
+		masks:     pre.Masks,
+		openmasks: pre.OpenMasks,
+		inputs:    inputs,
+	}
+}
+
+// FieldExample returns n parties of the field f connected by channels in
+// this process, with material from DealField.  Party i has the input i.
+func FieldExample[E any](f Field[E], n int) []*FieldX[E] {
+	pres := DealField(f, n, 200, 10)
+	xs := make([]*X, n)
+	for id := range xs {
+		xs[id] = newBareX(context.Background(), id, n)
+	}
+	connectExample(xs)
+	result := make([]*FieldX[E], n)
+	for id := range result {
+		result[id] = newFieldX(xs[id], f, pres[id], []E{f.FromUint64(uint64(id))})
+	}
+	return result
+}
+
+// Connect to the other parties and run the computation over the field f
+// as party pre.Party, see SetupPeer.
+func SetupFieldPeer[E any](ctx context.Context, f Field[E], pre *FieldPreprocessed[E], inputs []E, runPeer func(FieldIo[E])) error {
+	if err := pre.check(pre.Party, len(Hosts)); err != nil {
+		return err
+	}
+	x := newBareX(ctx, pre.Party, pre.Parties)
+	defer x.cancel(nil)
+	fx := newFieldX(x, f, pre, inputs)
+	return x.runNetwork(pre.ID, x.connect, func(Io) { runPeer(fx) })
+}
+
+// Run runs runPeer on x, see X.Run.
+func (x *FieldX[E]) Run(runPeer func(FieldIo[E])) error {
+	return x.x.Run(func(Io) { runPeer(x) })
+}
+
+func (x *FieldX[E]) Id() int {
+	return x.x.id
+}
+
+func (x *FieldX[E]) Field() Field[E] {
+	return x.f
+}
+
+func (x *FieldX[E]) Alpha() E {
+	return x.alpha
+}
+
+func (x *FieldX[E]) Triple() (a, b, c FieldShare[E]) {
+	if len(x.triples) == 0 {
+		x.Abort(errors.New("out of multiplication triples"))
+	}
+	hd := x.triples[0]
+	x.triples = x.triples[1:]
+	return hd.A, hd.B, hd.C
+}
+
+func (x *FieldX[E]) Mask(party int) FieldShare[E] {
+	if len(x.masks[party]) == 0 {
+		x.Abort(fmt.Errorf("out of masks for the inputs of party %d", party))
+	}
+	r := x.masks[party][0]
+	x.masks[party] = x.masks[party][1:]
+	return r
+}
+
+func (x *FieldX[E]) MaskOpen() (FieldShare[E], E) {
+	r := x.Mask(x.Id())
+	R := x.openmasks[0]
+	x.openmasks = x.openmasks[1:]
+	return r, R
+}
+
+func (x *FieldX[E]) GetInput() E {
+	if len(x.inputs) == 0 {
+		x.Abort(errors.New("out of inputs"))
+	}
+	result := x.inputs[0]
+	x.inputs = x.inputs[1:]
+	return result
+}
+
+func (x *FieldX[E]) Broadcast(v E) {
+	w := make([]uint64, x.f.Words())
+	x.f.ToWords(v, w)
+	for _, v := range w {
+		x.x.Broadcast(v)
+	}
+}
+
+// Receive aborts if the party sends an element that is not reduced.
+func (x *FieldX[E]) Receive(party int) E {
+	if party == x.Id() {
+		return x.f.Zero()
+	}
+	v, err := x.f.FromWords(x.x.receiveWords(party, x.f.Words()))
+	if err != nil {
+		x.Abort(fmt.Errorf("party %d: %v", party, err))
+	}
+	return v
+}
+
+func (x *FieldX[E]) Open(s FieldShare[E]) E {
+	x.Broadcast(s.Val)
+	result := s.Val
+	for i := range x.x.rchannels {
+		if i != x.Id() {
+			result = x.f.Add(result, x.Receive(i))
+		}
+	}
+	x.opened = append(x.opened, FieldShare[E]{result, s.Mac})
+	return result
+}
+
+// MACCheck checks the MACs of the values opened since the last check, as
+// X.MACCheck does, with coefficients in the field.
+func (x *FieldX[E]) MACCheck() bool {
+	if len(x.opened) == 0 {
+		return true
+	}
+	opened := x.opened
+	x.opened = nil
+	seed := x.x.coinToss()
+	r := prg{ot.NewPRG(seed[:ot.SeedBytes])}
+	f := x.f
+	a, gamma := f.Zero(), f.Zero()
+	for _, s := range opened {
+		c := f.Random(r)
+		a = f.Add(a, f.Mul(c, s.Val))
+		gamma = f.Add(gamma, f.Mul(c, s.Mac))
+	}
+	sigma := make([]uint64, f.Words())
+	f.ToWords(f.Sub(gamma, f.Mul(x.alpha, a)), sigma)
+	sum := f.Zero()
+	for j, w := range x.x.commitOpen(sigma) {
+		v, err := f.FromWords(w)
+		if err != nil {
+			x.Abort(fmt.Errorf("party %d: %v", j, err))
+		}
+		sum = f.Add(sum, v)
+	}
+	return f.Equal(sum, f.Zero())
+}
+
+func (x *FieldX[E]) Abort(err error) {
+	x.x.Abort(err)
+}
+
+func FieldInput[E any](io FieldIo[E], party int) FieldShare[E] {
+	f := io.Field()
+	if io.Id() == party {
+		X := io.GetInput()
+		r, R := io.MaskOpen()
+		delta := f.Sub(X, R)
+		io.Broadcast(delta)
+		return FieldShare[E]{f.Add(r.Val, delta), f.Add(r.Mac, f.Mul(io.Alpha(), delta))}
+	}
+	r := io.Mask(party)
+	delta := io.Receive(party)
+	return FieldShare[E]{r.Val, f.Add(r.Mac, f.Mul(io.Alpha(), delta))}
+}
+
+func FieldAdd[E any](io FieldIo[E], x, y FieldShare[E]) FieldShare[E] {
+	f := io.Field()
+	return FieldShare[E]{f.Add(x.Val, y.Val), f.Add(x.Mac, y.Mac)}
+}
+
+func FieldSub[E any](io FieldIo[E], x, y FieldShare[E]) FieldShare[E] {
+	f := io.Field()
+	return FieldShare[E]{f.Sub(x.Val, y.Val), f.Sub(x.Mac, y.Mac)}
+}
+
+// FieldScale multiplies x by the public c, for example by the inverse of
+// a public divisor.
+func FieldScale[E any](io FieldIo[E], c E, x FieldShare[E]) FieldShare[E] {
+	f := io.Field()
+	return FieldShare[E]{f.Mul(c, x.Val), f.Mul(c, x.Mac)}
+}
+
+// FieldAddConst adds the public c to x.
+func FieldAddConst[E any](io FieldIo[E], c E, x FieldShare[E]) FieldShare[E] {
+	f := io.Field()
+	val := x.Val
+	if io.Id() == 0 {
+		val = f.Add(val, c)
+	}
+	return FieldShare[E]{val, f.Add(x.Mac, f.Mul(io.Alpha(), c))}
+}
+
+func FieldMul[E any](io FieldIo[E], x, y FieldShare[E]) FieldShare[E] {
+	f := io.Field()
+	a, b, c := io.Triple()
+	e := io.Open(FieldSub(io, x, a))
+	r := io.Open(FieldSub(io, y, b))
+	z := FieldAdd(io, c, FieldAdd(io, FieldScale(io, e, b), FieldScale(io, r, a)))
+	return FieldAddConst(io, f.Mul(e, r), z)
+}
+
+// FieldOutput opens x to all parties, checking MACs as Output does.
+func FieldOutput[E any](io FieldIo[E], x FieldShare[E]) E {
+	return FieldOutputs(io, []FieldShare[E]{x})[0]
+}
+
+// FieldOutputs opens xs to all parties, with one MAC check for all of
+// them.
+func FieldOutputs[E any](io FieldIo[E], xs []FieldShare[E]) []E {
+	if !io.MACCheck() {
+		io.Abort(errors.New("MAC check failed"))
+	}
+	result := make([]E, len(xs))
+	for i, x := range xs {
+		result[i] = io.Open(x)
+	}
+	if !io.MACCheck() {
+		io.Abort(errors.New("MAC check of the outputs failed"))
+	}
+	if log_results {
+		for _, v := range result {
+			fmt.Printf("%d: RESULT %v\n", io.Id(), v)
+		}
+	}
+	return result
+}
@@ -1,63 +1,129 @@
 package spdz
 
+import "context"
 import "crypto/rand"
-import "math/big"
+import "encoding/binary"
+import "errors"
 import "fmt"
+import "github.com/tjim/smpcc/runtime/ot"
+import "runtime"
 
 var print_masks bool = false
+var print_messages bool = false
+var log_results bool = false
 
+// Shares are SPDZ2k shares (Cramer, Damgard, Escudero, Scholze, and Xing,
+// "SPDZ2k: Efficient MPC mod 2^k for Dishonest Majority",
+// http://eprint.iacr.org/2018/482): the values of a computation are K-bit
+// integers, but the parties compute modulo 2^(K+S), and the MACs too.  A
+// party that changes a value by an error below 2^K passes a MAC check
+// with probability about 2^-S, as it must guess the low bits of the MAC
+// key alpha, and an error of 2^K or more never reaches the K bits of a
+// result.
+//
+// The shares are uint64s, so K+S is 64 and K and S are fixed: the values
+// are 32 bits, and a MAC check passes a cheating party with probability
+// about 2^-(S-log S), as in the SPDZ2k paper.  For 64-bit values, a
+// Share128 computes modulo 2^128 (see Input128).  A FieldShare over P127
+// holds 64-bit values too, but its arithmetic is modulo the prime, not
+// 2^64.
+const (
+	K = 32 // bits of a value, see Output
+	S = 32 // bits of statistical security
+)
+
+/* Shares of a value x and of its MAC alpha*x, modulo 2^(K+S) */
 type Share struct {
-	Val uint32
-	Mac uint32
+	Val uint64
+	Mac uint64
 }
 
 type Io interface {
 	Id() int
-	Alpha() uint32
+	N() int
+	Alpha() uint64
 	Triple() (a, b, c Share)
 	Mask(int) (r Share)
-	MaskOpen() (r Share, R uint32)
-	Open(Share) uint32
+	MaskOpen() (r Share, R uint64)
+	Bit() (b Share, ok bool) // a random bit of the offline phase, if any are left
+	Open(Share) uint64
 	GetInput() uint32
-	Broadcast(uint32)
-	Receive(party int) uint32
+	Broadcast(uint64)
+	Receive(party int) uint64
 	MACCheck() bool
+	Abort(error)
+	InitRam([]Share)
+	Ram() []Share
+}
+
+/* Shares of a multiplication triple, C = A*B */
+type Triple struct {
+	A, B, C Share
 }
 
 type X struct {
-	id        int                       /* id of party, range is 0..n-1 */
-	alpha     uint32                    /* share of mac as per SPDZ paper */
-	triples   []struct{ a, b, c Share } /* multiplication triples */
-	masks     [][]Share                 /* input masks, indexed by party providing the input */
-	openmasks []uint32                  /* unmasked input mask values for this party */
-	rchannels []chan uint32             /* channels for reading from other parties */
-	wchannels []chan uint32             /* channels for writing to other parties */
-	inputs    []uint32                  /* inputs of this party */
-}
-
-/* return a slice of n random uint32 values that sum to x */
-func split_uint32(x uint32, n int) []uint32 {
+	id        int                     /* id of party, range is 0..n-1 */
+	alpha     uint64                  /* share of mac as per SPDZ paper */
+	triples   []Triple                /* multiplication triples */
+	masks     [][]Share               /* input masks, indexed by party providing the input */
+	openmasks []uint64                /* unmasked input mask values for this party */
+	bits      []Share                 /* random bits */
+	rchannels []chan uint64           /* channels for reading from other parties */
+	wchannels []chan uint64           /* channels for writing to other parties, buffered */
+	inputs    []uint32                /* inputs of this party */
+	opened    []Share                 /* values opened since the last MAC check, with our MAC shares */
+	ram       []Share                 /* memory of the VM, a share of each byte, see Load */
+	ctx       context.Context         /* done when the computation is aborted */
+	cancel    context.CancelCauseFunc /* aborts the computation */
+
+	cheat func(to int, m1 []ot.Message) /* for the tests: changes the OT messages of an OLE, see oleSend */
+}
+
+// channelBuffer is the capacity of the channels to other parties, so that
+// a party can broadcast without waiting for the others to receive
+const channelBuffer = 1024
+
+// newX returns party pre.Party of a computation on the preprocessed
+// material pre, with channels for the other parties to be filled in.
+func newX(ctx context.Context, pre *Preprocessed, inputs []uint32) *X {
+	x := &X{
+		id:        pre.Party,
+		alpha:     pre.Alpha,
+		triples:   pre.Triples,
+		masks:     pre.Masks,
+		openmasks: pre.OpenMasks,
+		bits:      pre.Bits,
+		rchannels: make([]chan uint64, pre.Parties),
+		wchannels: make([]chan uint64, pre.Parties),
+		inputs:    inputs,
+	}
+	x.ctx, x.cancel = context.WithCancelCause(ctx)
+	return x
+}
+
+/* return a slice of n random uint64 values that sum to x */
+func split_uint64(x uint64, n int) []uint64 {
 	if n <= 0 {
 		panic("Error: split")
 	}
-	result := make([]uint32, n)
+	result := make([]uint64, n)
 	for i := 1; i < n; i++ {
-		xi := rand32()
+		xi := rand64()
 		x -= xi
 		result[i] = xi
 	}
 	result[0] = x
-	var y uint32 = 0
+	var y uint64 = 0
 	for _, s := range result {
 		y += s
 	}
 	return result
 }
 
-func shares(x uint32, n int, alpha uint32) []Share {
+func shares(x uint64, n int, alpha uint64) []Share {
 	mx := alpha * x
-	x_split := split_uint32(x, n)
-	mx_split := split_uint32(mx, n)
+	x_split := split_uint64(x, n)
+	mx_split := split_uint64(mx, n)
 	result := make([]Share, n)
 	for i, _ := range x_split {
 		result[i] = Share{x_split[i], mx_split[i]}
@@ -66,147 +132,156 @@ func shares(x uint32, n int, alpha uint32) []Share {
 }
 
 /* create n shares of a multiplication triple */
-func triple(n int, alpha uint32) []struct{ a, b, c Share } {
-	a, b := rand32(), rand32()
+func triple(n int, alpha uint64) []Triple {
+	a, b := rand64(), rand64()
 	c := a * b
 	a_shares := shares(a, n, alpha)
 	b_shares := shares(b, n, alpha)
 	c_shares := shares(c, n, alpha)
-	result := make([]struct{ a, b, c Share }, n)
+	result := make([]Triple, n)
 	for i, _ := range result {
-		result[i] = struct{ a, b, c Share }{a_shares[i], b_shares[i], c_shares[i]}
+		result[i] = Triple{a_shares[i], b_shares[i], c_shares[i]}
 	}
 	return result
 }
 
-func mask(n int, alpha uint32) (R uint32, r []Share) {
-	R = rand32()
+func mask(n int, alpha uint64) (R uint64, r []Share) {
+	R = rand64()
 	r = shares(R, n, alpha)
 	if print_masks {
-		fmt.Printf("Mask 0x%08x = 0", R)
+		fmt.Printf("Mask 0x%016x = 0", R)
 		for _, s := range r {
-			fmt.Printf(" + 0x%08x", s.Val)
+			fmt.Printf(" + 0x%016x", s.Val)
 		}
 		fmt.Printf("\n")
 	}
 	return
 }
 
-func rand32() uint32 {
-	max := big.NewInt(1 << 32)
-	x, err := rand.Int(rand.Reader, max)
-	if err != nil {
+func rand64() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
 		panic("Error: random number generation")
 	}
-	return uint32(x.Int64())
+	return binary.BigEndian.Uint64(b[:])
 }
 
-func Example(n int) []X {
-	alpha := rand32()
-	alphas := split_uint32(alpha, n)
+// Example returns n parties connected by channels in this process, with
+// material from a trusted dealer (see Deal).  Party i has the input i.
+// If a party aborts then they all do.
+func Example(n int) []*X {
+	pres := Deal(n, 200, 10)
+	result := make([]*X, n)
+	for id := range result {
+		result[id] = newX(context.Background(), pres[id], []uint32{uint32(id)})
+	}
+	connectExample(result)
+	return result
+}
 
-	/* triples */
-	triples := make([][]struct{ a, b, c Share }, n)
-	num_triples := 200
-	for i, _ := range triples {
-		triples[i] = make([]struct{ a, b, c Share }, num_triples)
+// Simulation runs runPeer with all parties in this process, on material
+// from a trusted dealer (see Deal): numTriples triples, and numMasks input
+// masks for each party.  Party i has inputs[i].  Simulation returns when
+// every party is done, or with an error when the computation is aborted.
+func Simulation(ctx context.Context, inputs [][]uint32, numTriples, numMasks int, runPeer func(Io)) error {
+	n := len(inputs)
+	pres := Deal(n, numTriples, numMasks)
+	xs := make([]*X, n)
+	for id := range xs {
+		xs[id] = newX(ctx, pres[id], inputs[id])
 	}
-	for j := 0; j < num_triples; j++ {
-		shares_of_a_triple := triple(n, alpha)
-		for i, t := range shares_of_a_triple {
-			triples[i][j] = t
-		}
+	connectExample(xs)
+	defer xs[0].cancel(nil)
+	done := make(chan error, n)
+	for _, x := range xs {
+		go func(x *X) {
+			done <- x.Run(runPeer)
+		}(x)
 	}
-
-	/* masks */
-	masks := make([] /*n*/ [] /*n*/ [] /*10*/ Share, n)
-	for i := range masks {
-		masks[i] = make([] /*n*/ [] /*10*/ Share, n)
-		for j := range masks[i] {
-			masks[i][j] = make([] /*10*/ Share, 10)
+	var err error
+	for range xs {
+		if e := <-done; err == nil {
+			err = e
 		}
 	}
-	openmasks := make([] /*n*/ [] /*10*/ uint32, n)
-	for i := range openmasks {
-		openmasks[i] = make([] /*10*/ uint32, 10)
+	return err
+}
+
+// connectExample connects the parties xs by channels, so that if a party
+// aborts then they all do.
+func connectExample(xs []*X) {
+	cancels := make([]context.CancelCauseFunc, len(xs))
+	for i, x := range xs {
+		cancels[i] = x.cancel
 	}
-	for k := range masks[0][0] {
-		for i := range masks {
-			R, r := mask(n, alpha)
-			for j := range r {
-				openmasks[i][k] = R
-				masks[j][i][k] = r[j]
+	for _, x := range xs {
+		x.cancel = func(err error) {
+			for _, cancel := range cancels {
+				cancel(err)
 			}
 		}
 	}
-
-	/* channels */
-	rchannels := make([] /*n*/ [] /*n*/ chan uint32, n)
-	wchannels := make([] /*n*/ [] /*n*/ chan uint32, n)
-	for i := range rchannels {
-		rchannels[i] = make([] /*n*/ chan uint32, n)
-		wchannels[i] = make([] /*n*/ chan uint32, n)
-	}
-	for i := range rchannels {
-		for j := range rchannels {
+	for i := range xs {
+		for j := range xs {
 			if i == j {
 				continue
 			}
-			ch := make(chan uint32)
-			rchannels[i][j] = ch
-			wchannels[j][i] = ch
+			ch := make(chan uint64, channelBuffer)
+			xs[i].rchannels[j] = ch
+			xs[j].wchannels[i] = ch
 		}
 	}
-
-	/* final result */
-	result := make([]X, n)
-	for id := range result {
-		inputs := make([]uint32, 1)
-		inputs[0] = uint32(id)
-		result[id] =
-			X{id,
-				alphas[id],
-				triples[id],
-				masks[id],
-				openmasks[id],
-				rchannels[id],
-				wchannels[id],
-				inputs}
-	}
-	return result
 }
 
-func (x X) Id() int {
+func (x *X) Id() int {
 	return x.id
 }
 
-func (x X) Alpha() uint32 {
+func (x *X) N() int {
+	return len(x.rchannels)
+}
+
+func (x *X) Alpha() uint64 {
 	return x.alpha
 }
 
-func (x X) Triple() (a, b, c Share) {
+func (x *X) Triple() (a, b, c Share) {
+	if len(x.triples) == 0 {
+		x.Abort(errors.New("out of multiplication triples"))
+	}
 	hd := x.triples[0]
 	x.triples = x.triples[1:]
-	a, b, c = hd.a, hd.b, hd.c
+	a, b, c = hd.A, hd.B, hd.C
 	return
 }
 
-func (x X) Mask(party int) Share {
+func (x *X) Mask(party int) Share {
+	if len(x.masks[party]) == 0 {
+		x.Abort(fmt.Errorf("out of masks for the inputs of party %d", party))
+	}
 	r := x.masks[party][0]
 	x.masks[party] = x.masks[party][1:]
 	return r
 }
 
-func (x X) MaskOpen() (Share, uint32) {
+func (x *X) MaskOpen() (Share, uint64) {
 	party := x.id
-	r := x.masks[party][0]
-	x.masks[party] = x.masks[party][1:]
+	r := x.Mask(party)
 	R := x.openmasks[0]
 	x.openmasks = x.openmasks[1:]
 	return r, R
 }
 
-func (x X) Open(s Share) uint32 {
+func (x *X) Bit() (Share, bool) {
+	if len(x.bits) == 0 {
+		return Share{}, false
+	}
+	b := x.bits[0]
+	x.bits = x.bits[1:]
+	return b, true
+}
+
+func (x *X) Open(s Share) uint64 {
 	x.Broadcast(s.Val)
 	result := s.Val
 	id := x.Id()
@@ -216,49 +291,110 @@ func (x X) Open(s Share) uint32 {
 		}
 		result += x.Receive(i)
 	}
+	x.opened = append(x.opened, Share{result, s.Mac})
 	return result
 }
 
-func (x X) GetInput() uint32 {
+func (x *X) GetInput() uint32 {
+	if len(x.inputs) == 0 {
+		x.Abort(errors.New("out of inputs"))
+	}
 	result := x.inputs[0]
 	x.inputs = x.inputs[1:]
 	return result
 }
 
-func (x X) Broadcast(n uint32) {
+// Broadcast sends n to the other parties, in order: the channels are
+// buffered, so it waits only if a channel is full.
+func (x *X) Broadcast(n uint64) {
 	id := x.Id()
-	fmt.Printf("%d: BROADCAST 0x%08x\n", id, n)
+	if print_messages {
+		fmt.Printf("%d: BROADCAST 0x%016x\n", id, n)
+	}
 	for i, ch := range x.wchannels {
 		if i == id {
 			continue
 		}
-		go func(ch chan<- uint32, i int) {
-			ch <- n
-			fmt.Printf("%d -- 0x%08x -> %d\n", id, n, i)
-		}(ch, i)
+		select {
+		case ch <- n:
+		case <-x.ctx.Done():
+			x.Abort(x.Err())
+		}
 	}
 }
 
-func (x X) Receive(party int) uint32 {
+func (x *X) Receive(party int) uint64 {
 	id := x.Id()
 	if party == id {
 		return 0
 	}
-	ch := x.rchannels[party]
-	result := <-ch
-	fmt.Printf("%d <- 0x%08x -- %d\n", id, result, party)
+	var result uint64
+	select {
+	case v, ok := <-x.rchannels[party]:
+		if !ok {
+			x.Abort(fmt.Errorf("party %d closed the connection", party))
+		}
+		result = v
+	case <-x.ctx.Done():
+		x.Abort(x.Err())
+	}
+	if print_messages {
+		fmt.Printf("%d <- 0x%016x -- %d\n", id, result, party)
+	}
 	return result
 }
 
-func (x X) MACCheck() bool {
-	// TODO
-	return true
+// Err returns the reason the computation was aborted, or nil if it has not been.
+func (x *X) Err() error {
+	if x.ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(x.ctx)
+}
+
+// Abort aborts the computation with err and ends the calling goroutine,
+// see Run.  The connections to the other parties are closed, so they
+// abort too.
+func (x *X) Abort(err error) {
+	x.cancel(err)
+	runtime.Goexit()
+}
+
+func (x *X) InitRam(contents []Share) {
+	x.ram = contents
+}
+
+func (x *X) Ram() []Share {
+	return x.ram
+}
+
+// Run runs runPeer on x and waits until it returns or the computation is
+// aborted.
+func (x *X) Run(runPeer func(Io)) error {
+	done := make(chan bool, 1)
+	go func() {
+		runPeer(x)
+		done <- true
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-x.ctx.Done():
+		return x.Err()
+	}
 }
 
 func Input(io Io, party int) Share {
-	id := io.Id()
-	if id == party {
-		X := io.GetInput()
+	var X uint64
+	if io.Id() == party {
+		X = uint64(io.GetInput())
+	}
+	return inputValue(io, party, X)
+}
+
+// inputValue shares X, a value of party; the other parties ignore X.
+func inputValue(io Io, party int, X uint64) Share {
+	if io.Id() == party {
 		r, R := io.MaskOpen()
 		delta := X - R
 		io.Broadcast(delta)
@@ -285,14 +421,39 @@ func Mul(io Io, x, y Share) Share {
 	}
 }
 
+// Output opens the K bits of x to all parties.  It first checks the
+// values opened so far, so that a party that cheated learns nothing, then
+// checks x.  The bits of x above K depend on the carries of the
+// computation, so Output hides them with 2^K*a, for the a of a triple.
 func Output(io Io, x Share) uint32 {
-	result := io.Open(x)
-	if io.MACCheck() {
-		fmt.Printf("%d: RESULT 0x%08x\n", io.Id(), result)
-		return result
-	} else {
-		panic("Error: MACCheck failed")
+	return Outputs(io, []Share{x})[0]
+}
+
+// Outputs opens xs to all parties, with one MAC check for all of them.
+func Outputs(io Io, xs []Share) []uint32 {
+	if !io.MACCheck() {
+		io.Abort(errors.New("MAC check failed"))
+	}
+	result := make([]uint32, len(xs))
+	for i, x := range xs {
+		result[i] = reveal(io, x)
+	}
+	if !io.MACCheck() {
+		io.Abort(errors.New("MAC check of the outputs failed"))
+	}
+	if log_results {
+		for _, v := range result {
+			fmt.Printf("%d: RESULT 0x%08x\n", io.Id(), v)
+		}
 	}
+	return result
+}
+
+// reveal opens the K bits of x without a MAC check, hiding the bits
+// above K as Output does.  The next MAC check checks it.
+func reveal(io Io, x Share) uint32 {
+	a, _, _ := io.Triple()
+	return uint32(io.Open(Add(io, x, scale(1<<K, a))))
 }
 
 func RunExample() uint32 {
@@ -300,7 +461,7 @@ func RunExample() uint32 {
 	done := make(chan uint32, len(xs))
 	results := make([]uint32, len(xs))
 	for _, x := range xs {
-		go func(x X) {
+		go func(x *X) {
 			y := Input(x, 2)
 			//			Output(x, y)
 			z := Mul(x, y, y)
@@ -0,0 +1,481 @@
+package spdz
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/tjim/smpcc/runtime/ot"
+	"github.com/tjim/smpcc/runtime/secure"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExample(t *testing.T) {
+	if got := RunExample(); got != 4 {
+		t.Errorf("RunExample() = %d, want 4", got)
+	}
+}
+
+// TestNetwork runs the offline phase and then the online phase for three
+// parties over loopback TCP with secure channels, each loading its
+// material from a file.  MyKeys is global, so the parties
+// share one key pair.
+func TestNetwork(t *testing.T) {
+	const n = 3
+	base := 20000 + os.Getpid()%20000
+	dir := t.TempDir()
+	keys, err := secure.GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	MyKeys = keys
+	for i := 0; i < n; i++ {
+		Hosts[i] = "127.0.0.1"
+		Ports[i] = base + n*i
+		Keys[i] = keys.Public
+	}
+	defer func() {
+		Hosts, Ports, Keys = make(map[int]string), make(map[int]int), make(map[int]*[32]byte)
+		MyKeys = nil
+	}()
+	offline := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			pre, err := SetupOffline(context.Background(), i, 13, 5, 1)
+			if err == nil {
+				err = WritePreprocessed(filepath.Join(dir, string(rune('0'+i))), pre)
+			}
+			offline <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-offline; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := make(chan uint32, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		pre, err := ReadPreprocessed(filepath.Join(dir, string(rune('0'+i))), i, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(pre *Preprocessed, input uint32) {
+			errs <- SetupPeer(context.Background(), pre, []uint32{input}, func(io Io) {
+				x := Input(io, 0)
+				y := Input(io, 1)
+				z := Input(io, 2)
+				results <- Output(io, Add(io, Mul(io, x, y), z))
+			})
+		}(pre, uint32(i+5))
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if got := <-results; got != 5*6+7 {
+			t.Errorf("result %d, want %d", got, 5*6+7)
+		}
+	}
+}
+
+// TestPreprocessedUsedOnce checks that material is consumed when it is
+// read, and only if it is the material of the party.
+func TestPreprocessedUsedOnce(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "0")
+	if err := WritePreprocessed(filename, Deal(2, 1, 1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPreprocessed(filename, 1, 2); err == nil {
+		t.Fatal("material of party 0 read as party 1")
+	}
+	if pre, err := ReadPreprocessed(filename, 0, 2); err != nil {
+		t.Fatalf("ReadPreprocessed = %v, %v", pre, err)
+	}
+	if _, err := ReadPreprocessed(filename, 0, 2); err == nil {
+		t.Error("material read twice")
+	}
+	fieldname := filepath.Join(t.TempDir(), "field")
+	if err := WriteFieldPreprocessed(fieldname, DealField[uint64](Mersenne61{}, 2, 1, 1)[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFieldPreprocessed[uint64](fieldname, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFieldPreprocessed[uint64](fieldname, 1, 2); err == nil {
+		t.Error("field material read twice")
+	}
+}
+
+// TestMACCheck has party 1 add 1 to its share of a product; every party
+// must abort.
+func TestMACCheck(t *testing.T) {
+	xs := Example(3)
+	errs := make(chan error, len(xs))
+	for _, x := range xs {
+		go func(x *X) {
+			errs <- x.Run(func(io Io) {
+				y := Input(io, 2)
+				z := Mul(io, y, y)
+				if io.Id() == 1 {
+					z.Val++
+				}
+				Output(io, z)
+			})
+		}(x)
+	}
+	for range xs {
+		if err := <-errs; err == nil || err.Error() != "MAC check of the outputs failed" {
+			t.Errorf("got error %v, want a failed MAC check", err)
+		}
+	}
+}
+
+// TestOffline runs the online phase on material from the offline phase,
+// with a comparison that uses its random bits.
+func TestOffline(t *testing.T) {
+	const n = 3
+	pres, err := OfflineExample(n, 16, 2, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xs := make([]*X, n)
+	for i := range xs {
+		xs[i] = newX(context.Background(), pres[i], []uint32{uint32(i + 5)})
+	}
+	connectExample(xs)
+	results := make(chan [2]uint32, n)
+	errs := make(chan error, n)
+	for _, x := range xs {
+		go func(x *X) {
+			errs <- x.Run(func(io Io) {
+				y := Input(io, 0)
+				z := Input(io, 2)
+				results <- [2]uint32{Output(io, Mul(io, y, Mul(io, z, z))), Output(io, LT(io, y, z, 8))}
+			})
+		}(x)
+	}
+	for range xs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, x := range xs {
+		if got := <-results; got != [2]uint32{5 * 7 * 7, 1} {
+			t.Errorf("results %d, want %d and 1", got, 5*7*7)
+		}
+		if len(x.bits) != 0 {
+			t.Errorf("%d random bits left, want 0", len(x.bits))
+		}
+	}
+}
+
+// bitCheater adds 2^K to the inputs of the party, which leaves them bits
+// modulo 2^K.
+type bitCheater struct {
+	Io
+}
+
+func (io bitCheater) MaskOpen() (Share, uint64) {
+	r, R := io.Io.MaskOpen()
+	return r, R - 1<<K
+}
+
+// TestInputBit has party 1 input 2^K or 2^K+1 as a random bit; every party
+// must abort.
+func TestInputBit(t *testing.T) {
+	pres := Deal(2, 10, 2)
+	xs := []*X{
+		newX(context.Background(), pres[0], nil),
+		newX(context.Background(), pres[1], nil),
+	}
+	connectExample(xs)
+	errs := make(chan error, len(xs))
+	for _, x := range xs {
+		go func(x *X) {
+			errs <- x.Run(func(io Io) {
+				if io.Id() == 1 {
+					io = bitCheater{io}
+				}
+				inputBit(io)
+			})
+		}(x)
+	}
+	for range xs {
+		if err := <-errs; err == nil || err.Error() != "party 1 input a random bit that is not a bit" {
+			t.Errorf("got error %v, want party 1 caught", err)
+		}
+	}
+}
+
+// TestCombineUniform checks that the low bits of the a of the combined
+// triples are uniform, as they hide the low bits of the values that Mul
+// opens.  The coefficients are even for 1 in 8 values of a without the
+// coefficient 1, which would make 8750 of 20000 odd, not 10000.
+func TestCombineUniform(t *testing.T) {
+	const N = 20000
+	var seed [32]byte
+	copy(seed[:], "TestCombineUniform")
+	a, _ := combineCandidates(coefficients(seed, combine*N), randomWords(combine*N), make([]uint64, combine*N))
+	var counts [4]int
+	for _, v := range a {
+		counts[v%4]++
+	}
+	// 5000 each, with a standard deviation of 61
+	for low, c := range counts {
+		if c < 4700 || c > 5300 {
+			t.Errorf("%d of %d values of a are %d modulo 4", c, N, low)
+		}
+	}
+	if odd := counts[1] + counts[3]; odd < 9650 || odd > 10350 {
+		t.Errorf("%d of %d values of a are odd", odd, N)
+	}
+}
+
+// TestOfflineCheating plays a party that sends wrong OT messages in the
+// OLEs of the products, and one that authenticates a value inconsistently,
+// and checks that the offline phase gives no material to anyone.
+func TestOfflineCheating(t *testing.T) {
+	const numTriples, numMasks = 4, 2
+	for name, ole := range map[string]struct{ values, first, last int }{
+		"products": {2 * combine * numTriples, 0, 2 * combine * numTriples},
+		"MAC":      {5*numTriples + 1 + numMasks, 5*numTriples + 1, 5*numTriples + 2},
+	} {
+		ole := ole
+		cheat := func(from, to int, m1 []ot.Message) {
+			if from != 1 || to != 0 || len(m1) != 64*ole.values {
+				return
+			}
+			for _, m := range m1[64*ole.first : 64*ole.last] {
+				binary.BigEndian.PutUint64(m, binary.BigEndian.Uint64(m)+1)
+			}
+		}
+		if pres, err := offlineExample(2, numTriples, numMasks, 0, cheat); err == nil || pres != nil {
+			t.Errorf("%s: cheating not caught", name)
+		}
+	}
+}
+
+// TestWraparound checks that the results are modulo 2^K, although the
+// parties compute modulo 2^(K+S).
+func TestWraparound(t *testing.T) {
+	pres := Deal(2, 10, 2)
+	xs := []*X{
+		newX(context.Background(), pres[0], []uint32{0x10000}),
+		newX(context.Background(), pres[1], []uint32{0xffffffff}),
+	}
+	connectExample(xs)
+	results := make(chan []uint32, len(xs))
+	for _, x := range xs {
+		go x.Run(func(io Io) {
+			y := Input(io, 0)
+			z := Input(io, 1)
+			results <- Outputs(io, []Share{Mul(io, y, y), Add(io, z, z)})
+		})
+	}
+	for range xs {
+		got := <-results
+		if got[0] != 0 || got[1] != 0xfffffffe {
+			t.Errorf("results 0x%x, want 0 and 0xfffffffe", got)
+		}
+	}
+}
+
+func TestField(t *testing.T) {
+	t.Run("Mersenne61", func(t *testing.T) { testField[uint64](t, Mersenne61{}) })
+	t.Run("P127", func(t *testing.T) { testField[*big.Int](t, P127()) })
+}
+
+// TestRing128 computes with 64-bit values, and has party 1 cheat in a
+// second run.
+func TestRing128(t *testing.T) {
+	for _, cheat := range []bool{false, true} {
+		xs := Example128(3)
+		results := make(chan []uint64, len(xs))
+		errs := make(chan error, len(xs))
+		for _, x := range xs {
+			go func(x *X128) {
+				errs <- x.Run(func(io Io128) {
+					b, c := Input128(io, 1), Input128(io, 2)
+					product := Mul128(io, Scale128(io, 1<<40, b), Scale128(io, 1<<20, c))
+					if cheat && io.Id() == 1 {
+						product.Val = product.Val.add(Uint128{0, 1})
+					}
+					wrapped := AddConst128(io, ^uint64(0), Mul128(io, c, c))
+					results <- Outputs128(io, []Share128{product, wrapped})
+				})
+			}(x)
+		}
+		for range xs {
+			err := <-errs
+			if cheat {
+				if err == nil {
+					t.Error("no error from a party that cheated")
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-results; got[0] != 1<<61 || got[1] != 3 {
+				t.Errorf("results 0x%x, want 2^61 and 3", got)
+			}
+		}
+	}
+}
+
+// testField computes the mean of the inputs 0, 1, 2 and the product of
+// the last two, and has party 1 cheat in a second run.
+func testField[E any](t *testing.T, f Field[E]) {
+	if !f.Equal(f.Mul(f.FromUint64(3), f.Inv(f.FromUint64(3))), f.One()) {
+		t.Fatal("3 * 1/3 != 1")
+	}
+	for _, cheat := range []bool{false, true} {
+		xs := FieldExample(f, 3)
+		results := make(chan []E, len(xs))
+		errs := make(chan error, len(xs))
+		for _, x := range xs {
+			go func(x *FieldX[E]) {
+				errs <- x.Run(func(io FieldIo[E]) {
+					a, b, c := FieldInput(io, 0), FieldInput(io, 1), FieldInput(io, 2)
+					sum := FieldAdd(io, a, FieldAdd(io, b, c))
+					mean := FieldScale(io, f.Inv(f.FromUint64(3)), sum)
+					product := FieldMul(io, b, c)
+					if cheat && io.Id() == 1 {
+						product.Val = f.Add(product.Val, f.One())
+					}
+					results <- FieldOutputs(io, []FieldShare[E]{mean, product})
+				})
+			}(x)
+		}
+		for range xs {
+			err := <-errs
+			if cheat {
+				if err == nil {
+					t.Error("no error from a party that cheated")
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := <-results
+			if !f.Equal(got[0], f.One()) || !f.Equal(got[1], f.FromUint64(2)) {
+				t.Errorf("results %v, want 1 and 2", got)
+			}
+		}
+	}
+}
+
+// TestVM runs the VM functions on the inputs 7, 200 and 7.
+func TestVM(t *testing.T) {
+	pres := Deal(3, 20000, 3000)
+	xs := make([]*X, len(pres))
+	for i := range xs {
+		xs[i] = newX(context.Background(), pres[i], []uint32{[]uint32{7, 200, 7}[i]})
+	}
+	connectExample(xs)
+	results := make(chan []uint32, len(xs))
+	errs := make(chan error, len(xs))
+	for _, x := range xs {
+		go func(x *X) {
+			errs <- x.Run(func(io Io) {
+				mask := Uint1(io, 1)
+				a := Input32(io, mask, Uint32(io, 0))
+				b := Input32(io, mask, Uint32(io, 1))
+				c := Input8(io, mask, Uint32(io, 2))
+				gt := Icmp_ugt32(io, a, b)
+				io.InitRam(make([]Share, 8))
+				Store(io, Uint32(io, 4), Uint32(io, 2), Add32(io, b, Uint32(io, 0x300)))
+				results <- Outputs(io, []Share{
+					gt,
+					Select32(io, gt, a, b),
+					Icmp_eq32(io, a, Zext8_32(io, c)),
+					Icmp_eq8(io, c, Uint8(io, 8)),
+					Add8(io, Trunc32_8(io, b), Uint8(io, 100)),
+					Icmp_slt32(io, Not32(io, a), a),
+					Lshr32(io, b, 3),
+					Xor32(io, a, b),
+					Unary(io, c, 10),
+					Load(io, Uint32(io, 4), Uint32(io, 4)),
+					Switch32(io, Uint32(io, 1), Uint32(io, 9), b, a),
+					Switch32(io, c, Uint32(io, 9), b, a),
+					NumPeers32(io),
+				})
+			})
+		}(x)
+	}
+	want := []uint32{0, 200, 1, 0, 44, 1, 25, 7 ^ 200, 1 << 7, 0x3c8, 7, 9, 3}
+	for range xs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		got := <-results
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("result %d is 0x%x, want 0x%x", i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// TestProtocols checks the protocols on the bits of shared values against
+// the plaintext results.
+func TestProtocols(t *testing.T) {
+	as := []uint32{0, 5, 7, 0xffffffff, 1 << 31, 123456789, 0xfffe}
+	bs := []uint32{0, 7, 5, 0, 1<<31 - 1, 123456789, 0xffff}
+	pres := Deal(2, 40000, 2000)
+	xs := []*X{
+		newX(context.Background(), pres[0], as),
+		newX(context.Background(), pres[1], bs),
+	}
+	connectExample(xs)
+	results := make(chan []uint32, len(xs))
+	errs := make(chan error, len(xs))
+	for _, x := range xs {
+		go func(x *X) {
+			errs <- x.Run(func(io Io) {
+				var ys []Share
+				for range as {
+					a := Input(io, 0)
+					b := Input(io, 1)
+					ys = append(ys,
+						LT(io, a, b, 32),
+						LT(io, Mod2m(io, a, 16), Mod2m(io, b, 16), 16),
+						EQ(io, a, b, 32),
+						EQZ(io, a, 32),
+						Mod2m(io, a, 5),
+						BitDec(io, a, 32)[31],
+						Trunc(io, a, 4))
+				}
+				results <- Outputs(io, ys)
+			})
+		}(x)
+	}
+	b2u := func(b bool) uint32 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	for range xs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		got := <-results
+		for i, a := range as {
+			b := bs[i]
+			want := []uint32{b2u(a < b), b2u(uint16(a) < uint16(b)), b2u(a == b), b2u(a == 0), a % 32, a >> 31}
+			for j, w := range want {
+				if got[7*i+j] != w {
+					t.Errorf("result %d for %d and %d is %d, want %d", j, a, b, got[7*i+j], w)
+				}
+			}
+			if tr := got[7*i+6]; tr != a>>4 && tr != a>>4+1 {
+				t.Errorf("Trunc(%d, 4) is %d, want %d or %d", a, tr, a>>4, a>>4+1)
+			}
+		}
+	}
+}
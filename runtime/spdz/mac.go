@@ -0,0 +1,156 @@
+package spdz
+
+// MAC check.
+//
+// Every value that the parties open, with Open, is recorded with the
+// share of its MAC.  MACCheck checks all of the values opened since the
+// last check in one batch, as in the SPDZ paper:
+//
+//  1. The parties agree on a random seed: each commits to a random
+//     string, then opens it, and the seed is the XOR of the strings.  The
+//     seed gives a random coefficient r_k in Z_2^S for each opened value
+//     a_k.
+//  2. Each party i computes a = sum r_k*a_k, its share gamma_i = sum
+//     r_k*gamma(a_k)_i of the MAC of a, and sigma_i = gamma_i - alpha_i*a.
+//  3. Each party commits to sigma_i, then opens it, and the check passes
+//     if the sigma_i sum to 0.
+//
+// The sums are modulo 2^(K+S), as in SPDZ2k.  A party that changed an
+// opened value by an error below 2^K must guess alpha to pass the check.
+//
+// The commitments are hashes (SHA-256) of the value and a random nonce,
+// so a party cannot choose its string or its sigma after seeing those of
+// the others.
+//
+// The parties open the same values in the same order, so they compute
+// the same sum and abort together when a check fails.  A party that sends
+// different values to different parties makes some of them abort, and
+// they close their connections, so the rest abort too (see X.Abort).
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const commitWords = sha256.Size / 8 // size of a commitment, and of a nonce
+
+// MACCheck checks the MACs of the values opened since the last check, see
+// above.  It returns false if a party cheated.
+func (x *X) MACCheck() bool {
+	if len(x.opened) == 0 {
+		return true
+	}
+	opened := x.opened
+	x.opened = nil
+
+	/* agree on the coefficients */
+	r := coefficients(x.coinToss(), len(opened))
+
+	/* check the random linear combination */
+	var a, gamma uint64
+	for k, s := range opened {
+		a += r[k] * s.Val
+		gamma += r[k] * s.Mac
+	}
+	var sum uint64
+	for _, sigma := range x.commitOpen([]uint64{gamma - x.alpha*a}) {
+		sum += sigma[0]
+	}
+	return sum == 0
+}
+
+// coinToss returns a random seed that no party chooses: each party
+// commits to a random string, then opens it, and the seed is their XOR.
+func (x *X) coinToss() [sha256.Size]byte {
+	var seed [sha256.Size]byte
+	for _, s := range x.commitOpen(randomWords(commitWords)) {
+		for i, w := range s {
+			binary.BigEndian.PutUint64(seed[8*i:], binary.BigEndian.Uint64(seed[8*i:])^w)
+		}
+	}
+	return seed
+}
+
+// commitOpen commits to vals, then opens them, and returns the values of
+// every party, indexed by party.  It aborts if a party opens a value that
+// it did not commit to.
+func (x *X) commitOpen(vals []uint64) [][]uint64 {
+	n := len(x.rchannels)
+	nonce := randomWords(commitWords)
+	for _, w := range commitment(nonce, vals) {
+		x.Broadcast(w)
+	}
+	commitments := make([][]uint64, n)
+	for j := range commitments {
+		if j != x.id {
+			commitments[j] = x.receiveWords(j, commitWords)
+		}
+	}
+	for _, w := range append(nonce, vals...) {
+		x.Broadcast(w)
+	}
+	result := make([][]uint64, n)
+	result[x.id] = vals
+	for j := range result {
+		if j == x.id {
+			continue
+		}
+		opening := x.receiveWords(j, commitWords+len(vals))
+		c := commitment(opening[:commitWords], opening[commitWords:])
+		for i := range c {
+			if c[i] != commitments[j][i] {
+				x.Abort(fmt.Errorf("party %d opened a value that it did not commit to", j))
+			}
+		}
+		result[j] = opening[commitWords:]
+	}
+	return result
+}
+
+func (x *X) receiveWords(party, n int) []uint64 {
+	result := make([]uint64, n)
+	for i := range result {
+		result[i] = x.Receive(party)
+	}
+	return result
+}
+
+// commitment returns the hash of nonce and vals
+func commitment(nonce, vals []uint64) []uint64 {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, nonce)
+	binary.Write(h, binary.BigEndian, vals)
+	return bytesToWords(h.Sum(nil))
+}
+
+// coefficients expands seed into n pseudorandom values in Z_2^S
+func coefficients(seed [sha256.Size]byte, n int) []uint64 {
+	result := make([]uint64, 0, n+commitWords)
+	var block [sha256.Size + 8]byte
+	copy(block[:], seed[:])
+	for i := uint64(0); len(result) < n; i++ {
+		binary.BigEndian.PutUint64(block[sha256.Size:], i)
+		sum := sha256.Sum256(block[:])
+		for _, w := range bytesToWords(sum[:]) {
+			result = append(result, w&(1<<S-1))
+		}
+	}
+	return result[:n]
+}
+
+func bytesToWords(b []byte) []uint64 {
+	result := make([]uint64, len(b)/8)
+	for i := range result {
+		result[i] = binary.BigEndian.Uint64(b[8*i:])
+	}
+	return result
+}
+
+func randomWords(n int) []uint64 {
+	result := make([]uint64, n)
+	for i := range result {
+		result[i] = rand64()
+	}
+	return result
+}
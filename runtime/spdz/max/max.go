@@ -0,0 +1,262 @@
+package max
+
+import . "github.com/tjim/smpcc/runtime/spdz"
+import "fmt"
+
+func initialize_ram(io Io) {
+	ram := make([]Share, 0x24)
+	// @.str at location 0 == 0x0
+	ram[0x0] = Uint8(io, 0x50)
+	ram[0x1] = Uint8(io, 0x61)
+	ram[0x2] = Uint8(io, 0x72)
+	ram[0x3] = Uint8(io, 0x74)
+	ram[0x4] = Uint8(io, 0x69)
+	ram[0x5] = Uint8(io, 0x63)
+	ram[0x6] = Uint8(io, 0x69)
+	ram[0x7] = Uint8(io, 0x70)
+	ram[0x8] = Uint8(io, 0x61)
+	ram[0x9] = Uint8(io, 0x6e)
+	ram[0xa] = Uint8(io, 0x74)
+	ram[0xb] = Uint8(io, 0x20)
+	ram[0xc] = Uint8(io, 0x25)
+	ram[0xd] = Uint8(io, 0x64)
+	ram[0xe] = Uint8(io, 0x20)
+	ram[0xf] = Uint8(io, 0x68)
+	ram[0x10] = Uint8(io, 0x61)
+	ram[0x11] = Uint8(io, 0x64)
+	ram[0x12] = Uint8(io, 0x20)
+	ram[0x13] = Uint8(io, 0x6d)
+	ram[0x14] = Uint8(io, 0x61)
+	ram[0x15] = Uint8(io, 0x78)
+	ram[0x16] = Uint8(io, 0x20)
+	ram[0x17] = Uint8(io, 0x76)
+	ram[0x18] = Uint8(io, 0x61)
+	ram[0x19] = Uint8(io, 0x6c)
+	ram[0x1a] = Uint8(io, 0x75)
+	ram[0x1b] = Uint8(io, 0x65)
+	ram[0x1c] = Uint8(io, 0x20)
+	ram[0x1d] = Uint8(io, 0x25)
+	ram[0x1e] = Uint8(io, 0x64)
+	ram[0x1f] = Uint8(io, 0xa)
+	io.InitRam(ram)
+}
+
+func blocks_main(io Io) {
+
+	initialize_ram(io)
+
+	/* create output channels */
+	ch0 := make(chan Share, 4)
+	ch1 := make(chan Share, 6)
+	ch2 := make(chan Share, 2)
+	ch3 := make(chan Share, 4)
+	ch4 := make(chan Share, 4)
+	ch5 := make(chan Share, 5)
+	ch6 := make(chan Share, 5)
+
+	/* special variables */
+	_vAnswer := Uint32(io, 0)
+	_vIsDone := Uint1(io, 0)
+
+	/* block masks */
+	_block0 := Uint1(io, 0)
+	_block1 := Uint1(io, 0)
+	_block2 := Uint1(io, 0)
+	_block3 := Uint1(io, 0)
+	_block4 := Uint1(io, 0)
+	_block5 := Uint1(io, 0)
+	_block6 := Uint1(io, 0)
+	_block0 = Uint1(io, 1)
+
+	/* block free variables */
+	_1 := Uint32(io, 0)
+	_6 := Uint32(io, 0)
+	___main_cur_max_0 := Uint32(io, 0)
+	__main_cur_max_0_lcssa := Uint32(io, 0)
+	__main_cur_max_03 := Uint32(io, 0)
+	__main_i_0__main_max_i_0 := Uint32(io, 0)
+	__main_i_01 := Uint32(io, 0)
+	__main_max_i_0_lcssa := Uint32(io, 0)
+	__main_max_i_02 := Uint32(io, 0)
+
+	done := false
+	for !done {
+
+		/* one invocation per block, in turn */
+		block0(io, ch0, _block0)
+		block1(io, ch1, _block1, __main_cur_max_03, __main_i_01, __main_max_i_02)
+		block2(io, ch2, _block2, __main_cur_max_0_lcssa, __main_max_i_0_lcssa)
+		block3(io, ch3, _block3, ___main_cur_max_0, __main_i_0__main_max_i_0)
+		block4(io, ch4, _block4, _1)
+		block5(io, ch5, _block5, _1)
+		block6(io, ch6, _block6, _6, ___main_cur_max_0, __main_i_0__main_max_i_0)
+
+		/* mux the outputs*/
+		mask_0 := _block0
+		_1_0 := <-ch0
+		_block0_0 := <-ch0
+		_block4_0 := <-ch0
+		_block5_0 := <-ch0
+		mask_1 := _block1
+		_6_1 := <-ch1
+		___main_cur_max_0_1 := <-ch1
+		__main_i_0__main_max_i_0_1 := <-ch1
+		_block1_1 := <-ch1
+		_block3_1 := <-ch1
+		_block6_1 := <-ch1
+		_vAnswer_2 := <-ch2
+		_vIsDone_2 := <-ch2
+		mask_3 := _block3
+		__main_cur_max_0_lcssa_3 := <-ch3
+		__main_max_i_0_lcssa_3 := <-ch3
+		_block2_3 := <-ch3
+		_block3_3 := <-ch3
+		mask_4 := _block4
+		__main_cur_max_0_lcssa_4 := <-ch4
+		__main_max_i_0_lcssa_4 := <-ch4
+		_block2_4 := <-ch4
+		_block4_4 := <-ch4
+		mask_5 := _block5
+		__main_cur_max_03_5 := <-ch5
+		__main_i_01_5 := <-ch5
+		__main_max_i_02_5 := <-ch5
+		_block1_5 := <-ch5
+		_block5_5 := <-ch5
+		mask_6 := _block6
+		__main_cur_max_03_6 := <-ch6
+		__main_i_01_6 := <-ch6
+		__main_max_i_02_6 := <-ch6
+		_block1_6 := <-ch6
+		_block6_6 := <-ch6
+		_1 = Sum32(io, _1_0, Mask32(io, Not1(io, Sum1(io, mask_0)), _1))
+		_6 = Sum32(io, _6_1, Mask32(io, Not1(io, Sum1(io, mask_1)), _6))
+		___main_cur_max_0 = Sum32(io, ___main_cur_max_0_1, Mask32(io, Not1(io, Sum1(io, mask_1)), ___main_cur_max_0))
+		__main_cur_max_0_lcssa = Sum32(io, __main_cur_max_0_lcssa_3, __main_cur_max_0_lcssa_4, Mask32(io, Not1(io, Sum1(io, mask_3, mask_4)), __main_cur_max_0_lcssa))
+		__main_cur_max_03 = Sum32(io, __main_cur_max_03_5, __main_cur_max_03_6, Mask32(io, Not1(io, Sum1(io, mask_5, mask_6)), __main_cur_max_03))
+		__main_i_0__main_max_i_0 = Sum32(io, __main_i_0__main_max_i_0_1, Mask32(io, Not1(io, Sum1(io, mask_1)), __main_i_0__main_max_i_0))
+		__main_i_01 = Sum32(io, __main_i_01_5, __main_i_01_6, Mask32(io, Not1(io, Sum1(io, mask_5, mask_6)), __main_i_01))
+		__main_max_i_0_lcssa = Sum32(io, __main_max_i_0_lcssa_3, __main_max_i_0_lcssa_4, Mask32(io, Not1(io, Sum1(io, mask_3, mask_4)), __main_max_i_0_lcssa))
+		__main_max_i_02 = Sum32(io, __main_max_i_02_5, __main_max_i_02_6, Mask32(io, Not1(io, Sum1(io, mask_5, mask_6)), __main_max_i_02))
+		_block0 = Sum1(io, _block0_0, Mask1(io, Not1(io, Sum1(io, mask_0)), _block0))
+		_block1 = Sum1(io, _block1_1, _block1_5, _block1_6, Mask1(io, Not1(io, Sum1(io, mask_1, mask_5, mask_6)), _block1))
+		_block2 = Sum1(io, _block2_3, _block2_4, Mask1(io, Not1(io, Sum1(io, mask_3, mask_4)), _block2))
+		_block3 = Sum1(io, _block3_1, _block3_3, Mask1(io, Not1(io, Sum1(io, mask_1, mask_3)), _block3))
+		_block4 = Sum1(io, _block4_0, _block4_4, Mask1(io, Not1(io, Sum1(io, mask_0, mask_4)), _block4))
+		_block5 = Sum1(io, _block5_0, _block5_5, Mask1(io, Not1(io, Sum1(io, mask_0, mask_5)), _block5))
+		_block6 = Sum1(io, _block6_1, _block6_6, Mask1(io, Not1(io, Sum1(io, mask_1, mask_6)), _block6))
+		_vAnswer = Sum32(io, _vAnswer_2)
+		_vIsDone = Sum1(io, _vIsDone_2)
+
+		/* are we done? */
+		done = Reveal1(io, _vIsDone)
+	}
+	answer := Output32(io, _vAnswer)
+	fmt.Printf("%d: %v\n", io.Id(), answer)
+}
+
+// <label>:0
+func block0(io Io, ch chan Share, mask Share) {
+	_1 := Input32(io, mask, Uint32(io, 0))
+	_2 := NumPeers32(io)
+	_3 := Icmp_ugt32(io, _2, Uint32(io, 1))
+	_block0 := Uint1(io, 0)
+	_block5 := _3
+	_block4 := Xor1(io, _3, Uint1(io, 1))
+	ch <- Mask32(io, mask, _1)
+	ch <- Mask1(io, mask, _block0)
+	ch <- Mask1(io, mask, _block4)
+	ch <- Mask1(io, mask, _block5)
+}
+
+// <label>:.lr.ph
+func block1(io Io, ch chan Share, mask Share, __main_cur_max_03 Share, __main_i_01 Share, __main_max_i_02 Share) {
+	_4 := Input32(io, mask, __main_i_01)
+	_5 := Icmp_ugt32(io, _4, __main_cur_max_03)
+	__main_i_0__main_max_i_0 := Select32(io, _5, __main_i_01, __main_max_i_02)
+	___main_cur_max_0 := Select32(io, _5, _4, __main_cur_max_03)
+	_6 := Add32(io, __main_i_01, Uint32(io, 1))
+	_7 := NumPeers32(io)
+	_8 := Icmp_ult32(io, _6, _7)
+	_block1 := Uint1(io, 0)
+	_block6 := _8
+	_block3 := Xor1(io, _8, Uint1(io, 1))
+	ch <- Mask32(io, mask, _6)
+	ch <- Mask32(io, mask, ___main_cur_max_0)
+	ch <- Mask32(io, mask, __main_i_0__main_max_i_0)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block3)
+	ch <- Mask1(io, mask, _block6)
+}
+
+// <label>:._crit_edge
+func block2(io Io, ch chan Share, mask Share, __main_cur_max_0_lcssa Share, __main_max_i_0_lcssa Share) {
+	Printf(io, mask, "Participant %d had max value %d\n", __main_max_i_0_lcssa, __main_cur_max_0_lcssa)
+	_vAnswer := Uint32(io, 0)
+	_vIsDone := Uint1(io, 1)
+	ch <- Mask32(io, mask, _vAnswer)
+	ch <- Mask1(io, mask, _vIsDone)
+}
+
+// <label>:vLabel3
+func block3(io Io, ch chan Share, mask Share, ___main_cur_max_0 Share, __main_i_0__main_max_i_0 Share) {
+	_x12 := __main_i_0__main_max_i_0
+	_x13 := ___main_cur_max_0
+	__main_max_i_0_lcssa := _x12
+	__main_cur_max_0_lcssa := _x13
+	_block3 := Uint1(io, 0)
+	_block2 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_max_0_lcssa)
+	ch <- Mask32(io, mask, __main_max_i_0_lcssa)
+	ch <- Mask1(io, mask, _block2)
+	ch <- Mask1(io, mask, _block3)
+}
+
+// <label>:vLabel2
+func block4(io Io, ch chan Share, mask Share, _1 Share) {
+	_x10 := Uint32(io, 0)
+	_x11 := _1
+	__main_max_i_0_lcssa := _x10
+	__main_cur_max_0_lcssa := _x11
+	_block4 := Uint1(io, 0)
+	_block2 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_max_0_lcssa)
+	ch <- Mask32(io, mask, __main_max_i_0_lcssa)
+	ch <- Mask1(io, mask, _block2)
+	ch <- Mask1(io, mask, _block4)
+}
+
+// <label>:vLabel1
+func block5(io Io, ch chan Share, mask Share, _1 Share) {
+	_x7 := Uint32(io, 1)
+	_x8 := Uint32(io, 0)
+	_x9 := _1
+	__main_i_01 := _x7
+	__main_max_i_02 := _x8
+	__main_cur_max_03 := _x9
+	_block5 := Uint1(io, 0)
+	_block1 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_max_03)
+	ch <- Mask32(io, mask, __main_i_01)
+	ch <- Mask32(io, mask, __main_max_i_02)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block5)
+}
+
+// <label>:vLabel0
+func block6(io Io, ch chan Share, mask Share, _6 Share, ___main_cur_max_0 Share, __main_i_0__main_max_i_0 Share) {
+	_x4 := _6
+	_x5 := __main_i_0__main_max_i_0
+	_x6 := ___main_cur_max_0
+	__main_i_01 := _x4
+	__main_max_i_02 := _x5
+	__main_cur_max_03 := _x6
+	_block6 := Uint1(io, 0)
+	_block1 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_max_03)
+	ch <- Mask32(io, mask, __main_i_01)
+	ch <- Mask32(io, mask, __main_max_i_02)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block6)
+}
+
+var Handle = MPC{Main: blocks_main}
@@ -0,0 +1,498 @@
+package spdz
+
+// Networked parties.
+//
+// Each pair of parties has one TCP connection: party i listens for each
+// party j > i on port Ports[i]+j, and dials each party j < i.  If the
+// config file gives keys, the connection is a secure channel (see the
+// secure package), the dialer being the initiator.  The parties then
+// exchange a hello with their ids and the ID of their preprocessed
+// material, so parties with material from different runs do not start.
+//
+// After the hello the connection carries the values that the parties
+// broadcast, as 8-byte big-endian integers, in order.  When a party is
+// done it flushes what it has sent and closes the connection; a party
+// that still expects a value from it aborts.  In the offline phase the
+// connection carries frames instead, see frame.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/ot"
+	"github.com/tjim/smpcc/runtime/secure"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Connect to the other parties and run the computation as party
+// pre.Party, with the preprocessed material pre and inputs.  SetupPeer
+// returns when runPeer returns, or with an error when the computation is
+// aborted: ctx is done, a connection fails, or runPeer aborts.
+func SetupPeer(ctx context.Context, pre *Preprocessed, inputs []uint32, runPeer func(Io)) error {
+	if err := pre.check(pre.Party, len(Hosts)); err != nil {
+		return err
+	}
+	x := newX(ctx, pre, inputs)
+	defer x.cancel(nil)
+	return x.runNetwork(pre.ID, x.connect, runPeer)
+}
+
+// offlineID is the ID of the hello of the offline phase, so that parties
+// of the offline phase do not talk to parties of the online phase
+var offlineID = []byte("offline")
+
+// Connect to the other parties and run the offline phase as party id,
+// generating numTriples triples, numMasks input masks for each party, and
+// numBits random bits (see RandomBit).  Every party must ask for the same
+// numbers.
+func SetupOffline(ctx context.Context, id, numTriples, numMasks, numBits int) (*Preprocessed, error) {
+	n := len(Hosts)
+	if id < 0 || id >= n {
+		return nil, fmt.Errorf("party %d of %d", id, n)
+	}
+	x := newBareX(ctx, id, n)
+	defer x.cancel(nil)
+	chans := make([]*otChans, n)
+	connect := func(j int, conn net.Conn, sent *sync.WaitGroup) {
+		chans[j] = newOTChans()
+		x.connectOffline(j, conn, chans[j], sent)
+	}
+	var pre *Preprocessed
+	err := x.runNetwork(offlineID, connect, func(Io) {
+		pre = x.offline(chans, numTriples, numMasks, numBits)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pre, nil
+}
+
+// runNetwork connects to the other parties, sending the hello with id,
+// and runs runPeer, with connect setting up the channels over each
+// connection.  The values that connect sends must be done when sent is.
+func (x *X) runNetwork(id []byte, connect func(j int, conn net.Conn, sent *sync.WaitGroup), runPeer func(Io)) error {
+	n := len(x.rchannels)
+	type dialed struct {
+		party int
+		conn  net.Conn
+		err   error
+	}
+	conns := make([]net.Conn, n)
+	done := make(chan dialed, n)
+	for j := 0; j < n; j++ {
+		if j == x.id {
+			continue
+		}
+		go func(j int) {
+			conn, err := x.dial(j, id)
+			done <- dialed{j, conn, err}
+		}(j)
+	}
+	var err error
+	for j := 0; j < n-1; j++ {
+		d := <-done
+		if d.err != nil && err == nil {
+			err = d.err
+			x.cancel(err) // the other connections fail too
+		}
+		conns[d.party] = d.conn
+	}
+	if err != nil {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		return err
+	}
+	var sent sync.WaitGroup
+	for j, conn := range conns {
+		if conn != nil {
+			connect(j, conn, &sent)
+		}
+	}
+	err = x.Run(runPeer)
+	if err == nil {
+		// flush what we have sent before closing the connections
+		for j, ch := range x.wchannels {
+			if j != x.id {
+				close(ch)
+			}
+		}
+		sent.Wait()
+	}
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	return err
+}
+
+// dial connects to party j, in either direction, and exchanges the hello.
+func (x *X) dial(j int, id []byte) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if j < x.id {
+		conn, err = x.connectTo(j)
+	} else {
+		conn, err = x.listenFor(j)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connection to party %d: %v", j, err)
+	}
+	stop := context.AfterFunc(x.ctx, func() { conn.Close() })
+	defer stop()
+	if err := hello(conn, x.id, j, id); err != nil {
+		conn.Close()
+		if x.ctx.Err() != nil {
+			return nil, x.Err()
+		}
+		return nil, fmt.Errorf("connection to party %d: %v", j, err)
+	}
+	return conn, nil
+}
+
+// connectTo dials party j, retrying until it is listening.
+func (x *X) connectTo(j int) (net.Conn, error) {
+	addr := fmt.Sprintf("%s:%d", Hosts[j], Ports[j]+x.id)
+	for {
+		var d net.Dialer
+		conn, err := d.DialContext(x.ctx, "tcp", addr)
+		if err == nil {
+			return secureConn(conn, j, true)
+		}
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-x.ctx.Done():
+			return nil, x.Err()
+		}
+	}
+}
+
+// listenFor accepts the connection of party j.
+func (x *X) listenFor(j int) (net.Conn, error) {
+	addr := fmt.Sprintf("%s:%d", Hosts[x.id], Ports[x.id]+j)
+	var lc net.ListenConfig
+	listener, err := lc.Listen(x.ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(x.ctx, func() { listener.Close() })
+	defer stop()
+	conn, err := listener.Accept()
+	listener.Close()
+	if err != nil {
+		if x.ctx.Err() != nil {
+			return nil, x.Err()
+		}
+		return nil, err
+	}
+	return secureConn(conn, j, false)
+}
+
+// Wrap conn in a secure channel if the config file gave a key for party,
+// as in gmw.  Either every party has a key or none does.
+func secureConn(conn net.Conn, party int, initiator bool) (net.Conn, error) {
+	peer, ok := Keys[party]
+	if !ok {
+		if len(Keys) > 0 {
+			conn.Close()
+			return nil, fmt.Errorf("no key for party %d in config", party)
+		}
+		return conn, nil
+	}
+	if MyKeys == nil {
+		conn.Close()
+		return nil, errors.New("config has keys but no private key was given")
+	}
+	handshake := secure.Server
+	if initiator {
+		handshake = secure.Client
+	}
+	sconn, err := handshake(conn, MyKeys, peer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sconn, nil
+}
+
+// hello sends our id and the ID of our material to party j, and checks
+// what it sends back.
+func hello(conn net.Conn, me, j int, id []byte) error {
+	msg := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint32(msg, uint32(me))
+	binary.BigEndian.PutUint32(msg[4:], uint32(len(id)))
+	copy(msg[8:], id)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(msg)
+		errc <- err
+	}()
+	reply := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	switch {
+	case binary.BigEndian.Uint32(reply) != uint32(j):
+		return fmt.Errorf("peer says it is party %d", binary.BigEndian.Uint32(reply))
+	case !bytes.Equal(reply[4:], msg[4:]):
+		return errors.New("the preprocessed material of the peer is from another run")
+	}
+	return nil
+}
+
+// connect sends and receives the values for party j over conn.
+func (x *X) connect(j int, conn net.Conn, sent *sync.WaitGroup) {
+	wch := make(chan uint64, channelBuffer)
+	rch := make(chan uint64, channelBuffer)
+	x.wchannels[j] = wch
+	x.rchannels[j] = rch
+	sent.Add(1)
+	go func() {
+		defer sent.Done()
+		if err := x.send(conn, wch); err != nil && x.ctx.Err() == nil {
+			x.cancel(fmt.Errorf("connection to party %d: %v", j, err))
+		}
+	}()
+	go func() {
+		if err := x.receive(conn, rch); err != nil && x.ctx.Err() == nil {
+			x.cancel(fmt.Errorf("connection to party %d: %v", j, err))
+		}
+	}()
+}
+
+// send writes the values of ch to conn until ch is closed.
+func (x *X) send(conn net.Conn, ch chan uint64) error {
+	w := bufio.NewWriter(conn)
+	var buf [8]byte
+	for {
+		select {
+		case v, ok := <-ch:
+			if !ok {
+				return w.Flush()
+			}
+			binary.BigEndian.PutUint64(buf[:], v)
+			if _, err := w.Write(buf[:]); err != nil {
+				return err
+			}
+			if len(ch) == 0 {
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+		case <-x.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// receive reads values from conn to ch.  At the end of the stream it
+// closes ch, so that a party still waiting for a value aborts.
+func (x *X) receive(conn net.Conn, ch chan uint64) error {
+	r := bufio.NewReader(conn)
+	var buf [8]byte
+	for {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			if err == io.EOF {
+				close(ch)
+				return nil
+			}
+			return err
+		}
+		select {
+		case ch <- binary.BigEndian.Uint64(buf[:]):
+		case <-x.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// A frame is a message of the offline phase.  The connections of the
+// offline phase carry the values that the parties broadcast and the
+// messages of the oblivious transfers, so they carry gob-encoded frames,
+// each for the channel Ch at the other end.
+type frame struct {
+	Ch    byte
+	Word  uint64
+	Bytes []byte
+	Pair  ot.MessagePair
+	Int   *big.Int
+	Ciph  ot.HashedElGamalCiph
+}
+
+const (
+	frameWord = iota
+	frameParam
+	frameRecvPk
+	frameSendEncs
+	frameS2R0
+	frameR2S0
+	frameS2R1
+	frameR2S1
+)
+
+// connectOffline sends and receives the values and the OT messages for
+// party j over conn, see frame.
+func (x *X) connectOffline(j int, conn net.Conn, c *otChans, sent *sync.WaitGroup) {
+	wch := make(chan uint64, channelBuffer)
+	rch := make(chan uint64, channelBuffer)
+	x.wchannels[j] = wch
+	x.rchannels[j] = rch
+	fail := func(err error) {
+		if err != nil && x.ctx.Err() == nil {
+			x.cancel(fmt.Errorf("connection to party %d: %v", j, err))
+		}
+	}
+	w := bufio.NewWriter(conn)
+	enc := gob.NewEncoder(w)
+	var mu sync.Mutex
+	write := func(f *frame) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	out := func(f func() error) {
+		go func() { fail(f()) }()
+	}
+
+	/* the channels that we send on, and the channels that j sends on */
+	sent.Add(1)
+	go func() {
+		defer sent.Done()
+		for {
+			select {
+			case v, ok := <-wch:
+				if !ok {
+					return
+				}
+				if err := write(&frame{Ch: frameWord, Word: v}); err != nil {
+					fail(err)
+					return
+				}
+			case <-x.ctx.Done():
+				return
+			}
+		}
+	}()
+	in := map[byte]func(f *frame){
+		frameWord: func(f *frame) { deliver(x.ctx, rch, f.Word) },
+	}
+	if x.id < j {
+		out(func() error {
+			return forward(x.ctx, c.np.NpRecvPk, func(v *big.Int) error { return write(&frame{Ch: frameRecvPk, Int: v}) })
+		})
+		out(func() error {
+			return forward(x.ctx, c.s2r[0], func(v ot.MessagePair) error { return write(&frame{Ch: frameS2R0, Pair: v}) })
+		})
+		out(func() error {
+			return forward(x.ctx, c.r2s[1], func(v []byte) error { return write(&frame{Ch: frameR2S1, Bytes: v}) })
+		})
+		in[frameParam] = queue(x.ctx, c.np.ParamChan, func(f *frame) *big.Int { return f.Int })
+		in[frameSendEncs] = queue(x.ctx, c.np.NpSendEncs, func(f *frame) ot.HashedElGamalCiph { return f.Ciph })
+		in[frameR2S0] = queue(x.ctx, c.r2s[0], func(f *frame) []byte { return f.Bytes })
+		in[frameS2R1] = queue(x.ctx, c.s2r[1], func(f *frame) ot.MessagePair { return f.Pair })
+	} else {
+		out(func() error {
+			return forward(x.ctx, c.np.ParamChan, func(v *big.Int) error { return write(&frame{Ch: frameParam, Int: v}) })
+		})
+		out(func() error {
+			return forward(x.ctx, c.np.NpSendEncs, func(v ot.HashedElGamalCiph) error { return write(&frame{Ch: frameSendEncs, Ciph: v}) })
+		})
+		out(func() error {
+			return forward(x.ctx, c.r2s[0], func(v []byte) error { return write(&frame{Ch: frameR2S0, Bytes: v}) })
+		})
+		out(func() error {
+			return forward(x.ctx, c.s2r[1], func(v ot.MessagePair) error { return write(&frame{Ch: frameS2R1, Pair: v}) })
+		})
+		in[frameRecvPk] = queue(x.ctx, c.np.NpRecvPk, func(f *frame) *big.Int { return f.Int })
+		in[frameS2R0] = queue(x.ctx, c.s2r[0], func(f *frame) ot.MessagePair { return f.Pair })
+		in[frameR2S1] = queue(x.ctx, c.r2s[1], func(f *frame) []byte { return f.Bytes })
+	}
+
+	go func() {
+		dec := gob.NewDecoder(bufio.NewReader(conn))
+		for x.ctx.Err() == nil {
+			var f frame
+			if err := dec.Decode(&f); err != nil {
+				if err == io.EOF {
+					close(rch)
+					return
+				}
+				fail(err)
+				return
+			}
+			h, ok := in[f.Ch]
+			if !ok {
+				fail(fmt.Errorf("frame for channel %d", f.Ch))
+				return
+			}
+			h(&f)
+		}
+	}()
+}
+
+// forward calls f on the values of ch until f fails or ctx is done.
+func forward[T any](ctx context.Context, ch <-chan T, f func(T) error) error {
+	for {
+		select {
+		case v := <-ch:
+			if err := f(v); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// queue returns a handler that delivers the values of the frames, got by
+// get, on ch, in order and without waiting for the receiver.  The OT
+// messages of different channels are written by different goroutines, so
+// a frame can arrive before the last frames of another channel that its
+// receiver must read first.
+func queue[T any](ctx context.Context, ch chan<- T, get func(*frame) T) func(*frame) {
+	in := make(chan T)
+	go func() {
+		var q []T
+		for {
+			var out chan<- T
+			var next T
+			if len(q) > 0 {
+				out, next = ch, q[0]
+			}
+			select {
+			case v := <-in:
+				q = append(q, v)
+			case out <- next:
+				q = q[1:]
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func(f *frame) { deliver(ctx, in, get(f)) }
+}
+
+// deliver sends v on ch unless ctx is done first.
+func deliver[T any](ctx context.Context, ch chan<- T, v T) {
+	select {
+	case ch <- v:
+	case <-ctx.Done():
+	}
+}
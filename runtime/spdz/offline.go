@@ -0,0 +1,474 @@
+package spdz
+
+// Offline phase.
+//
+// The parties generate the material of the online phase between
+// themselves, in the style of MASCOT (Keller, Orsini, and Scholl, "MASCOT:
+// Faster Malicious Arithmetic Secure Computation with Oblivious Transfer",
+// http://eprint.iacr.org/2016/505), instead of getting it from a dealer:
+//
+//  1. Each party picks its share alpha_i of the MAC key, its shares of
+//     b and of combine candidates a_t and ahat_t for each triple, and its
+//     input masks R.
+//  2. Products.  For each pair of parties i, j, an oblivious linear
+//     evaluation (OLE, below) gives i and j shares of a_t,i*b_j and
+//     ahat_t,i*b_j, so each party gets shares of c_t = a_t*b and
+//     chat_t = ahat_t*b.
+//  3. Combine.  The parties toss a coin for random r_t and s_t, with r_1
+//     and s_1 fixed to 1, and take a = sum(r_t*a_t), c = sum(r_t*c_t), and
+//     ahat and chat by s_t.  The coefficients are in Z_2^S and may be
+//     even, so the 1 keeps a and ahat uniform.
+//  4. MACs.  An OLE of alpha_i with each value share v_j of party j gives
+//     i and j shares of alpha_i*v_j, so each party gets a share of the MAC
+//     alpha*v of each value, and of the input masks of every party.
+//  5. Correlation check.  The parties toss a coin for a random chi for
+//     each value, open sum(chi*v) + v_0 for an extra random value v_0, and
+//     check its MAC with the others below.
+//  6. Sacrifice.  The parties toss a coin for a random r for each triple,
+//     open rho = r*a - ahat, and check that r*c - chat - rho*b opens to 0,
+//     which holds only if c = a*b and chat = ahat*b.  Then they check the
+//     MACs of the opened values (see MACCheck), and keep (a, b, c).
+//  7. Random bits.  The parties make the random bits with some of the
+//     triples and input masks, as the online phase would (see RandomBit),
+//     and check the MACs of the values opened for them.
+//
+// The OLE is Gilboa's: for each bit x_k of its value x, the receiver
+// chooses between s_k and s_k + 2^k*y of the sender by oblivious transfer
+// (see the ot package), so that sum(received) - sum(s_k) = x*y.  Each
+// pair of parties runs a stream OT extension in each direction, and the
+// party with the lower id receives first.
+//
+// A party can send wrong messages in the OTs of an OLE, so that the result
+// is wrong only if a bit of the receiver is 1, and learn the bit from
+// whether the checks fail.  In the products the receiver's bits are those
+// of a candidate, which the combine hides in a random sum of candidates.
+// In the MACs the receiver's bits are those of its share of alpha, as in
+// MASCOT, and a party that guesses wrong is caught.  A receiver that uses
+// different shares of alpha for different values, or a sender that uses a
+// value that differs between its bits, gives the values MACs that fail the
+// correlation check, so that nothing is left to fail in the online phase.
+//
+// As in the online phase, the parties compute modulo 2^(K+S), and the
+// coefficients r are in Z_2^S (see Share).  A party that adds an error e
+// below 2^K to c must have r*e = ehat modulo 2^(K+S) to pass, which holds
+// for one r in 2^S; an error of 2^K or more does not reach the K bits of
+// a result.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/ot"
+	"math/big"
+	"sync"
+)
+
+// combine is the number of candidates in each a and ahat, see offline
+const combine = 3
+
+// otChans are the channels of the oblivious transfers between a pair of
+// parties.  Index 0 of s2r and r2s is for the stream sender of the lower
+// party, index 1 for the stream sender of the higher party.
+type otChans struct {
+	np  ot.NPChans
+	s2r [2]chan ot.MessagePair
+	r2s [2]chan []byte
+}
+
+func newOTChans() *otChans {
+	return &otChans{
+		np: ot.NPChans{
+			ParamChan:  make(chan *big.Int),
+			NpRecvPk:   make(chan *big.Int),
+			NpSendEncs: make(chan ot.HashedElGamalCiph),
+		},
+		s2r: [2]chan ot.MessagePair{make(chan ot.MessagePair), make(chan ot.MessagePair)},
+		r2s: [2]chan []byte{make(chan []byte), make(chan []byte)},
+	}
+}
+
+// pairOT is our end of the OT extensions with another party
+type pairOT struct {
+	sender   *ot.StreamSender
+	receiver *ot.StreamReceiver
+}
+
+// setupOT runs the base OTs with party j, over c, as gmw does: the lower
+// party is the base receiver.
+func (x *X) setupOT(j int, c *otChans) *pairOT {
+	var sender *ot.StreamSender
+	var receiver *ot.StreamReceiver
+	var err error
+	if x.id < j {
+		base := ot.NewNPReceiver(x.ctx, c.np.ParamChan, c.np.NpRecvPk, c.np.NpSendEncs)
+		if sender, err = ot.NewStreamSender(x.ctx, base, c.s2r[0], c.r2s[0]); err == nil {
+			receiver, err = ot.NewStreamReceiver(x.ctx, sender, c.r2s[1], c.s2r[1])
+		}
+	} else {
+		base := ot.NewNPSender(x.ctx, c.np.ParamChan, c.np.NpRecvPk, c.np.NpSendEncs)
+		if receiver, err = ot.NewStreamReceiver(x.ctx, base, c.r2s[0], c.s2r[0]); err == nil {
+			sender, err = ot.NewStreamSender(x.ctx, receiver, c.s2r[1], c.r2s[1])
+		}
+	}
+	if err != nil {
+		x.Abort(fmt.Errorf("OT setup with party %d: %v", j, err))
+	}
+	return &pairOT{sender, receiver}
+}
+
+// recoverAbort aborts the computation if an OT operation aborts
+func (x *X) recoverAbort() {
+	if r := recover(); r != nil {
+		a, ok := r.(ot.Abort)
+		if !ok {
+			panic(r)
+		}
+		x.Abort(a.Err)
+	}
+}
+
+// forPeers runs f for each other party concurrently, and waits for them.
+func (x *X) forPeers(f func(j int)) {
+	var wg sync.WaitGroup
+	for j := range x.rchannels {
+		if j == x.id {
+			continue
+		}
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			defer x.recoverAbort()
+			f(j)
+		}(j)
+	}
+	wg.Wait()
+	if x.ctx.Err() != nil {
+		x.Abort(x.Err())
+	}
+}
+
+// ole runs OLEs with every other party, with xs as receiver and ys as
+// sender.  recv[j][k] + (the send[k] of party j) = xs[k]*(the ys[k] of
+// party j).
+func (x *X) ole(ots []*pairOT, xs, ys []uint64) (recv, send [][]uint64) {
+	n := len(x.rchannels)
+	recv = make([][]uint64, n)
+	send = make([][]uint64, n)
+	x.forPeers(func(j int) {
+		if x.id < j {
+			recv[j] = x.oleReceive(j, ots[j].receiver, xs)
+			send[j] = x.oleSend(j, ots[j].sender, ys)
+		} else {
+			send[j] = x.oleSend(j, ots[j].sender, ys)
+			recv[j] = x.oleReceive(j, ots[j].receiver, xs)
+		}
+	})
+	return
+}
+
+// oleReceive chooses by the bits of xs, most significant first.
+func (x *X) oleReceive(j int, receiver *ot.StreamReceiver, xs []uint64) []uint64 {
+	result := make([]uint64, len(xs))
+	if len(xs) == 0 {
+		return result
+	}
+	choices := make([]byte, 8*len(xs))
+	for k, v := range xs {
+		binary.BigEndian.PutUint64(choices[8*k:], v)
+	}
+	msgs := receiver.ReceiveM(choices)
+	for i, m := range msgs {
+		if len(m) != 8 {
+			x.Abort(fmt.Errorf("party %d sent an OT message of %d bytes", j, len(m)))
+		}
+		result[i/64] += binary.BigEndian.Uint64(m)
+	}
+	return result
+}
+
+// oleSend sends to party j, by the bits of its choices.
+func (x *X) oleSend(j int, sender *ot.StreamSender, ys []uint64) []uint64 {
+	result := make([]uint64, len(ys))
+	if len(ys) == 0 {
+		return result
+	}
+	pad := ot.RandomBytes(8 * 64 * len(ys))
+	m0 := make([]ot.Message, 64*len(ys))
+	m1 := make([]ot.Message, 64*len(ys))
+	for i := range m0 {
+		s := binary.BigEndian.Uint64(pad[8*i:])
+		m0[i] = pad[8*i : 8*i+8]
+		m1[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(m1[i], s+ys[i/64]<<uint(63-i%64))
+		result[i/64] -= s
+	}
+	if x.cheat != nil {
+		x.cheat(j, m1)
+	}
+	sender.SendM(m0, m1)
+	return result
+}
+
+// offline runs the offline phase of party x over chans, the channels of
+// the OTs with the other parties, and returns its material.  Every party must
+// ask for the same numbers of triples, masks, and random bits.
+func (x *X) offline(chans []*otChans, numTriples, numMasks, numBits int) *Preprocessed {
+	n := len(x.rchannels)
+
+	/* agree on the sizes, and on an ID */
+	x.Broadcast(uint64(numTriples))
+	x.Broadcast(uint64(numMasks))
+	x.Broadcast(uint64(numBits))
+	for j := range x.rchannels {
+		if j == x.id {
+			continue
+		}
+		if t, m, b := x.Receive(j), x.Receive(j), x.Receive(j); t != uint64(numTriples) || m != uint64(numMasks) || b != uint64(numBits) {
+			x.Abort(fmt.Errorf("party %d asks for %d triples, %d masks and %d bits, not %d, %d and %d", j, t, m, b, numTriples, numMasks, numBits))
+		}
+	}
+	// the random bits use a mask of each party, and 2n-1 triples, each
+	numTriples += (2*n - 1) * numBits
+	numMasks += numBits
+	N := numTriples
+	seed := x.coinToss()
+	pre := &Preprocessed{
+		ID:        seed[:16],
+		Party:     x.id,
+		Parties:   n,
+		Alpha:     x.alpha,
+		Triples:   make([]Triple, N),
+		Masks:     make([][]Share, n),
+		OpenMasks: randomWords(numMasks),
+	}
+
+	ots := make([]*pairOT, n)
+	x.forPeers(func(j int) {
+		ots[j] = x.setupOT(j, chans[j])
+	})
+
+	/* products of the candidates */
+	T := combine * N
+	as, ahats, b := randomWords(T), randomWords(T), randomWords(N)
+	bs := make([]uint64, T)
+	for k := range bs {
+		bs[k] = b[k%N]
+	}
+	cands, bss := concat(as, ahats), concat(bs, bs)
+	recv, send := x.ole(ots, cands, bss)
+	prods := make([]uint64, 2*T)
+	for k := range prods {
+		prods[k] = cands[k] * bss[k]
+		for j := range recv {
+			if j != x.id {
+				prods[k] += recv[j][k] + send[j][k]
+			}
+		}
+	}
+
+	/* combine */
+	r := coefficients(x.coinToss(), 2*T)
+	a, c := combineCandidates(r[:T], as, prods[:T])
+	ahat, chat := combineCandidates(r[T:], ahats, prods[T:])
+
+	/* MACs; the values of all of the parties, then the masks of each */
+	M := 5*N + 1
+	vals := concat(a, ahat, b, c, chat, randomWords(1), pre.OpenMasks)
+	alphas := make([]uint64, len(vals))
+	for k := range alphas {
+		alphas[k] = x.alpha
+	}
+	recv, send = x.ole(ots, alphas, vals)
+	shares := make([]Share, len(vals))
+	for k, v := range vals {
+		shares[k] = Share{v, x.alpha * v}
+		for j := range recv {
+			if j != x.id {
+				shares[k].Mac += send[j][k]
+				if k < M {
+					shares[k].Mac += recv[j][k]
+				}
+			}
+		}
+	}
+	for p := range pre.Masks {
+		if p == x.id {
+			pre.Masks[p] = shares[M:]
+			continue
+		}
+		pre.Masks[p] = make([]Share, numMasks)
+		for k := range pre.Masks[p] {
+			pre.Masks[p][k] = Share{0, recv[p][M+k]}
+		}
+	}
+
+	/* correlation check, the MACs are checked after the sacrifice */
+	chi := coefficients(x.coinToss(), M-1+n*numMasks)
+	y := shares[M-1]
+	for k, s := range shares[:M-1] {
+		y = add(y, scale(chi[k], s))
+	}
+	for p := range pre.Masks {
+		for k, s := range pre.Masks[p] {
+			y = add(y, scale(chi[M-1+p*numMasks+k], s))
+		}
+	}
+	x.openAll([]Share{y})
+
+	/* sacrifice */
+	A, Ahat, B, C, Chat := shares[:N], shares[N:2*N], shares[2*N:3*N], shares[3*N:4*N], shares[4*N:5*N]
+	r = coefficients(x.coinToss(), N)
+	rhos := make([]Share, N)
+	for k := range rhos {
+		rhos[k] = sub(scale(r[k], A[k]), Ahat[k])
+	}
+	rho := x.openAll(rhos)
+	zs := make([]Share, N)
+	for k := range zs {
+		zs[k] = sub(sub(scale(r[k], C[k]), Chat[k]), scale(rho[k], B[k]))
+	}
+	for _, z := range x.openAll(zs) {
+		if z != 0 {
+			x.Abort(errors.New("sacrifice failed: a party cheated in the offline phase"))
+		}
+	}
+	if !x.MACCheck() {
+		x.Abort(errors.New("MAC check failed in the offline phase"))
+	}
+	for k := range pre.Triples {
+		pre.Triples[k] = Triple{A[k], B[k], C[k]}
+	}
+
+	/* random bits, from the triples and masks for them */
+	x.triples, x.masks, x.openmasks = pre.Triples, pre.Masks, pre.OpenMasks
+	pre.Bits = make([]Share, numBits)
+	for k := range pre.Bits {
+		pre.Bits[k] = inputBit(x)
+	}
+	if !x.MACCheck() {
+		x.Abort(errors.New("MAC check of the random bits failed in the offline phase"))
+	}
+	pre.Triples, pre.Masks, pre.OpenMasks = x.triples, x.masks, x.openmasks
+	return pre
+}
+
+// combineCandidates returns a = sum(r_t*a_t) and c = sum(r_t*c_t) for the
+// candidates a_t in cands, and their products c_t in prods, with r_1 = 1
+// and the other r_t in r.
+func combineCandidates(r, cands, prods []uint64) (a, c []uint64) {
+	N := len(cands) / combine
+	a, c = append([]uint64{}, cands[:N]...), append([]uint64{}, prods[:N]...)
+	for i := N; i < len(cands); i++ {
+		a[i%N] += r[i] * cands[i]
+		c[i%N] += r[i] * prods[i]
+	}
+	return
+}
+
+// openAll opens ss, in one round for each channelBuffer values, so that
+// no party waits to broadcast while the others do
+func (x *X) openAll(ss []Share) []uint64 {
+	result := make([]uint64, len(ss))
+	for k, s := range ss {
+		result[k] = s.Val
+	}
+	for lo := 0; lo < len(ss); lo += channelBuffer {
+		hi := lo + channelBuffer
+		if hi > len(ss) {
+			hi = len(ss)
+		}
+		for _, s := range ss[lo:hi] {
+			x.Broadcast(s.Val)
+		}
+		for j := range x.rchannels {
+			if j == x.id {
+				continue
+			}
+			for k := lo; k < hi; k++ {
+				result[k] += x.Receive(j)
+			}
+		}
+	}
+	for k, s := range ss {
+		x.opened = append(x.opened, Share{result[k], s.Mac})
+	}
+	return result
+}
+
+func scale(c uint64, s Share) Share {
+	return Share{c * s.Val, c * s.Mac}
+}
+
+func add(s, t Share) Share {
+	return Share{s.Val + t.Val, s.Mac + t.Mac}
+}
+
+func sub(s, t Share) Share {
+	return Share{s.Val - t.Val, s.Mac - t.Mac}
+}
+
+func concat(xss ...[]uint64) []uint64 {
+	var result []uint64
+	for _, xs := range xss {
+		result = append(result, xs...)
+	}
+	return result
+}
+
+// newBareX returns party id of n with a fresh share of the MAC key and no
+// material, for the offline phase and for the fields.
+func newBareX(ctx context.Context, id, n int) *X {
+	return newX(ctx, &Preprocessed{Party: id, Parties: n, Alpha: rand64(), Masks: make([][]Share, n)}, nil)
+}
+
+// OfflineExample runs the offline phase for n parties connected by
+// channels in this process, and returns their material.
+func OfflineExample(n, numTriples, numMasks, numBits int) ([]*Preprocessed, error) {
+	return offlineExample(n, numTriples, numMasks, numBits, nil)
+}
+
+// offlineExample is OfflineExample, with cheat, if not nil, changing the
+// messages m1 that party from sends to party to in an OLE, so that the
+// tests can play a cheating OT sender.
+func offlineExample(n, numTriples, numMasks, numBits int, cheat func(from, to int, m1 []ot.Message)) ([]*Preprocessed, error) {
+	xs := make([]*X, n)
+	for id := range xs {
+		xs[id] = newBareX(context.Background(), id, n)
+		if cheat != nil {
+			id := id
+			xs[id].cheat = func(to int, m1 []ot.Message) { cheat(id, to, m1) }
+		}
+	}
+	connectExample(xs)
+	chans := make([][]*otChans, n)
+	for i := range chans {
+		chans[i] = make([]*otChans, n)
+	}
+	for i := range xs {
+		for j := i + 1; j < n; j++ {
+			c := newOTChans()
+			chans[i][j] = c
+			chans[j][i] = c
+		}
+	}
+	result := make([]*Preprocessed, n)
+	errs := make(chan error, n)
+	for i, x := range xs {
+		go func(i int, x *X) {
+			errs <- x.Run(func(Io) {
+				result[i] = x.offline(chans[i], numTriples, numMasks, numBits)
+			})
+		}(i, x)
+	}
+	var err error
+	for range xs {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
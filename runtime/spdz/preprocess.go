@@ -0,0 +1,138 @@
+package spdz
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Preprocessed is the material of one party from the offline phase: its
+// share of the MAC key, multiplication triples, input masks, and random
+// bits.
+type Preprocessed struct {
+	ID        []byte    // shared by the material of all of the parties of one run
+	Party     int       // id of the party, range is 0..Parties-1
+	Parties   int       // number of parties
+	Alpha     uint64    // share of the MAC key, see Share
+	Triples   []Triple  // multiplication triples
+	Masks     [][]Share // input masks, indexed by the party providing the input
+	OpenMasks []uint64  // values of the masks of the inputs of this party
+	Bits      []Share   // random bits, see RandomBit
+}
+
+// Deal plays a trusted dealer: it returns the material of n parties, with
+// numTriples triples and numMasks input masks for each party.  The dealer
+// knows all of the secrets, so use it only for testing.
+func Deal(n, numTriples, numMasks int) []*Preprocessed {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		panic("Error: random number generation")
+	}
+	alpha := rand64()
+	alphas := split_uint64(alpha, n)
+	result := make([]*Preprocessed, n)
+	for i := range result {
+		result[i] = &Preprocessed{
+			ID:        id,
+			Party:     i,
+			Parties:   n,
+			Alpha:     alphas[i],
+			Triples:   make([]Triple, numTriples),
+			Masks:     make([][]Share, n),
+			OpenMasks: make([]uint64, numMasks),
+		}
+		for j := range result[i].Masks {
+			result[i].Masks[j] = make([]Share, numMasks)
+		}
+	}
+
+	/* triples */
+	for k := 0; k < numTriples; k++ {
+		for i, t := range triple(n, alpha) {
+			result[i].Triples[k] = t
+		}
+	}
+
+	/* masks */
+	for k := 0; k < numMasks; k++ {
+		for i := range result {
+			R, r := mask(n, alpha)
+			result[i].OpenMasks[k] = R
+			for j := range r {
+				result[j].Masks[i][k] = r[j]
+			}
+		}
+	}
+	return result
+}
+
+// check returns an error if p is not the material of party id of n.
+func (p *Preprocessed) check(id, n int) error {
+	switch {
+	case p.Party != id:
+		return fmt.Errorf("preprocessed material of party %d, not %d", p.Party, id)
+	case p.Parties != n:
+		return fmt.Errorf("preprocessed material for %d parties, not %d", p.Parties, n)
+	case len(p.Masks) != n:
+		return fmt.Errorf("preprocessed material has masks for %d parties, not %d", len(p.Masks), n)
+	case len(p.OpenMasks) != len(p.Masks[id]):
+		return fmt.Errorf("preprocessed material has %d open masks for %d masks", len(p.OpenMasks), len(p.Masks[id]))
+	}
+	return nil
+}
+
+// WritePreprocessed writes p to filename, readable only by the owner.
+func WritePreprocessed(filename string, p *Preprocessed) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+// usedMarker replaces the material in a file read by ReadPreprocessed or
+// ReadFieldPreprocessed.
+var usedMarker = []byte("spdz: preprocessed material already used\n")
+
+// ReadPreprocessed reads material written by WritePreprocessed, checks
+// that it is the material of party id of n, and consumes it: the file is
+// overwritten before the material is returned, so that the same triples
+// and masks are never used in two computations.  A file that was already
+// read is refused, and a file that fails the check is left as it is.
+func ReadPreprocessed(filename string, id, n int) (*Preprocessed, error) {
+	var p Preprocessed
+	if err := readOnce(filename, &p, func() error { return p.check(id, n) }); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// readOnce decodes the material in filename into p, and consumes the file
+// if check passes.
+func readOnce(filename string, p interface{}, check func() error) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, usedMarker) {
+		return fmt.Errorf("%s: preprocessed material already used", filename)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(p); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := check(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(usedMarker); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,41 @@
+package spdz_test
+
+import (
+	"context"
+	. "github.com/tjim/smpcc/runtime/spdz"
+	"github.com/tjim/smpcc/runtime/spdz/max"
+	"github.com/tjim/smpcc/runtime/spdz/sum"
+	"github.com/tjim/smpcc/runtime/spdz/vickrey"
+	"testing"
+)
+
+// TestPrograms runs the programs that the compiler generated for the spdz
+// VM, and checks what they print.
+func TestPrograms(t *testing.T) {
+	tests := []struct {
+		name   string
+		mpc    MPC
+		inputs [][]uint32
+		want   string
+	}{
+		{"max", max.Handle, [][]uint32{{3}, {9}, {5}}, "Participant 1 had max value 9\n"},
+		{"sum", sum.Handle, [][]uint32{{1, 10}, {0, 20}, {1, 30}}, "20 40"},
+		{"vickrey", vickrey.Handle, [][]uint32{{3}, {9}, {5}}, "Bidder 1 pays 5\n"},
+	}
+	for _, test := range tests {
+		if err := Simulation(context.Background(), test.inputs, 100000, 10000, test.mpc.Main); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for range test.inputs {
+			select {
+			case got := <-MpcPrintsChan:
+				if got != test.want {
+					t.Errorf("%s printed %q, want %q", test.name, got, test.want)
+				}
+			default:
+				t.Errorf("%s printed nothing", test.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package spdz
+
+// Protocols on the bits of shared values.
+//
+// They follow Catrina and de Hoogh, "Improved Primitives for Secure
+// Multiparty Integer Computation", SCN 2010, modulo 2^(K+S) instead of a
+// prime.  The values are K-bit integers, and the bits of a share above K
+// are not those of the value (see Share), so a protocol that opens a
+// masked value x+r computes on the low bits of x+r, and masks the high
+// bits with a random multiple of 2^m, where m is the number of bits that
+// it needs.  The masks come from random bits (see RandomBit), and every
+// other product uses a triple.
+
+import "fmt"
+
+// RandomBit returns a Share of a random bit that no party knows, from the
+// bits of the offline phase, or from inputBit when they run out.
+func RandomBit(io Io) Share {
+	if b, ok := io.Bit(); ok {
+		return b
+	}
+	return inputBit(io)
+}
+
+// inputBit returns a Share of a random bit that no party knows: each party
+// inputs a random bit, and the result is their XOR, at the cost of an
+// input mask of each party and 2n-1 triples.  A party that inputs
+// something other than a bit is caught, as b*(b-1) is 0 modulo 2^(K+S)
+// only for the bits.
+func inputBit(io Io) Share {
+	var result Share
+	for p := 0; p < io.N(); p++ {
+		var v uint64
+		if p == io.Id() {
+			v = rand64() & 1
+		}
+		b := inputValue(io, p, v)
+		if io.Open(Mul(io, b, sub(b, constant(io, 1)))) != 0 {
+			io.Abort(fmt.Errorf("party %d input a random bit that is not a bit", p))
+		}
+		if p == 0 {
+			result = b
+		} else {
+			result = Xor1(io, result, b)
+		}
+	}
+	return result
+}
+
+// randomBits returns m random bits, and a Share of r = sum 2^i*r_i +
+// 2^m*t, for the bits r_i and a random t
+func randomBits(io Io, m int) ([]Share, Share) {
+	rs := make([]Share, m)
+	t, _, _ := io.Triple()
+	r := scale(1<<uint(m), t)
+	for i := range rs {
+		rs[i] = RandomBit(io)
+		r = Add(io, r, scale(1<<uint(i), rs[i]))
+	}
+	return rs, r
+}
+
+// BitDec returns the low m bits of x, LSB first.  The parties open x+r,
+// see randomBits, and compute the bits of x+r-r with a subtraction
+// circuit.
+func BitDec(io Io, x Share, m int) []Share {
+	rs, r := randomBits(io, m)
+	c := io.Open(Add(io, x, r))
+	result := make([]Share, m)
+	var borrow Share
+	for i := range result {
+		rb := Mul(io, rs[i], borrow)
+		d := sub(Add(io, rs[i], borrow), scale(2, rb)) // r_i xor borrow
+		if c>>uint(i)&1 == 1 {
+			result[i] = Not1(io, d)
+			borrow = rb
+		} else {
+			result[i] = d
+			borrow = sub(Add(io, rs[i], borrow), rb) // r_i or borrow
+		}
+	}
+	return result
+}
+
+// fromBits returns the value of bs, LSB first
+func fromBits(bs []Share) Share {
+	var result Share
+	for i, b := range bs {
+		result.Val += b.Val << uint(i)
+		result.Mac += b.Mac << uint(i)
+	}
+	return result
+}
+
+// Mod2m returns x modulo 2^m.  Unlike x, the result has no bits above m,
+// even above K.
+func Mod2m(io Io, x Share, m int) Share {
+	return fromBits(BitDec(io, x, m))
+}
+
+// EQZ tests whether x is 0 modulo 2^m.
+func EQZ(io Io, x Share, m int) Share {
+	xs := BitDec(io, x, m)
+	for len(xs) > 1 {
+		half := len(xs) / 2
+		for i := 0; i < half; i++ {
+			xs[i] = Or1(io, xs[i], xs[half+i])
+		}
+		xs = append(xs[:half], xs[2*half:]...)
+	}
+	return Not1(io, xs[0])
+}
+
+// EQ tests whether a = b modulo 2^m.
+func EQ(io Io, a, b Share, m int) Share {
+	return EQZ(io, sub(a, b), m)
+}
+
+// LT tests whether a < b, for a and b below 2^m.  For m < K, a < b if and
+// only if bit m of a-b+2^m is 0, which takes one BitDec; for m = K, LT
+// compares the bits of a and b.
+func LT(io Io, a, b Share, m int) Share {
+	if m < K {
+		z := Add(io, sub(a, b), constant(io, 1<<uint(m)))
+		return Not1(io, BitDec(io, z, m+1)[m])
+	}
+	return less(io, BitDec(io, a, m), BitDec(io, b, m))
+}
+
+// less tests whether as < bs, for bits LSB first: the result is the bit
+// of bs where they last differ.
+func less(io Io, as, bs []Share) Share {
+	var c Share
+	for i := range as {
+		e := Xor1(io, as[i], bs[i])
+		c = Add(io, c, Mul(io, e, sub(bs[i], c)))
+	}
+	return c
+}
+
+// Trunc returns x/2^m for m < K, rounded down or, with probability (x mod
+// 2^m)/2^m, up.  The parties open c = x+r, see randomBits, and x/2^m is
+// c/2^m - r/2^m, plus the carry from the low m bits of x+r, which is
+// the random rounding, and less 2^(K-m) if x+r wrapped modulo 2^K, which
+// they compute from the bits of r.
+func Trunc(io Io, x Share, m int) Share {
+	rs, r := randomBits(io, K)
+	c := io.Open(Add(io, x, r)) & (1<<K - 1)
+	var wrap Share // c < r modulo 2^K
+	for i, ri := range rs {
+		e := ri // c_i xor r_i
+		if c>>uint(i)&1 == 1 {
+			e = Not1(io, ri)
+		}
+		wrap = Add(io, wrap, Mul(io, e, sub(ri, wrap)))
+	}
+	result := sub(constant(io, c>>uint(m)), fromBits(rs[m:]))
+	return Add(io, result, scale(1<<uint(K-m), wrap))
+}
@@ -0,0 +1,424 @@
+package spdz
+
+// 64-bit SPDZ2k.
+//
+// Share128 and the functions below are the online phase of SPDZ2k for
+// programs whose values are 64-bit integers: K and S are both 64, so the
+// parties compute modulo 2^128, in Uint128, and the MACs too.  A party
+// that changes a value by an error below 2^64 passes a MAC check with
+// probability about 2^-(64-log 64), as for Share.  An X128 runs on an X,
+// sending each element as two words, as a FieldX does, so it uses the
+// same channels, networking, commitments, and aborts (see SetupPeer128
+// and Example128).
+//
+// The material comes from Deal128; the offline phase of RunOffline is for
+// Share only.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/ot"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// A Uint128 is an integer modulo 2^128.
+type Uint128 struct {
+	Hi, Lo uint64
+}
+
+func (a Uint128) add(b Uint128) Uint128 {
+	lo, carry := bits.Add64(a.Lo, b.Lo, 0)
+	hi, _ := bits.Add64(a.Hi, b.Hi, carry)
+	return Uint128{hi, lo}
+}
+
+func (a Uint128) sub(b Uint128) Uint128 {
+	lo, borrow := bits.Sub64(a.Lo, b.Lo, 0)
+	hi, _ := bits.Sub64(a.Hi, b.Hi, borrow)
+	return Uint128{hi, lo}
+}
+
+func (a Uint128) mul(b Uint128) Uint128 {
+	hi, lo := bits.Mul64(a.Lo, b.Lo)
+	return Uint128{hi + a.Hi*b.Lo + a.Lo*b.Hi, lo}
+}
+
+func rand128() Uint128 {
+	return Uint128{rand64(), rand64()}
+}
+
+// random64 reads a uint64 from r
+func random64(r io.Reader) uint64 {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		panic("Error: random number generation")
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+/* Shares of a value x and of its MAC alpha*x, modulo 2^128 */
+type Share128 struct {
+	Val Uint128
+	Mac Uint128
+}
+
+/* Shares of a multiplication triple, C = A*B */
+type Triple128 struct {
+	A, B, C Share128
+}
+
+type Io128 interface {
+	Id() int
+	Alpha() Uint128
+	Triple() (a, b, c Share128)
+	Mask(int) (r Share128)
+	MaskOpen() (r Share128, R Uint128)
+	Open(Share128) Uint128
+	GetInput() uint64
+	Broadcast(Uint128)
+	Receive(party int) Uint128
+	MACCheck() bool
+	Abort(error)
+}
+
+// Preprocessed128 is the material of one party for Share128, see
+// Preprocessed.
+type Preprocessed128 struct {
+	ID        []byte
+	Party     int
+	Parties   int
+	Alpha     Uint128
+	Triples   []Triple128
+	Masks     [][]Share128 // indexed by the party providing the input
+	OpenMasks []Uint128
+}
+
+// Deal128 plays a trusted dealer for Share128, see Deal.
+func Deal128(n, numTriples, numMasks int) []*Preprocessed128 {
+	id := ot.RandomBytes(16)
+	alpha := rand128()
+	alphas := split128(alpha, n)
+	result := make([]*Preprocessed128, n)
+	for i := range result {
+		result[i] = &Preprocessed128{
+			ID:        id,
+			Party:     i,
+			Parties:   n,
+			Alpha:     alphas[i],
+			Triples:   make([]Triple128, numTriples),
+			Masks:     make([][]Share128, n),
+			OpenMasks: make([]Uint128, numMasks),
+		}
+		for j := range result[i].Masks {
+			result[i].Masks[j] = make([]Share128, numMasks)
+		}
+	}
+	for k := 0; k < numTriples; k++ {
+		a, b := rand128(), rand128()
+		as := shares128(a, n, alpha)
+		bs := shares128(b, n, alpha)
+		cs := shares128(a.mul(b), n, alpha)
+		for i := range result {
+			result[i].Triples[k] = Triple128{as[i], bs[i], cs[i]}
+		}
+	}
+	for k := 0; k < numMasks; k++ {
+		for i := range result {
+			R := rand128()
+			result[i].OpenMasks[k] = R
+			for j, r := range shares128(R, n, alpha) {
+				result[j].Masks[i][k] = r
+			}
+		}
+	}
+	return result
+}
+
+/* return a slice of n random values that sum to x */
+func split128(x Uint128, n int) []Uint128 {
+	result := make([]Uint128, n)
+	for i := 1; i < n; i++ {
+		result[i] = rand128()
+		x = x.sub(result[i])
+	}
+	result[0] = x
+	return result
+}
+
+func shares128(x Uint128, n int, alpha Uint128) []Share128 {
+	vals := split128(x, n)
+	macs := split128(alpha.mul(x), n)
+	result := make([]Share128, n)
+	for i := range result {
+		result[i] = Share128{vals[i], macs[i]}
+	}
+	return result
+}
+
+// check returns an error if p is not the material of party id of n.
+func (p *Preprocessed128) check(id, n int) error {
+	switch {
+	case p.Party != id:
+		return fmt.Errorf("preprocessed material of party %d, not %d", p.Party, id)
+	case p.Parties != n:
+		return fmt.Errorf("preprocessed material for %d parties, not %d", p.Parties, n)
+	case len(p.Masks) != n:
+		return fmt.Errorf("preprocessed material has masks for %d parties, not %d", len(p.Masks), n)
+	case len(p.OpenMasks) != len(p.Masks[id]):
+		return fmt.Errorf("preprocessed material has %d open masks for %d masks", len(p.OpenMasks), len(p.Masks[id]))
+	}
+	return nil
+}
+
+// WritePreprocessed128 writes p to filename, readable only by the owner.
+func WritePreprocessed128(filename string, p *Preprocessed128) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+// ReadPreprocessed128 reads material written by WritePreprocessed128,
+// checks that it is the material of party id of n, and consumes it, as
+// ReadPreprocessed.
+func ReadPreprocessed128(filename string, id, n int) (*Preprocessed128, error) {
+	var p Preprocessed128
+	if err := readOnce(filename, &p, func() error { return p.check(id, n) }); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// X128 is a party of a computation on 64-bit values, on the X x.
+type X128 struct {
+	x         *X
+	alpha     Uint128
+	triples   []Triple128
+	masks     [][]Share128
+	openmasks []Uint128
+	inputs    []uint64
+	opened    []Share128 /* values opened since the last MAC check */
+}
+
+func newX128(x *X, pre *Preprocessed128, inputs []uint64) *X128 {
+	return &X128{
+		x:         x,
+		alpha:     pre.Alpha,
+		triples:   pre.Triples,
+		masks:     pre.Masks,
+		openmasks: pre.OpenMasks,
+		inputs:    inputs,
+	}
+}
+
+// Example128 returns n parties connected by channels in this process,
+// with material from Deal128.  Party i has the input i.
+func Example128(n int) []*X128 {
+	pres := Deal128(n, 200, 10)
+	xs := make([]*X, n)
+	for id := range xs {
+		xs[id] = newBareX(context.Background(), id, n)
+	}
+	connectExample(xs)
+	result := make([]*X128, n)
+	for id := range result {
+		result[id] = newX128(xs[id], pres[id], []uint64{uint64(id)})
+	}
+	return result
+}
+
+// Connect to the other parties and run the computation on 64-bit values
+// as party pre.Party, see SetupPeer.
+func SetupPeer128(ctx context.Context, pre *Preprocessed128, inputs []uint64, runPeer func(Io128)) error {
+	if err := pre.check(pre.Party, len(Hosts)); err != nil {
+		return err
+	}
+	x := newBareX(ctx, pre.Party, pre.Parties)
+	defer x.cancel(nil)
+	x128 := newX128(x, pre, inputs)
+	return x.runNetwork(pre.ID, x.connect, func(Io) { runPeer(x128) })
+}
+
+// Run runs runPeer on x, see X.Run.
+func (x *X128) Run(runPeer func(Io128)) error {
+	return x.x.Run(func(Io) { runPeer(x) })
+}
+
+func (x *X128) Id() int {
+	return x.x.id
+}
+
+func (x *X128) Alpha() Uint128 {
+	return x.alpha
+}
+
+func (x *X128) Triple() (a, b, c Share128) {
+	if len(x.triples) == 0 {
+		x.Abort(errors.New("out of multiplication triples"))
+	}
+	hd := x.triples[0]
+	x.triples = x.triples[1:]
+	return hd.A, hd.B, hd.C
+}
+
+func (x *X128) Mask(party int) Share128 {
+	if len(x.masks[party]) == 0 {
+		x.Abort(fmt.Errorf("out of masks for the inputs of party %d", party))
+	}
+	r := x.masks[party][0]
+	x.masks[party] = x.masks[party][1:]
+	return r
+}
+
+func (x *X128) MaskOpen() (Share128, Uint128) {
+	r := x.Mask(x.Id())
+	R := x.openmasks[0]
+	x.openmasks = x.openmasks[1:]
+	return r, R
+}
+
+func (x *X128) GetInput() uint64 {
+	if len(x.inputs) == 0 {
+		x.Abort(errors.New("out of inputs"))
+	}
+	result := x.inputs[0]
+	x.inputs = x.inputs[1:]
+	return result
+}
+
+func (x *X128) Broadcast(v Uint128) {
+	x.x.Broadcast(v.Hi)
+	x.x.Broadcast(v.Lo)
+}
+
+func (x *X128) Receive(party int) Uint128 {
+	if party == x.Id() {
+		return Uint128{}
+	}
+	return Uint128{x.x.Receive(party), x.x.Receive(party)}
+}
+
+func (x *X128) Open(s Share128) Uint128 {
+	x.Broadcast(s.Val)
+	result := s.Val
+	for i := range x.x.rchannels {
+		if i != x.Id() {
+			result = result.add(x.Receive(i))
+		}
+	}
+	x.opened = append(x.opened, Share128{result, s.Mac})
+	return result
+}
+
+// MACCheck checks the MACs of the values opened since the last check, as
+// X.MACCheck does, with coefficients in Z_2^64.
+func (x *X128) MACCheck() bool {
+	if len(x.opened) == 0 {
+		return true
+	}
+	opened := x.opened
+	x.opened = nil
+	seed := x.x.coinToss()
+	r := prg{ot.NewPRG(seed[:ot.SeedBytes])}
+	var a, gamma Uint128
+	for _, s := range opened {
+		c := Uint128{0, random64(r)}
+		a = a.add(c.mul(s.Val))
+		gamma = gamma.add(c.mul(s.Mac))
+	}
+	sigma := gamma.sub(x.alpha.mul(a))
+	var sum Uint128
+	for _, w := range x.x.commitOpen([]uint64{sigma.Hi, sigma.Lo}) {
+		sum = sum.add(Uint128{w[0], w[1]})
+	}
+	return sum == Uint128{}
+}
+
+func (x *X128) Abort(err error) {
+	x.x.Abort(err)
+}
+
+func Input128(io Io128, party int) Share128 {
+	if io.Id() == party {
+		X := Uint128{0, io.GetInput()}
+		r, R := io.MaskOpen()
+		delta := X.sub(R)
+		io.Broadcast(delta)
+		return Share128{r.Val.add(delta), r.Mac.add(io.Alpha().mul(delta))}
+	}
+	r := io.Mask(party)
+	delta := io.Receive(party)
+	return Share128{r.Val, r.Mac.add(io.Alpha().mul(delta))}
+}
+
+func Add128(io Io128, x, y Share128) Share128 {
+	return Share128{x.Val.add(y.Val), x.Mac.add(y.Mac)}
+}
+
+func Sub128(io Io128, x, y Share128) Share128 {
+	return Share128{x.Val.sub(y.Val), x.Mac.sub(y.Mac)}
+}
+
+// Scale128 multiplies x by the public c.
+func Scale128(io Io128, c uint64, x Share128) Share128 {
+	return scale128(Uint128{0, c}, x)
+}
+
+func scale128(c Uint128, x Share128) Share128 {
+	return Share128{c.mul(x.Val), c.mul(x.Mac)}
+}
+
+// AddConst128 adds the public c to x.
+func AddConst128(io Io128, c uint64, x Share128) Share128 {
+	return addConst128(io, Uint128{0, c}, x)
+}
+
+func addConst128(io Io128, c Uint128, x Share128) Share128 {
+	val := x.Val
+	if io.Id() == 0 {
+		val = val.add(c)
+	}
+	return Share128{val, x.Mac.add(io.Alpha().mul(c))}
+}
+
+func Mul128(io Io128, x, y Share128) Share128 {
+	a, b, c := io.Triple()
+	e := io.Open(Sub128(io, x, a))
+	r := io.Open(Sub128(io, y, b))
+	z := Add128(io, c, Add128(io, scale128(e, b), scale128(r, a)))
+	return addConst128(io, e.mul(r), z)
+}
+
+// Output128 opens the 64 bits of x to all parties, checking MACs and
+// hiding the bits above 64 as Output does.
+func Output128(io Io128, x Share128) uint64 {
+	return Outputs128(io, []Share128{x})[0]
+}
+
+// Outputs128 opens xs to all parties, with one MAC check for all of them.
+func Outputs128(io Io128, xs []Share128) []uint64 {
+	if !io.MACCheck() {
+		io.Abort(errors.New("MAC check failed"))
+	}
+	result := make([]uint64, len(xs))
+	for i, x := range xs {
+		a, _, _ := io.Triple()
+		result[i] = io.Open(Add128(io, x, scale128(Uint128{1, 0}, a))).Lo
+	}
+	if !io.MACCheck() {
+		io.Abort(errors.New("MAC check of the outputs failed"))
+	}
+	if log_results {
+		for _, v := range result {
+			fmt.Printf("%d: RESULT 0x%016x\n", io.Id(), v)
+		}
+	}
+	return result
+}
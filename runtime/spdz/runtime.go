@@ -0,0 +1,176 @@
+package spdz
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tjim/smpcc/runtime/input"
+	"github.com/tjim/smpcc/runtime/secure"
+	"os"
+	"strings"
+)
+
+// An MPC is a program that the compiler generated for this package (see
+// vm.go).  Its blocks run in turn on the Io of the party, so unlike
+// gmw.MPC it has no Io for each block.
+type MPC struct {
+	Main func(io Io)
+}
+
+var Hosts map[int]string = make(map[int]string)
+var Ports map[int]int = make(map[int]int)
+
+// Static public keys of the parties, from the config file.
+// If a party has a key then all connections with it use a secure channel.
+var Keys map[int]*[32]byte = make(map[int]*[32]byte)
+
+// The static key pair of this party, see the -key flag of Run.
+var MyKeys *secure.Keys
+
+var MpcPrintsChan chan string = make(chan string, 100)
+
+const base_port int = 4042
+
+// Read a configuration file in the format of gmw.ReadConfig: one line
+// host:port [key] per party, in order.  Fill in the maps Hosts, Ports,
+// and Keys.  Party i listens for party j on port Ports[i]+j.
+func ReadConfig(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	numParties := 0
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return fmt.Errorf("%s:%d: expected host:port [key]", filename, line)
+		}
+		var host string
+		var port int
+		parts := strings.Split(fields[0], ":")
+		if len(parts) == 2 {
+			host = parts[0]
+			fmt.Sscanf(parts[1], "%d", &port)
+		}
+		if host == "" || port <= 0 {
+			return fmt.Errorf("%s:%d: expected host:port [key]", filename, line)
+		}
+		Hosts[numParties] = host
+		Ports[numParties] = port
+		if len(fields) == 2 {
+			key, err := secure.UnmarshalPublicKey(fields[1])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", filename, line, err)
+			}
+			Keys[numParties] = key
+		}
+		numParties++
+	}
+	return scanner.Err()
+}
+
+func SetupHostsPorts(parties int) {
+	for i := 0; i < parties; i++ {
+		Hosts[i] = "127.0.0.1"
+		Ports[i] = base_port + i*parties
+	}
+}
+
+// Run the computation as a party, according to the command-line flags,
+// with the preprocessed material of the -pre flag (see Deal and
+// RunOffline).  Run returns when runPeer returns, or with an error
+// when the computation is aborted.
+func Run(ctx context.Context, runPeer func(Io)) error {
+	var id int
+	var parties int
+	var config string
+	var keyfile string
+	var prefile string
+	var inputfile string
+	flag.IntVar(&id, "id", 0, "id of this party")
+	flag.IntVar(&parties, "parties", 0, "number of parties, on localhost (without a config file)")
+	flag.StringVar(&config, "config", "", "config file")
+	flag.StringVar(&keyfile, "key", "", "private key file of this party (required if the config file has keys)")
+	flag.StringVar(&prefile, "pre", "", "file of the preprocessed material of this party, consumed by the run")
+	flag.StringVar(&inputfile, "input", "", "file of inputs, JSON or CSV, - for stdin; read before the inputs on the command line")
+	flag.Parse()
+	if err := setupNetwork(parties, config, keyfile); err != nil {
+		return err
+	}
+	source, err := input.Load(inputfile, flag.Args())
+	if err != nil {
+		return err
+	}
+	var inputs []uint32
+	for source.Len() > 0 {
+		x, err := source.Next(32)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, uint32(x))
+	}
+	// last, as it consumes the material
+	pre, err := ReadPreprocessed(prefile, id, len(Hosts))
+	if err != nil {
+		return err
+	}
+	return SetupPeer(ctx, pre, inputs, runPeer)
+}
+
+// Run the offline phase as a party, according to the command-line flags,
+// and write the preprocessed material of the party to the file of the
+// -out flag, for the -pre flag of Run.
+func RunOffline(ctx context.Context) error {
+	var id int
+	var parties int
+	var config string
+	var keyfile string
+	var outfile string
+	var numTriples int
+	var numMasks int
+	var numBits int
+	flag.IntVar(&id, "id", 0, "id of this party")
+	flag.IntVar(&parties, "parties", 0, "number of parties, on localhost (without a config file)")
+	flag.StringVar(&config, "config", "", "config file")
+	flag.StringVar(&keyfile, "key", "", "private key file of this party (required if the config file has keys)")
+	flag.StringVar(&outfile, "out", "", "file for the preprocessed material of this party")
+	flag.IntVar(&numTriples, "triples", 1000, "number of multiplication triples")
+	flag.IntVar(&numMasks, "masks", 100, "number of input masks for each party: each input uses one, and so does each random bit beyond -bits, of every party")
+	flag.IntVar(&numBits, "bits", 256, "number of random bits, for comparisons, truncations and bit decompositions: each uses one for each bit")
+	flag.Parse()
+	if outfile == "" {
+		return errors.New("no -out file")
+	}
+	if err := setupNetwork(parties, config, keyfile); err != nil {
+		return err
+	}
+	pre, err := SetupOffline(ctx, id, numTriples, numMasks, numBits)
+	if err != nil {
+		return err
+	}
+	return WritePreprocessed(outfile, pre)
+}
+
+// setupNetwork reads the key file and the config file of the flags, or
+// sets up parties on localhost without a config file.
+func setupNetwork(parties int, config, keyfile string) error {
+	if keyfile != "" {
+		keys, err := secure.ReadKeys(keyfile)
+		if err != nil {
+			return err
+		}
+		MyKeys = keys
+	}
+	if config != "" {
+		return ReadConfig(config)
+	}
+	SetupHostsPorts(parties)
+	return nil
+}
@@ -0,0 +1,233 @@
+package sum
+
+import . "github.com/tjim/smpcc/runtime/spdz"
+import "fmt"
+
+func initialize_ram(io Io) {
+	ram := make([]Share, 0x8)
+	// @.str at location 0 == 0x0
+	ram[0x0] = Uint8(io, 0x25)
+	ram[0x1] = Uint8(io, 0x64)
+	ram[0x2] = Uint8(io, 0x20)
+	ram[0x3] = Uint8(io, 0x25)
+	ram[0x4] = Uint8(io, 0x64)
+	io.InitRam(ram)
+}
+
+func blocks_main(io Io) {
+
+	initialize_ram(io)
+
+	/* create output channels */
+	ch0 := make(chan Share, 3)
+	ch1 := make(chan Share, 6)
+	ch2 := make(chan Share, 2)
+	ch3 := make(chan Share, 4)
+	ch4 := make(chan Share, 4)
+	ch5 := make(chan Share, 5)
+	ch6 := make(chan Share, 5)
+
+	/* special variables */
+	_vAnswer := Uint32(io, 0)
+	_vIsDone := Uint1(io, 0)
+
+	/* block masks */
+	_block0 := Uint1(io, 0)
+	_block1 := Uint1(io, 0)
+	_block2 := Uint1(io, 0)
+	_block3 := Uint1(io, 0)
+	_block4 := Uint1(io, 0)
+	_block5 := Uint1(io, 0)
+	_block6 := Uint1(io, 0)
+	_block0 = Uint1(io, 1)
+
+	/* block free variables */
+	_8 := Uint32(io, 0)
+	__main_cur_sum_females_0_lcssa := Uint32(io, 0)
+	__main_cur_sum_females_02 := Uint32(io, 0)
+	__main_cur_sum_females_1 := Uint32(io, 0)
+	__main_cur_sum_males_0_lcssa := Uint32(io, 0)
+	__main_cur_sum_males_03 := Uint32(io, 0)
+	__main_cur_sum_males_1 := Uint32(io, 0)
+	__main_i_01 := Uint32(io, 0)
+
+	done := false
+	for !done {
+
+		/* one invocation per block, in turn */
+		block0(io, ch0, _block0)
+		block1(io, ch1, _block1, __main_cur_sum_females_02, __main_cur_sum_males_03, __main_i_01)
+		block2(io, ch2, _block2, __main_cur_sum_females_0_lcssa, __main_cur_sum_males_0_lcssa)
+		block3(io, ch3, _block3, __main_cur_sum_females_1, __main_cur_sum_males_1)
+		block4(io, ch4, _block4)
+		block5(io, ch5, _block5)
+		block6(io, ch6, _block6, _8, __main_cur_sum_females_1, __main_cur_sum_males_1)
+
+		/* mux the outputs*/
+		mask_0 := _block0
+		_block0_0 := <-ch0
+		_block4_0 := <-ch0
+		_block5_0 := <-ch0
+		mask_1 := _block1
+		_8_1 := <-ch1
+		__main_cur_sum_females_1_1 := <-ch1
+		__main_cur_sum_males_1_1 := <-ch1
+		_block1_1 := <-ch1
+		_block3_1 := <-ch1
+		_block6_1 := <-ch1
+		_vAnswer_2 := <-ch2
+		_vIsDone_2 := <-ch2
+		mask_3 := _block3
+		__main_cur_sum_females_0_lcssa_3 := <-ch3
+		__main_cur_sum_males_0_lcssa_3 := <-ch3
+		_block2_3 := <-ch3
+		_block3_3 := <-ch3
+		mask_4 := _block4
+		__main_cur_sum_females_0_lcssa_4 := <-ch4
+		__main_cur_sum_males_0_lcssa_4 := <-ch4
+		_block2_4 := <-ch4
+		_block4_4 := <-ch4
+		mask_5 := _block5
+		__main_cur_sum_females_02_5 := <-ch5
+		__main_cur_sum_males_03_5 := <-ch5
+		__main_i_01_5 := <-ch5
+		_block1_5 := <-ch5
+		_block5_5 := <-ch5
+		mask_6 := _block6
+		__main_cur_sum_females_02_6 := <-ch6
+		__main_cur_sum_males_03_6 := <-ch6
+		__main_i_01_6 := <-ch6
+		_block1_6 := <-ch6
+		_block6_6 := <-ch6
+		_8 = Sum32(io, _8_1, Mask32(io, Not1(io, Sum1(io, mask_1)), _8))
+		__main_cur_sum_females_0_lcssa = Sum32(io, __main_cur_sum_females_0_lcssa_3, __main_cur_sum_females_0_lcssa_4, Mask32(io, Not1(io, Sum1(io, mask_3, mask_4)), __main_cur_sum_females_0_lcssa))
+		__main_cur_sum_females_02 = Sum32(io, __main_cur_sum_females_02_5, __main_cur_sum_females_02_6, Mask32(io, Not1(io, Sum1(io, mask_5, mask_6)), __main_cur_sum_females_02))
+		__main_cur_sum_females_1 = Sum32(io, __main_cur_sum_females_1_1, Mask32(io, Not1(io, Sum1(io, mask_1)), __main_cur_sum_females_1))
+		__main_cur_sum_males_0_lcssa = Sum32(io, __main_cur_sum_males_0_lcssa_3, __main_cur_sum_males_0_lcssa_4, Mask32(io, Not1(io, Sum1(io, mask_3, mask_4)), __main_cur_sum_males_0_lcssa))
+		__main_cur_sum_males_03 = Sum32(io, __main_cur_sum_males_03_5, __main_cur_sum_males_03_6, Mask32(io, Not1(io, Sum1(io, mask_5, mask_6)), __main_cur_sum_males_03))
+		__main_cur_sum_males_1 = Sum32(io, __main_cur_sum_males_1_1, Mask32(io, Not1(io, Sum1(io, mask_1)), __main_cur_sum_males_1))
+		__main_i_01 = Sum32(io, __main_i_01_5, __main_i_01_6, Mask32(io, Not1(io, Sum1(io, mask_5, mask_6)), __main_i_01))
+		_block0 = Sum1(io, _block0_0, Mask1(io, Not1(io, Sum1(io, mask_0)), _block0))
+		_block1 = Sum1(io, _block1_1, _block1_5, _block1_6, Mask1(io, Not1(io, Sum1(io, mask_1, mask_5, mask_6)), _block1))
+		_block2 = Sum1(io, _block2_3, _block2_4, Mask1(io, Not1(io, Sum1(io, mask_3, mask_4)), _block2))
+		_block3 = Sum1(io, _block3_1, _block3_3, Mask1(io, Not1(io, Sum1(io, mask_1, mask_3)), _block3))
+		_block4 = Sum1(io, _block4_0, _block4_4, Mask1(io, Not1(io, Sum1(io, mask_0, mask_4)), _block4))
+		_block5 = Sum1(io, _block5_0, _block5_5, Mask1(io, Not1(io, Sum1(io, mask_0, mask_5)), _block5))
+		_block6 = Sum1(io, _block6_1, _block6_6, Mask1(io, Not1(io, Sum1(io, mask_1, mask_6)), _block6))
+		_vAnswer = Sum32(io, _vAnswer_2)
+		_vIsDone = Sum1(io, _vIsDone_2)
+
+		/* are we done? */
+		done = Reveal1(io, _vIsDone)
+	}
+	answer := Output32(io, _vAnswer)
+	fmt.Printf("%d: %v\n", io.Id(), answer)
+}
+
+// <label>:0
+func block0(io Io, ch chan Share, mask Share) {
+	_1 := NumPeers32(io)
+	_2 := Icmp_eq32(io, _1, Uint32(io, 0))
+	_block0 := Uint1(io, 0)
+	_block4 := _2
+	_block5 := Xor1(io, _2, Uint1(io, 1))
+	ch <- Mask1(io, mask, _block0)
+	ch <- Mask1(io, mask, _block4)
+	ch <- Mask1(io, mask, _block5)
+}
+
+// <label>:.lr.ph
+func block1(io Io, ch chan Share, mask Share, __main_cur_sum_females_02 Share, __main_cur_sum_males_03 Share, __main_i_01 Share) {
+	_3 := Input32(io, mask, __main_i_01)
+	_4 := Input32(io, mask, __main_i_01)
+	_5 := Icmp_eq32(io, _3, Uint32(io, 1))
+	_6 := Select32(io, _5, _4, Uint32(io, 0))
+	__main_cur_sum_females_1 := Add32(io, _6, __main_cur_sum_females_02)
+	_7 := Select32(io, _5, Uint32(io, 0), _4)
+	__main_cur_sum_males_1 := Add32(io, _7, __main_cur_sum_males_03)
+	_8 := Add32(io, __main_i_01, Uint32(io, 1))
+	_9 := NumPeers32(io)
+	_10 := Icmp_ult32(io, _8, _9)
+	_block1 := Uint1(io, 0)
+	_block6 := _10
+	_block3 := Xor1(io, _10, Uint1(io, 1))
+	ch <- Mask32(io, mask, _8)
+	ch <- Mask32(io, mask, __main_cur_sum_females_1)
+	ch <- Mask32(io, mask, __main_cur_sum_males_1)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block3)
+	ch <- Mask1(io, mask, _block6)
+}
+
+// <label>:._crit_edge
+func block2(io Io, ch chan Share, mask Share, __main_cur_sum_females_0_lcssa Share, __main_cur_sum_males_0_lcssa Share) {
+	Printf(io, mask, "%d %d", __main_cur_sum_males_0_lcssa, __main_cur_sum_females_0_lcssa)
+	_vAnswer := Uint32(io, 0)
+	_vIsDone := Uint1(io, 1)
+	ch <- Mask32(io, mask, _vAnswer)
+	ch <- Mask1(io, mask, _vIsDone)
+}
+
+// <label>:vLabel3
+func block3(io Io, ch chan Share, mask Share, __main_cur_sum_females_1 Share, __main_cur_sum_males_1 Share) {
+	_x12 := __main_cur_sum_females_1
+	_x13 := __main_cur_sum_males_1
+	__main_cur_sum_females_0_lcssa := _x12
+	__main_cur_sum_males_0_lcssa := _x13
+	_block3 := Uint1(io, 0)
+	_block2 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_sum_females_0_lcssa)
+	ch <- Mask32(io, mask, __main_cur_sum_males_0_lcssa)
+	ch <- Mask1(io, mask, _block2)
+	ch <- Mask1(io, mask, _block3)
+}
+
+// <label>:vLabel2
+func block4(io Io, ch chan Share, mask Share) {
+	_x10 := Uint32(io, 0)
+	_x11 := Uint32(io, 0)
+	__main_cur_sum_females_0_lcssa := _x10
+	__main_cur_sum_males_0_lcssa := _x11
+	_block4 := Uint1(io, 0)
+	_block2 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_sum_females_0_lcssa)
+	ch <- Mask32(io, mask, __main_cur_sum_males_0_lcssa)
+	ch <- Mask1(io, mask, _block2)
+	ch <- Mask1(io, mask, _block4)
+}
+
+// <label>:vLabel1
+func block5(io Io, ch chan Share, mask Share) {
+	_x7 := Uint32(io, 0)
+	_x8 := Uint32(io, 0)
+	_x9 := Uint32(io, 0)
+	__main_i_01 := _x7
+	__main_cur_sum_females_02 := _x8
+	__main_cur_sum_males_03 := _x9
+	_block5 := Uint1(io, 0)
+	_block1 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_sum_females_02)
+	ch <- Mask32(io, mask, __main_cur_sum_males_03)
+	ch <- Mask32(io, mask, __main_i_01)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block5)
+}
+
+// <label>:vLabel0
+func block6(io Io, ch chan Share, mask Share, _8 Share, __main_cur_sum_females_1 Share, __main_cur_sum_males_1 Share) {
+	_x4 := _8
+	_x5 := __main_cur_sum_females_1
+	_x6 := __main_cur_sum_males_1
+	__main_i_01 := _x4
+	__main_cur_sum_females_02 := _x5
+	__main_cur_sum_males_03 := _x6
+	_block6 := Uint1(io, 0)
+	_block1 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_cur_sum_females_02)
+	ch <- Mask32(io, mask, __main_cur_sum_males_03)
+	ch <- Mask32(io, mask, __main_i_01)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block6)
+}
+
+var Handle = MPC{Main: blocks_main}
@@ -0,0 +1,351 @@
+package vickrey
+
+import . "github.com/tjim/smpcc/runtime/spdz"
+import "fmt"
+
+func initialize_ram(io Io) {
+	ram := make([]Share, 0x14)
+	// @.str at location 0 == 0x0
+	ram[0x0] = Uint8(io, 0x42)
+	ram[0x1] = Uint8(io, 0x69)
+	ram[0x2] = Uint8(io, 0x64)
+	ram[0x3] = Uint8(io, 0x64)
+	ram[0x4] = Uint8(io, 0x65)
+	ram[0x5] = Uint8(io, 0x72)
+	ram[0x6] = Uint8(io, 0x20)
+	ram[0x7] = Uint8(io, 0x25)
+	ram[0x8] = Uint8(io, 0x64)
+	ram[0x9] = Uint8(io, 0x20)
+	ram[0xa] = Uint8(io, 0x70)
+	ram[0xb] = Uint8(io, 0x61)
+	ram[0xc] = Uint8(io, 0x79)
+	ram[0xd] = Uint8(io, 0x73)
+	ram[0xe] = Uint8(io, 0x20)
+	ram[0xf] = Uint8(io, 0x25)
+	ram[0x10] = Uint8(io, 0x64)
+	ram[0x11] = Uint8(io, 0xa)
+	io.InitRam(ram)
+}
+
+func blocks_main(io Io) {
+
+	initialize_ram(io)
+
+	/* create output channels */
+	ch0 := make(chan Share, 4)
+	ch1 := make(chan Share, 4)
+	ch2 := make(chan Share, 3)
+	ch3 := make(chan Share, 4)
+	ch4 := make(chan Share, 2)
+	ch5 := make(chan Share, 4)
+	ch6 := make(chan Share, 6)
+	ch7 := make(chan Share, 5)
+	ch8 := make(chan Share, 4)
+	ch9 := make(chan Share, 6)
+	ch10 := make(chan Share, 5)
+
+	/* special variables */
+	_vAnswer := Uint32(io, 0)
+	_vIsDone := Uint1(io, 0)
+
+	/* block masks */
+	_block0 := Uint1(io, 0)
+	_block1 := Uint1(io, 0)
+	_block10 := Uint1(io, 0)
+	_block2 := Uint1(io, 0)
+	_block3 := Uint1(io, 0)
+	_block4 := Uint1(io, 0)
+	_block5 := Uint1(io, 0)
+	_block6 := Uint1(io, 0)
+	_block7 := Uint1(io, 0)
+	_block8 := Uint1(io, 0)
+	_block9 := Uint1(io, 0)
+	_block0 = Uint1(io, 1)
+
+	/* block free variables */
+	_1 := Uint32(io, 0)
+	_4 := Uint32(io, 0)
+	_9 := Uint32(io, 0)
+	___main_penultimate_0 := Uint32(io, 0)
+	__main_bidder_0_lcssa := Uint32(io, 0)
+	__main_bidder_04 := Uint32(io, 0)
+	__main_bidder_1 := Uint32(io, 0)
+	__main_i_01 := Uint32(io, 0)
+	__main_penultimate_0_lcssa := Uint32(io, 0)
+	__main_penultimate_02 := Uint32(io, 0)
+	__main_penultimate_1 := Uint32(io, 0)
+	__main_ultimate_03 := Uint32(io, 0)
+	__main_ultimate_1 := Uint32(io, 0)
+
+	done := false
+	for !done {
+
+		/* one invocation per block, in turn */
+		block0(io, ch0, _block0)
+		block1(io, ch1, _block1, __main_i_01, __main_ultimate_03)
+		block2(io, ch2, _block2, _4, __main_penultimate_02)
+		block3(io, ch3, _block3, __main_i_01)
+		block4(io, ch4, _block4, __main_bidder_0_lcssa, __main_penultimate_0_lcssa)
+		block5(io, ch5, _block5)
+		block6(io, ch6, _block6, _1)
+		block7(io, ch7, _block7, _4, __main_i_01, __main_ultimate_03)
+		block8(io, ch8, _block8, __main_bidder_1, __main_penultimate_1)
+		block9(io, ch9, _block9, _9, __main_bidder_1, __main_penultimate_1, __main_ultimate_1)
+		block10(io, ch10, _block10, ___main_penultimate_0, __main_bidder_04, __main_ultimate_03)
+
+		/* mux the outputs*/
+		mask_0 := _block0
+		_1_0 := <-ch0
+		_block0_0 := <-ch0
+		_block5_0 := <-ch0
+		_block6_0 := <-ch0
+		mask_1 := _block1
+		_4_1 := <-ch1
+		_block1_1 := <-ch1
+		_block2_1 := <-ch1
+		_block7_1 := <-ch1
+		mask_2 := _block2
+		___main_penultimate_0_2 := <-ch2
+		_block10_2 := <-ch2
+		_block2_2 := <-ch2
+		mask_3 := _block3
+		_9_3 := <-ch3
+		_block3_3 := <-ch3
+		_block8_3 := <-ch3
+		_block9_3 := <-ch3
+		_vAnswer_4 := <-ch4
+		_vIsDone_4 := <-ch4
+		mask_5 := _block5
+		__main_bidder_0_lcssa_5 := <-ch5
+		__main_penultimate_0_lcssa_5 := <-ch5
+		_block4_5 := <-ch5
+		_block5_5 := <-ch5
+		mask_6 := _block6
+		__main_bidder_04_6 := <-ch6
+		__main_i_01_6 := <-ch6
+		__main_penultimate_02_6 := <-ch6
+		__main_ultimate_03_6 := <-ch6
+		_block1_6 := <-ch6
+		_block6_6 := <-ch6
+		mask_7 := _block7
+		__main_bidder_1_7 := <-ch7
+		__main_penultimate_1_7 := <-ch7
+		__main_ultimate_1_7 := <-ch7
+		_block3_7 := <-ch7
+		_block7_7 := <-ch7
+		mask_8 := _block8
+		__main_bidder_0_lcssa_8 := <-ch8
+		__main_penultimate_0_lcssa_8 := <-ch8
+		_block4_8 := <-ch8
+		_block8_8 := <-ch8
+		mask_9 := _block9
+		__main_bidder_04_9 := <-ch9
+		__main_i_01_9 := <-ch9
+		__main_penultimate_02_9 := <-ch9
+		__main_ultimate_03_9 := <-ch9
+		_block1_9 := <-ch9
+		_block9_9 := <-ch9
+		mask_10 := _block10
+		__main_bidder_1_10 := <-ch10
+		__main_penultimate_1_10 := <-ch10
+		__main_ultimate_1_10 := <-ch10
+		_block10_10 := <-ch10
+		_block3_10 := <-ch10
+		_1 = Sum32(io, _1_0, Mask32(io, Not1(io, Sum1(io, mask_0)), _1))
+		_4 = Sum32(io, _4_1, Mask32(io, Not1(io, Sum1(io, mask_1)), _4))
+		_9 = Sum32(io, _9_3, Mask32(io, Not1(io, Sum1(io, mask_3)), _9))
+		___main_penultimate_0 = Sum32(io, ___main_penultimate_0_2, Mask32(io, Not1(io, Sum1(io, mask_2)), ___main_penultimate_0))
+		__main_bidder_0_lcssa = Sum32(io, __main_bidder_0_lcssa_5, __main_bidder_0_lcssa_8, Mask32(io, Not1(io, Sum1(io, mask_5, mask_8)), __main_bidder_0_lcssa))
+		__main_bidder_04 = Sum32(io, __main_bidder_04_6, __main_bidder_04_9, Mask32(io, Not1(io, Sum1(io, mask_6, mask_9)), __main_bidder_04))
+		__main_bidder_1 = Sum32(io, __main_bidder_1_7, __main_bidder_1_10, Mask32(io, Not1(io, Sum1(io, mask_7, mask_10)), __main_bidder_1))
+		__main_i_01 = Sum32(io, __main_i_01_6, __main_i_01_9, Mask32(io, Not1(io, Sum1(io, mask_6, mask_9)), __main_i_01))
+		__main_penultimate_0_lcssa = Sum32(io, __main_penultimate_0_lcssa_5, __main_penultimate_0_lcssa_8, Mask32(io, Not1(io, Sum1(io, mask_5, mask_8)), __main_penultimate_0_lcssa))
+		__main_penultimate_02 = Sum32(io, __main_penultimate_02_6, __main_penultimate_02_9, Mask32(io, Not1(io, Sum1(io, mask_6, mask_9)), __main_penultimate_02))
+		__main_penultimate_1 = Sum32(io, __main_penultimate_1_7, __main_penultimate_1_10, Mask32(io, Not1(io, Sum1(io, mask_7, mask_10)), __main_penultimate_1))
+		__main_ultimate_03 = Sum32(io, __main_ultimate_03_6, __main_ultimate_03_9, Mask32(io, Not1(io, Sum1(io, mask_6, mask_9)), __main_ultimate_03))
+		__main_ultimate_1 = Sum32(io, __main_ultimate_1_7, __main_ultimate_1_10, Mask32(io, Not1(io, Sum1(io, mask_7, mask_10)), __main_ultimate_1))
+		_block0 = Sum1(io, _block0_0, Mask1(io, Not1(io, Sum1(io, mask_0)), _block0))
+		_block1 = Sum1(io, _block1_1, _block1_6, _block1_9, Mask1(io, Not1(io, Sum1(io, mask_1, mask_6, mask_9)), _block1))
+		_block10 = Sum1(io, _block10_2, _block10_10, Mask1(io, Not1(io, Sum1(io, mask_2, mask_10)), _block10))
+		_block2 = Sum1(io, _block2_1, _block2_2, Mask1(io, Not1(io, Sum1(io, mask_1, mask_2)), _block2))
+		_block3 = Sum1(io, _block3_3, _block3_7, _block3_10, Mask1(io, Not1(io, Sum1(io, mask_3, mask_7, mask_10)), _block3))
+		_block4 = Sum1(io, _block4_5, _block4_8, Mask1(io, Not1(io, Sum1(io, mask_5, mask_8)), _block4))
+		_block5 = Sum1(io, _block5_0, _block5_5, Mask1(io, Not1(io, Sum1(io, mask_0, mask_5)), _block5))
+		_block6 = Sum1(io, _block6_0, _block6_6, Mask1(io, Not1(io, Sum1(io, mask_0, mask_6)), _block6))
+		_block7 = Sum1(io, _block7_1, _block7_7, Mask1(io, Not1(io, Sum1(io, mask_1, mask_7)), _block7))
+		_block8 = Sum1(io, _block8_3, _block8_8, Mask1(io, Not1(io, Sum1(io, mask_3, mask_8)), _block8))
+		_block9 = Sum1(io, _block9_3, _block9_9, Mask1(io, Not1(io, Sum1(io, mask_3, mask_9)), _block9))
+		_vAnswer = Sum32(io, _vAnswer_4)
+		_vIsDone = Sum1(io, _vIsDone_4)
+
+		/* are we done? */
+		done = Reveal1(io, _vIsDone)
+	}
+	answer := Output32(io, _vAnswer)
+	fmt.Printf("%d: %v\n", io.Id(), answer)
+}
+
+// <label>:0
+func block0(io Io, ch chan Share, mask Share) {
+	_1 := Input32(io, mask, Uint32(io, 0))
+	_2 := NumPeers32(io)
+	_3 := Icmp_ugt32(io, _2, Uint32(io, 1))
+	_block0 := Uint1(io, 0)
+	_block6 := _3
+	_block5 := Xor1(io, _3, Uint1(io, 1))
+	ch <- Mask32(io, mask, _1)
+	ch <- Mask1(io, mask, _block0)
+	ch <- Mask1(io, mask, _block5)
+	ch <- Mask1(io, mask, _block6)
+}
+
+// <label>:.lr.ph
+func block1(io Io, ch chan Share, mask Share, __main_i_01 Share, __main_ultimate_03 Share) {
+	_4 := Input32(io, mask, __main_i_01)
+	_5 := Icmp_ugt32(io, _4, __main_ultimate_03)
+	_block1 := Uint1(io, 0)
+	_block7 := _5
+	_block2 := Xor1(io, _5, Uint1(io, 1))
+	ch <- Mask32(io, mask, _4)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block2)
+	ch <- Mask1(io, mask, _block7)
+}
+
+// <label>:6
+func block2(io Io, ch chan Share, mask Share, _4 Share, __main_penultimate_02 Share) {
+	_7 := Icmp_ugt32(io, _4, __main_penultimate_02)
+	___main_penultimate_0 := Select32(io, _7, _4, __main_penultimate_02)
+	_block2 := Uint1(io, 0)
+	_block10 := Uint1(io, 1)
+	ch <- Mask32(io, mask, ___main_penultimate_0)
+	ch <- Mask1(io, mask, _block10)
+	ch <- Mask1(io, mask, _block2)
+}
+
+// <label>:8
+func block3(io Io, ch chan Share, mask Share, __main_i_01 Share) {
+	_9 := Add32(io, __main_i_01, Uint32(io, 1))
+	_10 := NumPeers32(io)
+	_11 := Icmp_ult32(io, _9, _10)
+	_block3 := Uint1(io, 0)
+	_block9 := _11
+	_block8 := Xor1(io, _11, Uint1(io, 1))
+	ch <- Mask32(io, mask, _9)
+	ch <- Mask1(io, mask, _block3)
+	ch <- Mask1(io, mask, _block8)
+	ch <- Mask1(io, mask, _block9)
+}
+
+// <label>:._crit_edge
+func block4(io Io, ch chan Share, mask Share, __main_bidder_0_lcssa Share, __main_penultimate_0_lcssa Share) {
+	Printf(io, mask, "Bidder %d pays %d\n", __main_bidder_0_lcssa, __main_penultimate_0_lcssa)
+	_vAnswer := Uint32(io, 0)
+	_vIsDone := Uint1(io, 1)
+	ch <- Mask32(io, mask, _vAnswer)
+	ch <- Mask1(io, mask, _vIsDone)
+}
+
+// <label>:vLabel4
+func block5(io Io, ch chan Share, mask Share) {
+	_x22 := Uint32(io, 0)
+	_x23 := Uint32(io, 0)
+	__main_penultimate_0_lcssa := _x22
+	__main_bidder_0_lcssa := _x23
+	_block5 := Uint1(io, 0)
+	_block4 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_bidder_0_lcssa)
+	ch <- Mask32(io, mask, __main_penultimate_0_lcssa)
+	ch <- Mask1(io, mask, _block4)
+	ch <- Mask1(io, mask, _block5)
+}
+
+// <label>:vLabel1
+func block6(io Io, ch chan Share, mask Share, _1 Share) {
+	_x18 := Uint32(io, 1)
+	_x19 := Uint32(io, 0)
+	_x20 := _1
+	_x21 := Uint32(io, 0)
+	__main_i_01 := _x18
+	__main_penultimate_02 := _x19
+	__main_ultimate_03 := _x20
+	__main_bidder_04 := _x21
+	_block6 := Uint1(io, 0)
+	_block1 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_bidder_04)
+	ch <- Mask32(io, mask, __main_i_01)
+	ch <- Mask32(io, mask, __main_penultimate_02)
+	ch <- Mask32(io, mask, __main_ultimate_03)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block6)
+}
+
+// <label>:vLabel2
+func block7(io Io, ch chan Share, mask Share, _4 Share, __main_i_01 Share, __main_ultimate_03 Share) {
+	_x15 := __main_i_01
+	_x16 := _4
+	_x17 := __main_ultimate_03
+	__main_bidder_1 := _x15
+	__main_ultimate_1 := _x16
+	__main_penultimate_1 := _x17
+	_block7 := Uint1(io, 0)
+	_block3 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_bidder_1)
+	ch <- Mask32(io, mask, __main_penultimate_1)
+	ch <- Mask32(io, mask, __main_ultimate_1)
+	ch <- Mask1(io, mask, _block3)
+	ch <- Mask1(io, mask, _block7)
+}
+
+// <label>:vLabel5
+func block8(io Io, ch chan Share, mask Share, __main_bidder_1 Share, __main_penultimate_1 Share) {
+	_x13 := __main_penultimate_1
+	_x14 := __main_bidder_1
+	__main_penultimate_0_lcssa := _x13
+	__main_bidder_0_lcssa := _x14
+	_block8 := Uint1(io, 0)
+	_block4 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_bidder_0_lcssa)
+	ch <- Mask32(io, mask, __main_penultimate_0_lcssa)
+	ch <- Mask1(io, mask, _block4)
+	ch <- Mask1(io, mask, _block8)
+}
+
+// <label>:vLabel0
+func block9(io Io, ch chan Share, mask Share, _9 Share, __main_bidder_1 Share, __main_penultimate_1 Share, __main_ultimate_1 Share) {
+	_x9 := _9
+	_x10 := __main_penultimate_1
+	_x11 := __main_ultimate_1
+	_x12 := __main_bidder_1
+	__main_i_01 := _x9
+	__main_penultimate_02 := _x10
+	__main_ultimate_03 := _x11
+	__main_bidder_04 := _x12
+	_block9 := Uint1(io, 0)
+	_block1 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_bidder_04)
+	ch <- Mask32(io, mask, __main_i_01)
+	ch <- Mask32(io, mask, __main_penultimate_02)
+	ch <- Mask32(io, mask, __main_ultimate_03)
+	ch <- Mask1(io, mask, _block1)
+	ch <- Mask1(io, mask, _block9)
+}
+
+// <label>:vLabel3
+func block10(io Io, ch chan Share, mask Share, ___main_penultimate_0 Share, __main_bidder_04 Share, __main_ultimate_03 Share) {
+	_x6 := __main_bidder_04
+	_x7 := __main_ultimate_03
+	_x8 := ___main_penultimate_0
+	__main_bidder_1 := _x6
+	__main_ultimate_1 := _x7
+	__main_penultimate_1 := _x8
+	_block10 := Uint1(io, 0)
+	_block3 := Uint1(io, 1)
+	ch <- Mask32(io, mask, __main_bidder_1)
+	ch <- Mask32(io, mask, __main_penultimate_1)
+	ch <- Mask32(io, mask, __main_ultimate_1)
+	ch <- Mask1(io, mask, _block10)
+	ch <- Mask1(io, mask, _block3)
+}
+
+var Handle = MPC{Main: blocks_main}
@@ -0,0 +1,534 @@
+package spdz
+
+// The functions of the code that the compiler generates for gmw (see
+// gmw/vm.go), on SPDZ shares.
+//
+// They have the names and arguments of the gmw functions, but every value
+// is a Share: a value of 8 or 32 bits is a Share of the value, and a
+// bool is a Share of 0 or 1, a bit.  There are no 64-bit functions, as
+// the values have K bits.  The gmw code converts its XOR shares with Go
+// conversions, which are Trunc32_8, Trunc32_1, Trunc8_1, Bit8 and Bit32
+// here, and keeps the memory in a []byte, which is a []Share of the bytes
+// here.
+//
+// The compiler generates code for these functions with -circuitlib spdz
+// (see compiler/gmw.ml), as in the max, sum and vickrey packages here.
+// That code types its values as Shares, and runs its blocks in turn on
+// the one Io of the party, not in goroutines on an Io each, as the
+// parties exchange their messages in one stream.  It combines the outputs
+// of the blocks with Sum rather than TreeXor.  There are no functions for
+// the 64-bit values, for the reason above, nor InputBytes or the OutputTo
+// functions, which would need a private opening with a MAC check.
+//
+// Addition and subtraction are local, and multiplication uses a triple.
+// The bitwise operations, the comparisons, and the 8-bit arithmetic
+// decompose their arguments into bits (see BitDec), and compute on the
+// bits, with a triple for each AND.  A value of 8 bits is kept below 2^8,
+// so 8-bit arithmetic reduces its result.
+
+import "fmt"
+
+// constant returns a Share of v, held by party 0, with its MAC
+func constant(io Io, v uint64) Share {
+	if io.Id() == 0 {
+		return Share{v, io.Alpha() * v}
+	}
+	return Share{0, io.Alpha() * v}
+}
+
+/* bits */
+
+func Uint1(io Io, a uint8) Share {
+	if a > 0 {
+		return constant(io, 1)
+	}
+	return Share{}
+}
+
+func Not1(io Io, a Share) Share {
+	return sub(constant(io, 1), a)
+}
+
+func Xor1(io Io, a, b Share) Share {
+	return sub(Add(io, a, b), scale(2, Mul(io, a, b)))
+}
+
+func And1(io Io, a, b Share) Share {
+	return Mul(io, a, b)
+}
+
+func Or1(io Io, a, b Share) Share {
+	return sub(Add(io, a, b), Mul(io, a, b))
+}
+
+/* words */
+
+func Uint8(io Io, a uint8) Share {
+	return constant(io, uint64(a))
+}
+
+func Uint32(io Io, a uint32) Share {
+	return constant(io, uint64(a))
+}
+
+func Add8(io Io, a, b Share) Share {
+	return Mod2m(io, Add(io, a, b), 8)
+}
+
+func Add32(io Io, a, b Share) Share {
+	return Add(io, a, b)
+}
+
+func Sub8(io Io, a, b Share) Share {
+	return Mod2m(io, sub(a, b), 8)
+}
+
+func Sub32(io Io, a, b Share) Share {
+	return sub(a, b)
+}
+
+func Mul8(io Io, a, b Share) Share {
+	return Mod2m(io, Mul(io, a, b), 8)
+}
+
+func Mul32(io Io, a, b Share) Share {
+	return Mul(io, a, b)
+}
+
+// bitwise applies op to the bits of a and b
+func bitwise(io Io, a, b Share, w int, op func(Io, Share, Share) Share) Share {
+	as, bs := BitDec(io, a, w), BitDec(io, b, w)
+	for i := range as {
+		as[i] = op(io, as[i], bs[i])
+	}
+	return fromBits(as)
+}
+
+func Xor8(io Io, a, b Share) Share {
+	return bitwise(io, a, b, 8, Xor1)
+}
+
+func Xor32(io Io, a, b Share) Share {
+	return bitwise(io, a, b, 32, Xor1)
+}
+
+func And8(io Io, a, b Share) Share {
+	return bitwise(io, a, b, 8, And1)
+}
+
+func And32(io Io, a, b Share) Share {
+	return bitwise(io, a, b, 32, And1)
+}
+
+func Or8(io Io, a, b Share) Share {
+	return bitwise(io, a, b, 8, Or1)
+}
+
+func Or32(io Io, a, b Share) Share {
+	return bitwise(io, a, b, 32, Or1)
+}
+
+func Not8(io Io, a Share) Share {
+	return sub(constant(io, 0xff), a)
+}
+
+func Not32(io Io, a Share) Share {
+	return sub(constant(io, 0xffffffff), a)
+}
+
+func Shl8(io Io, a Share, b uint) Share {
+	return Mod2m(io, scale(1<<b, a), 8)
+}
+
+func Shl32(io Io, a Share, b uint) Share {
+	return scale(1<<b, a)
+}
+
+// shr shifts the w bits of a right by b, filling with 0s, or with the
+// sign bit if arith
+func shr(io Io, a Share, b uint, w int, arith bool) Share {
+	as := BitDec(io, a, w)
+	fill := Share{}
+	if arith {
+		fill = as[w-1]
+	}
+	result := make([]Share, w)
+	for i := range result {
+		if i+int(b) < w {
+			result[i] = as[i+int(b)]
+		} else {
+			result[i] = fill
+		}
+	}
+	return fromBits(result)
+}
+
+func Lshr8(io Io, a Share, b uint) Share {
+	return shr(io, a, b, 8, false)
+}
+
+func Lshr32(io Io, a Share, b uint) Share {
+	return shr(io, a, b, 32, false)
+}
+
+func Ashr8(io Io, a Share, b uint) Share {
+	return shr(io, a, b, 8, true)
+}
+
+func Ashr32(io Io, a Share, b uint) Share {
+	return shr(io, a, b, 32, true)
+}
+
+func Zext8_32(io Io, a Share) Share {
+	return a
+}
+
+func Trunc32_8(io Io, a Share) Share {
+	return Mod2m(io, a, 8)
+}
+
+func Trunc32_1(io Io, a Share) Share {
+	return BitDec(io, a, 1)[0]
+}
+
+func Trunc8_1(io Io, a Share) Share {
+	return BitDec(io, a, 1)[0]
+}
+
+// Bit8 and Bit32 return bit i of a
+func Bit8(io Io, a Share, i uint) Share {
+	return BitDec(io, a, 8)[i]
+}
+
+func Bit32(io Io, a Share, i uint) Share {
+	return BitDec(io, a, 32)[i]
+}
+
+/* comparisons */
+
+// slt compares the bits of a and b as LT does, with the sign bits flipped
+func slt(io Io, a, b Share, w int) Share {
+	as, bs := BitDec(io, a, w), BitDec(io, b, w)
+	as[w-1], bs[w-1] = Not1(io, as[w-1]), Not1(io, bs[w-1])
+	return less(io, as, bs)
+}
+
+func Icmp_eq8(io Io, a, b Share) Share {
+	return EQ(io, a, b, 8)
+}
+
+func Icmp_eq32(io Io, a, b Share) Share {
+	return EQ(io, a, b, 32)
+}
+
+func Icmp_ugt8(io Io, a, b Share) Share {
+	return LT(io, b, a, 8)
+}
+
+func Icmp_ugt32(io Io, a, b Share) Share {
+	return LT(io, b, a, 32)
+}
+
+func Icmp_ult8(io Io, a, b Share) Share {
+	return LT(io, a, b, 8)
+}
+
+func Icmp_ult32(io Io, a, b Share) Share {
+	return LT(io, a, b, 32)
+}
+
+func Icmp_sgt8(io Io, a, b Share) Share {
+	return slt(io, b, a, 8)
+}
+
+func Icmp_sgt32(io Io, a, b Share) Share {
+	return slt(io, b, a, 32)
+}
+
+func Icmp_slt8(io Io, a, b Share) Share {
+	return slt(io, a, b, 8)
+}
+
+func Icmp_slt32(io Io, a, b Share) Share {
+	return slt(io, a, b, 32)
+}
+
+func Icmp_uge8(io Io, a, b Share) Share {
+	return Not1(io, LT(io, a, b, 8))
+}
+
+func Icmp_uge32(io Io, a, b Share) Share {
+	return Not1(io, LT(io, a, b, 32))
+}
+
+func Icmp_ule8(io Io, a, b Share) Share {
+	return Not1(io, LT(io, b, a, 8))
+}
+
+func Icmp_ule32(io Io, a, b Share) Share {
+	return Not1(io, LT(io, b, a, 32))
+}
+
+// NumPeers32 is the number of parties; every party may have inputs.
+func NumPeers32(io Io) Share {
+	return Uint32(io, uint32(io.N()))
+}
+
+/* selection */
+
+// Select1, Select8 and Select32 return a if s is 1, and b if s is 0.
+func Select1(io Io, s, a, b Share) Share {
+	return Add(io, b, Mul(io, s, sub(a, b)))
+}
+
+func Select8(io Io, s, a, b Share) Share {
+	return Select1(io, s, a, b)
+}
+
+func Select32(io Io, s, a, b Share) Share {
+	return Select1(io, s, a, b)
+}
+
+// Mask1, Mask8 and Mask32 return a if s is 1, and 0 if s is 0.
+func Mask1(io Io, s, a Share) Share {
+	return Mul(io, s, a)
+}
+
+func Mask8(io Io, s, a Share) Share {
+	return Mul(io, s, a)
+}
+
+func Mask32(io Io, s, a Share) Share {
+	return Mul(io, s, a)
+}
+
+func TreeXor1(io Io, x ...Share) Share {
+	return treeXor(io, x, Xor1)
+}
+
+func TreeXor8(io Io, x ...Share) Share {
+	return treeXor(io, x, Xor8)
+}
+
+func TreeXor32(io Io, x ...Share) Share {
+	return treeXor(io, x, Xor32)
+}
+
+// Sum1, Sum8 and Sum32 add x.  The compiler combines the outputs of the
+// blocks with them: the outputs are masked by the block masks, of which
+// at most one is 1, so at most one of x is not 0, and the sum is the XOR
+// without the bit decompositions of TreeXor.
+func Sum1(io Io, x ...Share) Share {
+	return sum(x)
+}
+
+func Sum8(io Io, x ...Share) Share {
+	return sum(x)
+}
+
+func Sum32(io Io, x ...Share) Share {
+	return sum(x)
+}
+
+func sum(x []Share) Share {
+	var result Share
+	for _, s := range x {
+		result = add(result, s)
+	}
+	return result
+}
+
+func treeXor(io Io, x []Share, xor func(Io, Share, Share) Share) Share {
+	switch len(x) {
+	case 0:
+		panic("TreeXor with no arguments")
+	case 1:
+		return x[0]
+	default:
+		mid := len(x) / 2
+		return xor(io, treeXor(io, x[:mid], xor), treeXor(io, x[mid:], xor))
+	}
+}
+
+/* inputs and outputs */
+
+// Input8 and Input32 share the next input of party, reduced to 8 or 32
+// bits, if mask is 1.  They reveal mask and party, as in gmw.
+func Input8(io Io, mask, party Share) Share {
+	return maskedInput(io, mask, party, 0xff)
+}
+
+func Input32(io Io, mask, party Share) Share {
+	return maskedInput(io, mask, party, 0xffffffff)
+}
+
+func maskedInput(io Io, mask, party Share, ones uint32) Share {
+	if !Reveal1(io, mask) {
+		return Share{}
+	}
+	p := int(Reveal32(io, party))
+	if p >= io.N() {
+		io.Abort(fmt.Errorf("Input: no party %d", p))
+	}
+	var v uint64
+	if p == io.Id() {
+		v = uint64(io.GetInput() & ones)
+	}
+	return inputValue(io, p, v)
+}
+
+func Output1(io Io, x Share) uint32 {
+	return Output(io, x)
+}
+
+func Output8(io Io, x Share) uint32 {
+	return Output(io, x)
+}
+
+func Output32(io Io, x Share) uint32 {
+	return Output(io, x)
+}
+
+// The Reveal functions open a value for the control flow of the
+// computation.  They do not check the MACs; the next output does.
+
+func Reveal1(io Io, a Share) bool {
+	return reveal(io, a) != 0
+}
+
+func Reveal8(io Io, a Share) uint8 {
+	return uint8(reveal(io, a))
+}
+
+func Reveal32(io Io, a Share) uint32 {
+	return reveal(io, a)
+}
+
+// NB Printf() reveals the active block as well as the values of its
+// arguments.  Every party sends the text to MpcPrintsChan, if it has room,
+// as in gmw, and party 0 prints it.
+func Printf(io Io, mask Share, f string, args ...Share) {
+	if !Reveal1(io, mask) {
+		return
+	}
+	fargs := make([]interface{}, len(args))
+	for i := range args {
+		fargs[i] = reveal(io, args[i])
+	}
+	stringRes := fmt.Sprintf(f, fargs...)
+	select {
+	case MpcPrintsChan <- stringRes:
+	default:
+	}
+	if io.Id() == 0 {
+		fmt.Print(stringRes)
+	}
+}
+
+func Printf32(io Io, mask Share, f string, args ...Share) {
+	Printf(io, mask, f, args...)
+}
+
+// Switch32 returns cases[s], or dflt if s is not the index of a case, as
+// gmw.Switch32.  At most one of the tests holds, so the masked cases add.
+func Switch32(io Io, s, dflt Share, cases ...Share) Share {
+	if len(cases) == 0 {
+		return dflt
+	}
+	m := Uint1(io, 0)
+	x := Uint32(io, 0)
+	for i, c := range cases {
+		eq := Icmp_eq32(io, s, Uint32(io, uint32(i)))
+		m = Add(io, m, eq)
+		x = Add(io, x, Mask32(io, eq, c))
+	}
+	return Select32(io, m, x, dflt)
+}
+
+/* binary to unary conversion, see gmw.Unary0 */
+
+func unaryB(io Io, A []Share, isOther Share) []Share {
+	nodesInTree := 2 * (1 << uint(len(A)))
+	phi := make([]Share, nodesInTree)
+	phi[1] = Not1(io, isOther)
+	for i := range A {
+		bitposition := len(A) - 1 - i
+		leftmost := (1 << uint(i)) * 2
+		for j := leftmost; j < leftmost*2; j += 2 {
+			phi[j+1] = And1(io, phi[j/2], A[bitposition])
+			phi[j] = sub(phi[j/2], phi[j+1])
+		}
+	}
+	return phi[nodesInTree/2:]
+}
+
+// Unary0(A, possibles) converts the bits A, LSB first, to possibles+1
+// bits, of which bit i is 1 if A is i < possibles, and the last is 1 if A
+// is out of range.
+func Unary0(io Io, A []Share, possibles int) []Share {
+	b := 1 // bits for the range [0,possibles)
+	for 1<<uint(b) < possibles {
+		b++
+	}
+	if len(A) < b {
+		panic("Unary: not enough possibilities")
+	}
+	relevantBits, otherBits := A[:b], A[b:]
+	var isOther0 Share
+	for _, x := range otherBits {
+		isOther0 = Or1(io, isOther0, x)
+	}
+	unaryOfRelevant := unaryB(io, relevantBits, isOther0)
+	var isOther1 Share
+	for _, x := range unaryOfRelevant[possibles:] {
+		isOther1 = Add(io, isOther1, x) // at most one is 1
+	}
+	result := make([]Share, possibles+1)
+	copy(result, unaryOfRelevant[:possibles])
+	result[possibles] = Or1(io, isOther0, isOther1)
+	return result
+}
+
+// Unary(io, x, y) is Unary0 on the 32 bits of x, as a word; like
+// gmw.Unary, it is correct only for y < 32.
+func Unary(io Io, x Share, y int) Share {
+	return fromBits(Unary0(io, BitDec(io, x, 32), y))
+}
+
+/* memory */
+
+// Load and Store reveal the memory access pattern but not memory
+// contents, as in gmw.  Values of 8 bytes are not supported.
+func Load(io Io, loc, eltsize Share) Share {
+	address, n := memAccess(io, "Load", loc, eltsize)
+	ram := io.Ram()
+	var x Share
+	for j := 0; j < n; j++ {
+		x = Add(io, x, scale(1<<uint(j*8), ram[address+j]))
+	}
+	return x
+}
+
+func Store(io Io, loc, eltsize, x Share) {
+	address, n := memAccess(io, "Store", loc, eltsize)
+	ram := io.Ram()
+	xs := BitDec(io, x, 8*n)
+	for j := 0; j < n; j++ {
+		ram[address+j] = fromBits(xs[8*j : 8*j+8])
+	}
+}
+
+// memAccess reveals the address and size of an access to memory
+func memAccess(io Io, op string, loc, eltsize Share) (address, n int) {
+	address = int(Reveal32(io, loc))
+	n = int(Reveal32(io, eltsize))
+	switch n {
+	default:
+		io.Abort(fmt.Errorf("%s: bad element size %d", op, n))
+	case 1, 2, 4:
+	}
+	if address+n > len(io.Ram()) {
+		io.Abort(fmt.Errorf("%s: address 0x%08x out of range", op, address))
+	}
+	return
+}
@@ -0,0 +1,9 @@
+package sum
+
+import _ "embed"
+
+// Source is the text of the generated program, which the chat rooms hash
+// to agree on the program they run.
+//
+//go:embed sum.go
+var Source []byte
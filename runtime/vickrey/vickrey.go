@@ -181,7 +181,7 @@ func blocks_main(io Io, ios []Io) {
 		/* are we done? */
 		done = Reveal1(io, _vIsDone)
 	}
-	answer := Reveal32(io, _vAnswer)
+	answer := Output32(io, _vAnswer)
 	fmt.Printf("%d: %v\n", io.Id(), answer)
 }
 